@@ -1,10 +1,15 @@
 package pm
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/url"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -25,10 +30,10 @@ type Version string
 // Versions is a slice of Version ... with sorting!
 type Versions []Version
 
-// TODO (sm): make this semver sort?
+// Versions sort as CompareVersions orders them.
 func (v Versions) Len() int           { return len(v) }
 func (v Versions) Swap(a, b int)      { v[a], v[b] = v[b], v[a] }
-func (v Versions) Less(a, b int) bool { return v[a] < v[b] }
+func (v Versions) Less(a, b int) bool { return CompareVersions(v[a], v[b]) < 0 }
 
 type label struct {
 	n Name
@@ -37,14 +42,13 @@ type label struct {
 
 type labels []label
 
-// TODO (sm): make this semver sort?
 func (n labels) Len() int      { return len(n) }
 func (n labels) Swap(a, b int) { n[a], n[b] = n[b], n[a] }
 func (n labels) Less(a, b int) bool {
 	if n[a].n != n[b].n {
 		return n[a].n < n[b].n
 	}
-	return n[a].v < n[b].v
+	return CompareVersions(n[a].v, n[b].v) < 0
 }
 
 // Available is the structure used to represent the collection of all packages
@@ -76,11 +80,12 @@ func (a Available) Get(n Name, v Version) (Meta, error) {
 	return a[n][v], nil
 }
 
-// Add inserts m into a.
+// Add inserts m into a, under its QualifiedName.
 func (a Available) Add(m Meta) error {
 	if _, err := m.Valid(); err != nil {
 		return errors.Wrap(err, "invalid meta")
 	}
+	m.Name = m.QualifiedName()
 
 	if _, ok := a[Name(m.Name)]; !ok {
 		a[m.Name] = map[Version]Meta{}
@@ -103,40 +108,112 @@ func (a Available) Update(o Available) error {
 
 // SetRemote adds the information in the url to the database.
 func (a Available) SetRemote(u url.URL) {
+	l := Label(u)
 	for n, vers := range a {
 		for v := range vers {
 			m := a[n][v]
 			m.Remote = u
+			m.Repository = l
 			a[n][v] = m
 		}
 	}
 }
 
+// Label returns the short name used to refer to the remote at u: the last
+// element of its namespace, e.g. "stable" for
+// https://pm.mcquay.me/darwin/amd64/stable. Remotes without a namespace are
+// labeled by their host.
+func Label(u url.URL) string {
+	l := path.Base(u.Path)
+	if l == "/" || l == "." {
+		return u.Host
+	}
+	return l
+}
+
+// Fingerprint returns a sha256 of the name, version and URL of every package
+// in a, in Traverse order. Two Availables offering the same packages from the
+// same places have the same Fingerprint, so comparing them is a cheap way to
+// tell if a Pull changed anything.
+func (a Available) Fingerprint() string {
+	h := sha256.New()
+	it := a.Iterator()
+	for it.Next() {
+		m := it.Value()
+		fmt.Fprintf(h, "%v@%v\t%v\n", m.Name, m.Version, m.URL())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // Traverse returns a chan of Meta that will be sanely sorted.
 func (a Available) Traverse() <-chan Meta {
 	r := make(chan Meta)
 	go func() {
-		names := Names{}
-		nvs := map[Name]Versions{}
-		for n, vers := range a {
-			names = append(names, n)
-			for v := range vers {
-				nvs[n] = append(nvs[n], v)
-			}
-			sort.Sort(nvs[n])
-		}
-		sort.Sort(names)
-
-		for _, n := range names {
-			for _, v := range nvs[n] {
-				r <- a[n][v]
-			}
+		it := a.Iterator()
+		for it.Next() {
+			r <- it.Value()
 		}
 		close(r)
 	}()
 	return r
 }
 
+// Iterator steps through the packages in an Available in the same order as
+// Traverse, in the style of sql.Rows:
+//
+//	it := a.Iterator()
+//	for it.Next() {
+//		m := it.Value()
+//		...
+//	}
+//
+// Only the names are sorted up front; versions are sorted one name at a time
+// as the Iterator reaches them. It implements db.PackageIterator.
+type Iterator struct {
+	a     Available
+	names Names
+	vers  Versions
+	cur   Meta
+}
+
+// Iterator returns an Iterator positioned before the first package in a.
+func (a Available) Iterator() *Iterator {
+	names := Names{}
+	for n := range a {
+		names = append(names, n)
+	}
+	sort.Sort(names)
+	return &Iterator{a: a, names: names}
+}
+
+// Next advances the Iterator, and reports if there is a package to be read
+// with Value.
+func (it *Iterator) Next() bool {
+	for len(it.vers) == 0 {
+		if len(it.names) == 0 {
+			return false
+		}
+		for v := range it.a[it.names[0]] {
+			it.vers = append(it.vers, v)
+		}
+		sort.Sort(it.vers)
+		if len(it.vers) == 0 {
+			it.names = it.names[1:]
+		}
+	}
+	it.cur = it.a[it.names[0]][it.vers[0]]
+	it.vers = it.vers[1:]
+	if len(it.vers) == 0 {
+		it.names = it.names[1:]
+	}
+	return true
+}
+
+// Value returns the package the Iterator is currently on.
+func (it *Iterator) Value() Meta {
+	return it.cur
+}
+
 func labelForString(s string) (label, error) {
 	r := label{}
 	c := strings.Count(s, "@")
@@ -155,8 +232,23 @@ func labelForString(s string) (label, error) {
 	return r, nil
 }
 
+// ParseLabel splits a package label of the form name or name@version into its
+// parts.
+func ParseLabel(s string) (Name, Version, error) {
+	l, err := labelForString(s)
+	return l.n, l.v, err
+}
+
 // Installable calculates if the packages requested in "in" can be installed.
+// Packages that have expired can't be; see InstallableAt.
 func (a Available) Installable(in []string) (Metas, error) {
+	return a.InstallableAt(in, time.Now())
+}
+
+// InstallableAt is Installable as of now: it returns a PackageExpiredError
+// for a requested package whose ExpiresAt is not after now. A zero now
+// ignores expiry.
+func (a Available) InstallableAt(in []string, now time.Time) (Metas, error) {
 	ls := labels{}
 	for _, i := range in {
 		l, err := labelForString(i)
@@ -176,12 +268,385 @@ func (a Available) Installable(in []string) (Metas, error) {
 
 	ms := Metas{}
 	for _, l := range ls {
-		m, err := a.Get(l.n, l.v)
+		n, err := a.archFor(l.n)
+		if err != nil {
+			return ms, err
+		}
+		m, err := a.Get(n, l.v)
 		if err != nil {
 			return ms, errors.Wrapf(err, "getting %v", l)
 		}
+		if !now.IsZero() {
+			if err := m.CheckExpiry(now); err != nil {
+				return nil, err
+			}
+		}
 		ms = append(ms, m)
 	}
 
-	return ms, nil
+	order, err := ms.order()
+	if err != nil {
+		return nil, err
+	}
+	r := Metas{}
+	for _, i := range order {
+		r = append(r, ms[i])
+	}
+	return r, nil
+}
+
+// Providers returns the newest version of each package in a that provides
+// the virtual package v, most important first, by Priority, and then by
+// name; see Meta.Provides. The builds of a MultiArchSame package named v,
+// known by their qualified names, provide v too.
+func (a Available) Providers(v Name) Metas {
+	r := Metas{}
+	for m := range a.Traverse() {
+		if m.BaseName() == v && m.Name != v {
+			r = append(r, m)
+			continue
+		}
+		for _, p := range m.Provides {
+			if Name(p) == v {
+				r = append(r, m)
+				break
+			}
+		}
+	}
+	r = r.Newest()
+	sort.SliceStable(r, func(i, j int) bool {
+		pi, pj := priorities[r[i].Priority], priorities[r[j].Priority]
+		if pi != pj {
+			return pi < pj
+		}
+		return r[i].Name < r[j].Name
+	})
+	return r
+}
+
+// provider returns the package to satisfy a dependency of m on the virtual
+// package v: one already in chosen, if any provides it, or else the first of
+// a.Providers(v) built for m's architecture, or else the first of them.
+func (a Available) provider(m Meta, v Name, chosen map[Name]Meta) (Meta, bool) {
+	ps := a.Providers(v)
+	for _, p := range ps {
+		if cm, ok := chosen[p.Name]; ok {
+			return cm, true
+		}
+	}
+	if len(ps) == 0 {
+		return Meta{}, false
+	}
+	for _, p := range ps {
+		if m.Arch != "" && p.Arch == m.Arch {
+			return p, true
+		}
+	}
+	return ps[0], true
+}
+
+// ErrNoContents is returned by Available.WhatProvides when none of the
+// remotes publish the file lists of their packages.
+var ErrNoContents = errors.New("no remote publishes a contents index; can't search the files of available packages")
+
+// WhatProvides returns the available packages, sorted by name and version,
+// with a file matching the filepath.Match pattern, e.g.
+// "usr/bin/convert" or "lib/libssl.so*", as Installed.FindByFile matches
+// them.
+//
+// Only packages whose remote publishes their file lists, as Meta.Files,
+// can be found. If no package in a has one it returns ErrNoContents, rather
+// than claiming that nothing provides pattern.
+func (a Available) WhatProvides(pattern string) (Metas, error) {
+	pattern = strings.TrimPrefix(filepath.Clean(pattern), "/")
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+	}
+	contents := false
+	r := Metas{}
+	it := a.Iterator()
+	for it.Next() {
+		m := it.Value()
+		if len(m.Files) > 0 {
+			contents = true
+		}
+		for f := range m.Files {
+			if matchFile(pattern, f) {
+				r = append(r, m)
+				break
+			}
+		}
+	}
+	if !contents {
+		return nil, ErrNoContents
+	}
+	return r, nil
+}
+
+// archFor returns the name to install for a request for n: n itself, unless
+// a only has builds of n for particular architectures, as name:arch, in
+// which case it must have exactly one. See MultiArchSame.
+func (a Available) archFor(n Name) (Name, error) {
+	if _, ok := a[n]; ok {
+		return n, nil
+	}
+	qs := Names{}
+	for qn, vers := range a {
+		for _, m := range vers {
+			if m.BaseName() == n && qn != n {
+				qs = append(qs, qn)
+			}
+			break
+		}
+	}
+	switch len(qs) {
+	case 0:
+		return n, nil
+	case 1:
+		return qs[0], nil
+	}
+	sort.Sort(qs)
+	return "", fmt.Errorf("%v is available for several architectures; ask for one of %v", n, qs)
+}
+
+// UpgradeablePackages returns the newest version a offers of each package in
+// i that a has a newer version of, sorted by name. Packages another installed
+// package depends on at a specific version, as name@version, are pinned to it
+// and left out.
+func (a Available) UpgradeablePackages(i Installed) (Metas, error) {
+	pinned := map[Name]bool{}
+	for _, m := range i {
+		for _, d := range m.Deps {
+			l, err := labelForString(d)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing dependency %q of %v", d, m.Name)
+			}
+			if l.v != "" {
+				pinned[l.n] = true
+			}
+		}
+	}
+
+	names := Names{}
+	for n := range i {
+		if _, ok := a[n]; ok && !pinned[n] {
+			names = append(names, n)
+		}
+	}
+	sort.Sort(names)
+
+	r := Metas{}
+	for _, n := range names {
+		m, err := a.Get(n, "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting newest %v", n)
+		}
+		if CompareVersions(m.Version, i[n].Version) > 0 {
+			r = append(r, m)
+		}
+	}
+	return r, nil
+}
+
+// Selection explains why a particular version of a package was chosen by
+// Resolve.
+type Selection struct {
+	Package Name
+	Version Version
+	Reason  string
+}
+
+func (s Selection) String() string {
+	return fmt.Sprintf("%v@%v: %v", s.Package, s.Version, s.Reason)
+}
+
+// Resolve returns ms along with all of their transitive dependencies, ordered
+// such that each package comes after everything it depends on and respecting
+// any Before and After constraints between them.
+//
+// Dependencies that do not specify a version resolve to the newest available
+// version, unless the package was explicitly provided in ms.
+func (a Available) Resolve(ms Metas) (Metas, error) {
+	r, _, err := a.Explain(ms)
+	return r, err
+}
+
+// Explain resolves ms like Resolve, and also returns a Selection for each of
+// the resolved packages describing why its version was chosen. The first
+// constraint listed in each Reason is the one that determined the version.
+func (a Available) Explain(ms Metas) (Metas, []Selection, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	chosen := map[Name]Meta{}
+	requested := map[Name]bool{}
+	for _, m := range ms {
+		chosen[m.Name] = m
+		requested[m.Name] = true
+	}
+	pinned := map[Name]Name{}
+	needed := map[Name][]string{}
+	state := map[Name]int{}
+	r := Metas{}
+
+	var visit func(m Meta) error
+	visit = func(m Meta) error {
+		switch state[m.Name] {
+		case visiting:
+			return errors.Errorf("dependency cycle involving %q", m.Name)
+		case visited:
+			return nil
+		}
+		state[m.Name] = visiting
+		for _, d := range m.Deps {
+			l, err := labelForString(d)
+			if err != nil {
+				return errors.Wrapf(err, "parsing dependency %q of %v", d, m.Name)
+			}
+			dm, ok := chosen[l.n]
+			if _, exists := a[l.n]; !ok && !exists && l.v == "" {
+				// a virtual package stands for one of its providers.
+				if dm, ok = a.provider(m, l.n, chosen); ok {
+					if _, done := chosen[dm.Name]; !done {
+						chosen[dm.Name] = dm
+					}
+					needed[dm.Name] = append(needed[dm.Name], fmt.Sprintf("provides %v for %v", l.n, m.Name))
+					if err := visit(dm); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if !ok {
+				dm, err = a.Get(l.n, l.v)
+				if err != nil {
+					return errors.Wrapf(err, "resolving dependency of %v", m.Name)
+				}
+				chosen[dm.Name] = dm
+				if l.v != "" {
+					pinned[dm.Name] = m.Name
+				}
+			}
+			if l.v != "" && dm.Version != l.v {
+				return errors.Errorf("%v depends on %v@%v, but %v@%v was already selected", m.Name, l.n, l.v, dm.Name, dm.Version)
+			}
+			switch {
+			case pinned[dm.Name] == m.Name:
+			case l.v != "":
+				needed[dm.Name] = append(needed[dm.Name], fmt.Sprintf("also pinned by %v", m.Name))
+			default:
+				needed[dm.Name] = append(needed[dm.Name], fmt.Sprintf("required by %v", m.Name))
+			}
+			if err := visit(dm); err != nil {
+				return err
+			}
+		}
+		state[m.Name] = visited
+		r = append(r, m)
+		return nil
+	}
+
+	for _, m := range ms {
+		if err := visit(m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	order, err := r.order()
+	if err != nil {
+		return nil, nil, err
+	}
+	ordered := Metas{}
+	for _, i := range order {
+		ordered = append(ordered, r[i])
+	}
+	r = ordered
+
+	sels := []Selection{}
+	for _, m := range r {
+		why := []string{}
+		switch {
+		case requested[m.Name]:
+			why = append(why, "requested")
+		case pinned[m.Name] != "":
+			why = append(why, fmt.Sprintf("pinned to %v by %v", m.Version, pinned[m.Name]))
+		default:
+			why = append(why, "newest available")
+		}
+		why = append(why, needed[m.Name]...)
+		if newest, err := a.Get(m.Name, ""); err == nil && newest.Version != m.Version {
+			why = append(why, fmt.Sprintf("newest available is %v", newest.Version))
+		}
+		sels = append(sels, Selection{Package: m.Name, Version: m.Version, Reason: strings.Join(why, "; ")})
+	}
+	return r, sels, nil
+}
+
+// order returns the indexes of ms sorted such that dependencies and After
+// constraints come before, and Before constraints after, the packages that
+// declare them. Constraints naming packages outside of ms are ignored.
+// Otherwise the existing order of ms is kept where possible.
+func (ms Metas) order() ([]int, error) {
+	idx := map[Name]int{}
+	for i, m := range ms {
+		idx[m.Name] = i
+	}
+	// edges[i] holds the packages that must come after ms[i].
+	edges := make([][]int, len(ms))
+	in := make([]int, len(ms))
+	edge := func(from, to int) {
+		edges[from] = append(edges[from], to)
+		in[to]++
+	}
+	for i, m := range ms {
+		for _, d := range m.Deps {
+			l, err := labelForString(d)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing dependency %q of %v", d, m.Name)
+			}
+			if j, ok := idx[l.n]; ok {
+				edge(j, i)
+			}
+		}
+		for _, n := range m.After {
+			if j, ok := idx[Name(n)]; ok {
+				edge(j, i)
+			}
+		}
+		for _, n := range m.Before {
+			if j, ok := idx[Name(n)]; ok {
+				edge(i, j)
+			}
+		}
+	}
+
+	r := []int{}
+	done := make([]bool, len(ms))
+	for len(r) < len(ms) {
+		next := -1
+		for i := range ms {
+			if !done[i] && in[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			stuck := []string{}
+			for i, m := range ms {
+				if !done[i] {
+					stuck = append(stuck, string(m.Name))
+				}
+			}
+			return nil, errors.Errorf("contradictory ordering constraints between %v", strings.Join(stuck, ", "))
+		}
+		done[next] = true
+		r = append(r, next)
+		for _, j := range edges[next] {
+			in[j]--
+		}
+	}
+	return r, nil
 }
@@ -3,7 +3,10 @@ package pm
 import (
 	"errors"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAvailableAdd(t *testing.T) {
@@ -102,4 +105,711 @@ func TestAvailableUpdate(t *testing.T) {
 	if got, want := a["a"]["v1.0.0"].Remote, *u; got != want {
 		t.Fatalf("last in didn't override")
 	}
+	if got, want := a["a"]["v1.0.0"].Repository, "amd64"; got != want {
+		t.Fatalf("repository: got %v, want %v", got, want)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"https://pm.mcquay.me/darwin/amd64/stable", "stable"},
+		{"https://pm.mcquay.me/darwin/amd64/stable/", "stable"},
+		{"https://pm.example.com/generic/testing", "testing"},
+		{"https://pm.example.com", "pm.example.com"},
+		{"https://pm.example.com/", "pm.example.com"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.uri)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		if got := Label(*u); got != test.want {
+			t.Fatalf("Label(%q): got %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "app", Version: "1.0.0", Description: "d", Deps: []string{"lib", "tool@1.0.0"}},
+		{Name: "lib", Version: "1.0.0", Description: "d", Deps: []string{"base"}},
+		{Name: "lib", Version: "2.0.0", Description: "d", Deps: []string{"base"}},
+		{Name: "base", Version: "1.0.0", Description: "d"},
+		{Name: "tool", Version: "1.0.0", Description: "d", Deps: []string{"base"}},
+		{Name: "tool", Version: "2.0.0", Description: "d"},
+		{Name: "picky", Version: "1.0.0", Description: "d", Deps: []string{"tool@2.0.0"}},
+		{Name: "missing", Version: "1.0.0", Description: "d", Deps: []string{"nope"}},
+		{Name: "x", Version: "1.0.0", Description: "d", Deps: []string{"y"}},
+		{Name: "y", Version: "1.0.0", Description: "d", Deps: []string{"x"}},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	tests := []struct {
+		label string
+		in    []string
+		want  []string
+		err   bool
+	}{
+		{
+			label: "no deps",
+			in:    []string{"base"},
+			want:  []string{"base@1.0.0"},
+		},
+		{
+			label: "transitive",
+			in:    []string{"app"},
+			want:  []string{"base@1.0.0", "lib@2.0.0", "tool@1.0.0", "app@1.0.0"},
+		},
+		{
+			label: "explicit version wins",
+			in:    []string{"app", "lib@1.0.0"},
+			want:  []string{"base@1.0.0", "lib@1.0.0", "tool@1.0.0", "app@1.0.0"},
+		},
+		{
+			label: "conflicting pins",
+			in:    []string{"app", "picky"},
+			err:   true,
+		},
+		{
+			label: "missing dep",
+			in:    []string{"missing"},
+			err:   true,
+		},
+		{
+			label: "cycle",
+			in:    []string{"x"},
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			ms, err := a.Installable(test.in)
+			if err != nil {
+				t.Fatalf("installable: %v", err)
+			}
+			r, err := a.Resolve(ms)
+			if (err != nil) != test.err {
+				t.Fatalf("resolve: got %v, want error: %v", err, test.err)
+			}
+			if test.err {
+				return
+			}
+			got := []string{}
+			for _, m := range r {
+				got = append(got, string(m.Name)+"@"+string(m.Version))
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Fatalf("order: got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIterator(t *testing.T) {
+	a := Available{"empty": map[Version]Meta{}}
+	for _, m := range []Meta{
+		{Name: "b", Version: "2.0.0", Description: "d"},
+		{Name: "a", Version: "1.1.0", Description: "d"},
+		{Name: "b", Version: "1.0.0", Description: "d"},
+		{Name: "a", Version: "1.0.0", Description: "d"},
+		{Name: "c", Version: "1.0.0", Description: "d"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	want := []string{"a@1.0.0", "a@1.1.0", "b@1.0.0", "b@2.0.0", "c@1.0.0"}
+
+	got := []string{}
+	it := a.Iterator()
+	for it.Next() {
+		m := it.Value()
+		got = append(got, string(m.Name)+"@"+string(m.Version))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("iterator: got %v, want %v", got, want)
+	}
+
+	got = []string{}
+	for m := range a.Traverse() {
+		got = append(got, string(m.Name)+"@"+string(m.Version))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("traverse: got %v, want %v", got, want)
+	}
+
+	if (Available{}).Iterator().Next() {
+		t.Fatalf("empty Available should not iterate")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "app", Version: "1.0.0", Description: "d", Deps: []string{"tool", "lib"}},
+		{Name: "cli", Version: "1.0.0", Description: "d", Deps: []string{"lib"}},
+		{Name: "tool", Version: "1.0.0", Description: "d", Deps: []string{"lib@1.4.2"}},
+		{Name: "lib", Version: "1.4.2", Description: "d"},
+		{Name: "lib", Version: "1.5.0", Description: "d"},
+		{Name: "other", Version: "1.0.0", Description: "d", Deps: []string{"lib@1.4.2"}},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	tests := []struct {
+		label string
+		in    []string
+		want  []Selection
+	}{
+		{
+			label: "dependent caps version",
+			in:    []string{"tool"},
+			want: []Selection{
+				{"lib", "1.4.2", "pinned to 1.4.2 by tool; newest available is 1.5.0"},
+				{"tool", "1.0.0", "requested"},
+			},
+		},
+		{
+			label: "newest",
+			in:    []string{"cli"},
+			want: []Selection{
+				{"lib", "1.5.0", "newest available; required by cli"},
+				{"cli", "1.0.0", "requested"},
+			},
+		},
+		{
+			label: "pin binds over unversioned",
+			in:    []string{"app"},
+			want: []Selection{
+				{"lib", "1.4.2", "pinned to 1.4.2 by tool; required by app; newest available is 1.5.0"},
+				{"tool", "1.0.0", "newest available; required by app"},
+				{"app", "1.0.0", "requested"},
+			},
+		},
+		{
+			label: "shared pin",
+			in:    []string{"tool", "other"},
+			want: []Selection{
+				{"lib", "1.4.2", "pinned to 1.4.2 by tool; also pinned by other; newest available is 1.5.0"},
+				{"tool", "1.0.0", "requested"},
+				{"other", "1.0.0", "requested"},
+			},
+		},
+		{
+			label: "requested older",
+			in:    []string{"lib@1.4.2", "app"},
+			want: []Selection{
+				{"lib", "1.4.2", "requested; also pinned by tool; required by app; newest available is 1.5.0"},
+				{"tool", "1.0.0", "newest available; required by app"},
+				{"app", "1.0.0", "requested"},
+			},
+		},
+	}
+	for _, test := range tests {
+		ms, err := a.Installable(test.in)
+		if err != nil {
+			t.Fatalf("%v: installable: %v", test.label, err)
+		}
+		_, got, err := a.Explain(ms)
+		if err != nil {
+			t.Fatalf("%v: explain: %v", test.label, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v:\ngot  %v\nwant %v", test.label, got, test.want)
+		}
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "app", Version: "1.0.0", Description: "d", Deps: []string{"lib"}},
+		{Name: "lib", Version: "1.0.0", Description: "d"},
+		{Name: "db", Version: "1.0.0", Description: "d", Before: []string{"app"}},
+		{Name: "web", Version: "1.0.0", Description: "d", After: []string{"app", "absent"}},
+		{Name: "early", Version: "1.0.0", Description: "d", Before: []string{"lib"}},
+		{Name: "late", Version: "1.0.0", Description: "d", Deps: []string{"lib"}, Before: []string{"lib"}},
+		{Name: "x", Version: "1.0.0", Description: "d", Before: []string{"y"}},
+		{Name: "y", Version: "1.0.0", Description: "d", Before: []string{"x"}},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	tests := []struct {
+		label string
+		in    []string
+		want  []string
+		err   bool
+	}{
+		{
+			label: "before",
+			in:    []string{"app", "db"},
+			want:  []string{"db", "lib", "app"},
+		},
+		{
+			label: "after, ignoring absent packages",
+			in:    []string{"web", "app"},
+			want:  []string{"lib", "app", "web"},
+		},
+		{
+			label: "before a dependency",
+			in:    []string{"app", "early"},
+			want:  []string{"early", "lib", "app"},
+		},
+		{
+			label: "ordering contradicts dependency",
+			in:    []string{"late"},
+			err:   true,
+		},
+		{
+			label: "ordering cycle",
+			in:    []string{"x", "y"},
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		ms, err := a.Installable(test.in)
+		if err == nil {
+			ms, err = a.Resolve(ms)
+		}
+		if (err != nil) != test.err {
+			t.Fatalf("%v: unexpected error state: %v", test.label, err)
+		}
+		if err != nil {
+			continue
+		}
+		got := []string{}
+		for _, m := range ms {
+			got = append(got, string(m.Name))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: got %v, want %v", test.label, got, test.want)
+		}
+	}
+}
+
+func TestInstallableExpired(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "a", Version: "1.0.0", Description: "a", ExpiresAt: &past},
+		{Name: "a", Version: "2.0.0", Description: "a", ExpiresAt: &future},
+		{Name: "b", Version: "1.0.0", Description: "b", ExpiresAt: &now},
+		{Name: "c", Version: "1.0.0", Description: "c"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	tests := []struct {
+		in      string
+		expired bool
+	}{
+		{"a@1.0.0", true},
+		{"a@2.0.0", false},
+		{"a", false},
+		{"b", true},
+		{"c", false},
+	}
+	for _, test := range tests {
+		_, err := a.InstallableAt([]string{test.in}, now)
+		pe, ok := err.(PackageExpiredError)
+		if ok != test.expired {
+			t.Fatalf("%v: got %v, want expired %v", test.in, err, test.expired)
+		}
+		if ok && pe.Name != Name(strings.Split(test.in, "@")[0]) {
+			t.Fatalf("%v: got %+v", test.in, pe)
+		}
+		if _, err := a.InstallableAt([]string{test.in}, time.Time{}); err != nil {
+			t.Fatalf("%v: ignoring expiry: %v", test.in, err)
+		}
+	}
+}
+
+func TestUpgradable(t *testing.T) {
+	i := Installed{
+		"a": Meta{Name: "a", Version: "1.0.0"},
+		"b": Meta{Name: "b", Version: "2.0.0"},
+		"c": Meta{Name: "c", Version: "1.0.0"},
+	}
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "a", Version: "1.0.0", Description: "a"},
+		{Name: "a", Version: "1.1.0", Description: "a"},
+		{Name: "a", Version: "1.2.0", Description: "a"},
+		{Name: "b", Version: "1.0.0", Description: "b"},
+		{Name: "d", Version: "1.0.0", Description: "d"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	got := i.Upgradable(a)
+	if len(got) != 1 || got[0].Name != "a" || got[0].Version != "1.2.0" {
+		t.Fatalf("got %v, want only a@1.2.0", got)
+	}
+}
+
+func TestUpgradeablePackages(t *testing.T) {
+	i := Installed{
+		"c":    Meta{Name: "c", Version: "1.0.0"},
+		"a":    Meta{Name: "a", Version: "1.0.0"},
+		"b":    Meta{Name: "b", Version: "2.0.0"},
+		"lib":  Meta{Name: "lib", Version: "1.0.0"},
+		"tool": Meta{Name: "tool", Version: "1.0.0", Deps: []string{"lib@1.0.0"}},
+	}
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "a", Version: "1.2.0", Description: "a"},
+		{Name: "a", Version: "1.1.0", Description: "a"},
+		{Name: "b", Version: "1.0.0", Description: "b"},
+		{Name: "c", Version: "1.0.1", Description: "c"},
+		{Name: "d", Version: "1.0.0", Description: "d"},
+		{Name: "lib", Version: "2.0.0", Description: "lib"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	ms, err := a.UpgradeablePackages(i)
+	if err != nil {
+		t.Fatalf("upgradeable: %v", err)
+	}
+	got := []string{}
+	for _, m := range ms {
+		got = append(got, string(m.Name)+"@"+string(m.Version))
+	}
+	if want := []string{"a@1.2.0", "c@1.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	i["tool"] = Meta{Name: "tool", Version: "1.0.0", Deps: []string{"lib@1@0"}}
+	if _, err := a.UpgradeablePackages(i); err == nil {
+		t.Fatalf("accepted a malformed dependency")
+	}
+}
+
+func TestAutoremovable(t *testing.T) {
+	i := Installed{
+		"a": Meta{Name: "a", Version: "1.0.0", Deps: []string{"b"}},
+		"b": Meta{Name: "b", Version: "1.0.0", Deps: []string{"c@1.0.0"}, Auto: true},
+		"c": Meta{Name: "c", Version: "1.0.0", Auto: true},
+		"d": Meta{Name: "d", Version: "1.0.0", Deps: []string{"e"}, Auto: true},
+		"e": Meta{Name: "e", Version: "1.0.0", Auto: true},
+	}
+	got := Names{}
+	for _, m := range i.Autoremovable() {
+		got = append(got, m.Name)
+	}
+	if want := (Names{"d", "e"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDependents(t *testing.T) {
+	i := Installed{
+		"lib":   Meta{Name: "lib", Version: "1.0.0"},
+		"ext":   Meta{Name: "ext", Version: "1.0.0", Deps: []string{"lib@1.0.0"}},
+		"app":   Meta{Name: "app", Version: "1.0.0", Deps: []string{"ext", "tool"}},
+		"tool":  Meta{Name: "tool", Version: "1.0.0", Deps: []string{"ext"}},
+		"other": Meta{Name: "other", Version: "1.0.0", Deps: []string{"unrelated"}},
+	}
+	got := Names{}
+	for _, m := range i.Dependents("lib") {
+		got = append(got, m.Name)
+	}
+	if want := (Names{"ext", "tool", "app"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := i.Dependents("app"); len(got) != 0 {
+		t.Fatalf("got %v, want nothing", got)
+	}
+}
+
+func TestFindByFile(t *testing.T) {
+	files := func(fs ...string) map[string]string {
+		r := map[string]string{}
+		for _, f := range fs {
+			r[f] = "sum"
+		}
+		return r
+	}
+	i := Installed{
+		"nginx":   Meta{Name: "nginx", Files: files("bin/nginx", "etc/nginx/nginx.conf", "etc/nginx/mime.types")},
+		"modsec":  Meta{Name: "modsec", Files: files("etc/nginx/modules/modsec.conf", "lib/modsec.so")},
+		"certbot": Meta{Name: "certbot", Files: files("bin/certbot", "etc/letsencrypt/cli.ini", "etc/nginx/certbot.conf")},
+		"old":     Meta{Name: "old"},
+	}
+
+	tests := []struct {
+		pattern string
+		want    map[string][]string
+		err     bool
+	}{
+		{
+			pattern: "/etc/nginx/",
+			want: map[string][]string{
+				"nginx":   {"etc/nginx/mime.types", "etc/nginx/nginx.conf"},
+				"modsec":  {"etc/nginx/modules/modsec.conf"},
+				"certbot": {"etc/nginx/certbot.conf"},
+			},
+		},
+		{
+			pattern: "etc/nginx/modules",
+			want:    map[string][]string{"modsec": {"etc/nginx/modules/modsec.conf"}},
+		},
+		{
+			pattern: "etc/*/*.conf",
+			want: map[string][]string{
+				"nginx":   {"etc/nginx/nginx.conf"},
+				"certbot": {"etc/nginx/certbot.conf"},
+			},
+		},
+		{
+			pattern: "bin/*",
+			want: map[string][]string{
+				"nginx":   {"bin/nginx"},
+				"certbot": {"bin/certbot"},
+			},
+		},
+		{
+			pattern: "etc",
+			want: map[string][]string{
+				"nginx":   {"etc/nginx/mime.types", "etc/nginx/nginx.conf"},
+				"modsec":  {"etc/nginx/modules/modsec.conf"},
+				"certbot": {"etc/letsencrypt/cli.ini", "etc/nginx/certbot.conf"},
+			},
+		},
+		{pattern: "usr", want: map[string][]string{}},
+		{pattern: "etc/[", err: true},
+	}
+	for _, test := range tests {
+		got, err := i.FindByFile(test.pattern)
+		if (err != nil) != test.err {
+			t.Fatalf("%q: unexpected error state: %v", test.pattern, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%q: got %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	u, err := url.Parse("https://pm.mcquay.me/linux/amd64/stable")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	build := func(ms ...Meta) Available {
+		a := Available{}
+		for _, m := range ms {
+			m.Description = "a test pkg"
+			if err := a.Add(m); err != nil {
+				t.Fatalf("add: %v", err)
+			}
+		}
+		a.SetRemote(*u)
+		return a
+	}
+	a := build(Meta{Name: "a", Version: "1.0.0"}, Meta{Name: "b", Version: "1.0.0"})
+	same := build(Meta{Name: "b", Version: "1.0.0"}, Meta{Name: "a", Version: "1.0.0"})
+	newer := build(Meta{Name: "a", Version: "1.1.0"}, Meta{Name: "b", Version: "1.0.0"})
+	if a.Fingerprint() != same.Fingerprint() {
+		t.Fatalf("same packages, different fingerprints")
+	}
+	if a.Fingerprint() == newer.Fingerprint() {
+		t.Fatalf("different packages, same fingerprint")
+	}
+
+	moved := build(Meta{Name: "a", Version: "1.0.0"}, Meta{Name: "b", Version: "1.0.0"})
+	o, err := url.Parse("https://pm.example.com/linux/amd64/stable")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	moved.SetRemote(*o)
+	if a.Fingerprint() == moved.Fingerprint() {
+		t.Fatalf("different remotes, same fingerprint")
+	}
+	if got, want := (Available{}).Fingerprint(), Available(nil).Fingerprint(); got != want {
+		t.Fatalf("empty: got %v, want %v", got, want)
+	}
+}
+
+func TestResolveProviders(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "mailer", Version: "1.0.0", Description: "d", Deps: []string{"mta"}},
+		{Name: "exim", Version: "1.0.0", Description: "d", Provides: []string{"mta"}, Priority: Optional},
+		{Name: "postfix", Version: "1.0.0", Description: "d", Provides: []string{"mta"}},
+		{Name: "postfix", Version: "2.0.0", Description: "d", Provides: []string{"mta"}},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	got := []string{}
+	for _, m := range a.Providers("mta") {
+		got = append(got, string(m.Name)+"@"+string(m.Version))
+	}
+	if want := []string{"postfix@2.0.0", "exim@1.0.0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("providers: got %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{"mailer"}, []string{"postfix@2.0.0", "mailer@1.0.0"}},
+		{[]string{"exim", "mailer"}, []string{"exim@1.0.0", "mailer@1.0.0"}},
+	}
+	for _, test := range tests {
+		ms, err := a.Installable(test.in)
+		if err != nil {
+			t.Fatalf("%v: installable: %v", test.in, err)
+		}
+		r, err := a.Resolve(ms)
+		if err != nil {
+			t.Fatalf("%v: resolve: %v", test.in, err)
+		}
+		got := []string{}
+		for _, m := range r {
+			got = append(got, string(m.Name)+"@"+string(m.Version))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestWhatProvides(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "imagemagick", Version: "1.0.0", Description: "d", Files: map[string]string{"usr/bin/convert": "", "usr/bin/identify": ""}},
+		{Name: "imagemagick", Version: "2.0.0", Description: "d", Files: map[string]string{"usr/bin/magick": ""}},
+		{Name: "graphicsmagick", Version: "1.0.0", Description: "d", Files: map[string]string{"usr/bin/convert": ""}},
+		{Name: "nocontents", Version: "1.0.0", Description: "d"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"/usr/bin/convert", []string{"graphicsmagick@1.0.0", "imagemagick@1.0.0"}},
+		{"usr/bin/magick", []string{"imagemagick@2.0.0"}},
+		{"usr/bin", []string{"graphicsmagick@1.0.0", "imagemagick@1.0.0", "imagemagick@2.0.0"}},
+		{"usr/bin/gimp", []string{}},
+	}
+	for _, test := range tests {
+		ms, err := a.WhatProvides(test.pattern)
+		if err != nil {
+			t.Fatalf("%v: %v", test.pattern, err)
+		}
+		got := []string{}
+		for _, m := range ms {
+			got = append(got, string(m.Name)+"@"+string(m.Version))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: got %v, want %v", test.pattern, got, test.want)
+		}
+	}
+
+	if _, err := a.WhatProvides("["); err == nil {
+		t.Fatalf("bad pattern accepted")
+	}
+	none := Available{}
+	if err := none.Add(Meta{Name: "a", Version: "1.0.0", Description: "d"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := none.WhatProvides("usr/bin/convert"); err != ErrNoContents {
+		t.Fatalf("got %v, want ErrNoContents", err)
+	}
+}
+
+func TestMultiArch(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "libfoo", Version: "1.0.0", Description: "d", Arch: "amd64", MultiArch: MultiArchSame},
+		{Name: "libfoo", Version: "1.0.0", Description: "d", Arch: "arm64", MultiArch: MultiArchSame},
+		{Name: "app", Version: "1.0.0", Description: "d", Arch: "arm64", Deps: []string{"libfoo"}},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	for _, n := range []Name{"libfoo:amd64", "libfoo:arm64"} {
+		if _, ok := a[n]; !ok {
+			t.Fatalf("%v not available", n)
+		}
+	}
+	if err := a.Add(Meta{Name: "bad", Version: "1.0.0", Description: "d", MultiArch: "sometimes"}); err == nil {
+		t.Fatalf("unknown multi-arch accepted")
+	}
+
+	m := a["libfoo:arm64"]["1.0.0"]
+	if got, want := m.Pkg(), "libfoo-1.0.0_arm64.pkg"; got != want {
+		t.Fatalf("pkg: got %q, want %q", got, want)
+	}
+	if got, want := m.BaseName(), Name("libfoo"); got != want {
+		t.Fatalf("base name: got %q, want %q", got, want)
+	}
+
+	if _, err := a.Installable([]string{"libfoo"}); err == nil {
+		t.Fatalf("ambiguous request for libfoo accepted")
+	}
+	ms, err := a.Installable([]string{"libfoo:amd64", "libfoo:arm64"})
+	if err != nil {
+		t.Fatalf("installable: %v", err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("got %v, want both architectures", ms)
+	}
+
+	ms, err = a.Installable([]string{"app"})
+	if err != nil {
+		t.Fatalf("installable: %v", err)
+	}
+	r, err := a.Resolve(ms)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	got := []string{}
+	for _, m := range r {
+		got = append(got, string(m.Name))
+	}
+	if want := []string{"libfoo:arm64", "app"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("resolve: got %v, want %v", got, want)
+	}
+
+	i := Installed{"libfoo:amd64": a["libfoo:amd64"]["1.0.0"]}
+	if err := i.CoInstallable(m); err != nil {
+		t.Fatalf("co-installing same: %v", err)
+	}
+	no := Meta{Name: "libfoo", Version: "1.0.0", Description: "d", Arch: "arm64"}
+	if err := i.CoInstallable(no); err == nil {
+		t.Fatalf("co-installing multi-arch no accepted")
+	} else if _, ok := err.(CoInstallationError); !ok {
+		t.Fatalf("got %T, want CoInstallationError", err)
+	}
 }
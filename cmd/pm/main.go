@@ -2,15 +2,27 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/errors"
 	"mcquay.me/fs"
+	"mcquay.me/pm"
 	"mcquay.me/pm/db"
 	"mcquay.me/pm/keyring"
 	"mcquay.me/pm/pkg"
+	"mcquay.me/pm/plugin"
 )
 
 // Version stores the current version, and is updated at build time.
@@ -19,30 +31,54 @@ const Version = "dev"
 const usage = `pm: simple, cross-platform system package manager
 
 subcommands:
+  autoremove       -- remove packages no longer needed as dependencies
   available  (av)  -- print out all installable packages
+  cache            -- inspect and clean the package cache
+  changelog        -- print a package's changelog
+  diff             -- compare the packages installed in two roots
   environ    (env) -- print environment information
   install    (in)  -- install packages
   keyring    (key) -- interact with pm's OpenPGP keyring
   ls               -- list installed packages
+  manifest         -- print the verified manifest of an available package
+  mark             -- mark packages as installed explicitly or automatically
+  owns             -- print the installed packages owning files matching a pattern
   package    (pkg) -- create packages
   pull             -- fetch all available packages from all configured remotes
+  reclaimable      -- print how much space autoremove and cache clean would free
+  recover          -- rebuild a corrupt installed package database
   remote           -- configure remote pmd servers
   rm               -- remove packages
+  search           -- find available packages matching a query
+  status           -- print the last install, remove or upgrade
+  upgrade    (up)  -- upgrade installed packages from one remote
+  verify           -- check a .pkg file's signature and contents
   version    (v)   -- print version information
+  what-provides    -- find the available packages with files matching a pattern
 `
 
 const keyUsage = `pm keyring: interact with pm's OpenPGP keyring
 
 subcommands:
+  audit            --  report every key and its trust, as json
   create      (c)  --  create a fresh keypair
   export      (e)  --  export a public key to stdout
   import      (i)  --  import a public key from stdin
   ls               --  list configured key info
+  revoke           --  stop accepting signatures from a key
   rm               --  remove a key from the keyring
   sign        (s)  --  sign a file
+  trust            --  set the trust level of a key
   verify      (v)  --  verify a detached signature
 `
 
+const cacheUsage = `pm cache: inspect and clean the package cache
+
+subcommands:
+  clean            --  remove cached files matching a policy
+  ls               --  list cached files
+`
+
 const pkgUsage = `pm package: generate pm-compatible packages
 
 subcommands:
@@ -68,11 +104,13 @@ func main() {
 		root = "/usr/local"
 	}
 	signID := os.Getenv("PM_PGP_ID")
+	abi := os.Getenv("PM_ABI")
 
 	switch cmd {
 	case "env", "environ":
 		fmt.Printf("PM_ROOT=%q\n", root)
 		fmt.Printf("PM_PGP_ID=%q\n", signID)
+		fmt.Printf("PM_ABI=%q\n", abi)
 	case "key", "keyring":
 		if len(os.Args[1:]) < 2 {
 			fatalf("pm keyring: insufficient args\n\nusage: %v", keyUsage)
@@ -83,6 +121,16 @@ func main() {
 			if err := keyring.ListKeys(root, os.Stdout); err != nil {
 				fatalf("listing keypair: %v\n", err)
 			}
+		case "audit":
+			r, err := keyring.Audit(root)
+			if err != nil {
+				fatalf("auditing keyring: %v\n", err)
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(r); err != nil {
+				fatalf("encoding trust report: %v\n", err)
+			}
 		case "c", "create":
 			var name, email string
 			s := bufio.NewScanner(os.Stdin)
@@ -157,6 +205,24 @@ func main() {
 			if err := keyring.Remove(root, id); err != nil {
 				fatalf("removing key for %q: %v\n", id, err)
 			}
+		case "revoke":
+			if len(args) != 1 {
+				fatalf("missing fingerprint\n\nusage: pm key revoke <fingerprint>\n")
+			}
+			if err := keyring.Revoke(root, args[0]); err != nil {
+				fatalf("revoking %q: %v\n", args[0], err)
+			}
+		case "trust":
+			if len(args) != 2 {
+				fatalf("missing fingerprint or trust level\n\nusage: pm key trust <fingerprint> <trusted|marginal|untrusted>\n")
+			}
+			level, err := keyring.ParseTrustLevel(args[1])
+			if err != nil {
+				fatalf("%v\n", err)
+			}
+			if err := keyring.SetTrust(root, args[0], level); err != nil {
+				fatalf("setting trust for %q: %v\n", args[0], err)
+			}
 		default:
 			fatalf("unknown keyring subcommand: %q\n\nusage: %v", sub, keyUsage)
 		}
@@ -218,20 +284,156 @@ func main() {
 		default:
 			fatalf("unknown package subcommand: %q\n\nusage: %v", sub, remoteUsage)
 		}
+	case "cache":
+		if len(os.Args[1:]) < 2 {
+			fatalf("pm cache: insufficient args\n\nusage: %v", cacheUsage)
+		}
+		sub := os.Args[2]
+		report, err := pkg.CacheReport(root)
+		if err != nil {
+			fatalf("reading cache: %v\n", err)
+		}
+		switch sub {
+		case "ls":
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+			for _, e := range report {
+				fmt.Fprintf(w, "%v\t%d\t%v\treferenced=%v\tinstallable=%v\n", e.Path, e.Size, e.Age.Round(time.Second), e.Referenced, e.Installable)
+			}
+			w.Flush()
+		case "clean":
+			policy := pkg.CachePolicy{}
+			flags := flag.NewFlagSet("cache clean", flag.ExitOnError)
+			flags.BoolVar(&policy.Unreferenced, "unreferenced", false, "remove files the available db doesn't list")
+			flags.BoolVar(&policy.Superseded, "superseded", false, "remove packages for which a newer version is available")
+			flags.DurationVar(&policy.OlderThan, "older-than", 0, "remove files older than this")
+			flags.Parse(os.Args[3:])
+			freed, err := pkg.CacheClean(report, policy)
+			if err != nil {
+				fatalf("cleaning cache: %v\n", err)
+			}
+			fmt.Printf("freed %d bytes\n", freed)
+		default:
+			fatalf("unknown cache subcommand: %q\n\nusage: %v", sub, cacheUsage)
+		}
 	case "pull":
-		if err := db.Pull(root); err != nil {
+		st, err := db.Sync(root)
+		if err != nil {
 			fatalf("pulling available packages: %v\n", err)
 		}
+		for _, u := range st.Updated {
+			fmt.Printf("updated: %v\n", u.String())
+		}
+		for _, u := range st.Unchanged {
+			fmt.Printf("unchanged: %v\n", u.String())
+		}
 	case "available", "av":
 		if err := db.ListAvailable(root, os.Stdout); err != nil {
 			fatalf("pulling available packages: %v\n", err)
 		}
+	case "search":
+		if len(os.Args) < 3 {
+			fatalf("usage: pm search <query>\n\nterms match package names and descriptions, and can be combined\nwith AND, OR, NOT and parentheses, e.g. '(network OR dns) NOT deprecated'\n")
+		}
+		if err := db.SearchAvailable(root, strings.Join(os.Args[2:], " "), os.Stdout); err != nil {
+			fatalf("searching available packages: %v\n", err)
+		}
 	case "install", "in":
-		if len(os.Args[1:]) < 2 {
-			fatalf("pm install: insufficient args\n\nusage: pm install [pkg1, pkg2, ..., pkgN]\n")
+		opts := pkg.Options{}
+		flags := flag.NewFlagSet("install", flag.ExitOnError)
+		flags.BoolVar(&opts.NoDeps, "no-deps", false, "install only the named packages, skipping their dependencies")
+		flags.BoolVar(&opts.ReinstallDeps, "reinstall-deps", false, "also reinstall the installed packages that depend on those being installed")
+		opts.Mirrors = map[string][]string{}
+		flags.Var(mirrors(opts.Mirrors), "mirror", "also fetch packages from a remote from this mirror, as <remote url>=<mirror url>, preferring whichever does best; may be repeated")
+		flags.BoolVar(&opts.AutoApprove, "y", false, "install without asking for confirmation")
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "show what would be installed, without installing it")
+		flags.BoolVar(&opts.Simulate, "simulate", false, "the same as --dry-run")
+		flags.StringVar(&opts.TargetDir, "target-dir", "", "extract packages into this directory without recording them as installed")
+		flags.Var((*patterns)(&opts.ExcludePatterns), "exclude", "skip files matching this pattern; may be repeated")
+		flags.BoolVar(&opts.PostInstallVerify, "verify", false, "re-read installed files from disk and check them against the package")
+		flags.StringVar(&opts.FromSource, "from", "", "install the named packages from the remote with this label")
+		flags.BoolVar(&opts.AllowMarginal, "allow-marginal", false, "accept packages signed by marginally trusted keys")
+		flags.IntVar(&opts.MinSignatureStrength.MinBits, "min-key-bits", 0, "refuse packages signed by RSA, DSA or ElGamal keys shorter than this")
+		flags.BoolVar(&opts.MinSignatureStrength.RejectSHA1, "reject-sha1", false, "refuse packages signed over SHA-1 or weaker digests")
+		flags.DurationVar(&opts.MinSignatureStrength.MinValidity, "min-key-validity", 0, "refuse packages signed by keys that expire within this long")
+		flags.BoolVar(&opts.AllowExpired, "allow-expired", false, "install packages that have expired; for emergencies only")
+		flags.BoolVar(&opts.Strict, "strict", false, "treat warnings as errors")
+		flags.BoolVar(&opts.StagedInstall, "staged", false, "download and verify every package before installing any, and install all or nothing; the default for more than one package")
+		flags.BoolVar(&opts.Incremental, "incremental", false, "install each package as soon as it is verified, instead of staging")
+		flags.IntVar(&opts.Concurrency, "jobs", 1, "download this many packages at once")
+		flags.IntVar(&opts.MaxConcurrency, "max-jobs", 0, "adapt the number of concurrent downloads between --jobs and this, based on throughput")
+		flags.IntVar(&opts.StripComponents, "strip-components", 0, "strip this many leading path components from each file, like tar")
+		flags.BoolVar(&opts.StripDebug, "strip", false, "strip debug symbols from installed ELF binaries")
+		flags.StringVar(&opts.StripBin, "strip-bin", "", "the strip program to use with --strip (default strip)")
+		flags.BoolVar(&opts.SpecialFiles, "special-files", false, "allow packages to create device nodes and fifos")
+		flags.BoolVar(&opts.AllowExtraFiles, "allow-extra-files", false, "ignore files in a package that its manifest doesn't list, instead of failing")
+		umask := flags.String("umask", "", "clear these permission bits, in octal, from every installed file and directory")
+		minPriority := flags.String("min-priority", "", "skip dependencies less important than this: required, important, standard, optional or extra")
+		flags.BoolVar(&opts.HTTPSOnly, "https-only", false, "refuse packages from remotes reached over plain http")
+		conflicts := flags.String("conflicts", "fail", "what to do with packages that conflict with installed ones: fail, remove the installed ones, or skip them")
+		unowned := flags.String("unowned", "abort", "what to do with files a package would overwrite that no installed package owns: abort, backup (to <file>.pmorig) or overwrite")
+		opts.TransparencyLogs = map[string]string{}
+		flags.Var(logs(opts.TransparencyLogs), "transparency-log", "check signatures of packages from a remote against a transparency log, as <remote url>=<log url>; may be repeated")
+		flags.BoolVar(&opts.RequireTransparency, "require-transparency", false, "refuse packages whose signature is missing from their remote's transparency log")
+		flags.StringVar(&opts.UnixSocketProxy, "unix-socket-proxy", "", "download packages through the http proxy listening on this unix socket")
+		flags.Int64Var(&opts.MaxPackageBytes, "max-package-bytes", 0, "refuse to install any package larger than this many bytes")
+		flags.Int64Var(&opts.MaxTransactionBytes, "max-transaction-bytes", 0, "refuse to install more than this many bytes in total")
+		bom := flags.String("bom", "", "write a bill of materials for the installed packages to this file")
+		env := flags.String("env", "", "write a NAME_VERSION=<version> line for each installed package to this file")
+		flags.Parse(os.Args[2:])
+		pkgs := flags.Args()
+		if len(pkgs) < 1 {
+			fatalf("pm install: insufficient args\n\nusage: pm install [-y] [--dry-run|--simulate] [--staged|--incremental] [--strict] [--jobs=<n>] [--max-jobs=<n>] [--verify] [--allow-marginal] [--min-key-bits=<n>] [--reject-sha1] [--min-key-validity=<duration>] [--allow-expired] [--from=<label>] [--no-deps] [--reinstall-deps] [--special-files] [--allow-extra-files] [--umask=<octal>] [--min-priority=<priority>] [--https-only] [--unowned=abort|backup|overwrite] [--conflicts=fail|remove|skip] [--transparency-log=<remote>=<log> [--require-transparency]] [--mirror=<remote>=<mirror>] [--unix-socket-proxy=<path>] [--max-package-bytes=<n>] [--max-transaction-bytes=<n>] [--strip-components=<n>] [--strip [--strip-bin=<path>]] [--target-dir=<dir>] [--exclude=<pattern>] [--bom=<file>] [--env=<file>] [pkg1, pkg2, ..., pkgN]\n")
+		}
+		if *umask != "" {
+			u, err := strconv.ParseUint(*umask, 8, 32)
+			if err != nil || u > 0777 {
+				fatalf("pm install: bad umask %q\n", *umask)
+			}
+			opts.Umask = os.FileMode(u)
+		}
+		if *minPriority != "" {
+			p, err := pm.ParsePriority(*minPriority)
+			if err != nil {
+				fatalf("pm install: %v\n", err)
+			}
+			opts.MinPriority = p
+		}
+		u, err := pkg.ParseUnownedPolicy(*unowned)
+		if err != nil {
+			fatalf("pm install: %v\n", err)
+		}
+		opts.UnownedFiles = u
+		c, err := pkg.ParseConflictResolution(*conflicts)
+		if err != nil {
+			fatalf("pm install: %v\n", err)
+		}
+		opts.ConflictResolution = c
+		opts.Confirm = confirm
+		opts.PlanWriter = os.Stdout
+		opts.SystemABI = abi
+		if *bom != "" {
+			f, err := os.Create(*bom)
+			if err != nil {
+				fatalf("creating bill of materials: %v\n", err)
+			}
+			defer f.Close()
+			opts.BOM = f
+		}
+		if *env != "" {
+			f, err := os.Create(*env)
+			if err != nil {
+				fatalf("creating env file: %v\n", err)
+			}
+			defer f.Close()
+			opts.EnvOutput = f
+		}
+		hooks, err := plugin.Load(root)
+		if err != nil {
+			fatalf("loading plugins: %v\n", err)
 		}
-		pkgs := os.Args[2:]
-		if err := pkg.Install(root, pkgs); err != nil {
+		opts.Hooks = hooks
+		opts.Stop = stopOnSignal()
+		if err := pkg.Install(root, pkgs, opts); err != nil {
 			fatalf("installing: %v\n", err)
 		}
 	case "ls":
@@ -244,14 +446,178 @@ func main() {
 				fatalf("listing installed: %v\n", err)
 			}
 		}
+	case "owns":
+		if len(os.Args) != 3 {
+			fatalf("usage: pm owns <pattern>\n\npattern is matched against installed files and the directories\ncontaining them, e.g. 'etc/nginx' or 'bin/*ctl'\n")
+		}
+		if err := db.ListOwners(root, os.Args[2], os.Stdout); err != nil {
+			fatalf("finding owners: %v\n", err)
+		}
+	case "status":
+		t, err := pkg.LastTransaction(root)
+		if os.IsNotExist(err) {
+			fmt.Println("last operation: none")
+			break
+		}
+		if err != nil {
+			fatalf("reading last transaction: %v\n", err)
+		}
+		fmt.Printf("last operation: %v\n", t)
+	case "what-provides":
+		if len(os.Args) != 3 {
+			fatalf("usage: pm what-provides <pattern>\n\npattern is matched against the files of available packages and the\ndirectories containing them, e.g. 'usr/bin/convert' or 'lib/libssl.so*'\n")
+		}
+		av, _, err := db.LoadAvailable(root)
+		if err != nil {
+			fatalf("loading available db: %v\n", err)
+		}
+		ms, err := av.WhatProvides(os.Args[2])
+		if err != nil {
+			fatalf("what provides: %v\n", err)
+		}
+		for _, m := range ms {
+			fmt.Printf("%v\t%v\t%v\n", m.Name, m.Version, m.Remote.String())
+		}
 	case "rm":
-		if len(os.Args[1:]) < 2 {
-			fatalf("pm rm: insufficient args\n\nusage: pm rm [pkg1, pkg2, ..., pkgN]\n")
+		flags := flag.NewFlagSet("rm", flag.ExitOnError)
+		yes := flags.Bool("y", false, "remove without asking for confirmation")
+		dryRun := flags.Bool("dry-run", false, "show what would be removed, without removing it")
+		flags.Parse(os.Args[2:])
+		pkgs := flags.Args()
+		if len(pkgs) < 1 {
+			fatalf("pm rm: insufficient args\n\nusage: pm rm [-y] [--dry-run] [pkg1, pkg2, ..., pkgN]\n")
+		}
+		p, err := pkg.PlanRemove(root, pkgs)
+		if err != nil {
+			fatalf("planning removal: %v\n", err)
+		}
+		if *dryRun {
+			fmt.Print(p)
+			break
+		}
+		if !*yes && !confirmRemove(p) {
+			fatalf("cancelled\n")
 		}
-		pkgs := os.Args[2:]
 		if err := pkg.Remove(root, pkgs); err != nil {
 			fatalf("removing: %v\n", err)
 		}
+	case "changelog":
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			fatalf("usage: pm changelog <pkg> [version]\n")
+		}
+		version := ""
+		if len(os.Args) == 4 {
+			version = os.Args[3]
+		}
+		cl, err := pkg.Changelog(root, os.Args[2], version)
+		if err != nil {
+			fatalf("changelog: %v\n", err)
+		}
+		fmt.Print(cl)
+	case "manifest":
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			fatalf("usage: pm manifest <pkg> [version]\n")
+		}
+		version := ""
+		if len(os.Args) == 4 {
+			version = os.Args[3]
+		}
+		av, _, err := db.LoadAvailable(root)
+		if err != nil {
+			fatalf("loading available db: %v\n", err)
+		}
+		m, err := av.Get(pm.Name(os.Args[2]), pm.Version(version))
+		if err != nil {
+			fatalf("manifest: %v\n", err)
+		}
+		cs, err := pkg.Manifest(root, m, pkg.Options{})
+		if err != nil {
+			fatalf("manifest: %v\n", err)
+		}
+		fns := []string{}
+		for fn := range cs {
+			fns = append(fns, fn)
+		}
+		sort.Strings(fns)
+		for _, fn := range fns {
+			fmt.Printf("%v\t%v\n", cs[fn], fn)
+		}
+	case "recover":
+		if err := db.Recover(root, os.Stdout); err != nil {
+			fatalf("recovering installed db: %v\n", err)
+		}
+	case "autoremove":
+		ms, err := pkg.Autoremove(root)
+		if err != nil {
+			fatalf("autoremoving: %v\n", err)
+		}
+		for _, m := range ms {
+			fmt.Printf("removed %v@%v\n", m.Name, m.Version)
+		}
+	case "diff":
+		if len(os.Args) != 4 {
+			fatalf("pm diff: wrong number of args\n\nusage: pm diff <root a> <root b>\n")
+		}
+		d, err := pkg.DiffRoots(os.Args[2], os.Args[3])
+		if err != nil {
+			fatalf("comparing roots: %v\n", err)
+		}
+		for _, m := range d.OnlyA {
+			fmt.Printf("only in a: %v@%v\n", m.Name, m.Version)
+		}
+		for _, m := range d.OnlyB {
+			fmt.Printf("only in b: %v@%v\n", m.Name, m.Version)
+		}
+		for _, v := range d.Versions {
+			fmt.Printf("version: %v: %v in a, %v in b\n", v.Name, v.A, v.B)
+		}
+		for _, f := range d.Files {
+			fmt.Printf("file: %v: %v\n", f.Package, f.File)
+		}
+		if !d.Empty() {
+			os.Exit(1)
+		}
+	case "reclaimable":
+		ab, cb, err := pkg.ReclaimableSpace(root)
+		if err != nil {
+			fatalf("computing reclaimable space: %v\n", err)
+		}
+		fmt.Printf("autoremove: %d bytes\n", ab)
+		fmt.Printf("cache: %d bytes (pm cache clean -unreferenced -superseded)\n", cb)
+	case "mark":
+		if len(os.Args[1:]) < 3 {
+			fatalf("pm mark: insufficient args\n\nusage: pm mark <explicit|auto> [pkg1, pkg2, ..., pkgN]\n")
+		}
+		mark := db.MarkExplicit
+		switch os.Args[2] {
+		case "explicit", "manual":
+		case "auto":
+			mark = db.MarkAuto
+		default:
+			fatalf("unknown mark: %q\n\nusage: pm mark <explicit|auto> [pkg1, pkg2, ..., pkgN]\n", os.Args[2])
+		}
+		for _, name := range os.Args[3:] {
+			if err := mark(root, name); err != nil {
+				fatalf("marking %v: %v\n", name, err)
+			}
+		}
+	case "upgrade", "up":
+		if len(os.Args[1:]) != 2 {
+			fatalf("pm upgrade: insufficient args\n\nusage: pm upgrade <remote label>\n")
+		}
+		if err := pkg.UpgradeFromRepo(root, os.Args[2]); err != nil {
+			fatalf("upgrading: %v\n", err)
+		}
+	case "verify":
+		flags := flag.NewFlagSet("verify", flag.ExitOnError)
+		key := flags.String("key", "", "check the signature against the armored public key in this file instead of the keyring")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 1 {
+			fatalf("pm verify: insufficient args\n\nusage: pm verify [--key=<file>] <pkg>\n")
+		}
+		if err := pkg.VerifyFile(root, flags.Arg(0), *key); err != nil {
+			fatalf("verifying %v: %v\n", flags.Arg(0), err)
+		}
 	case "version", "v":
 		fmt.Printf("pm: version %v\n", Version)
 	default:
@@ -259,6 +625,113 @@ func main() {
 	}
 }
 
+// stopOnSignal returns a channel that is closed on the first SIGINT or
+// SIGTERM, allowing the current package to finish; a second signal exits
+// immediately.
+func stopOnSignal() <-chan struct{} {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintf(os.Stderr, "pm: stopping after the current package; signal again to abort\n")
+		close(stop)
+		<-sigs
+		fatalf("pm: aborted\n")
+	}()
+	return stop
+}
+
+// patterns is a flag.Value that collects each use of a repeated flag.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+// logs is a flag.Value that collects repeated remote=log pairs; see
+// pkg.Options.TransparencyLogs.
+type logs map[string]string
+
+func (l logs) String() string {
+	r := []string{}
+	for remote, log := range l {
+		r = append(r, remote+"="+log)
+	}
+	return strings.Join(r, ",")
+}
+
+func (l logs) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("want <remote url>=<log url>, got %q", s)
+	}
+	u, err := url.Parse(s[:i])
+	if err != nil {
+		return err
+	}
+	// remotes are stored, and so matched, in canonical form.
+	cu, err := pm.CanonicalURL(*u)
+	if err != nil {
+		return err
+	}
+	l[cu.String()] = s[i+1:]
+	return nil
+}
+
+type mirrors map[string][]string
+
+func (m mirrors) String() string {
+	r := []string{}
+	for remote, urls := range m {
+		for _, u := range urls {
+			r = append(r, remote+"="+u)
+		}
+	}
+	return strings.Join(r, ",")
+}
+
+func (m mirrors) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("want <remote url>=<mirror url>, got %q", s)
+	}
+	u, err := url.Parse(s[:i])
+	if err != nil {
+		return err
+	}
+	m[u.String()] = append(m[u.String()], s[i+1:])
+	return nil
+}
+
+// confirm shows the user p and asks if they want to proceed.
+func confirm(p pkg.Plan) bool {
+	fmt.Printf("the following packages will be installed:\n\n%v\nproceed? [y/N] ", p)
+	s := bufio.NewScanner(os.Stdin)
+	s.Scan()
+	switch strings.ToLower(strings.TrimSpace(s.Text())) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+func confirmRemove(p *pkg.RemovePlan) bool {
+	fmt.Printf("%v\nproceed? [y/N] ", p)
+	s := bufio.NewScanner(os.Stdin)
+	s.Scan()
+	switch strings.ToLower(strings.TrimSpace(s.Text())) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
 func fatalf(f string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, f, args...)
 	os.Exit(1)
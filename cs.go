@@ -7,6 +7,17 @@ import (
 	"strings"
 )
 
+// DuplicateManifestEntryError is returned by ParseCS when a checksum file
+// lists the same file more than once, which is a sign it is malformed or has
+// been tampered with.
+type DuplicateManifestEntryError struct {
+	Filename string
+}
+
+func (e DuplicateManifestEntryError) Error() string {
+	return fmt.Sprintf("%q listed more than once", e.Filename)
+}
+
 // ParseCS returns a parsed checksum file.
 func ParseCS(f io.Reader) (map[string]string, error) {
 	cs := map[string]string{}
@@ -16,7 +27,13 @@ func ParseCS(f io.Reader) (map[string]string, error) {
 		if len(elems) != 2 {
 			return nil, fmt.Errorf("manifest format error; got %d elements, want 2", len(elems))
 		}
+		if _, ok := cs[elems[1]]; ok {
+			return nil, DuplicateManifestEntryError{Filename: elems[1]}
+		}
 		cs[elems[1]] = elems[0]
 	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
 	return cs, nil
 }
@@ -0,0 +1,38 @@
+package pm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCS(t *testing.T) {
+	tests := []struct {
+		fn  string
+		n   int
+		dup string
+	}{
+		{fn: "valid.sha256", n: 2},
+		{fn: "duplicate.sha256", dup: "bin/a"},
+	}
+	for _, test := range tests {
+		f, err := os.Open(filepath.Join("testdata", test.fn))
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		cs, err := ParseCS(f)
+		f.Close()
+		if test.dup != "" {
+			if got, want := err, (DuplicateManifestEntryError{Filename: test.dup}); got != want {
+				t.Fatalf("%v: got %v, want %v", test.fn, got, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: parse: %v", test.fn, err)
+		}
+		if got, want := len(cs), test.n; got != want {
+			t.Fatalf("%v: got %v entries, want %v", test.fn, got, want)
+		}
+	}
+}
@@ -1,57 +1,218 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"mcquay.me/fs"
 	"mcquay.me/pm"
+	"mcquay.me/pm/oci"
 )
 
 const an = "var/lib/pm/available.json"
 
-// Pull updates the available package database.
+// Pull updates the available package database, and the record of packages
+// the remotes have renamed; it is Sync without the report.
 func Pull(root string) error {
+	_, err := Sync(root)
+	return err
+}
+
+// SyncStatus reports, for each remote, whether a Sync changed what the
+// remote contributes to the available and obsoletes dbs.
+type SyncStatus struct {
+	Updated   []url.URL
+	Unchanged []url.URL
+}
+
+// Sync updates the available package database, and the record of packages
+// the remotes have renamed. Every remote's indexes are fetched and decoded
+// before anything is written, and each db is then replaced atomically (see
+// writeJSON), so a failed or interrupted Sync leaves the previous dbs in
+// place.
+//
+// The indexes of remotes that publish a Release are checked against it, and
+// the time of each Release is recorded so that a later Sync can reject an
+// older one.
+func Sync(root string) (SyncStatus, error) {
+	st := SyncStatus{}
 	db, err := load(root)
 	if err != nil {
-		return errors.Wrap(err, "loading db")
+		return st, errors.Wrap(err, "loading db")
+	}
+
+	rels, err := fetchReleases(root, db)
+	if err != nil {
+		return st, errors.Wrap(err, "loading releases")
+	}
+	o, err := loadAvailableFromSources(db, rels)
+	if err != nil {
+		return st, errors.Wrap(err, "loading sources")
+	}
+	obs, err := loadObsoletesFromSources(db, rels)
+	if err != nil {
+		return st, errors.Wrap(err, "loading obsoletes")
+	}
+
+	// a missing or unreadable old db just means every remote is updated.
+	oldo, _, _ := LoadAvailable(root)
+	oldobs, _ := LoadObsoletes(root)
+	for _, u := range db {
+		if bytes.Equal(contribution(oldo, oldobs, u), contribution(o, obs, u)) {
+			st.Unchanged = append(st.Unchanged, u)
+		} else {
+			st.Updated = append(st.Updated, u)
+		}
 	}
 
-	o := pm.Available{}
+	if err := saveAvailable(root, o); err != nil {
+		return st, errors.Wrap(err, "saving available db")
+	}
+	if err := saveObsoletes(root, obs); err != nil {
+		return st, errors.Wrap(err, "saving obsoletes db")
+	}
+	if err := saveReleases(root, rels); err != nil {
+		return st, errors.Wrap(err, "saving releases db")
+	}
+	return st, nil
+}
+
+// contribution returns the packages and renames in a and obs that came
+// from the remote at u, encoded for comparison.
+func contribution(a pm.Available, obs []pm.Obsolete, u url.URL) []byte {
+	c := struct {
+		Available pm.Available
+		Obsoletes []pm.Obsolete
+	}{Available: pm.Available{}}
+	for n, vers := range a {
+		for v, m := range vers {
+			if m.Remote.String() != u.String() {
+				continue
+			}
+			if c.Available[n] == nil {
+				c.Available[n] = map[pm.Version]pm.Meta{}
+			}
+			c.Available[n][v] = m
+		}
+	}
+	l := pm.Label(u)
+	for _, o := range obs {
+		if o.Repository == l {
+			c.Obsoletes = append(c.Obsoletes, o)
+		}
+	}
+	b, _ := json.Marshal(c)
+	return b
+}
+
+// LoadAvailableFromSources fetches the available packages from each of srcs
+// and merges them. srcs are given in priority order: if a name@version is
+// offered by more than one source only the copy from the earliest is kept.
+//
+// TODO (sm): make this concurrent
+func LoadAvailableFromSources(srcs []url.URL) (pm.Available, error) {
+	return loadAvailableFromSources(srcs, nil)
+}
 
-	// Order here is important: the guarantee made is that any packages that
-	// exist in multiple remotes will be fetched by the first configured
-	// remote, which is why we traverse the database in reverse.
-	//
-	// TODO (sm): make this concurrent
-	for i := range db {
-		u := db[len(db)-i-1]
-		resp, err := http.Get(u.String() + "/available.json")
+// loadAvailableFromSources is LoadAvailableFromSources, checking the index of
+// each of srcs against its Release in rels, by url, if any.
+func loadAvailableFromSources(srcs []url.URL, rels map[string]*Release) (pm.Available, error) {
+	r := pm.Available{}
+	for _, u := range srcs {
+		a, err := fetch(u, rels[u.String()])
 		if err != nil {
-			return errors.Wrap(err, "http get")
+			return nil, errors.Wrapf(err, "fetching %q", u.String())
+		}
+		for m := range a.Traverse() {
+			if _, err := r.Get(m.QualifiedName(), m.Version); err == nil {
+				continue
+			}
+			if err := r.Add(m); err != nil {
+				return nil, errors.Wrapf(err, "adding %v@%v", m.Name, m.Version)
+			}
 		}
+	}
+	return r, nil
+}
+
+// errNotFound is returned by getIndex when a remote doesn't publish the
+// requested index.
+var errNotFound = errors.New("not found")
 
-		a := pm.Available{}
-		if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
-			return errors.Wrapf(err, "decode remote available for %q", u.String())
+// getIndex returns the body of the index, e.g. available, published by the
+// remote at u: <u>/<index>.json, or for remotes in an OCI registry, the
+// artifact <u>/<index>:latest.
+func getIndex(u url.URL, index string) (io.ReadCloser, error) {
+	if u.Scheme == oci.Scheme {
+		body, _, err := oci.Fetch(fmt.Sprintf("%v/%v:latest", u.String(), index))
+		if errors.Cause(err) == oci.ErrNotFound {
+			return nil, errNotFound
 		}
-		a.SetRemote(u)
-		o.Update(a)
+		return body, err
 	}
-	if err := saveAvailable(root, o); err != nil {
-		return errors.Wrap(err, "saving available db")
+	return getFile(fmt.Sprintf("%v/%v.json", u.String(), index))
+}
+
+// getFile returns the body of the file at the http url u, or errNotFound.
+func getFile(u string) (io.ReadCloser, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, errors.Wrap(err, "http get")
 	}
-	return nil
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("http get: %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Fetch retrieves the available packages advertised by the remote at u.
+func Fetch(u url.URL) (pm.Available, error) {
+	return fetch(u, nil)
+}
+
+// FetchPinned is Fetch, checking the index against the remote's Release, if
+// it publishes one; see FetchRelease.
+func FetchPinned(root string, u url.URL) (pm.Available, error) {
+	rel, err := FetchRelease(root, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching release")
+	}
+	return fetch(u, rel)
+}
+
+// fetch is Fetch, checking the index against rel if set.
+func fetch(u url.URL, rel *Release) (pm.Available, error) {
+	body, err := getPinned(u, "available", rel)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting available")
+	}
+	defer body.Close()
+
+	a := pm.Available{}
+	if err := json.NewDecoder(body).Decode(&a); err != nil {
+		return nil, errors.Wrapf(err, "decode remote available for %q", u.String())
+	}
+	a.SetRemote(u)
+	return a, nil
 }
 
 // ListAvailable prints all installable packages
 func ListAvailable(root string, w io.Writer) error {
-	db, err := LoadAvailable(root)
+	db, _, err := LoadAvailable(root)
 	if err != nil {
 		return errors.Wrap(err, "loading")
 	}
@@ -61,39 +222,221 @@ func ListAvailable(root string, w io.Writer) error {
 	return nil
 }
 
-// LoadAvailable returns the collection of available packages
-func LoadAvailable(root string) (pm.Available, error) {
+// SearchAvailable prints the available packages matching query, a
+// pm.ParseQuery query, to w, as ListAvailable does.
+func SearchAvailable(root, query string, w io.Writer) error {
+	q, err := pm.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	db, _, err := LoadAvailable(root)
+	if err != nil {
+		return errors.Wrap(err, "loading")
+	}
+	for _, m := range db.Search(q) {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", m.Name, m.Version, m.Remote.String())
+	}
+	return nil
+}
+
+// PackageIterator steps through packages one at a time, in the style of
+// sql.Rows, for tools that needn't hold every pm.Meta at once. It is
+// returned by the Iterator method of the pm.Available LoadAvailable
+// returns: that type belongs to package pm, which db builds on, so the
+// method can't be declared here.
+type PackageIterator interface {
+	// Next advances to the next package, and reports if there is one.
+	Next() bool
+	// Value returns the package the iterator is on.
+	Value() pm.Meta
+}
+
+var _ PackageIterator = (*pm.Iterator)(nil)
+
+// LoadAvailable returns the collection of available packages, along with a
+// DBWarning for each reference in it to a package it doesn't offer. Like
+// LoadInstalled, it takes no lock and is safe to call during a Pull. Remote
+// urls are canonicalized, and an unusable one is reported as a pm.URLError.
+func LoadAvailable(root string) (pm.Available, []DBWarning, error) {
 	r := pm.Available{}
 	dbn := filepath.Join(root, rn)
 
 	if !fs.Exists(dbn) {
-		return r, nil
+		return r, nil, nil
 	}
 
 	f, err := os.Open(filepath.Join(root, an))
 	if err != nil {
-		return r, errors.Wrap(err, "open")
+		return r, nil, errors.Wrap(err, "open")
 	}
+	defer f.Close()
 
 	if err := json.NewDecoder(f).Decode(&r); err != nil {
-		return r, errors.Wrap(err, "decoding db")
+		return r, nil, errors.Wrap(err, "decoding db")
+	}
+	if err := r.CheckURLs(false); err != nil {
+		return r, nil, errors.Wrap(err, "checking urls")
+	}
+	c, err := LoadConfig(root)
+	if err != nil {
+		return r, nil, errors.Wrap(err, "loading config")
+	}
+	if c.StrictProvides {
+		if err := checkProviders(r); err != nil {
+			return r, nil, err
+		}
 	}
 
-	return r, nil
+	return r, CheckReferences(r), nil
 }
 
-func saveAvailable(root string, db pm.Available) error {
-	f, err := os.Create(filepath.Join(root, an))
+// RawJSON returns the record of the available package name at version, or
+// its newest version if version is empty, exactly as the available db holds
+// it. It lets other tools read fields pm.Meta doesn't know about, and none of
+// the other records are decoded to find it.
+func RawJSON(root string, name pm.Name, version pm.Version) ([]byte, error) {
+	if !fs.Exists(filepath.Join(root, rn)) {
+		return nil, errors.Errorf("could not find package named %q", name)
+	}
+	f, err := os.Open(filepath.Join(root, an))
 	if err != nil {
-		return errors.Wrap(err, "create")
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+
+	r := map[pm.Name]map[pm.Version]json.RawMessage{}
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "decoding db")
+	}
+	vers, ok := r[name]
+	if !ok {
+		return nil, errors.Errorf("could not find package named %q", name)
+	}
+	if version == "" {
+		vs := pm.Versions{}
+		for v := range vers {
+			vs = append(vs, v)
+		}
+		if len(vs) == 0 {
+			return nil, errors.Errorf("no configured versions for %q", name)
+		}
+		sort.Sort(vs)
+		version = vs[len(vs)-1]
 	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "\t")
-	if err := enc.Encode(&db); err != nil {
-		return errors.Wrap(err, "decoding db")
+	b, ok := vers[version]
+	if !ok {
+		return nil, errors.Errorf("could not find %v@%v in database", name, version)
 	}
-	if err := f.Close(); err != nil {
-		return errors.Wrap(err, "close db")
+	return b, nil
+}
+
+// DuplicateProviderError is returned by LoadAvailable, when
+// Config.StrictProvides is set, for a virtual package that more than one
+// package in a repository provides.
+type DuplicateProviderError struct {
+	Virtual   string
+	Providers []string
+}
+
+func (e DuplicateProviderError) Error() string {
+	return fmt.Sprintf("%v is provided by more than one package: %v", e.Virtual, strings.Join(e.Providers, ", "))
+}
+
+// checkProviders returns a DuplicateProviderError for the first virtual
+// package, by repository and name, that more than one package from the same
+// repository provides. Versions of one package count once.
+func checkProviders(a pm.Available) error {
+	providers := map[string]map[string]map[pm.Name]bool{}
+	for m := range a.Traverse() {
+		for _, v := range m.Provides {
+			if providers[m.Repository] == nil {
+				providers[m.Repository] = map[string]map[pm.Name]bool{}
+			}
+			if providers[m.Repository][v] == nil {
+				providers[m.Repository][v] = map[pm.Name]bool{}
+			}
+			providers[m.Repository][v][m.Name] = true
+		}
+	}
+	repos := []string{}
+	for r := range providers {
+		repos = append(repos, r)
+	}
+	sort.Strings(repos)
+	for _, r := range repos {
+		vs := []string{}
+		for v := range providers[r] {
+			vs = append(vs, v)
+		}
+		sort.Strings(vs)
+		for _, v := range vs {
+			if len(providers[r][v]) < 2 {
+				continue
+			}
+			e := DuplicateProviderError{Virtual: v}
+			for n := range providers[r][v] {
+				e.Providers = append(e.Providers, string(n))
+			}
+			sort.Strings(e.Providers)
+			return e
+		}
 	}
 	return nil
 }
+
+// DBWarning records a package in the available db that refers, in Field, to
+// a package the db doesn't offer; usually a typo in the package's metadata.
+type DBWarning struct {
+	Package        pm.Name
+	Field          string
+	ReferencedName string
+}
+
+func (w DBWarning) String() string {
+	return fmt.Sprintf("%v: %v refers to unknown package %q", w.Package, w.Field, w.ReferencedName)
+}
+
+// CheckReferences returns a DBWarning for each entry in the deps, before and
+// after of the packages in a that names a package a doesn't offer, or can't
+// be parsed. Each is reported once per package, however many of its
+// versions share it. A virtual package some package in a provides counts as
+// offered.
+func CheckReferences(a pm.Available) []DBWarning {
+	r := []DBWarning{}
+	seen := map[DBWarning]bool{}
+	provided := map[pm.Name]bool{}
+	ms := pm.Metas{}
+	for m := range a.Traverse() {
+		ms = append(ms, m)
+		for _, p := range m.Provides {
+			provided[pm.Name(p)] = true
+		}
+	}
+	for _, m := range ms {
+		for _, f := range []struct {
+			name string
+			refs []string
+		}{
+			{"deps", m.Deps},
+			{"before", m.Before},
+			{"after", m.After},
+		} {
+			for _, ref := range f.refs {
+				n, _, err := pm.ParseLabel(ref)
+				if _, ok := a[n]; (ok || provided[n]) && err == nil {
+					continue
+				}
+				w := DBWarning{Package: m.Name, Field: f.name, ReferencedName: ref}
+				if !seen[w] {
+					seen[w] = true
+					r = append(r, w)
+				}
+			}
+		}
+	}
+	return r
+}
+
+func saveAvailable(root string, db pm.Available) error {
+	return writeJSON(filepath.Join(root, an), &db)
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"mcquay.me/pm"
+)
+
+func serve(t *testing.T, ms ...pm.Meta) *httptest.Server {
+	a := pm.Available{}
+	for _, m := range ms {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/available.json" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(a)
+	}))
+}
+
+func TestLoadAvailableFromSources(t *testing.T) {
+	hi := serve(t,
+		pm.Meta{Name: "foo", Version: "1.0", Description: "from hi"},
+	)
+	defer hi.Close()
+	lo := serve(t,
+		pm.Meta{Name: "foo", Version: "1.0", Description: "from lo"},
+		pm.Meta{Name: "foo", Version: "2.0", Description: "from lo"},
+	)
+	defer lo.Close()
+
+	srcs := []url.URL{}
+	for _, s := range []*httptest.Server{hi, lo} {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		srcs = append(srcs, *u)
+	}
+
+	tests := []struct {
+		label string
+		srcs  []url.URL
+		v1    string
+	}{
+		{"hi first", srcs, "from hi"},
+		{"lo first", []url.URL{srcs[1], srcs[0]}, "from lo"},
+	}
+	for _, test := range tests {
+		a, err := LoadAvailableFromSources(test.srcs)
+		if err != nil {
+			t.Fatalf("%v: load: %v", test.label, err)
+		}
+		if got, want := len(a["foo"]), 2; got != want {
+			t.Fatalf("%v: versions: got %v, want %v", test.label, got, want)
+		}
+		if got, want := a["foo"]["1.0"].Description, test.v1; got != want {
+			t.Fatalf("%v: foo@1.0: got %q, want %q", test.label, got, want)
+		}
+		if got, want := a["foo"]["2.0"].Description, "from lo"; got != want {
+			t.Fatalf("%v: foo@2.0: got %q, want %q", test.label, got, want)
+		}
+	}
+}
+
+func TestCheckReferences(t *testing.T) {
+	a := pm.Available{}
+	for _, m := range []pm.Meta{
+		{Name: "a", Version: "1.0", Description: "a", Deps: []string{"b", "c@1.0"}, After: []string{"d"}},
+		{Name: "a", Version: "2.0", Description: "a", Deps: []string{"b", "c@1.0"}, After: []string{"d"}},
+		{Name: "b", Version: "1.0", Description: "b", Before: []string{"a", "x@@1"}},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	got := CheckReferences(a)
+	want := []DBWarning{
+		{Package: "a", Field: "deps", ReferencedName: "c@1.0"},
+		{Package: "a", Field: "after", ReferencedName: "d"},
+		{Package: "b", Field: "before", ReferencedName: "x@@1"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("warning %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	files := map[string]string{
+		"/stable/available.json":  `{"foo": {"1.0": {"name": "foo", "version": "1.0", "description": "foo"}}}`,
+		"/testing/available.json": `{"bar": {"1.0": {"name": "bar", "version": "1.0", "description": "bar"}}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, s)
+	}))
+	defer srv.Close()
+
+	root, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := AddRemotes(root, []string{srv.URL + "/stable", srv.URL + "/testing"}); err != nil {
+		t.Fatalf("add remotes: %v", err)
+	}
+
+	labels := func(us []url.URL) []string {
+		r := []string{}
+		for _, u := range us {
+			r = append(r, pm.Label(u))
+		}
+		return r
+	}
+	sync := func(updated, unchanged []string) {
+		st, err := Sync(root)
+		if err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		if got := labels(st.Updated); !reflect.DeepEqual(got, updated) {
+			t.Fatalf("updated: got %v, want %v", got, updated)
+		}
+		if got := labels(st.Unchanged); !reflect.DeepEqual(got, unchanged) {
+			t.Fatalf("unchanged: got %v, want %v", got, unchanged)
+		}
+	}
+
+	sync([]string{"stable", "testing"}, []string{})
+	sync([]string{}, []string{"stable", "testing"})
+	files["/testing/available.json"] = `{"bar": {"1.0": {"name": "bar", "version": "1.0", "description": "bar, again"}}}`
+	sync([]string{"testing"}, []string{"stable"})
+
+	// a remote serving garbage fails the sync and leaves the old db alone.
+	before, err := ioutil.ReadFile(filepath.Join(root, an))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	files["/stable/available.json"] = `{"foo": {"2.0": {"na`
+	if _, err := Sync(root); err == nil {
+		t.Fatalf("synced a truncated index")
+	}
+	after, err := ioutil.ReadFile(filepath.Join(root, an))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("failed sync changed the available db")
+	}
+}
+
+func TestLoadAvailableStrictProvides(t *testing.T) {
+	srv := serve(t,
+		pm.Meta{Name: "exim", Version: "1.0.0", Description: "d", Provides: []string{"mta"}},
+		pm.Meta{Name: "postfix", Version: "1.0.0", Description: "d", Provides: []string{"mta"}},
+		pm.Meta{Name: "postfix", Version: "2.0.0", Description: "d", Provides: []string{"mta"}},
+		pm.Meta{Name: "mailer", Version: "1.0.0", Description: "d", Deps: []string{"mta"}},
+	)
+	defer srv.Close()
+
+	root, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := AddRemotes(root, []string{srv.URL}); err != nil {
+		t.Fatalf("add remotes: %v", err)
+	}
+	if err := Pull(root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+
+	// both providers are kept by default, and the virtual package counts as
+	// offered.
+	a, ws, err := LoadAvailable(root)
+	if err != nil {
+		t.Fatalf("load available: %v", err)
+	}
+	if got := len(a.Providers("mta")); got != 2 {
+		t.Fatalf("providers: got %v, want 2", got)
+	}
+	if len(ws) != 0 {
+		t.Fatalf("warnings: got %v, want none", ws)
+	}
+
+	if err := SaveConfig(root, Config{StrictProvides: true}); err != nil {
+		t.Fatalf("save config: %v", err)
+	}
+	_, _, err = LoadAvailable(root)
+	want := DuplicateProviderError{Virtual: "mta", Providers: []string{"exim", "postfix"}}
+	if dpe, ok := err.(DuplicateProviderError); !ok || !reflect.DeepEqual(dpe, want) {
+		t.Fatalf("got %v, want %v", err, want)
+	}
+}
+
+func TestRawJSON(t *testing.T) {
+	srv := serve(t,
+		pm.Meta{Name: "foo", Version: "1.0.0", Description: "d", Extra: map[string]json.RawMessage{"homepage": json.RawMessage(`"https://example.com/foo"`)}},
+		pm.Meta{Name: "foo", Version: "2.0.0", Description: "d"},
+	)
+	defer srv.Close()
+
+	root, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := AddRemotes(root, []string{srv.URL}); err != nil {
+		t.Fatalf("add remotes: %v", err)
+	}
+	if err := Pull(root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+
+	b, err := RawJSON(root, "foo", "1.0.0")
+	if err != nil {
+		t.Fatalf("raw json: %v", err)
+	}
+	r := map[string]interface{}{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got, want := r["homepage"], "https://example.com/foo"; got != want {
+		t.Fatalf("homepage: got %v, want %v", got, want)
+	}
+
+	if b, err = RawJSON(root, "foo", ""); err != nil {
+		t.Fatalf("raw json: %v", err)
+	}
+	m := pm.Meta{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if m.Version != "2.0.0" {
+		t.Fatalf("got %v, want the newest version", m.Version)
+	}
+
+	for _, test := range []struct {
+		name pm.Name
+		ver  pm.Version
+	}{{"foo", "3.0.0"}, {"bar", ""}} {
+		if _, err := RawJSON(root, test.name, test.ver); err == nil {
+			t.Fatalf("%v@%v: got record for a package that isn't available", test.name, test.ver)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+)
+
+const cn = "var/lib/pm/config.json"
+
+// Config holds the settings of the pm installation in a root. The zero
+// Config, which is what a root without a config file gets, is the default.
+type Config struct {
+	// StrictProvides makes LoadAvailable fail with a DuplicateProviderError
+	// when more than one package in a repository provides the same
+	// virtual package. Otherwise all of them are kept, and dependencies on
+	// the virtual package pick one by priority; see pm.Available.Providers.
+	StrictProvides bool `json:"strict_provides,omitempty"`
+}
+
+// LoadConfig returns the Config of root.
+func LoadConfig(root string) (Config, error) {
+	r := Config{}
+	fn := filepath.Join(root, cn)
+	if !fs.Exists(fn) {
+		return r, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return r, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return r, errors.Wrap(err, "decoding config")
+	}
+	return r, nil
+}
+
+// SaveConfig replaces the Config of root with c.
+func SaveConfig(root string, c Config) error {
+	return writeJSON(filepath.Join(root, cn), &c)
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// writeJSON replaces fn with the indented JSON encoding of v; see
+// writeFile.
+func writeJSON(fn string, v interface{}) error {
+	b, err := encodeJSON(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b)
+}
+
+func encodeJSON(v interface{}) ([]byte, error) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding db")
+	}
+	return append(b, '\n'), nil
+}
+
+// writeFile replaces fn with b. It is written to a temporary file beside fn
+// and renamed into place, so that readers, which take no lock, see either the
+// old contents or the new, never a partial write, and an interrupted write
+// leaves the old contents intact.
+func writeFile(fn string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing db")
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "chmod db")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "close db")
+	}
+	if err := os.Rename(f.Name(), fn); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "replacing db")
+	}
+	return nil
+}
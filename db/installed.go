@@ -1,12 +1,16 @@
 package db
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"mcquay.me/fs"
@@ -21,6 +25,9 @@ func AddInstalled(root string, m pm.Meta) error {
 	if err != nil {
 		return errors.Wrap(err, "loading installed db")
 	}
+	if err := journal(root, db, entry{Op: opAdd, Meta: m}); err != nil {
+		return err
+	}
 	db[m.Name] = m
 	return savei(root, db)
 }
@@ -31,6 +38,9 @@ func RemoveInstalled(root string, m pm.Meta) error {
 	if err != nil {
 		return errors.Wrap(err, "loading installed db")
 	}
+	if err := journal(root, db, entry{Op: opRemove, Meta: pm.Meta{Name: m.Name}}); err != nil {
+		return err
+	}
 	delete(db, m.Name)
 	return savei(root, db)
 }
@@ -59,6 +69,30 @@ func ListInstalled(root string, w io.Writer) error {
 	return nil
 }
 
+// ListOwners prints each installed file matching pattern, and the package
+// that owns it, to w; see pm.Installed.FindByFile.
+func ListOwners(root, pattern string, w io.Writer) error {
+	db, err := loadi(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+	owners, err := db.FindByFile(pattern)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for n := range owners {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		for _, f := range owners[n] {
+			fmt.Fprintf(w, "%v\t%v\n", n, f)
+		}
+	}
+	return nil
+}
+
 // ListInstalledFiles prints the contents of a package.
 func ListInstalledFiles(root string, w io.Writer, names []string) error {
 	for _, name := range names {
@@ -71,6 +105,10 @@ func ListInstalledFiles(root string, w io.Writer, names []string) error {
 		}
 	}
 
+	db, err := loadi(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
 	for _, name := range names {
 		fn := filepath.Join(root, "var", "lib", "pm", "installed", name, "bom.sha256")
 		f, err := os.Open(fn)
@@ -87,7 +125,9 @@ func ListInstalledFiles(root string, w io.Writer, names []string) error {
 
 		ks := []string{}
 		for k := range bom {
-			ks = append(ks, k)
+			if k = pm.StripPath(k, db[pm.Name(name)].StripComponents); k != "" {
+				ks = append(ks, k)
+			}
 		}
 		sort.Strings(ks)
 		for _, k := range ks {
@@ -97,11 +137,44 @@ func ListInstalledFiles(root string, w io.Writer, names []string) error {
 	return nil
 }
 
+// LoadInstalled returns the installed package database. It takes no lock, and
+// is safe to call while another process is installing or removing packages:
+// it sees the db as of before or after each change.
+//
+// A db that can't be decoded, or doesn't match the checksums recorded when
+// it was written, is rebuilt from the journal of changes made to it. If that
+// fails too, a CorruptError is returned.
 func LoadInstalled(root string) (pm.Installed, error) {
 	return loadi(root)
 }
 
+// loadi returns the installed db, rebuilt from the journal if it is corrupt.
+// The rebuilt db is only written back by the next change to it.
 func loadi(root string) (pm.Installed, error) {
+	r, err := readi(root)
+	if ce, ok := err.(CorruptError); ok {
+		jr, jerr := replay(root)
+		if jerr != nil {
+			ce.Journal = jerr
+			return pm.Installed{}, ce
+		}
+		return jr, nil
+	}
+	return r, err
+}
+
+// checksumRetries is how many times readi re-reads a db that doesn't match
+// its checksum, and checksumRetryDelay how long it waits first, since a
+// reader that reads the db, and then its checksum, can see the two from
+// different changes if more than one lands in between; see savei.
+const (
+	checksumRetries    = 3
+	checksumRetryDelay = 10 * time.Millisecond
+)
+
+// readi reads the installed db, checking it against its checksums if they
+// were recorded: it is sound if it matches either.
+func readi(root string) (pm.Installed, error) {
 	r := pm.Installed{}
 	dbn := filepath.Join(root, in)
 
@@ -109,30 +182,103 @@ func loadi(root string) (pm.Installed, error) {
 		return r, nil
 	}
 
-	f, err := os.Open(dbn)
-	if err != nil {
-		return r, errors.Wrap(err, "open")
+	var b []byte
+	for i := 0; ; i++ {
+		var err error
+		b, err = ioutil.ReadFile(dbn)
+		if err != nil {
+			return r, errors.Wrap(err, "open")
+		}
+		sum, err := ioutil.ReadFile(dbn + ".sha256")
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return r, errors.Wrap(err, "reading checksum")
+		}
+		got, want := fmt.Sprintf("%x", sha256.Sum256(b)), strings.Fields(string(sum))
+		if contains(want, got) {
+			break
+		}
+		if i == checksumRetries {
+			return pm.Installed{}, CorruptError{Path: dbn, Err: errors.Errorf("checksum is %v, want one of %v", got, strings.Join(want, ", "))}
+		}
+		time.Sleep(checksumRetryDelay)
 	}
 
-	if err := json.NewDecoder(f).Decode(&r); err != nil {
-		return r, errors.Wrap(err, "decoding db")
+	if err := json.Unmarshal(b, &r); err != nil {
+		return pm.Installed{}, CorruptError{Path: dbn, Err: err}
 	}
 
 	return r, nil
 }
 
+// savei replaces the installed db with db; see writeFile. The db being
+// replaced is kept as a backup for Recover.
+//
+// The checksums of the new db and of the one it replaces are recorded
+// beside it, as installed.json.sha256, before it is replaced, so that a
+// reader sees a db that matches them whether it lands before the
+// replacement or after it.
 func savei(root string, db pm.Installed) error {
-	f, err := os.Create(filepath.Join(root, in))
+	fn := filepath.Join(root, in)
+	b, err := encodeJSON(&db)
 	if err != nil {
-		return errors.Wrap(err, "create")
+		return err
 	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "\t")
-	if err := enc.Encode(&db); err != nil {
-		return errors.Wrap(err, "decoding db")
+	sums := fmt.Sprintf("%x\n", sha256.Sum256(b))
+	if old, err := ioutil.ReadFile(fn); err == nil && json.Valid(old) {
+		if err := ioutil.WriteFile(fn+".bak", old, 0644); err != nil {
+			return errors.Wrap(err, "backing up db")
+		}
+		// the db being replaced is only vouched for if it was sound.
+		sum := fmt.Sprintf("%x", sha256.Sum256(old))
+		if want, err := ioutil.ReadFile(fn + ".sha256"); os.IsNotExist(err) || err == nil && contains(strings.Fields(string(want)), sum) {
+			sums += sum + "\n"
+		}
 	}
-	if err := f.Close(); err != nil {
-		return errors.Wrap(err, "close db")
+	if err := writeFile(fn+".sha256", []byte(sums)); err != nil {
+		return err
 	}
-	return nil
+	return writeFile(fn, b)
+}
+
+// MarkExplicit records the installed package name as having been installed
+// explicitly, so that it is kept however many other packages depend on it;
+// see pm.Installed.Autoremovable.
+func MarkExplicit(root string, name string) error {
+	return mark(root, name, false)
+}
+
+// MarkAuto records the installed package name as having been installed only
+// as a dependency, so that it is autoremoved once nothing depends on it.
+func MarkAuto(root string, name string) error {
+	return mark(root, name, true)
+}
+
+func mark(root, name string, auto bool) error {
+	db, err := loadi(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+	m, ok := db[pm.Name(name)]
+	if !ok {
+		return errors.Errorf("%v not installed", name)
+	}
+	m.Auto = auto
+	m.AutoInstalledBy = ""
+	if err := journal(root, db, entry{Op: opAdd, Meta: m}); err != nil {
+		return err
+	}
+	db[m.Name] = m
+	return savei(root, db)
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
 }
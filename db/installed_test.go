@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mcquay.me/pm"
+)
+
+// TestLoadDuringWrite checks that a reader, which takes no lock, always
+// sees a complete db while another goroutine keeps rewriting it.
+func TestLoadDuringWrite(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	const n = 100
+	done := make(chan error)
+	go func() {
+		for i := 0; i < n; i++ {
+			m := pm.Meta{Name: pm.Name(fmt.Sprintf("p%03d", i)), Version: "1.0.0"}
+			if err := AddInstalled(root, m); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	last := 0
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("add: %v", err)
+			}
+			i, err := LoadInstalled(root)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if len(i) != n {
+				t.Fatalf("got %d packages, want %d", len(i), n)
+			}
+			return
+		default:
+		}
+		i, err := LoadInstalled(root)
+		if err != nil {
+			t.Fatalf("load during write: %v", err)
+		}
+		if len(i) < last {
+			t.Fatalf("db went backwards: %d packages after %d", len(i), last)
+		}
+		last = len(i)
+	}
+}
+
+// TestLoadBetweenRenames checks that a db left as it was before a change, by
+// a writer that stopped after recording the new checksum, still loads.
+func TestLoadBetweenRenames(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	for _, n := range []pm.Name{"a", "b"} {
+		if err := AddInstalled(root, pm.Meta{Name: n, Version: "1.0.0"}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	// the db from before b was added, beside the checksums recorded for
+	// adding it.
+	fn := filepath.Join(root, in)
+	if err := os.Rename(fn+".bak", fn); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	iDB, err := readi(root)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if _, ok := iDB["b"]; len(iDB) != 1 || ok {
+		t.Fatalf("got %v, want the db from before b was added", iDB)
+	}
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+// jn is the journal of changes to the installed db, from which it can be
+// rebuilt if it is corrupted. Each change is recorded in its own file, named
+// for its sequence number, before it is made. The first entry is always a
+// snapshot of the whole db.
+const jn = "var/lib/pm/journal"
+
+// journalMax is how many entries the journal grows to before it is compacted
+// into a single snapshot.
+const journalMax = 64
+
+const (
+	opSnapshot = "snapshot"
+	opAdd      = "add"
+	opRemove   = "remove"
+)
+
+// entry is a change recorded in the journal: a snapshot of the whole db,
+// or the addition (or replacement) or removal of a package.
+type entry struct {
+	Op   string       `json:"op"`
+	Meta pm.Meta      `json:"meta,omitempty"`
+	DB   pm.Installed `json:"db,omitempty"`
+}
+
+func (e entry) apply(db pm.Installed) (pm.Installed, error) {
+	switch e.Op {
+	case opSnapshot:
+		return copyInstalled(e.DB), nil
+	case opAdd:
+		db[e.Meta.Name] = e.Meta
+	case opRemove:
+		delete(db, e.Meta.Name)
+	default:
+		return nil, errors.Errorf("unknown op %q", e.Op)
+	}
+	return db, nil
+}
+
+// journal records e, a change about to be made to db, the installed db as
+// it stands. A journal that doesn't exist yet is started with a snapshot of
+// db, and one that has grown past journalMax entries is compacted.
+func journal(root string, db pm.Installed, e entry) error {
+	dir := filepath.Join(root, jn)
+	seqs, err := journalSeqs(dir)
+	if err != nil {
+		return err
+	}
+	if len(seqs) == 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "making journal dir")
+		}
+		if err := writeEntry(dir, 0, entry{Op: opSnapshot, DB: db}); err != nil {
+			return err
+		}
+		seqs = []int{0}
+	}
+	if len(seqs) >= journalMax {
+		next, err := e.apply(copyInstalled(db))
+		if err != nil {
+			return err
+		}
+		return snapshot(dir, seqs, next)
+	}
+	return writeEntry(dir, seqs[len(seqs)-1]+1, e)
+}
+
+// resetJournal replaces the journal with a snapshot of db.
+func resetJournal(root string, db pm.Installed) error {
+	dir := filepath.Join(root, jn)
+	seqs, err := journalSeqs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "making journal dir")
+	}
+	return snapshot(dir, seqs, db)
+}
+
+// snapshot writes a snapshot of db after the entries seqs, and then removes
+// them.
+func snapshot(dir string, seqs []int, db pm.Installed) error {
+	next := 0
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+	if err := writeEntry(dir, next, entry{Op: opSnapshot, DB: db}); err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if err := os.Remove(entryPath(dir, seq)); err != nil {
+			return errors.Wrap(err, "compacting journal")
+		}
+	}
+	return nil
+}
+
+// replay rebuilds the installed db from the journal.
+func replay(root string) (pm.Installed, error) {
+	dir := filepath.Join(root, jn)
+	seqs, err := journalSeqs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) == 0 {
+		return nil, errors.New("no journal")
+	}
+	var db pm.Installed
+	for i, seq := range seqs {
+		b, err := ioutil.ReadFile(entryPath(dir, seq))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading journal")
+		}
+		e := entry{}
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, errors.Wrapf(err, "journal entry %d", seq)
+		}
+		if i == 0 && e.Op != opSnapshot {
+			return nil, errors.Errorf("journal starts with %q entry %d, not a snapshot", e.Op, seq)
+		}
+		if db, err = e.apply(db); err != nil {
+			return nil, errors.Wrapf(err, "journal entry %d", seq)
+		}
+	}
+	return db, nil
+}
+
+// journalSeqs returns the sequence numbers of the entries in the journal at
+// dir, in order.
+func journalSeqs(dir string) ([]int, error) {
+	if !fs.Exists(dir) {
+		return nil, nil
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing journal")
+	}
+	r := []int{}
+	for _, fi := range fis {
+		seq, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(fi.Name(), ".json") {
+			// writeFile's temporary files, or strays.
+			continue
+		}
+		r = append(r, seq)
+	}
+	sort.Ints(r)
+	return r, nil
+}
+
+func entryPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.json", seq))
+}
+
+func writeEntry(dir string, seq int, e entry) error {
+	if err := writeJSON(entryPath(dir, seq), e); err != nil {
+		return errors.Wrap(err, "writing journal")
+	}
+	return nil
+}
+
+func copyInstalled(db pm.Installed) pm.Installed {
+	r := pm.Installed{}
+	for n, m := range db {
+		r[n] = m
+	}
+	return r
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+const on = "var/lib/pm/obsoletes.json"
+
+// FetchObsoletes retrieves the package renames published by the remote at u.
+// Remotes aren't required to publish any.
+func FetchObsoletes(u url.URL) ([]pm.Obsolete, error) {
+	return fetchObsoletes(u, nil)
+}
+
+// fetchObsoletes is FetchObsoletes, checking the index against rel if set.
+func fetchObsoletes(u url.URL, rel *Release) ([]pm.Obsolete, error) {
+	body, err := getPinned(u, "obsoletes", rel)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r := []pm.Obsolete{}
+	if err := json.NewDecoder(body).Decode(&r); err != nil {
+		return nil, errors.Wrapf(err, "decode remote obsoletes for %q", u.String())
+	}
+	l := pm.Label(u)
+	for i := range r {
+		r[i].Repository = l
+	}
+	return r, nil
+}
+
+// LoadObsoletes returns the package renames recorded by the last Pull.
+func LoadObsoletes(root string) ([]pm.Obsolete, error) {
+	r := []pm.Obsolete{}
+	dbn := filepath.Join(root, on)
+	if !fs.Exists(dbn) {
+		return r, nil
+	}
+
+	f, err := os.Open(dbn)
+	if err != nil {
+		return r, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return r, errors.Wrap(err, "decoding db")
+	}
+	return r, nil
+}
+
+// loadObsoletesFromSources fetches the renames published by each of srcs. As
+// with LoadAvailableFromSources, srcs are given in priority order: only the
+// earliest rename of a package is kept. Each index is checked against its
+// Release in rels, by url, if any.
+func loadObsoletesFromSources(srcs []url.URL, rels map[string]*Release) ([]pm.Obsolete, error) {
+	r := []pm.Obsolete{}
+	seen := map[pm.Name]bool{}
+	for _, u := range srcs {
+		obs, err := fetchObsoletes(u, rels[u.String()])
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching %q", u.String())
+		}
+		for _, o := range obs {
+			if seen[o.Old] {
+				continue
+			}
+			seen[o.Old] = true
+			r = append(r, o)
+		}
+	}
+	return r, nil
+}
+
+func saveObsoletes(root string, db []pm.Obsolete) error {
+	return writeJSON(filepath.Join(root, on), &db)
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"mcquay.me/pm"
+)
+
+func TestPullObsoletes(t *testing.T) {
+	obs := []pm.Obsolete{
+		{Old: "libssl", New: "libopenssl"},
+		{Old: "foo", New: "bar"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable/available.json":
+			json.NewEncoder(w).Encode(pm.Available{})
+		case "/stable/obsoletes.json":
+			json.NewEncoder(w).Encode(obs)
+		case "/testing/available.json":
+			json.NewEncoder(w).Encode(pm.Available{})
+		case "/testing/obsoletes.json":
+			json.NewEncoder(w).Encode([]pm.Obsolete{{Old: "foo", New: "baz"}})
+		case "/other/available.json":
+			// other publishes no renames at all.
+			json.NewEncoder(w).Encode(pm.Available{})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	root, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := AddRemotes(root, []string{srv.URL + "/other", srv.URL + "/stable", srv.URL + "/testing"}); err != nil {
+		t.Fatalf("add remotes: %v", err)
+	}
+	if err := Pull(root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+
+	got, err := LoadObsoletes(root)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := []pm.Obsolete{
+		{Old: "libssl", New: "libopenssl", Repository: "stable"},
+		{Old: "foo", New: "bar", Repository: "stable"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+// CorruptError is returned when the installed db can't be decoded, or
+// doesn't match its checksum, and couldn't be rebuilt from the journal; see
+// Recover.
+type CorruptError struct {
+	Path string
+	Err  error
+
+	// Journal is why the db couldn't be rebuilt from the journal.
+	Journal error
+}
+
+func (e CorruptError) Error() string {
+	msg := fmt.Sprintf("installed db %q is corrupt: %v", e.Path, e.Err)
+	if e.Journal != nil {
+		msg += fmt.Sprintf(", and can't be rebuilt from the journal: %v", e.Journal)
+	}
+	return msg + `; run "pm recover" to rebuild it from its backup and the install dirs`
+}
+
+// Recover rebuilds a corrupt installed db, describing what it could and
+// couldn't recover to w. The corrupt db is kept alongside as
+// installed.json.corrupt.
+//
+// The db is rebuilt from the journal of changes made to it if possible.
+// Otherwise it is restored from the backup taken the last time it was
+// written, if that is readable, and then checked against the install dirs
+// under var/lib/pm/installed: each package installed since the backup is
+// rebuilt from the meta.yaml and bom in its install dir, which lose where it
+// was installed from and who signed it, and packages that no longer have an
+// install dir are dropped. The journal is then restarted from the result.
+func Recover(root string, w io.Writer) error {
+	if _, err := readi(root); err == nil {
+		fmt.Fprintf(w, "installed db is fine\n")
+		return nil
+	} else if _, ok := err.(CorruptError); !ok {
+		return errors.Wrap(err, "loading installed db")
+	}
+
+	fn := filepath.Join(root, in)
+	if err := os.Rename(fn, fn+".corrupt"); err != nil {
+		return errors.Wrap(err, "setting corrupt db aside")
+	}
+	fmt.Fprintf(w, "moved corrupt db to %v\n", fn+".corrupt")
+
+	jr, err := replay(root)
+	if err == nil {
+		if err := savei(root, jr); err != nil {
+			return errors.Wrap(err, "saving recovered db")
+		}
+		fmt.Fprintf(w, "rebuilt %d packages from the journal\n", len(jr))
+		return nil
+	}
+	fmt.Fprintf(w, "can't rebuild from the journal: %v\n", err)
+
+	r := pm.Installed{}
+	if b, err := ioutil.ReadFile(fn + ".bak"); err != nil {
+		fmt.Fprintf(w, "no backup: %v\n", err)
+	} else if err := json.Unmarshal(b, &r); err != nil {
+		r = pm.Installed{}
+		fmt.Fprintf(w, "backup is unreadable: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "restored %d packages from backup\n", len(r))
+	}
+
+	dir := filepath.Join(root, "var", "lib", "pm", "installed")
+	present := map[pm.Name]bool{}
+	if fs.Exists(dir) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return errors.Wrap(err, "listing install dirs")
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() {
+				continue
+			}
+			ip := filepath.Join(dir, fi.Name())
+			m, err := rebuild(ip)
+			if err != nil {
+				fmt.Fprintf(w, "could not recover %v: %v\n", fi.Name(), err)
+				continue
+			}
+			present[m.Name] = true
+			if old, ok := r[m.Name]; ok && old.Version == m.Version {
+				continue
+			}
+			r[m.Name] = m
+			fmt.Fprintf(w, "rebuilt %v@%v from %v; its remote and signer are unknown\n", m.Name, m.Version, ip)
+		}
+	}
+	for n := range r {
+		if !present[n] {
+			delete(r, n)
+			fmt.Fprintf(w, "dropped %v, which has no install dir\n", n)
+		}
+	}
+
+	if err := savei(root, r); err != nil {
+		return errors.Wrap(err, "saving recovered db")
+	}
+	if err := resetJournal(root, r); err != nil {
+		return errors.Wrap(err, "restarting journal")
+	}
+	names := []string{}
+	for n := range r {
+		names = append(names, string(n))
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "recovered %d packages: %v\n", len(r), strings.Join(names, ", "))
+	return nil
+}
+
+// rebuild reconstructs the installed db record of the package whose install
+// dir is ip. A single leading <name>-<version>/ directory shared by every
+// file in its bom is assumed to have been stripped, as Install does by
+// default.
+func rebuild(ip string) (pm.Meta, error) {
+	mf, err := os.Open(filepath.Join(ip, "meta.yaml"))
+	if err != nil {
+		return pm.Meta{}, errors.Wrap(err, "opening meta.yaml")
+	}
+	defer mf.Close()
+	m := pm.Meta{}
+	if err := yaml.NewDecoder(mf).Decode(&m); err != nil {
+		return pm.Meta{}, errors.Wrap(err, "decoding meta.yaml")
+	}
+	if m.Name != pm.Name(filepath.Base(ip)) {
+		return pm.Meta{}, errors.Errorf("meta.yaml is for %v", m.Name)
+	}
+
+	bf, err := os.Open(filepath.Join(ip, "bom.sha256"))
+	if err != nil {
+		return pm.Meta{}, errors.Wrap(err, "opening bom")
+	}
+	defer bf.Close()
+	bom, err := pm.ParseCS(bf)
+	if err != nil {
+		return pm.Meta{}, errors.Wrap(err, "parsing bom")
+	}
+	prefix := fmt.Sprintf("%v-%v/", m.Name, m.Version)
+	m.StripComponents = 1
+	for n := range bom {
+		if !strings.HasPrefix(n, prefix) {
+			m.StripComponents = 0
+			break
+		}
+	}
+	m.Files = map[string]string{}
+	for n, sum := range bom {
+		if n = pm.StripPath(n, m.StripComponents); n != "" {
+			m.Files[n] = sum
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+func installDir(t *testing.T, root, name, meta, bom string) {
+	ip := filepath.Join(root, "var", "lib", "pm", "installed", name)
+	if err := os.MkdirAll(ip, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for fn, s := range map[string]string{"meta.yaml": meta, "bom.sha256": bom} {
+		if s == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(ip, fn), []byte(s), 0644); err != nil {
+			t.Fatalf("write %v: %v", fn, err)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	const sum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	installDir(t, root, "a", "name: a\nversion: 1.0.0\ndescription: a\n", sum+"\tbin/a\n")
+	installDir(t, root, "b", "name: b\nversion: 2.0.0\ndescription: b\n", sum+"\tb-2.0.0/bin/b\n")
+	installDir(t, root, "c", "", sum+"\tbin/c\n")
+
+	if err := AddInstalled(root, pm.Meta{Name: "a", Version: "1.0.0", SignedBy: "abc"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := AddInstalled(root, pm.Meta{Name: "gone", Version: "1.0.0"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := MarkAuto(root, "a"); err != nil {
+		t.Fatalf("mark: %v", err)
+	}
+	// the latest write, b's record, and the journal are lost; the backup
+	// from before the last write survives.
+	if err := ioutil.WriteFile(filepath.Join(root, in), []byte(`{"a": {"na`), 0644); err != nil {
+		t.Fatalf("corrupt: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, jn)); err != nil {
+		t.Fatalf("removing journal: %v", err)
+	}
+	if _, err := LoadInstalled(root); err == nil {
+		t.Fatalf("loaded a corrupt db")
+	} else if ce, ok := errors.Cause(err).(CorruptError); !ok || ce.Journal == nil {
+		t.Fatalf("got %v, want a CorruptError for the db and journal", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Recover(root, buf); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	for _, want := range []string{"restored 2 packages from backup", "rebuilt b@2.0.0", "could not recover c", "dropped gone"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("report %q doesn't mention %q", buf, want)
+		}
+	}
+
+	iDB, err := LoadInstalled(root)
+	if err != nil {
+		t.Fatalf("load recovered: %v", err)
+	}
+	if got, want := len(iDB), 2; got != want {
+		t.Fatalf("recovered %v, want a and b", iDB)
+	}
+	if got, want := iDB["a"].SignedBy, "abc"; got != want {
+		t.Fatalf("a from backup: signer got %q, want %q", got, want)
+	}
+	b := iDB["b"]
+	if b.StripComponents != 1 || b.Files["bin/b"] != sum {
+		t.Fatalf("b rebuilt as %+v", b)
+	}
+
+	buf.Reset()
+	if err := Recover(root, buf); err != nil || !strings.Contains(buf.String(), "fine") {
+		t.Fatalf("recovering a good db: %v, %q", err, buf)
+	}
+	if j, err := replay(root); err != nil || !reflect.DeepEqual(j, iDB) {
+		t.Fatalf("journal restarted as %v (%v), want %v", j, err, iDB)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	// enough changes to compact the journal.
+	for i := 0; i < journalMax+10; i++ {
+		m := pm.Meta{Name: pm.Name(fmt.Sprintf("p%03d", i%20)), Version: pm.Version(fmt.Sprintf("1.0.%d", i))}
+		if err := AddInstalled(root, m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if err := RemoveInstalled(root, pm.Meta{Name: "p000"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := MarkAuto(root, "p001"); err != nil {
+		t.Fatalf("mark: %v", err)
+	}
+	want, err := LoadInstalled(root)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if seqs, err := journalSeqs(filepath.Join(root, jn)); err != nil || len(seqs) > journalMax {
+		t.Fatalf("journal has %d entries (%v), want at most %d", len(seqs), err, journalMax)
+	}
+
+	fn := filepath.Join(root, in)
+	good, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, bad := range [][]byte{
+		[]byte(`{"p0`),
+		// valid, but not what was written.
+		[]byte(`{}`),
+	} {
+		if err := ioutil.WriteFile(fn, bad, 0644); err != nil {
+			t.Fatalf("corrupt: %v", err)
+		}
+		got, err := LoadInstalled(root)
+		if err != nil {
+			t.Fatalf("%s: load: %v", bad, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: rebuilt %v, want %v", bad, got, want)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Recover(root, buf); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if !strings.Contains(buf.String(), "from the journal") {
+		t.Fatalf("report %q doesn't mention the journal", buf)
+	}
+	if b, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(b, good) {
+		t.Fatalf("recovered db differs: %s (%v)", b, err)
+	}
+	if _, err := readi(root); err != nil {
+		t.Fatalf("recovered db doesn't check out: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm/keyring"
+	"mcquay.me/pm/oci"
+)
+
+const reln = "var/lib/pm/releases.json"
+
+// Release is the small, signed pointer a remote can publish alongside its
+// indexes, as release.json with an armored detached signature in
+// release.json.asc. It pins the sha256 of each index, so that an index
+// served stale or tampered with by a CDN in front of the remote is rejected
+// even though the remote's packages are themselves signed.
+type Release struct {
+	// Indexes maps the name of each pinned index, e.g. "available" or
+	// "obsoletes", to the hex sha256 of its contents.
+	Indexes map[string]string `json:"indexes"`
+
+	// Timestamp is when the release was made. A remote's releases must not
+	// go back in time; see ReleaseRollbackError.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Mirrors lists other urls the indexes can be fetched from, tried in
+	// order when the remote's own copy doesn't match its pin.
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// IndexMismatchError is returned when no copy of a pinned index could be
+// found whose sha256 matches its Release; Got is that of the last one tried.
+type IndexMismatchError struct {
+	Remote string
+	Index  string
+	Want   string
+	Got    string
+}
+
+func (e IndexMismatchError) Error() string {
+	return fmt.Sprintf("%v index of %v has sha256 %v, but its release pins %v", e.Index, e.Remote, e.Got, e.Want)
+}
+
+// ReleaseRollbackError is returned when a remote publishes a release older
+// than one already seen from it, or stops publishing releases at all, which
+// is how a stale or malicious mirror would replay an older generation of
+// the remote's indexes.
+type ReleaseRollbackError struct {
+	Remote string
+	Seen   time.Time
+	Got    time.Time
+}
+
+func (e ReleaseRollbackError) Error() string {
+	if e.Got.IsZero() {
+		return fmt.Sprintf("%v no longer publishes a release, but published one made at %v", e.Remote, e.Seen)
+	}
+	return fmt.Sprintf("%v published a release made at %v, older than the one made at %v already seen", e.Remote, e.Got, e.Seen)
+}
+
+// FetchRelease retrieves and verifies the Release published by the remote at
+// u, against the keyring in root, and checks that it isn't older than the
+// last one recorded by Sync. It returns nil if the remote doesn't publish
+// one, and never has. Remotes in an OCI registry don't publish releases.
+func FetchRelease(root string, u url.URL) (*Release, error) {
+	if u.Scheme == oci.Scheme {
+		return nil, nil
+	}
+	seen, err := loadReleases(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading releases db")
+	}
+	body, err := getFile(fmt.Sprintf("%v/release.json", u.String()))
+	if err == errNotFound {
+		if last, ok := seen[u.String()]; ok {
+			return nil, ReleaseRollbackError{Remote: u.String(), Seen: last}
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting release")
+	}
+	b, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading release")
+	}
+	sig, err := getFile(fmt.Sprintf("%v/release.json.asc", u.String()))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting release signature")
+	}
+	defer sig.Close()
+	if err := keyring.Verify(root, bytes.NewReader(b), sig); err != nil {
+		return nil, errors.Wrap(err, "verifying release")
+	}
+
+	r := &Release{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrapf(err, "decode release for %q", u.String())
+	}
+	if last, ok := seen[u.String()]; ok && r.Timestamp.Before(last) {
+		return nil, ReleaseRollbackError{Remote: u.String(), Seen: last, Got: r.Timestamp}
+	}
+	return r, nil
+}
+
+// getPinned returns the index published by the remote at u, as getIndex
+// does, checked against its pin in r, if any. Copies that don't match are
+// skipped in favor of the next of r's Mirrors.
+func getPinned(u url.URL, index string, r *Release) (io.ReadCloser, error) {
+	if r == nil || r.Indexes[index] == "" {
+		return getIndex(u, index)
+	}
+	want := r.Indexes[index]
+	srcs := []url.URL{u}
+	for _, m := range r.Mirrors {
+		mu, err := url.Parse(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing mirror %q", m)
+		}
+		srcs = append(srcs, *mu)
+	}
+
+	var last error
+	for _, src := range srcs {
+		body, err := getIndex(src, index)
+		if err != nil {
+			last = errors.Wrapf(err, "getting %v from %v", index, src.String())
+			continue
+		}
+		b, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			last = errors.Wrapf(err, "reading %v from %v", index, src.String())
+			continue
+		}
+		if got := fmt.Sprintf("%x", sha256.Sum256(b)); got != want {
+			last = IndexMismatchError{Remote: u.String(), Index: index, Want: want, Got: got}
+			continue
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	return nil, last
+}
+
+// fetchReleases returns the Release of each of srcs that publishes one, by
+// url.
+func fetchReleases(root string, srcs []url.URL) (map[string]*Release, error) {
+	r := map[string]*Release{}
+	for _, u := range srcs {
+		rel, err := FetchRelease(root, u)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching release of %q", u.String())
+		}
+		if rel != nil {
+			r[u.String()] = rel
+		}
+	}
+	return r, nil
+}
+
+// loadReleases returns the timestamp of the last Release synced from each
+// remote, by url.
+func loadReleases(root string) (map[string]time.Time, error) {
+	r := map[string]time.Time{}
+	dbn := filepath.Join(root, reln)
+	if !fs.Exists(dbn) {
+		return r, nil
+	}
+
+	f, err := os.Open(dbn)
+	if err != nil {
+		return r, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return r, errors.Wrap(err, "decoding db")
+	}
+	return r, nil
+}
+
+// saveReleases records the timestamps of rels, the releases of every
+// configured remote that publishes one, forgetting remotes that have since
+// been removed.
+func saveReleases(root string, rels map[string]*Release) error {
+	dbn := filepath.Join(root, reln)
+	if len(rels) == 0 && !fs.Exists(dbn) {
+		return nil
+	}
+	db := map[string]time.Time{}
+	for u, rel := range rels {
+		db[u] = rel.Timestamp
+	}
+	return writeJSON(dbn, &db)
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/keyring"
+)
+
+// releaseServer serves whatever files it is given, such as an available index
+// and a release pinning it.
+type releaseServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newReleaseServer() *releaseServer {
+	rs := &releaseServer{files: map[string][]byte{}}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs.mu.Lock()
+		b, ok := rs.files[r.URL.Path]
+		rs.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	return rs
+}
+
+func (rs *releaseServer) set(path string, b []byte) {
+	rs.mu.Lock()
+	rs.files[path] = b
+	rs.mu.Unlock()
+}
+
+// publish serves a and a release for it made at ts, signed with the key in
+// root named key.
+func (rs *releaseServer) publish(t *testing.T, root, key string, a pm.Available, ts time.Time, mirrors ...string) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	rs.set("/available.json", b)
+	rel := Release{
+		Indexes:   map[string]string{"available": fmt.Sprintf("%x", sha256.Sum256(b))},
+		Timestamp: ts,
+		Mirrors:   mirrors,
+	}
+	rb, err := json.Marshal(rel)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	e, err := keyring.FindSecretEntity(root, key)
+	if err != nil {
+		t.Fatalf("find key: %v", err)
+	}
+	sig := &bytes.Buffer{}
+	if err := keyring.Sign(e, bytes.NewReader(rb), sig); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	rs.set("/release.json", rb)
+	rs.set("/release.json.asc", sig.Bytes())
+}
+
+func TestSyncRelease(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	const key = "test@pm.mcquay.me"
+	if err := keyring.NewKeyPair(root, "pm tests", key); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+
+	a := pm.Available{}
+	if err := a.Add(pm.Meta{Name: "foo", Version: "1.0", Description: "foo"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	mirror := newReleaseServer()
+	defer mirror.Close()
+	rs := newReleaseServer()
+	defer rs.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	rs.publish(t, root, key, a, now, mirror.URL)
+	if err := AddRemotes(root, []string{rs.URL}); err != nil {
+		t.Fatalf("add remote: %v", err)
+	}
+	if _, err := Sync(root); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// the remote's copy goes stale, but the mirror has the pinned one.
+	good := rs.files["/available.json"]
+	mirror.set("/available.json", good)
+	rs.set("/available.json", []byte("{}"))
+	if _, err := Sync(root); err != nil {
+		t.Fatalf("sync from mirror: %v", err)
+	}
+	av, _, err := LoadAvailable(root)
+	if err != nil {
+		t.Fatalf("load available: %v", err)
+	}
+	if _, err := av.Get("foo", "1.0"); err != nil {
+		t.Fatalf("foo missing after syncing from mirror: %v", err)
+	}
+
+	// with no good copy left, Sync fails and leaves the db alone.
+	mirror.set("/available.json", []byte("{}"))
+	if _, err := Sync(root); err == nil {
+		t.Fatalf("synced an index that doesn't match its pin")
+	} else if _, ok := errors.Cause(err).(IndexMismatchError); !ok {
+		t.Fatalf("got %v, want an IndexMismatchError", err)
+	}
+
+	// an older release, however well signed, is refused.
+	rs.publish(t, root, key, a, now.Add(-time.Hour))
+	if _, err := Sync(root); err == nil {
+		t.Fatalf("synced an older release")
+	} else if _, ok := errors.Cause(err).(ReleaseRollbackError); !ok {
+		t.Fatalf("got %v, want a ReleaseRollbackError", err)
+	}
+
+	// as is dropping the release altogether.
+	rs.set("/available.json", good)
+	rs.mu.Lock()
+	delete(rs.files, "/release.json")
+	rs.mu.Unlock()
+	if _, err := Sync(root); err == nil {
+		t.Fatalf("synced without a release")
+	} else if _, ok := errors.Cause(err).(ReleaseRollbackError); !ok {
+		t.Fatalf("got %v, want a ReleaseRollbackError", err)
+	}
+
+	// a tampered release doesn't verify.
+	rs.publish(t, root, key, a, now.Add(time.Hour))
+	rs.set("/release.json.asc", []byte("not a signature"))
+	if _, err := Sync(root); err == nil {
+		t.Fatalf("synced with a bad release signature")
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/pkg/errors"
 	"mcquay.me/fs"
+	"mcquay.me/pm"
 )
 
 // DB is a slice of available URI
@@ -17,7 +18,8 @@ type DB []url.URL
 
 const rn = "var/lib/pm/remotes.json"
 
-// AddRemotes appends the provided uri to the list of configured remotes.
+// AddRemotes appends the provided uri to the list of configured remotes, in
+// canonical form; see pm.CanonicalURL.
 func AddRemotes(root string, uris []string) error {
 	db, err := load(root)
 	if err != nil {
@@ -35,7 +37,10 @@ func AddRemotes(root string, uris []string) error {
 			return errors.Wrap(err, "url parse")
 		}
 
-		u := strip(*pu)
+		u, err := pm.CanonicalURL(*pu)
+		if err != nil {
+			return errors.Wrapf(err, "remote %q", uri)
+		}
 
 		if _, ok := dbm[u.String()]; ok {
 			return fmt.Errorf("%q already in db", u.String())
@@ -63,6 +68,11 @@ func RemoveRemotes(root string, uris []string) error {
 		u := strip(*pu)
 
 		rms[u.String()] = true
+		// remotes added before urls were canonicalized may be stored
+		// either way.
+		if cu, err := pm.CanonicalURL(u); err == nil {
+			rms[cu.String()] = true
+		}
 	}
 
 	o := DB{}
@@ -91,6 +101,20 @@ func ListRemotes(root string, w io.Writer) error {
 	return nil
 }
 
+// FindRemote returns the configured remote labeled label; see pm.Label.
+func FindRemote(root, label string) (url.URL, error) {
+	db, err := load(root)
+	if err != nil {
+		return url.URL{}, errors.Wrap(err, "loading")
+	}
+	for _, u := range db {
+		if pm.Label(u) == label {
+			return u, nil
+		}
+	}
+	return url.URL{}, errors.Errorf("no remote labeled %q", label)
+}
+
 func load(root string) (DB, error) {
 	r := DB{}
 	dbn := filepath.Join(root, rn)
@@ -103,6 +127,7 @@ func load(root string) (DB, error) {
 	if err != nil {
 		return r, errors.Wrap(err, "open")
 	}
+	defer f.Close()
 
 	if err := json.NewDecoder(f).Decode(&r); err != nil {
 		return r, errors.Wrap(err, "decoding db")
@@ -112,22 +137,7 @@ func load(root string) (DB, error) {
 }
 
 func save(root string, db DB) error {
-	f, err := os.Create(filepath.Join(root, rn))
-	if err != nil {
-		return errors.Wrap(err, "create")
-	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "\t")
-
-	if err := enc.Encode(&db); err != nil {
-		return errors.Wrap(err, "decoding db")
-	}
-
-	if err := f.Close(); err != nil {
-		return errors.Wrap(err, "close db")
-	}
-
-	return nil
+	return writeJSON(filepath.Join(root, rn), &db)
 }
 
 // strip removes all fields we don't currently need.
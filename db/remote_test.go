@@ -44,6 +44,8 @@ func TestAdd(t *testing.T) {
 
 	bad := []string{
 		"http\ns://\nFoo|n",
+		"ftp://pm.mcquay.me/darwin/amd64",
+		"https:///darwin/amd64",
 	}
 
 	if err := AddRemotes(root, bad); err == nil {
@@ -128,6 +130,10 @@ func TestRemove(t *testing.T) {
 		}
 		t.Fatalf("failed to remove %v", uris[1:2])
 	}
+
+	if err := RemoveRemotes(root, []string{"HTTPS://PM.mcquay.me:443/baz/"}); err != nil {
+		t.Fatalf("remove non-canonical: %v", err)
+	}
 }
 
 func TestList(t *testing.T) {
@@ -0,0 +1,29 @@
+package pm
+
+import "fmt"
+
+// Phase names a step in operating on packages.
+type Phase string
+
+// The phases of an install, in the order they happen.
+const (
+	Resolve  Phase = "resolve"
+	Download Phase = "download"
+	Verify   Phase = "verify"
+	Extract  Phase = "extract"
+	Commit   Phase = "commit"
+)
+
+// Event is emitted as an operation moves a package through a Phase.
+type Event struct {
+	Phase   Phase   `json:"phase"`
+	Name    Name    `json:"name,omitempty"`
+	Version Version `json:"version,omitempty"`
+}
+
+func (e Event) String() string {
+	if e.Name == "" {
+		return string(e.Phase)
+	}
+	return fmt.Sprintf("%v %v@%v", e.Phase, e.Name, e.Version)
+}
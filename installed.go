@@ -3,6 +3,7 @@ package pm
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
 )
@@ -71,3 +72,136 @@ func (i Installed) Removable(names []string) (Metas, error) {
 
 	return r, nil
 }
+
+// Upgradable returns the newest version a offers of each installed package,
+// for those packages that a has a newer version of.
+func (i Installed) Upgradable(a Available) Metas {
+	r := Metas{}
+	for m := range i.Traverse() {
+		n, err := a.Get(m.Name, "")
+		if err != nil || CompareVersions(n.Version, m.Version) <= 0 {
+			continue
+		}
+		r = append(r, n)
+	}
+	return r
+}
+
+// Autoremovable returns the packages that were installed automatically, see
+// Meta.Auto, that no longer need to be: those that aren't depended on,
+// directly or not, by any package that was installed explicitly.
+func (i Installed) Autoremovable() Metas {
+	needed := map[Name]bool{}
+	var need func(n Name)
+	need = func(n Name) {
+		m, ok := i[n]
+		if !ok || needed[n] {
+			return
+		}
+		needed[n] = true
+		for _, d := range m.Deps {
+			if dn, _, err := ParseLabel(d); err == nil {
+				need(dn)
+			}
+		}
+	}
+	for n, m := range i {
+		if !m.Auto {
+			need(n)
+		}
+	}
+
+	r := Metas{}
+	for m := range i.Traverse() {
+		if !needed[m.Name] {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// ReverseDeps indexes i by dependency: it maps the name of each package
+// depended on to the installed packages that depend on it, in name order.
+func (i Installed) ReverseDeps() map[Name]Names {
+	r := map[Name]Names{}
+	for m := range i.Traverse() {
+		for _, d := range m.Deps {
+			if dn, _, err := ParseLabel(d); err == nil {
+				r[dn] = append(r[dn], m.Name)
+			}
+		}
+	}
+	return r
+}
+
+// Dependents returns the installed packages that depend, directly or not, on
+// any of names, leaving out names themselves. Each comes after those of them
+// it depends on.
+func (i Installed) Dependents(names ...Name) Metas {
+	rdeps := i.ReverseDeps()
+	from := map[Name]bool{}
+	for _, n := range names {
+		from[n] = true
+	}
+	seen := map[Name]bool{}
+	order := Names{}
+	var visit func(n Name)
+	visit = func(n Name) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		for _, dn := range rdeps[n] {
+			visit(dn)
+		}
+		order = append(order, n)
+	}
+	for _, n := range names {
+		visit(n)
+	}
+
+	// order has each package after everything that depends on it.
+	r := Metas{}
+	for j := len(order) - 1; j >= 0; j-- {
+		if m, ok := i[order[j]]; ok && !from[order[j]] {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// FindByFile returns, for each installed package that owns files matching
+// the filepath.Match pattern, the matching files in sorted order. A file
+// matches if it, or any directory containing it, does, so "etc/nginx" finds
+// everything under etc/nginx. Paths are relative to the install root, and a
+// leading / on pattern is ignored.
+//
+// Only the file lists recorded in Meta.Files are searched.
+func (i Installed) FindByFile(pattern string) (map[string][]string, error) {
+	pattern = strings.TrimPrefix(filepath.Clean(pattern), "/")
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+	}
+	r := map[string][]string{}
+	for n, m := range i {
+		for f := range m.Files {
+			if !matchFile(pattern, f) {
+				continue
+			}
+			r[string(n)] = append(r[string(n)], f)
+		}
+		sort.Strings(r[string(n)])
+	}
+	return r, nil
+}
+
+// matchFile reports if name, or any directory containing it, matches
+// pattern, which is known to be well formed.
+func matchFile(pattern, name string) bool {
+	for n := filepath.Clean(name); n != "." && n != "/"; n = filepath.Dir(n) {
+		if ok, _ := filepath.Match(pattern, n); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package keyring
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+
+	"mcquay.me/fs"
+)
+
+// TrustReport describes every key in a keyring and how far it is trusted,
+// for review; see Audit.
+type TrustReport struct {
+	Keys []KeyReport `json:"keys"`
+}
+
+// KeyReport describes a key in a TrustReport.
+type KeyReport struct {
+	Fingerprint string     `json:"fingerprint"`
+	UserIDs     []string   `json:"user_ids"`
+	Trust       TrustLevel `json:"trust"`
+
+	// Revoked is set for keys on the revocation list; see Revoke. Their
+	// signatures are rejected whatever their Trust.
+	Revoked bool `json:"revoked,omitempty"`
+
+	// Secret is set if the keyring holds the key's private half, and so
+	// can sign with it.
+	Secret bool `json:"secret,omitempty"`
+
+	// Created is when the key was made, and Expires when it stops being
+	// valid, if ever.
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Imported is when the key was added to the keyring, if that was
+	// recorded; keys added by older versions of pm weren't.
+	Imported *time.Time `json:"imported,omitempty"`
+}
+
+// Audit reports on every public key in the keyring in root, in fingerprint
+// order. It changes nothing.
+func Audit(root string) (*TrustReport, error) {
+	srn, prn := getNames(root)
+	secs, pubs, err := getELs(srn, prn)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting existing keyrings")
+	}
+	tdb, err := loadTrust(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading trustdb")
+	}
+	revoked, err := loadRevoked(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading revocation list")
+	}
+	imported, err := loadImported(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading import times")
+	}
+	secret := map[string]bool{}
+	for _, s := range secs {
+		secret[Fingerprint(s)] = true
+	}
+
+	r := &TrustReport{Keys: []KeyReport{}}
+	for _, p := range pubs {
+		fp := Fingerprint(p)
+		k := KeyReport{
+			Fingerprint: fp,
+			UserIDs:     []string{},
+			Trust:       trustOf(tdb, p),
+			Revoked:     revoked[fp],
+			Secret:      secret[fp],
+			Created:     p.PrimaryKey.CreationTime,
+			Expires:     expiry(p),
+		}
+		for id := range p.Identities {
+			k.UserIDs = append(k.UserIDs, id)
+		}
+		sort.Strings(k.UserIDs)
+		if t, ok := imported[fp]; ok {
+			k.Imported = &t
+		}
+		r.Keys = append(r.Keys, k)
+	}
+	sort.Slice(r.Keys, func(i, j int) bool { return r.Keys[i].Fingerprint < r.Keys[j].Fingerprint })
+	return r, nil
+}
+
+// expiry returns when e expires, according to the self-signatures on its
+// identities, or nil if it doesn't.
+func expiry(e *openpgp.Entity) *time.Time {
+	for _, id := range e.Identities {
+		if id.SelfSignature == nil || id.SelfSignature.KeyLifetimeSecs == nil || *id.SelfSignature.KeyLifetimeSecs == 0 {
+			continue
+		}
+		t := e.PrimaryKey.CreationTime.Add(time.Duration(*id.SelfSignature.KeyLifetimeSecs) * time.Second)
+		return &t
+	}
+	return nil
+}
+
+func importedName(root string) string {
+	return filepath.Join(pGPDir(root), "imported.json")
+}
+
+// loadImported returns when each key was added to the keyring in root, keyed
+// by fingerprint.
+func loadImported(root string) (map[string]time.Time, error) {
+	r := map[string]time.Time{}
+	fn := importedName(root)
+	if !fs.Exists(fn) {
+		return r, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "decoding import times")
+	}
+	return r, nil
+}
+
+// recordImported records that es were added to the keyring in root at now.
+func recordImported(root string, es openpgp.EntityList, now time.Time) error {
+	imported, err := loadImported(root)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		imported[Fingerprint(e)] = now.UTC()
+	}
+	f, err := os.Create(importedName(root))
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(imported); err != nil {
+		f.Close()
+		return errors.Wrap(err, "encoding import times")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close import times")
+	}
+	return nil
+}
@@ -1,15 +1,20 @@
 package keyring
 
 import (
+	"bytes"
+	"crypto"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"mcquay.me/fs"
 )
@@ -73,6 +78,9 @@ func NewKeyPair(root, name, email string) error {
 	if err := pr.Close(); err != nil {
 		return errors.Wrap(err, "closing pubring")
 	}
+	if err := recordImported(root, openpgp.EntityList{fresh}, time.Now()); err != nil {
+		return errors.Wrap(err, "recording import time")
+	}
 	return nil
 }
 
@@ -93,12 +101,16 @@ func ListKeys(root string, w io.Writer) error {
 		}
 		fmt.Fprintf(w, "sec: %+v:\t%v\n", s.PrimaryKey.KeyIdShortString(), strings.Join(names, ","))
 	}
+	tdb, err := loadTrust(root)
+	if err != nil {
+		return errors.Wrap(err, "loading trustdb")
+	}
 	for _, p := range pubs {
 		names := []string{}
 		for _, v := range p.Identities {
 			names = append(names, v.Name)
 		}
-		fmt.Fprintf(w, "pub: %+v:\t%v\n", p.PrimaryKey.KeyIdShortString(), strings.Join(names, ","))
+		fmt.Fprintf(w, "pub: %+v:\t%v\t%v\t%v\n", p.PrimaryKey.KeyIdShortString(), strings.Join(names, ","), Fingerprint(p), trustOf(tdb, p))
 	}
 	return nil
 }
@@ -180,6 +192,9 @@ func Import(root string, w io.Reader) error {
 	if err := pr.Close(); err != nil {
 		return errors.Wrap(err, "closing pubring")
 	}
+	if err := recordImported(root, foreign, time.Now()); err != nil {
+		return errors.Wrap(err, "recording import time")
+	}
 	return nil
 }
 
@@ -192,22 +207,170 @@ func Sign(key *openpgp.Entity, in io.Reader, sig io.Writer) error {
 	return nil
 }
 
-// Verify verifies a file's deatched signature.
+// Verify verifies a file's deatched signature. Signatures from keys that are
+// not fully trusted, or that have been revoked, are rejected.
 func Verify(root string, file, sig io.Reader) error {
+	s, err := CheckSignature(root, file, sig)
+	if err != nil {
+		return err
+	}
+	if s.Trust != Trusted {
+		return errors.Errorf("signed by %v key %v", s.Trust, s.Signer.PrimaryKey.KeyIdShortString())
+	}
+	return nil
+}
+
+// VerifyWithKey verifies a detached signature of data against pubkey, an
+// armored public key, alone. The keyring is not consulted, so a file can be
+// checked against a key obtained out-of-band without importing it.
+func VerifyWithKey(data, sig, pubkey io.Reader) error {
+	el, err := openpgp.ReadArmoredKeyRing(pubkey)
+	if err != nil {
+		return errors.Wrap(err, "reading public key")
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(el, data, sig); err != nil {
+		return errors.Wrap(err, "check sig")
+	}
+	return nil
+}
+
+// Signature describes a verified detached signature.
+type Signature struct {
+	Signer    *openpgp.Entity
+	CreatedAt time.Time
+	Trust     TrustLevel
+
+	// Algorithm and Bits describe the key, the signer's primary key or one
+	// of its subkeys, that made the signature, e.g. "RSA" and 2048.
+	Algorithm string
+	Bits      int
+
+	// Hash is the digest the signature was made over.
+	Hash crypto.Hash
+
+	// Expires is when the signer's key stops being valid, if ever.
+	Expires *time.Time
+}
+
+// CheckSignature verifies a file's detached signature and returns information
+// about it. Signatures from Untrusted keys are rejected, as are those from
+// revoked keys with a KeyRevokedError; it is up to the caller to decide what
+// to do with Marginal ones.
+func CheckSignature(root string, file, sig io.Reader) (*Signature, error) {
 	if err := ensureDir(root); err != nil {
-		return errors.Wrap(err, "can't find or create pgp dir")
+		return nil, errors.Wrap(err, "can't find or create pgp dir")
 	}
 	srn, prn := getNames(root)
 	_, pubs, err := getELs(srn, prn)
 	if err != nil {
-		return errors.Wrap(err, "getting existing keyrings")
+		return nil, errors.Wrap(err, "getting existing keyrings")
 	}
-	if _, err = openpgp.CheckArmoredDetachedSignature(pubs, file, sig); err != nil {
-		return errors.Wrap(err, "check sig")
+
+	buf, err := ioutil.ReadAll(sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sig")
+	}
+	e, err := openpgp.CheckArmoredDetachedSignature(pubs, file, bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.Wrap(err, "check sig")
+	}
+	info, err := readSignature(bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sig")
+	}
+	revoked, err := loadRevoked(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading revocation list")
+	}
+	if fp := Fingerprint(e); revoked[fp] {
+		return nil, KeyRevokedError{Fingerprint: fp}
+	}
+	tdb, err := loadTrust(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading trustdb")
+	}
+	trust := trustOf(tdb, e)
+	if trust == Untrusted {
+		return nil, errors.Errorf("signed by untrusted key %v", e.PrimaryKey.KeyIdShortString())
+	}
+	r := &Signature{
+		Signer:    e,
+		CreatedAt: info.created,
+		Trust:     trust,
+		Hash:      info.hash,
+		Expires:   expiry(e),
+	}
+	if k := signingKey(e, info.issuer); k != nil {
+		r.Algorithm = algorithm(k.PubKeyAlgo)
+		if bits, err := k.BitLength(); err == nil {
+			r.Bits = int(bits)
+		}
+	}
+	return r, nil
+}
+
+// sigInfo is what readSignature finds in a signature packet.
+type sigInfo struct {
+	created time.Time
+	hash    crypto.Hash
+	issuer  uint64
+}
+
+// readSignature returns the creation time, digest and issuer of the armored
+// signature in sig.
+func readSignature(sig io.Reader) (sigInfo, error) {
+	b, err := armor.Decode(sig)
+	if err != nil {
+		return sigInfo{}, errors.Wrap(err, "armor decode")
+	}
+	p, err := packet.Read(b.Body)
+	if err != nil {
+		return sigInfo{}, errors.Wrap(err, "reading packet")
+	}
+	switch s := p.(type) {
+	case *packet.Signature:
+		r := sigInfo{created: s.CreationTime, hash: s.Hash}
+		if s.IssuerKeyId != nil {
+			r.issuer = *s.IssuerKeyId
+		}
+		return r, nil
+	case *packet.SignatureV3:
+		return sigInfo{created: s.CreationTime, hash: s.Hash, issuer: s.IssuerKeyId}, nil
+	}
+	return sigInfo{}, errors.Errorf("unexpected packet type %T", p)
+}
+
+// signingKey returns the key of e with the given id, its primary key or one
+// of its subkeys, or nil.
+func signingKey(e *openpgp.Entity, id uint64) *packet.PublicKey {
+	if e.PrimaryKey.KeyId == id {
+		return e.PrimaryKey
+	}
+	for _, sk := range e.Subkeys {
+		if sk.PublicKey.KeyId == id {
+			return sk.PublicKey
+		}
 	}
 	return nil
 }
 
+// algorithm names the public key algorithm a.
+func algorithm(a packet.PublicKeyAlgorithm) string {
+	switch a {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoRSAEncryptOnly:
+		return "RSA"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	}
+	return fmt.Sprintf("algorithm %d", a)
+}
+
 // Remove removes public key information for a given id.
 //
 // It skips public keys that have matching secret keys, and does not effect
@@ -0,0 +1,288 @@
+package keyring
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func keyMe(t *testing.T) (string, *openpgp.Entity, func()) {
+	root, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	if err := NewKeyPair(root, "pm tests", "test@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+	e, err := FindSecretEntity(root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret entity: %v", err)
+	}
+	return root, e, func() {
+		if err := os.RemoveAll(root); err != nil {
+			t.Fatalf("cleanup: %v", err)
+		}
+	}
+}
+
+func TestCheckSignatureFuture(t *testing.T) {
+	root, e, del := keyMe(t)
+	defer del()
+
+	data := []byte("some signed contents\n")
+	future := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	sig := &bytes.Buffer{}
+	cfg := &packet.Config{Time: func() time.Time { return future }}
+	if err := openpgp.ArmoredDetachSign(sig, e, bytes.NewReader(data), cfg); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	s, err := CheckSignature(root, bytes.NewReader(data), sig)
+	if err != nil {
+		t.Fatalf("check signature: %v", err)
+	}
+	if got, want := s.CreatedAt, future; !got.Equal(want) {
+		t.Fatalf("created at: got %v, want %v", got, want)
+	}
+	if got, want := s.Signer.PrimaryKey.KeyId, e.PrimaryKey.KeyId; got != want {
+		t.Fatalf("signer: got %v, want %v", got, want)
+	}
+}
+
+func TestTrust(t *testing.T) {
+	root, e, del := keyMe(t)
+	defer del()
+
+	data := []byte("some signed contents\n")
+	sig := &bytes.Buffer{}
+	if err := Sign(e, bytes.NewReader(data), sig); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	if err := SetTrust(root, "0000", Marginal); err == nil {
+		t.Fatalf("set trust of unknown key")
+	}
+	if err := SetTrust(root, Fingerprint(e), "sorta"); err == nil {
+		t.Fatalf("set unknown trust level")
+	}
+
+	tests := []struct {
+		level  TrustLevel
+		check  bool
+		verify bool
+	}{
+		{Trusted, true, true},
+		{Marginal, true, false},
+		{Untrusted, false, false},
+	}
+	for _, test := range tests {
+		if err := SetTrust(root, Fingerprint(e), test.level); err != nil {
+			t.Fatalf("set trust: %v", err)
+		}
+		s, err := CheckSignature(root, bytes.NewReader(data), bytes.NewReader(sig.Bytes()))
+		if (err == nil) != test.check {
+			t.Fatalf("%v: check signature: got %v, want ok == %v", test.level, err, test.check)
+		}
+		if err == nil && s.Trust != test.level {
+			t.Fatalf("%v: got trust %v", test.level, s.Trust)
+		}
+		err = Verify(root, bytes.NewReader(data), bytes.NewReader(sig.Bytes()))
+		if (err == nil) != test.verify {
+			t.Fatalf("%v: verify: got %v, want ok == %v", test.level, err, test.verify)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ListKeys(root, buf); err != nil {
+		t.Fatalf("list keys: %v", err)
+	}
+	if !strings.Contains(buf.String(), string(Untrusted)) {
+		t.Fatalf("trust level not listed:\n%v", buf)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	root, e, del := keyMe(t)
+	defer del()
+
+	data := []byte("some signed contents\n")
+	sig := &bytes.Buffer{}
+	if err := Sign(e, bytes.NewReader(data), sig); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := Verify(root, bytes.NewReader(data), bytes.NewReader(sig.Bytes())); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// fingerprints are accepted as printed by gpg, spaces and all.
+	fp := strings.ToLower(Fingerprint(e))
+	if err := Revoke(root, fp[:4]+" "+fp[4:]); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := Revoke(root, Fingerprint(e)); err != nil {
+		t.Fatalf("revoke again: %v", err)
+	}
+	b, err := ioutil.ReadFile(revokedName(root))
+	if err != nil {
+		t.Fatalf("read revocation list: %v", err)
+	}
+	if got, want := string(b), Fingerprint(e)+"\n"; got != want {
+		t.Fatalf("revocation list: got %q, want %q", got, want)
+	}
+
+	err = Verify(root, bytes.NewReader(data), bytes.NewReader(sig.Bytes()))
+	if kre, ok := errors.Cause(err).(KeyRevokedError); !ok {
+		t.Fatalf("verify: got %v, want a KeyRevokedError", err)
+	} else if kre.Fingerprint != Fingerprint(e) {
+		t.Fatalf("got fingerprint %v, want %v", kre.Fingerprint, Fingerprint(e))
+	}
+	_, err = CheckSignature(root, bytes.NewReader(data), bytes.NewReader(sig.Bytes()))
+	if _, ok := errors.Cause(err).(KeyRevokedError); !ok {
+		t.Fatalf("check signature: got %v, want a KeyRevokedError", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	root, e, del := keyMe(t)
+	defer del()
+	if err := NewKeyPair(root, "pm tests", "second@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+	second, err := FindSecretEntity(root, "second@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret entity: %v", err)
+	}
+
+	// a third key comes from elsewhere, public half only.
+	other, third, delOther := keyMe(t)
+	defer delOther()
+	buf := &bytes.Buffer{}
+	if err := Export(other, buf, "test@pm.mcquay.me"); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	before := time.Now().Add(-time.Second)
+	if err := Import(root, buf); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	if err := SetTrust(root, Fingerprint(second), Marginal); err != nil {
+		t.Fatalf("set trust: %v", err)
+	}
+	if err := Revoke(root, Fingerprint(third)); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+
+	r, err := Audit(root)
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if got, want := len(r.Keys), 3; got != want {
+		t.Fatalf("got %v keys, want %v", got, want)
+	}
+	keys := map[string]KeyReport{}
+	for i, k := range r.Keys {
+		if i > 0 && r.Keys[i-1].Fingerprint >= k.Fingerprint {
+			t.Fatalf("keys not in fingerprint order")
+		}
+		if len(k.UserIDs) != 1 || k.Created.IsZero() || k.Imported == nil {
+			t.Fatalf("%v: incomplete report %+v", k.Fingerprint, k)
+		}
+		keys[k.Fingerprint] = k
+	}
+	if k := keys[Fingerprint(e)]; k.Trust != Trusted || !k.Secret || k.Revoked {
+		t.Fatalf("first key: got %+v", k)
+	}
+	if k := keys[Fingerprint(second)]; k.Trust != Marginal || !k.Secret || !strings.Contains(k.UserIDs[0], "second@pm.mcquay.me") {
+		t.Fatalf("second key: got %+v", k)
+	}
+	if k := keys[Fingerprint(third)]; !k.Revoked || k.Secret || k.Imported.Before(before) {
+		t.Fatalf("imported key: got %+v", k)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got := &TrustReport{}
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(got.Keys) != 3 || got.Keys[0].Fingerprint != r.Keys[0].Fingerprint {
+		t.Fatalf("round trip: got %+v", got)
+	}
+}
+
+func TestVerifyWithKey(t *testing.T) {
+	root, e, del := keyMe(t)
+	defer del()
+	other, _, odel := keyMe(t)
+	defer odel()
+
+	data := []byte("some signed contents\n")
+	sig := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(sig, e, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	tests := []struct {
+		label string
+		root  string
+		ok    bool
+	}{
+		{"matching", root, true},
+		{"non-matching", other, false},
+	}
+	for _, test := range tests {
+		key := &bytes.Buffer{}
+		if err := Export(test.root, key, "test@pm.mcquay.me"); err != nil {
+			t.Fatalf("%v: export: %v", test.label, err)
+		}
+		err := VerifyWithKey(bytes.NewReader(data), bytes.NewReader(sig.Bytes()), key)
+		if test.ok && err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.label, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("%v: verified against the wrong key", test.label)
+		}
+	}
+}
+
+func TestCheckSignatureStrength(t *testing.T) {
+	root, e, del := keyMe(t)
+	defer del()
+
+	data := []byte("some signed contents\n")
+	tests := []struct {
+		cfg  *packet.Config
+		bits int
+		hash crypto.Hash
+	}{
+		{nil, 2048, crypto.SHA256},
+		{&packet.Config{DefaultHash: crypto.SHA1}, 2048, crypto.SHA1},
+	}
+	for _, test := range tests {
+		sig := &bytes.Buffer{}
+		if err := openpgp.ArmoredDetachSign(sig, e, bytes.NewReader(data), test.cfg); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		s, err := CheckSignature(root, bytes.NewReader(data), sig)
+		if err != nil {
+			t.Fatalf("check signature: %v", err)
+		}
+		if s.Algorithm != "RSA" || s.Bits != test.bits || s.Hash != test.hash {
+			t.Fatalf("got %v %v %v, want RSA %v %v", s.Algorithm, s.Bits, s.Hash, test.bits, test.hash)
+		}
+		if s.Expires != nil {
+			t.Fatalf("expires: got %v, want never", s.Expires)
+		}
+	}
+}
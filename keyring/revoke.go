@@ -0,0 +1,90 @@
+package keyring
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"mcquay.me/fs"
+)
+
+// KeyRevokedError is returned for a signature made by a key that has been
+// revoked; see Revoke. The signature itself may well be valid.
+type KeyRevokedError struct {
+	Fingerprint string
+}
+
+func (e KeyRevokedError) Error() string {
+	return fmt.Sprintf("signed by revoked key %v", e.Fingerprint)
+}
+
+func revokedName(root string) string {
+	return filepath.Join(root, "var", "lib", "pm", "revoked.txt")
+}
+
+// normalize returns fingerprint in the form Fingerprint returns.
+func normalize(fingerprint string) string {
+	return strings.ToUpper(strings.Replace(fingerprint, " ", "", -1))
+}
+
+// Revoke adds the key with the given fingerprint to the revocation list in
+// root, so that its signatures are no longer accepted. The key needn't be in
+// the keyring: the list is a plain file, one fingerprint per line, that can
+// also be distributed by other means.
+func Revoke(root, fingerprint string) error {
+	fp := normalize(fingerprint)
+	if fp == "" {
+		return errors.New("empty fingerprint")
+	}
+	revoked, err := loadRevoked(root)
+	if err != nil {
+		return errors.Wrap(err, "loading revocation list")
+	}
+	if revoked[fp] {
+		return nil
+	}
+
+	f, err := os.OpenFile(revokedName(root), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	if _, err := fmt.Fprintln(f, fp); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing revocation list")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close revocation list")
+	}
+	return nil
+}
+
+// loadRevoked returns the fingerprints on the revocation list in root. Blank
+// lines, and those starting with #, are ignored.
+func loadRevoked(root string) (map[string]bool, error) {
+	r := map[string]bool{}
+	fn := revokedName(root)
+	if !fs.Exists(fn) {
+		return r, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		r[normalize(l)] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading revocation list")
+	}
+	return r, nil
+}
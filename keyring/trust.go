@@ -0,0 +1,159 @@
+package keyring
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+
+	"mcquay.me/fs"
+)
+
+// TrustLevel records how far the owner of a keyring trusts a key.
+type TrustLevel string
+
+// Keys that have not been assigned a TrustLevel are Trusted, since adding a
+// key to the keyring is already a statement of trust.
+const (
+	Trusted   TrustLevel = "trusted"
+	Marginal  TrustLevel = "marginal"
+	Untrusted TrustLevel = "untrusted"
+)
+
+// ParseTrustLevel returns the TrustLevel named s.
+func ParseTrustLevel(s string) (TrustLevel, error) {
+	switch l := TrustLevel(strings.ToLower(s)); l {
+	case Trusted, Marginal, Untrusted:
+		return l, nil
+	}
+	return "", errors.Errorf("unknown trust level %q", s)
+}
+
+func trustDBName(root string) string {
+	return filepath.Join(root, "var", "lib", "pm", "trustdb")
+}
+
+// Fingerprint returns the fingerprint of e in the form used by SetTrust.
+func Fingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// SetTrust records that the key with the given fingerprint is to be trusted
+// at level.
+func SetTrust(root, fingerprint string, level TrustLevel) error {
+	if _, err := ParseTrustLevel(string(level)); err != nil {
+		return err
+	}
+	fp := normalize(fingerprint)
+
+	if err := ensureDir(root); err != nil {
+		return errors.Wrap(err, "can't find or create pgp dir")
+	}
+	srn, prn := getNames(root)
+	_, pubs, err := getELs(srn, prn)
+	if err != nil {
+		return errors.Wrap(err, "getting existing keyrings")
+	}
+	found := false
+	for _, p := range pubs {
+		if Fingerprint(p) == fp {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("key %q not found", fingerprint)
+	}
+
+	tdb, err := loadTrust(root)
+	if err != nil {
+		return errors.Wrap(err, "loading trustdb")
+	}
+	tdb[fp] = level
+
+	f, err := os.Create(trustDBName(root))
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(tdb); err != nil {
+		f.Close()
+		return errors.Wrap(err, "encoding trustdb")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close trustdb")
+	}
+	return nil
+}
+
+// KeyNotFoundError is returned when the key with Fingerprint isn't in the
+// keyring.
+type KeyNotFoundError struct {
+	Fingerprint string
+}
+
+func (e KeyNotFoundError) Error() string {
+	return fmt.Sprintf("key %v not found", e.Fingerprint)
+}
+
+// TrustOf returns the trust level of the key with the given fingerprint in
+// the keyring in root. A key that isn't in the keyring is a
+// KeyNotFoundError, and one that has been revoked a KeyRevokedError.
+func TrustOf(root, fingerprint string) (TrustLevel, error) {
+	fp := normalize(fingerprint)
+	revoked, err := loadRevoked(root)
+	if err != nil {
+		return "", errors.Wrap(err, "loading revocation list")
+	}
+	if revoked[fp] {
+		return "", KeyRevokedError{Fingerprint: fp}
+	}
+
+	srn, prn := getNames(root)
+	_, pubs, err := getELs(srn, prn)
+	if err != nil {
+		return "", errors.Wrap(err, "getting existing keyrings")
+	}
+	for _, p := range pubs {
+		if Fingerprint(p) != fp {
+			continue
+		}
+		tdb, err := loadTrust(root)
+		if err != nil {
+			return "", errors.Wrap(err, "loading trustdb")
+		}
+		return trustOf(tdb, p), nil
+	}
+	return "", KeyNotFoundError{Fingerprint: fp}
+}
+
+// loadTrust returns the trust database in root, keyed by fingerprint.
+func loadTrust(root string) (map[string]TrustLevel, error) {
+	r := map[string]TrustLevel{}
+	fn := trustDBName(root)
+	if !fs.Exists(fn) {
+		return r, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "decoding trustdb")
+	}
+	return r, nil
+}
+
+// trustOf returns the TrustLevel of e according to tdb.
+func trustOf(tdb map[string]TrustLevel, e *openpgp.Entity) TrustLevel {
+	if l, ok := tdb[Fingerprint(e)]; ok {
+		return l
+	}
+	return Trusted
+}
@@ -1,9 +1,14 @@
 package pm
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 )
 
 // Meta tracks metadata for a package
@@ -12,7 +17,186 @@ type Meta struct {
 	Version     Version `json:"version"`
 	Description string  `json:"description"`
 
+	// Deps lists the packages this package depends on, either by name or
+	// pinned to a specific version as name@version.
+	Deps []string `json:"deps,omitempty"`
+
+	// Before and After name packages that, when installed alongside this
+	// one, must be installed after or before it respectively, without
+	// depending on them.
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+
+	// Conflicts names packages that can't be installed alongside this one,
+	// e.g. an alternative implementation of the same thing.
+	Conflicts []string `json:"conflicts,omitempty"`
+
+	// Provides names virtual packages this package stands in for, e.g.
+	// mail-transport-agent, so that other packages can depend on whichever
+	// of their providers is available.
+	Provides []string `json:"provides,omitempty" yaml:"provides"`
+
+	// Triggers lists filepath.Match patterns for files, installed by other
+	// packages, that this package wants to know about, e.g. lib/*.so for a
+	// package that maintains a linker cache. A pattern that matches a
+	// directory matches everything below it. Once an install is done, the
+	// package's trigger script is run with the files that matched.
+	Triggers []string `json:"triggers,omitempty"`
+
+	// Priority is how important the package is; Standard if unset.
+	Priority Priority `json:"priority,omitempty" yaml:"priority"`
+
+	// Arch is the architecture the package is built for, e.g. "amd64", and
+	// MultiArch whether it can be installed alongside builds of itself for
+	// other architectures.
+	Arch      string    `json:"arch,omitempty" yaml:"arch"`
+	MultiArch MultiArch `json:"multi_arch,omitempty" yaml:"multi_arch"`
+
+	// ABITag names the C library ABI the package was built against, e.g.
+	// "glibc" or "musl". Packages tagged "any", or not tagged at all, run
+	// anywhere.
+	ABITag string `json:"abi,omitempty" yaml:"abi"`
+
+	// DownloadSize and InstalledSize are the sizes in bytes of the .pkg and
+	// of the package's expanded root. They are advisory, and zero when the
+	// remote doesn't publish them.
+	DownloadSize  int64 `json:"download_size,omitempty" yaml:"download_size"`
+	InstalledSize int64 `json:"installed_size,omitempty" yaml:"installed_size"`
+
+	// Published is when the package was added to its remote, if the remote
+	// records it.
+	Published time.Time `json:"published,omitempty" yaml:"published"`
+
+	// ExpiresAt, if set, is when the package stops being supported. It
+	// can't be installed after then; see CheckExpiry.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" yaml:"expires_at"`
+
+	// Changelog is the url of the package's changelog, if it has one
+	// online. A package can instead ship one in its .pkg, as CHANGELOG.
+	Changelog string `json:"changelog,omitempty" yaml:"changelog"`
+
+	// ScriptInterpreter, if set, is the program that runs the package's
+	// install and remove scripts, e.g. /bin/sh or python3. Otherwise each
+	// script is run directly, by way of its #! line if it has one.
+	ScriptInterpreter string `json:"script_interpreter,omitempty" yaml:"script_interpreter"`
+
 	Remote url.URL `json:"remote"`
+
+	// Repository is the label of the remote the package came from; see
+	// Label.
+	Repository string `json:"repository,omitempty"`
+
+	// KeyFingerprint, if set, is the fingerprint of the key the remote
+	// says the package is signed with, so that a package whose key isn't
+	// trusted can be turned away before it is downloaded.
+	KeyFingerprint string `json:"key_fingerprint,omitempty" yaml:"key_fingerprint"`
+
+	// SignedBy is the id of the key that signed an installed package.
+	SignedBy string `json:"signed_by,omitempty"`
+
+	// Files maps the path of each file an installed package put on disk to
+	// its sha256 checksum. Remotes may also publish it for available
+	// packages, as a contents index; see Available.WhatProvides.
+	Files map[string]string `json:"files,omitempty"`
+
+	// Hardlinks maps each file of an installed package that was extracted
+	// as a hard link to the file it links to, which shares its contents.
+	Hardlinks map[string]string `json:"hardlinks,omitempty"`
+
+	// Excluded lists the files of an installed package that were skipped at
+	// install time.
+	Excluded []string `json:"excluded,omitempty"`
+
+	// StripComponents is how many leading path components were stripped
+	// from the names in an installed package's bom when it was extracted.
+	StripComponents int `json:"strip_components,omitempty" yaml:"-"`
+
+	// Auto is set on installed packages that were only installed as a
+	// dependency of another; see Installed.Autoremovable.
+	Auto bool `json:"auto,omitempty" yaml:"-"`
+
+	// AutoInstalledBy names the package an Auto package was installed as a
+	// dependency of, if any.
+	AutoInstalledBy Name `json:"auto_installed_by,omitempty" yaml:"-"`
+
+	// Extra holds the JSON fields this version of pm doesn't know about, so
+	// that indexes written by newer versions can be read, and written back,
+	// without losing them.
+	Extra map[string]json.RawMessage `json:"-" yaml:"-"`
+}
+
+// StripPath removes the first n components of name, a path in a package,
+// returning "" if nothing is left.
+func StripPath(name string, n int) string {
+	if n <= 0 {
+		return name
+	}
+	parts := strings.Split(strings.Trim(filepath.ToSlash(name), "/"), "/")
+	if len(parts) <= n {
+		return ""
+	}
+	return filepath.Join(parts[n:]...)
+}
+
+// knownFields are the lower-cased JSON names of Meta's fields.
+var knownFields = func() map[string]bool {
+	r := map[string]bool{}
+	t := reflect.TypeOf(Meta{})
+	for i := 0; i < t.NumField(); i++ {
+		n := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if n == "-" {
+			continue
+		}
+		if n == "" {
+			n = t.Field(i).Name
+		}
+		r[strings.ToLower(n)] = true
+	}
+	return r
+}()
+
+// UnmarshalJSON decodes m, keeping any fields it doesn't know about in
+// Extra.
+func (m *Meta) UnmarshalJSON(b []byte) error {
+	type meta Meta
+	if err := json.Unmarshal(b, (*meta)(m)); err != nil {
+		return err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	m.Extra = nil
+	for k, v := range all {
+		// encoding/json matches field names case-insensitively.
+		if knownFields[strings.ToLower(k)] {
+			continue
+		}
+		if m.Extra == nil {
+			m.Extra = map[string]json.RawMessage{}
+		}
+		m.Extra[k] = v
+	}
+	return nil
+}
+
+// MarshalJSON encodes m, including the fields in Extra.
+func (m Meta) MarshalJSON() ([]byte, error) {
+	type meta Meta
+	b, err := json.Marshal(meta(m))
+	if err != nil || len(m.Extra) == 0 {
+		return b, err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range m.Extra {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
 }
 
 // Valid validates the contents of a Meta for requires fields.
@@ -26,17 +210,86 @@ func (m Meta) Valid() (bool, error) {
 	if m.Description == "" {
 		return false, errors.New("description cannot be empty")
 	}
+	if _, ok := priorities[m.Priority]; !ok {
+		return false, fmt.Errorf("unknown priority %q", m.Priority)
+	}
+	if !multiArches[m.MultiArch] {
+		return false, fmt.Errorf("unknown multi-arch %q", m.MultiArch)
+	}
+	if m.Changelog != "" {
+		if u, err := url.Parse(m.Changelog); err != nil || !u.IsAbs() {
+			return false, fmt.Errorf("changelog %q is not an absolute url", m.Changelog)
+		}
+	}
+	if m.Remote.Scheme != "" {
+		if _, err := CanonicalURL(m.Remote); err != nil {
+			return false, URLError{Package: m.Name, Version: m.Version, URL: m.Remote.String(), Err: err}
+		}
+	}
 	return true, nil
 }
 
-// Pkg returns the string name the .pkg should have on disk.
+// AnyABI is the ABITag of packages that don't depend on a particular ABI.
+const AnyABI = "any"
+
+// ABIIncompatibilityError is returned when a package built for one ABI is
+// to be installed on a system using another.
+type ABIIncompatibilityError struct {
+	Package Name
+	ABI     string
+	System  string
+}
+
+func (e ABIIncompatibilityError) Error() string {
+	return fmt.Sprintf("%v is built for %v, but this system uses %v", e.Package, e.ABI, e.System)
+}
+
+// CheckABI returns an ABIIncompatibilityError if m can't run on a system
+// using abi. Every package is compatible with a system whose abi is unknown.
+func (m Meta) CheckABI(abi string) error {
+	if abi == "" || m.ABITag == "" || m.ABITag == AnyABI || m.ABITag == abi {
+		return nil
+	}
+	return ABIIncompatibilityError{Package: m.Name, ABI: m.ABITag, System: abi}
+}
+
+// PackageExpiredError is returned when a package is to be installed after
+// its ExpiresAt.
+type PackageExpiredError struct {
+	Name      Name
+	ExpiresAt time.Time
+}
+
+func (e PackageExpiredError) Error() string {
+	return fmt.Sprintf("%v expired on %v and is no longer supported", e.Name, e.ExpiresAt.Format(time.RFC3339))
+}
+
+// CheckExpiry returns a PackageExpiredError if m has expired by now.
+func (m Meta) CheckExpiry(now time.Time) error {
+	if m.ExpiresAt == nil || now.Before(*m.ExpiresAt) {
+		return nil
+	}
+	return PackageExpiredError{Name: m.Name, ExpiresAt: *m.ExpiresAt}
+}
+
+// Pkg returns the string name the .pkg should have on disk. Builds of a
+// MultiArchSame package for different architectures have the same name on
+// their remotes, so on disk the architecture is added, as name-version_arch.pkg.
 func (m Meta) Pkg() string {
+	if m.QualifiedName() != m.BaseName() {
+		return fmt.Sprintf("%s-%s_%s.pkg", m.BaseName(), m.Version, m.Arch)
+	}
 	return fmt.Sprintf("%s-%s.pkg", m.Name, m.Version)
 }
 
-// URL returns the http location of this package.
+// URL returns the location of this package: its http location, or for
+// remotes in an OCI registry, oci://registry/namespace/name:version. OCI
+// tags can't contain the + of semver build metadata, so it is written as _.
 func (m Meta) URL() string {
-	return fmt.Sprintf("%s/%s", m.Remote.String(), m.Pkg())
+	if m.Remote.Scheme == "oci" {
+		return fmt.Sprintf("%s/%s:%s", m.Remote.String(), m.BaseName(), strings.Replace(string(m.Version), "+", "_", -1))
+	}
+	return fmt.Sprintf("%s/%s-%s.pkg", m.Remote.String(), m.BaseName(), m.Version)
 }
 
 func (m Meta) String() string {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -79,7 +80,134 @@ func TestJsonRoundTrip(t *testing.T) {
 	if err := json.NewDecoder(buf).Decode(&a); err != nil {
 		t.Fatalf("decode: %v", err)
 	}
-	if b != a {
+	if !reflect.DeepEqual(a, b) {
 		t.Fatalf("a != b: %v != %v", a, b)
 	}
 }
+
+func TestCheckABI(t *testing.T) {
+	tests := []struct {
+		tag, system string
+		ok          bool
+	}{
+		{"", "", true},
+		{"", "musl", true},
+		{"any", "musl", true},
+		{"glibc", "", true},
+		{"glibc", "glibc", true},
+		{"glibc", "musl", false},
+	}
+	for _, test := range tests {
+		err := Meta{Name: "a", ABITag: test.tag}.CheckABI(test.system)
+		if test.ok {
+			if err != nil {
+				t.Errorf("%q on %q: unexpected error: %v", test.tag, test.system, err)
+			}
+			continue
+		}
+		if _, ok := err.(ABIIncompatibilityError); !ok {
+			t.Errorf("%q on %q: got %v, want an ABIIncompatibilityError", test.tag, test.system, err)
+		}
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	in := `{
+		"name": "heat",
+		"version": "1.1.0",
+		"description": "make heat using cpus",
+		"deps": ["cpu"],
+		"provides": ["warmth"],
+		"recommends": ["blanket"],
+		"restart": {"services": ["furnace"]}
+	}`
+	m := Meta{}
+	if err := json.Unmarshal([]byte(in), &m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if m.Name != "heat" || m.Version != "1.1.0" || !reflect.DeepEqual(m.Deps, []string{"cpu"}) || !reflect.DeepEqual(m.Provides, []string{"warmth"}) {
+		t.Fatalf("known fields not populated: %+v", m)
+	}
+	if got, want := len(m.Extra), 2; got != want {
+		t.Fatalf("extra fields: got %v, want %v", got, want)
+	}
+
+	// as part of an index, and back out again
+	a := Available{}
+	if err := a.Add(m); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	o := Available{}
+	if err := json.Unmarshal(b, &o); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(o["heat"]["1.1.0"].Extra["restart"], &got); err != nil {
+		t.Fatalf("unmarshal restart: %v", err)
+	}
+	want := map[string]interface{}{"services": []interface{}{"furnace"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restart: got %v, want %v", got, want)
+	}
+	if _, ok := o["heat"]["1.1.0"].Extra["recommends"]; !ok {
+		t.Fatalf("recommends lost on round trip")
+	}
+	if got := o["heat"]["1.1.0"].Provides; !reflect.DeepEqual(got, []string{"warmth"}) {
+		t.Fatalf("provides: got %v after round trip, want [warmth]", got)
+	}
+}
+
+func TestStripPath(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"foo-1.2/usr/bin/foo", 0, "foo-1.2/usr/bin/foo"},
+		{"foo-1.2/usr/bin/foo", 1, "usr/bin/foo"},
+		{"foo-1.2/usr/bin/foo", 3, "foo"},
+		{"foo-1.2/usr/bin/foo", 4, ""},
+		{"foo-1.2/", 1, ""},
+	}
+	for _, test := range tests {
+		if got := StripPath(test.name, test.n); got != test.want {
+			t.Errorf("StripPath(%q, %d): got %q, want %q", test.name, test.n, got, test.want)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	tests := []struct {
+		p, min Priority
+		want   bool
+	}{
+		{Required, Standard, true},
+		{Standard, Standard, true},
+		{"", Standard, true},
+		{"", Important, false},
+		{Optional, Standard, false},
+		{Extra, Optional, false},
+		{Extra, Extra, true},
+	}
+	for _, test := range tests {
+		if got := test.p.AtLeast(test.min); got != test.want {
+			t.Errorf("%q at least %q: got %v, want %v", test.p, test.min, got, test.want)
+		}
+	}
+	if _, err := ParsePriority("optional"); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, s := range []string{"", "urgent"} {
+		if _, err := ParsePriority(s); err == nil {
+			t.Fatalf("parsed %q", s)
+		}
+	}
+	m := Meta{Name: "a", Version: "1.0.0", Description: "a", Priority: "urgent"}
+	if _, err := m.Valid(); err == nil {
+		t.Fatalf("unknown priority is valid")
+	}
+}
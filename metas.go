@@ -0,0 +1,171 @@
+package pm
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Named returns the members of ms with any of the given names.
+func (ms Metas) Named(names ...Name) Metas {
+	want := map[Name]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+	return ms.filter(func(m Meta) bool { return want[m.Name] })
+}
+
+// Arch returns the members of ms offered by a remote namespaced by arch a,
+// e.g. "amd64" for packages from https://pm.mcquay.me/darwin/amd64.
+func (ms Metas) Arch(a string) Metas {
+	return ms.filter(func(m Meta) bool {
+		for _, elem := range strings.Split(m.Remote.Path, "/") {
+			if elem == a {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FromRepo returns the members of ms that came from the repository labeled r.
+func (ms Metas) FromRepo(r string) Metas {
+	return ms.filter(func(m Meta) bool { return m.Repository == r })
+}
+
+// Matching returns the members of ms whose version satisfies c.
+func (ms Metas) Matching(c Constraint) Metas {
+	return ms.filter(func(m Meta) bool { return c.Match(m.Version) })
+}
+
+// Newest collapses ms to the highest version of each name, keeping the order
+// in which each name first appears.
+func (ms Metas) Newest() Metas {
+	best := map[Name]int{}
+	r := Metas{}
+	for _, m := range ms {
+		i, ok := best[m.Name]
+		if !ok {
+			best[m.Name] = len(r)
+			r = append(r, m)
+			continue
+		}
+		if CompareVersions(m.Version, r[i].Version) > 0 {
+			r[i] = m
+		}
+	}
+	return r
+}
+
+func (ms Metas) filter(keep func(Meta) bool) Metas {
+	r := Metas{}
+	for _, m := range ms {
+		if keep(m) {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// Constraint restricts the versions of a package, e.g. ">=1.2.0". Versions
+// are ordered the same way as Versions.
+type Constraint struct {
+	op string
+	v  Version
+}
+
+var ops = []string{">=", "<=", ">", "<", "="}
+
+// ParseConstraint parses s, an optional comparison operator (one of >=, <=,
+// >, < or =) followed by a version. A bare version must match exactly, and the
+// empty string matches everything.
+func ParseConstraint(s string) (Constraint, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Constraint{}, nil
+	}
+	op := "="
+	for _, o := range ops {
+		if strings.HasPrefix(s, o) {
+			op, s = o, strings.TrimSpace(s[len(o):])
+			break
+		}
+	}
+	if s == "" {
+		return Constraint{}, errors.Errorf("constraint %q is missing a version", op)
+	}
+	return Constraint{op: op, v: Version(s)}, nil
+}
+
+// Match reports if v satisfies c.
+func (c Constraint) Match(v Version) bool {
+	cmp := CompareVersions(v, c.v)
+	switch c.op {
+	case "":
+		return true
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return v == c.v
+}
+
+func (c Constraint) String() string {
+	if c.op == "" {
+		return "*"
+	}
+	return c.op + string(c.v)
+}
+
+// CompareVersions returns -1, 0 or 1 as a sorts before, the same as, or
+// after b. Runs of digits are compared as numbers and everything else as
+// strings, so that "1.10" comes after "1.9"; a version that is a prefix of
+// another sorts first.
+func CompareVersions(a, b Version) int {
+	as, bs := versionRuns(string(a)), versionRuns(string(b))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		if isDigit(x[0]) && isDigit(y[0]) {
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				if len(x) < len(y) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// versionRuns splits v into alternating runs of digits and non-digits.
+func versionRuns(v string) []string {
+	r := []string{}
+	for i := 0; i < len(v); {
+		j := i + 1
+		for j < len(v) && isDigit(v[j]) == isDigit(v[i]) {
+			j++
+		}
+		r = append(r, v[i:j])
+		i = j
+	}
+	return r
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
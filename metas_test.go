@@ -0,0 +1,172 @@
+package pm
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func labelsOf(ms Metas) []string {
+	r := []string{}
+	for _, m := range ms {
+		r = append(r, string(m.Name)+"@"+string(m.Version))
+	}
+	return r
+}
+
+func testMetas(t *testing.T) Metas {
+	ms := Metas{}
+	for _, s := range []struct {
+		name, version, remote string
+	}{
+		{"a", "1.0.0", "https://pm.mcquay.me/darwin/amd64/stable"},
+		{"a", "1.1.0", "https://pm.mcquay.me/darwin/amd64/testing"},
+		{"b", "2.0.0", "https://pm.mcquay.me/linux/arm64/stable"},
+		{"b", "1.0.0", "https://pm.mcquay.me/linux/arm64/stable"},
+		{"c", "0.1.0", "https://pm.mcquay.me/darwin/amd64/stable"},
+	} {
+		u, err := url.Parse(s.remote)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		ms = append(ms, Meta{Name: Name(s.name), Version: Version(s.version), Remote: *u, Repository: Label(*u)})
+	}
+	return ms
+}
+
+func TestMetasFilters(t *testing.T) {
+	ms := testMetas(t)
+	mustParse := func(s string) Constraint {
+		c, err := ParseConstraint(s)
+		if err != nil {
+			t.Fatalf("parse constraint %q: %v", s, err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		label string
+		got   Metas
+		want  []string
+	}{
+		{"named", ms.Named("a", "c"), []string{"a@1.0.0", "a@1.1.0", "c@0.1.0"}},
+		{"named none", ms.Named(), []string{}},
+		{"arch", ms.Arch("arm64"), []string{"b@2.0.0", "b@1.0.0"}},
+		{"arch partial", ms.Arch("arm"), []string{}},
+		{"repo", ms.FromRepo("testing"), []string{"a@1.1.0"}},
+		{"matching any", ms.Matching(mustParse("")), labelsOf(ms)},
+		{"matching exact", ms.Matching(mustParse("1.0.0")), []string{"a@1.0.0", "b@1.0.0"}},
+		{"matching >=", ms.Matching(mustParse(">= 1.1.0")), []string{"a@1.1.0", "b@2.0.0"}},
+		{"matching <", ms.Matching(mustParse("<1.0.0")), []string{"c@0.1.0"}},
+		{"newest", ms.Newest(), []string{"a@1.1.0", "b@2.0.0", "c@0.1.0"}},
+		{"composed", ms.Arch("amd64").FromRepo("stable").Newest(), []string{"a@1.0.0", "c@0.1.0"}},
+		{"composed matching", ms.Named("b").Matching(mustParse("<2.0.0")).Newest(), []string{"b@1.0.0"}},
+	}
+	for _, test := range tests {
+		if got := labelsOf(test.got); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: got %v, want %v", test.label, got, test.want)
+		}
+	}
+}
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"", "*", false},
+		{"1.0.0", "=1.0.0", false},
+		{"=1.0.0", "=1.0.0", false},
+		{">=1.0.0", ">=1.0.0", false},
+		{"<= 1.0.0", "<=1.0.0", false},
+		{">", "", true},
+	}
+	for _, test := range tests {
+		c, err := ParseConstraint(test.in)
+		if (err != nil) != test.err {
+			t.Fatalf("%q: unexpected error state: %v", test.in, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := c.String(); got != test.want {
+			t.Fatalf("%q: got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b Version
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.9", "1.10", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.01", "1.1", 0},
+		{"1.0", "1.0.1", -1},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+		{"1.0.0b", "1.0.0a", 1},
+	}
+	for _, test := range tests {
+		if got := CompareVersions(test.a, test.b); got != test.want {
+			t.Fatalf("%v vs %v: got %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := CompareVersions(test.b, test.a); got != -test.want {
+			t.Fatalf("%v vs %v: got %v, want %v", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestMultiDigitVersions(t *testing.T) {
+	ms := Metas{}
+	a := Available{}
+	for _, v := range []Version{"1.9.0", "1.10.0", "1.2.0"} {
+		m := Meta{Name: "a", Version: v, Description: "a test pkg"}
+		ms = append(ms, m)
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	if got := labelsOf(ms.Newest()); !reflect.DeepEqual(got, []string{"a@1.10.0"}) {
+		t.Fatalf("newest: got %v", got)
+	}
+	c, err := ParseConstraint(">1.9.0")
+	if err != nil {
+		t.Fatalf("parse constraint: %v", err)
+	}
+	if got := labelsOf(ms.Matching(c)); !reflect.DeepEqual(got, []string{"a@1.10.0"}) {
+		t.Fatalf("matching: got %v", got)
+	}
+
+	in, err := a.Installable([]string{"a"})
+	if err != nil {
+		t.Fatalf("installable: %v", err)
+	}
+	if got := labelsOf(in); !reflect.DeepEqual(got, []string{"a@1.10.0"}) {
+		t.Fatalf("installable: got %v", got)
+	}
+	it := Metas{}
+	for i := a.Iterator(); i.Next(); {
+		it = append(it, i.Value())
+	}
+	got := labelsOf(it)
+	if want := []string{"a@1.2.0", "a@1.9.0", "a@1.10.0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("iterator: got %v, want %v", got, want)
+	}
+
+	i := Installed{"a": ms[0]}
+	if got := labelsOf(i.Upgradable(a)); !reflect.DeepEqual(got, []string{"a@1.10.0"}) {
+		t.Fatalf("upgradable: got %v", got)
+	}
+	up, err := a.UpgradeablePackages(i)
+	if err != nil {
+		t.Fatalf("upgradeable packages: %v", err)
+	}
+	if got := labelsOf(up); !reflect.DeepEqual(got, []string{"a@1.10.0"}) {
+		t.Fatalf("upgradeable packages: got %v", got)
+	}
+}
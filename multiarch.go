@@ -0,0 +1,88 @@
+package pm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MultiArch says whether a package can be installed alongside builds of
+// itself for other architectures, following Debian's model. Packages that
+// don't declare one are MultiArchNo.
+type MultiArch string
+
+// The MultiArch values a package can declare.
+const (
+	// MultiArchNo packages can only be installed for one architecture at a
+	// time.
+	MultiArchNo MultiArch = "no"
+
+	// MultiArchSame packages can be installed for several architectures at
+	// once, e.g. libraries, whose files are kept apart by architecture.
+	// They are known as name:arch in the available and installed dbs; see
+	// Meta.QualifiedName.
+	MultiArchSame MultiArch = "same"
+
+	// MultiArchForeign packages can satisfy the dependencies of packages
+	// built for other architectures, e.g. tools run at build time.
+	MultiArchForeign MultiArch = "foreign"
+
+	// MultiArchAllowed packages are MultiArchNo, but let the packages that
+	// depend on them choose which architecture they need.
+	MultiArchAllowed MultiArch = "allowed"
+)
+
+var multiArches = map[MultiArch]bool{
+	"":               true,
+	MultiArchNo:      true,
+	MultiArchSame:    true,
+	MultiArchForeign: true,
+	MultiArchAllowed: true,
+}
+
+// QualifiedName returns the name m is known by in the available and
+// installed dbs: name:arch for a MultiArchSame package built for a
+// particular architecture, so that its builds for different architectures
+// can be installed side by side, and its Name otherwise.
+func (m Meta) QualifiedName() Name {
+	if m.MultiArch != MultiArchSame || m.Arch == "" || strings.HasSuffix(string(m.Name), ":"+m.Arch) {
+		return m.Name
+	}
+	return Name(fmt.Sprintf("%v:%v", m.Name, m.Arch))
+}
+
+// BaseName returns m's name without the architecture QualifiedName adds.
+func (m Meta) BaseName() Name {
+	if m.MultiArch != MultiArchSame || m.Arch == "" {
+		return m.Name
+	}
+	return Name(strings.TrimSuffix(string(m.Name), ":"+m.Arch))
+}
+
+// CoInstallationError is returned by Installed.CoInstallable for a package
+// that can't be installed alongside Installed, a build of the same package
+// for another architecture.
+type CoInstallationError struct {
+	Package   Name
+	Installed Name
+}
+
+func (e CoInstallationError) Error() string {
+	return fmt.Sprintf("%v can't be installed alongside %v; both must be multi-arch: same", e.Package, e.Installed)
+}
+
+// CoInstallable returns a CoInstallationError if i holds a build of m for
+// another architecture and they can't both be installed, which they can
+// only if both are MultiArchSame. Installing m in place of an installed
+// build for the same architecture is an upgrade, and fine.
+func (i Installed) CoInstallable(m Meta) error {
+	qn, bn := m.QualifiedName(), m.BaseName()
+	for _, im := range i {
+		if im.BaseName() != bn || im.Name == qn {
+			continue
+		}
+		if m.MultiArch != MultiArchSame || im.MultiArch != MultiArchSame {
+			return CoInstallationError{Package: qn, Installed: im.Name}
+		}
+	}
+	return nil
+}
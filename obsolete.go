@@ -0,0 +1,11 @@
+package pm
+
+// Obsolete records that a remote has renamed the package Old to New, e.g.
+// libssl to libopenssl, so that installs of Old can be moved over to New.
+type Obsolete struct {
+	Old Name `json:"old"`
+	New Name `json:"new"`
+
+	// Repository is the label of the remote that published the rename.
+	Repository string `json:"repository,omitempty"`
+}
@@ -0,0 +1,332 @@
+// Package oci fetches pm packages and indexes stored as artifacts in an OCI
+// registry, by way of the OCI distribution API.
+//
+// A remote of the form oci://registry/namespace keeps each package in the
+// repository namespace/<name>, tagged with its version (see pm.Meta.URL),
+// and its available.json and obsoletes.json as namespace/available:latest
+// and namespace/obsoletes:latest. Each artifact's manifest has a single layer,
+// or a layer of type MediaType, holding the file.
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Scheme is the url scheme of remotes hosted in an OCI registry.
+const Scheme = "oci"
+
+// MediaType is the media type of the layer holding a pm artifact, for
+// manifests with more than one layer.
+const MediaType = "application/vnd.mcquay.pm.pkg"
+
+const manifestType = "application/vnd.oci.image.manifest.v1+json"
+
+// ErrNotFound is returned by Fetch when the registry doesn't have the
+// requested artifact.
+var ErrNotFound = errors.New("not found")
+
+// Ref is a parsed reference to an artifact, oci://host/repo:tag.
+type Ref struct {
+	Host string
+	Repo string
+	Tag  string
+}
+
+// Parse parses s, an oci://host/repo:tag reference.
+func Parse(s string) (Ref, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Ref{}, errors.Wrap(err, "parsing url")
+	}
+	if u.Scheme != Scheme {
+		return Ref{}, errors.Errorf("%q is not an %v:// reference", s, Scheme)
+	}
+	p := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(p, ":")
+	if u.Host == "" || i <= 0 || i == len(p)-1 {
+		return Ref{}, errors.Errorf("%q is not of the form %v://registry/repository:tag", s, Scheme)
+	}
+	return Ref{Host: u.Host, Repo: p[:i], Tag: p[i+1:]}, nil
+}
+
+func (r Ref) String() string {
+	return fmt.Sprintf("%v://%v/%v:%v", Scheme, r.Host, r.Repo, r.Tag)
+}
+
+// base returns the url of the registry's API. Registries are reached over
+// https, except on loopback addresses, which are reached over plain http
+// as docker does.
+func (r Ref) base() string {
+	scheme := "https"
+	h := r.Host
+	if hh, _, err := net.SplitHostPort(h); err == nil {
+		h = hh
+	}
+	if ip := net.ParseIP(h); h == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%v://%v/v2/%v", scheme, r.Host, r.Repo)
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type manifest struct {
+	Layers []descriptor `json:"layers"`
+}
+
+// Fetch returns the contents of the artifact at ref, an oci://host/repo:tag
+// reference, along with its length. The contents are checked against the
+// digest in the artifact's manifest as they are read; a mismatch is
+// reported by Read in place of io.EOF.
+//
+// Credentials for the registry are taken from the "auths" of the docker
+// config, $DOCKER_CONFIG/config.json or ~/.docker/config.json, if it has
+// any for the registry's host.
+func Fetch(ref string) (io.ReadCloser, int64, error) {
+	r, err := Parse(ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	c := &client{ref: r, user: credentials(r.Host)}
+
+	resp, err := c.get(r.base()+"/manifests/"+r.Tag, manifestType)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "getting manifest")
+	}
+	m := manifest{}
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "decoding manifest for %v", r)
+	}
+	l, err := layer(m)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "%v", r)
+	}
+	if !strings.HasPrefix(l.Digest, "sha256:") {
+		return nil, 0, errors.Errorf("%v: unsupported digest %q", r, l.Digest)
+	}
+
+	resp, err = c.get(r.base()+"/blobs/"+l.Digest, "")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "getting blob")
+	}
+	return &verifier{
+		rc:     resp.Body,
+		h:      sha256.New(),
+		digest: strings.TrimPrefix(l.Digest, "sha256:"),
+	}, l.Size, nil
+}
+
+// layer picks the layer of m that holds the artifact.
+func layer(m manifest) (descriptor, error) {
+	if len(m.Layers) == 1 {
+		return m.Layers[0], nil
+	}
+	for _, l := range m.Layers {
+		if l.MediaType == MediaType {
+			return l, nil
+		}
+	}
+	return descriptor{}, errors.Errorf("manifest has %d layers, none of type %v", len(m.Layers), MediaType)
+}
+
+// verifier checks what is read from rc against a sha256 digest.
+type verifier struct {
+	rc     io.ReadCloser
+	h      hash.Hash
+	digest string
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); got != v.digest {
+			return n, errors.Errorf("blob digest mismatch: got sha256:%v, want sha256:%v", got, v.digest)
+		}
+	}
+	return n, err
+}
+
+func (v *verifier) Close() error {
+	return v.rc.Close()
+}
+
+// client makes requests to a registry, authenticating when challenged.
+type client struct {
+	ref  Ref
+	user *url.Userinfo
+
+	// auth is the Authorization header to send, once known.
+	auth string
+}
+
+// get requests u, answering a 401's challenge once.
+func (c *client) get(u, accept string) (*http.Response, error) {
+	for try := 0; ; try++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "making request")
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "http get")
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusUnauthorized && try == 0:
+			ch := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := c.authenticate(ch); err != nil {
+				return nil, errors.Wrapf(err, "authenticating to %v", c.ref.Host)
+			}
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrapf(ErrNotFound, "%v", c.ref)
+		}
+		return nil, errors.Errorf("http get %q: %v", u, resp.Status)
+	}
+}
+
+var param = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate works out the Authorization header that answers the
+// WWW-Authenticate challenge ch: basic auth with the user's credentials, or
+// a bearer token from the registry's token service, which is asked for an
+// anonymous token if there are no credentials.
+func (c *client) authenticate(ch string) error {
+	i := strings.Index(ch, " ")
+	if i < 0 {
+		return errors.Errorf("unexpected challenge %q", ch)
+	}
+	scheme := strings.ToLower(ch[:i])
+	if scheme == "basic" {
+		if c.user == nil {
+			return errors.New("registry requires credentials")
+		}
+		p, _ := c.user.Password()
+		c.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user.Username()+":"+p))
+		return nil
+	}
+	if scheme != "bearer" {
+		return errors.Errorf("unsupported auth scheme %q", ch[:i])
+	}
+
+	ps := map[string]string{}
+	for _, m := range param.FindAllStringSubmatch(ch[i+1:], -1) {
+		ps[m[1]] = m[2]
+	}
+	if ps["realm"] == "" {
+		return errors.Errorf("challenge %q has no realm", ch)
+	}
+	u, err := url.Parse(ps["realm"])
+	if err != nil {
+		return errors.Wrap(err, "parsing realm")
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if ps[k] != "" {
+			q.Set(k, ps[k])
+		}
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "making token request")
+	}
+	if c.user != nil {
+		p, _ := c.user.Password()
+		req.SetBasicAuth(c.user.Username(), p)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "getting token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("getting token: %v", resp.Status)
+	}
+	t := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return errors.Wrap(err, "decoding token")
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	c.auth = "Bearer " + t.Token
+	return nil
+}
+
+// credentials returns the user and password the docker config has for host,
+// or nil.
+func credentials(host string) *url.Userinfo {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	f, err := os.Open(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	cfg := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil
+	}
+	for _, k := range []string{host, "https://" + host, "http://" + host} {
+		a, ok := cfg.Auths[k]
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil
+		}
+		sp := strings.SplitN(string(b), ":", 2)
+		if len(sp) != 2 {
+			return nil
+		}
+		return url.UserPassword(sp[0], sp[1])
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// registry is a minimal OCI registry serving artifacts from memory behind
+// token auth.
+type registry struct {
+	srv *httptest.Server
+
+	// artifacts maps repo:tag to contents.
+	artifacts map[string][]byte
+	// corrupt serves contents that don't match their digest.
+	corrupt bool
+}
+
+func newRegistry(t *testing.T, artifacts map[string][]byte) *registry {
+	r := &registry{artifacts: artifacts}
+	blobs := map[string][]byte{}
+	for _, b := range artifacts {
+		s := sha256.Sum256(b)
+		blobs["sha256:"+hex.EncodeToString(s[:])] = b
+	}
+	r.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			if u, p, ok := req.BasicAuth(); !ok || u != "user" || p != "secret" {
+				http.Error(w, "bad credentials", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v/token",service="test",scope="repository:pkgs:pull"`, r.srv.URL))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		p := strings.TrimPrefix(req.URL.Path, "/v2/")
+		if i := strings.LastIndex(p, "/manifests/"); i >= 0 {
+			b, ok := r.artifacts[p[:i]+":"+p[i+len("/manifests/"):]]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			s := sha256.Sum256(b)
+			json.NewEncoder(w).Encode(manifest{Layers: []descriptor{
+				{MediaType: MediaType, Digest: "sha256:" + hex.EncodeToString(s[:]), Size: int64(len(b))},
+			}})
+			return
+		}
+		if i := strings.LastIndex(p, "/blobs/"); i >= 0 {
+			b, ok := blobs[p[i+len("/blobs/"):]]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			if r.corrupt {
+				b = append([]byte{'!'}, b[1:]...)
+			}
+			w.Write(b)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	return r
+}
+
+func dockerConfig(t *testing.T, host string) func() {
+	dir, err := ioutil.TempDir("", "pm-tests-docker-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	cfg := fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, host, auth)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	old := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	return func() {
+		os.Setenv("DOCKER_CONFIG", old)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Ref
+		ok   bool
+	}{
+		{"oci://reg.example.com/pm/stable/a:1.0.0", Ref{"reg.example.com", "pm/stable/a", "1.0.0"}, true},
+		{"oci://localhost:5000/a:latest", Ref{"localhost:5000", "a", "latest"}, true},
+		{"https://reg.example.com/a:1.0.0", Ref{}, false},
+		{"oci://reg.example.com/a", Ref{}, false},
+		{"oci://reg.example.com/a:", Ref{}, false},
+		{"oci:///a:1.0.0", Ref{}, false},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.in)
+		if (err == nil) != test.ok {
+			t.Fatalf("%v: got err %v, want ok %v", test.in, err, test.ok)
+		}
+		if got != test.want {
+			t.Fatalf("%v: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	r := newRegistry(t, map[string][]byte{"pkgs/a:1.0.0": []byte("a package")})
+	defer r.srv.Close()
+	host := strings.TrimPrefix(r.srv.URL, "http://")
+	ref := fmt.Sprintf("oci://%v/pkgs/a:1.0.0", host)
+
+	if _, _, err := Fetch(ref); err == nil {
+		t.Fatalf("fetched without credentials")
+	}
+
+	defer dockerConfig(t, host)()
+	body, n, err := Fetch(ref)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	b, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got, want := string(b), "a package"; got != want || n != int64(len(want)) {
+		t.Fatalf("got %q (%d bytes), want %q", got, n, want)
+	}
+
+	if _, _, err := Fetch(fmt.Sprintf("oci://%v/pkgs/a:2.0.0", host)); errors.Cause(err) != ErrNotFound {
+		t.Fatalf("missing tag: got %v, want ErrNotFound", err)
+	}
+
+	r.corrupt = true
+	body, _, err = Fetch(ref)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer body.Close()
+	if _, err := ioutil.ReadAll(body); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("corrupt blob: got %v, want digest mismatch", err)
+	}
+}
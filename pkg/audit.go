@@ -0,0 +1,264 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/bzip2"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// AuditProblem describes a single issue found with a package in a remote.
+type AuditProblem struct {
+	Name    pm.Name    `json:"name"`
+	Version pm.Version `json:"version"`
+	Problem string     `json:"problem"`
+}
+
+func (ap AuditProblem) String() string {
+	return fmt.Sprintf("%v@%v: %v", ap.Name, ap.Version, ap.Problem)
+}
+
+// AuditReport collects the results of AuditRepo.
+type AuditReport struct {
+	Remote   url.URL        `json:"remote"`
+	Packages int            `json:"packages"`
+	Problems []AuditProblem `json:"problems"`
+}
+
+// OK reports if the audit found no problems.
+func (ar AuditReport) OK() bool {
+	return len(ar.Problems) == 0
+}
+
+// RepoConfig identifies the repo AuditRepo audits.
+type RepoConfig struct {
+	// Root is the pm root whose keyring, and pinned release keys, the
+	// repo's packages are verified against.
+	Root string
+
+	// Remote is the url of the repo, as in pm.Meta.Remote.
+	Remote url.URL
+}
+
+// AuditRepo fetches the index and every package offered by repo and
+// verifies each of them.
+//
+// Problems with individual packages are collected into the returned report
+// rather than causing AuditRepo to fail; a non-nil error is only returned if
+// the audit itself could not be performed.
+func AuditRepo(repo RepoConfig) (*AuditReport, error) {
+	root, u := repo.Root, repo.Remote
+	av, err := db.FetchPinned(root, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching index")
+	}
+
+	tmp, err := ioutil.TempDir("", "pm-audit-")
+	if err != nil {
+		return nil, errors.Wrap(err, "making temp dir")
+	}
+	defer os.RemoveAll(tmp)
+
+	r := &AuditReport{Remote: u}
+	for m := range av.Traverse() {
+		r.Packages++
+		for _, d := range m.Deps {
+			n, v, err := pm.ParseLabel(d)
+			if err == nil {
+				_, err = av.Get(n, v)
+			}
+			if err != nil {
+				r.Problems = append(r.Problems, AuditProblem{Name: m.Name, Version: m.Version, Problem: fmt.Sprintf("dangling dependency %q", d)})
+			}
+		}
+		for _, p := range audit(root, tmp, m) {
+			r.Problems = append(r.Problems, AuditProblem{Name: m.Name, Version: m.Version, Problem: p})
+		}
+	}
+	return r, nil
+}
+
+// audit downloads m into dir and returns a list of problems found with it.
+func audit(root, dir string, m pm.Meta) []string {
+	pn := filepath.Join(dir, m.Pkg())
+	defer os.Remove(pn)
+
+	if err := fetch(m.URL(), pn); err != nil {
+		return []string{err.Error()}
+	}
+
+	r := []string{}
+	if sig, err := getReadCloser(pn, "manifest.sha256.asc"); err != nil {
+		r = append(r, "unsigned")
+	} else {
+		sig.Close()
+		if _, err := verifyManifestIntegrity(root, pn); err != nil {
+			r = append(r, fmt.Sprintf("bad signature: %v", err))
+		}
+	}
+	if err := checkManifest(pn); err != nil {
+		r = append(r, err.Error())
+	}
+	if err := checkBOM(pn); err != nil {
+		r = append(r, err.Error())
+	}
+	if err := checkMeta(pn, m); err != nil {
+		r = append(r, err.Error())
+	}
+	return r
+}
+
+// fetch downloads u into the file fn.
+func fetch(u, fn string) error {
+	resp, err := http.Get(u)
+	if err != nil {
+		return errors.Wrap(err, "http get")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("http get: %v", resp.Status)
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return errors.Wrap(err, "creating")
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "copy after %d bytes", n)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "closing")
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return errors.Errorf("size mismatch: got %d bytes, want %d", n, resp.ContentLength)
+	}
+	return nil
+}
+
+// checkManifest verifies the contents of the .pkg at pn against its
+// manifest.
+func checkManifest(pn string) error {
+	man, err := getReadCloser(pn, "manifest.sha256")
+	if err != nil {
+		return errors.Wrap(err, "getting manifest reader")
+	}
+	cs, err := pm.ParseCS(man)
+	if err != nil {
+		return errors.Wrap(err, "parsing manifest")
+	}
+	if err := man.Close(); err != nil {
+		return errors.Wrap(err, "closing manifest reader")
+	}
+
+	pf, err := os.Open(pn)
+	if err != nil {
+		return errors.Wrap(err, "opening pkg file")
+	}
+	defer pf.Close()
+	tr := tar.NewReader(pf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar traversal")
+		}
+		if hdr.FileInfo().IsDir() || hdr.Name == "manifest.sha256" || hdr.Name == "manifest.sha256.asc" {
+			continue
+		}
+		sha, ok := cs[hdr.Name]
+		if !ok {
+			return ExtraFileError{Filename: hdr.Name}
+		}
+		s := sha256.New()
+		if n, err := io.Copy(s, tr); err != nil {
+			return errors.Wrapf(err, "reading %q after %d bytes", hdr.Name, n)
+		}
+		if sha != fmt.Sprintf("%x", s.Sum(nil)) {
+			return errors.Errorf("%q checksum was incorrect", hdr.Name)
+		}
+		delete(cs, hdr.Name)
+	}
+	if len(cs) > 0 {
+		return errors.Errorf("%d files in manifest but not in tarfile", len(cs))
+	}
+	return nil
+}
+
+// checkBOM verifies the contents of the root.tar.bz2 in the .pkg at pn
+// against the package's bom.
+func checkBOM(pn string) error {
+	bf, err := getReadCloser(pn, "bom.sha256")
+	if err != nil {
+		return errors.Wrap(err, "getting bom reader")
+	}
+	cs, err := pm.ParseCS(bf)
+	if err != nil {
+		return errors.Wrap(err, "parsing bom")
+	}
+	if err := bf.Close(); err != nil {
+		return errors.Wrap(err, "closing bom reader")
+	}
+
+	tbz, err := getReadCloser(pn, "root.tar.bz2")
+	if err != nil {
+		return errors.Wrap(err, "getting root.tar.bz2 reader")
+	}
+	defer tbz.Close()
+	tr := tar.NewReader(bzip2.NewReader(tbz))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "root tar traversal")
+		}
+		if hdr.FileInfo().IsDir() {
+			continue
+		}
+		sha, ok := cs[hdr.Name]
+		if !ok {
+			return errors.Errorf("%q not found in bom", hdr.Name)
+		}
+		s := sha256.New()
+		if n, err := io.Copy(s, tr); err != nil {
+			return errors.Wrapf(err, "reading %q after %d bytes", hdr.Name, n)
+		}
+		if sha != fmt.Sprintf("%x", s.Sum(nil)) {
+			return errors.Errorf("%q bom checksum was incorrect", hdr.Name)
+		}
+	}
+	return nil
+}
+
+// checkMeta verifies that the meta.yaml in the .pkg at pn agrees with the
+// index's record for it.
+func checkMeta(pn string, m pm.Meta) error {
+	mf, err := getReadCloser(pn, "meta.yaml")
+	if err != nil {
+		return errors.Wrap(err, "getting meta.yaml reader")
+	}
+	defer mf.Close()
+	md := pm.Meta{}
+	if err := yaml.NewDecoder(mf).Decode(&md); err != nil {
+		return errors.Wrap(err, "decoding meta.yaml")
+	}
+	if md.Name != m.BaseName() || md.Version != m.Version {
+		return errors.Errorf("metadata mismatch: index has %v@%v, package has %v@%v", m.Name, m.Version, md.Name, md.Version)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mcquay.me/pm"
+)
+
+func TestAuditRepo(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	u, err := url.Parse(fx.srv.URL)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	r, err := AuditRepo(RepoConfig{Root: fx.root, Remote: *u})
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if got, want := r.Packages, 2; got != want {
+		t.Fatalf("packages audited: got %v, want %v", got, want)
+	}
+	if !r.OK() {
+		t.Fatalf("unexpected problems: %v", r.Problems)
+	}
+
+	// serve a's package where b's should be.
+	copyFile(t, filepath.Join(fx.dist, "a-1.0.0.pkg"), filepath.Join(fx.dist, "b-1.0.0.pkg"))
+	r, err = AuditRepo(RepoConfig{Root: fx.root, Remote: *u})
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if got, want := len(r.Problems), 1; got != want {
+		t.Fatalf("problems: got %v, want %v: %v", got, want, r.Problems)
+	}
+	if p := r.Problems[0]; p.Name != "b" || !strings.Contains(p.Problem, "metadata mismatch") {
+		t.Fatalf("unexpected problem: %v", p)
+	}
+
+	fx.setFail("/b-1.0.0.pkg", true)
+	r, err = AuditRepo(RepoConfig{Root: fx.root, Remote: *u})
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if got, want := len(r.Problems), 1; got != want {
+		t.Fatalf("problems: got %v, want %v: %v", got, want, r.Problems)
+	}
+}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// BOM is a bill of materials for a set of installed packages.
+type BOM struct {
+	Packages []BOMPackage `json:"packages"`
+}
+
+// BOMPackage describes a single installed package in a BOM.
+type BOMPackage struct {
+	Name     pm.Name    `json:"name"`
+	Version  pm.Version `json:"version"`
+	Remote   string     `json:"remote"`
+	SignedBy string     `json:"signed_by"`
+
+	// Files maps each installed path to its sha256 checksum.
+	Files map[string]string `json:"files"`
+}
+
+// writeBOM writes a BOM for the installed packages ms to w as JSON.
+func writeBOM(w io.Writer, root string, ms pm.Metas) error {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+
+	b := BOM{Packages: []BOMPackage{}}
+	for _, m := range ms {
+		im, ok := iDB[m.Name]
+		if !ok {
+			return errors.Errorf("%v not installed", m.Name)
+		}
+		b.Packages = append(b.Packages, BOMPackage{
+			Name:     im.Name,
+			Version:  im.Version,
+			Remote:   im.Remote.String(),
+			SignedBy: im.SignedBy,
+			Files:    im.Files,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(&b); err != nil {
+		return errors.Wrap(err, "encoding")
+	}
+	return nil
+}
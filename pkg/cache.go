@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// CacheIsFileError is returned when the cache path is a regular file.
+type CacheIsFileError struct {
+	Path string
+}
+
+func (e CacheIsFileError) Error() string {
+	return fmt.Sprintf("cache path %q is a regular file; remove it or move it out of the way", e.Path)
+}
+
+// CacheSymlinkError is returned when the cache path is a symlink to something
+// other than a directory.
+type CacheSymlinkError struct {
+	Path   string
+	Target string
+}
+
+func (e CacheSymlinkError) Error() string {
+	return fmt.Sprintf("cache path %q is a symlink to %q, which is not a directory", e.Path, e.Target)
+}
+
+// CachePermissionError is returned when the cache path can't be read or
+// written by the current user.
+type CachePermissionError struct {
+	Path string
+	Err  error
+}
+
+func (e CachePermissionError) Error() string {
+	return fmt.Sprintf("cache path %q is not accessible; check its permissions or run pm as a user that can write to it: %v", e.Path, e.Err)
+}
+
+// ensureCache makes sure dir exists and is a usable directory, creating it if
+// needed.
+func ensureCache(dir string) error {
+	fi, err := os.Lstat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			if os.IsPermission(err) {
+				return CachePermissionError{Path: dir, Err: err}
+			}
+			return errors.Wrap(err, "creating non-existent cache dir")
+		}
+		return nil
+	case os.IsPermission(err):
+		return CachePermissionError{Path: dir, Err: err}
+	case err != nil:
+		return errors.Wrap(err, "stat cache dir")
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(dir)
+		if err != nil {
+			return errors.Wrap(err, "reading cache symlink")
+		}
+		fi, err = os.Stat(dir)
+		if os.IsPermission(err) {
+			return CachePermissionError{Path: dir, Err: err}
+		}
+		if err != nil || !fi.IsDir() {
+			return CacheSymlinkError{Path: dir, Target: target}
+		}
+	}
+	if !fi.IsDir() {
+		if fi.Mode().IsRegular() {
+			return CacheIsFileError{Path: dir}
+		}
+		return errors.Errorf("%q is not a directory!", dir)
+	}
+
+	// the cache is written to, so make sure that works before committing
+	// to downloading anything.
+	f, err := ioutil.TempFile(dir, ".pm-probe-")
+	if err != nil {
+		if os.IsPermission(err) {
+			return CachePermissionError{Path: dir, Err: err}
+		}
+		return errors.Wrap(err, "probing cache dir")
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// CacheEntry describes a file in the package cache.
+type CacheEntry struct {
+	Path string
+	Size int64
+	Age  time.Duration
+
+	// Referenced reports if the file is a package listed in the available
+	// db.
+	Referenced bool
+
+	// Installable reports if the file is the version of its package that
+	// Install would currently pick, i.e. the newest available.
+	Installable bool
+}
+
+// CacheReport describes each file in root's package cache.
+func CacheReport(root string) ([]CacheEntry, error) {
+	av, _, err := db.LoadAvailable(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading available db")
+	}
+	pkgs := map[string]pm.Meta{}
+	for m := range av.Traverse() {
+		pkgs[m.Pkg()] = m
+	}
+
+	dir := filepath.Join(root, cache)
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cache dir")
+	}
+
+	now := time.Now()
+	r := []CacheEntry{}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		e := CacheEntry{
+			Path: filepath.Join(dir, fi.Name()),
+			Size: fi.Size(),
+			Age:  now.Sub(fi.ModTime()),
+		}
+		if m, ok := pkgs[fi.Name()]; ok {
+			e.Referenced = true
+			newest, err := av.Get(m.Name, "")
+			e.Installable = err == nil && newest.Version == m.Version
+		}
+		r = append(r, e)
+	}
+	return r, nil
+}
+
+// CachePolicy selects the cache entries CacheClean removes. An entry is
+// removed if it matches any of the enabled criteria.
+type CachePolicy struct {
+	// Unreferenced selects files the available db doesn't list.
+	Unreferenced bool
+
+	// Superseded selects packages for which a newer version is available.
+	Superseded bool
+
+	// OlderThan, if non-zero, selects files older than it.
+	OlderThan time.Duration
+}
+
+func (p CachePolicy) match(e CacheEntry) bool {
+	switch {
+	case p.Unreferenced && !e.Referenced:
+		return true
+	case p.Superseded && e.Referenced && !e.Installable:
+		return true
+	case p.OlderThan > 0 && e.Age > p.OlderThan:
+		return true
+	}
+	return false
+}
+
+// CacheClean removes the entries of report that match policy, and returns
+// the number of bytes freed.
+func CacheClean(report []CacheEntry, policy CachePolicy) (int64, error) {
+	var freed int64
+	for _, e := range report {
+		if !policy.match(e) {
+			continue
+		}
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			return freed, errors.Wrapf(err, "removing %v", e.Path)
+		}
+		log.Printf("removed %v (%v)", e.Path, size(e.Size))
+		freed += e.Size
+	}
+	return freed, nil
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+func TestInstallCachePath(t *testing.T) {
+	tests := []struct {
+		label string
+		setup func(t *testing.T, cacheDir string)
+		check func(err error) bool
+	}{
+		{
+			label: "regular file",
+			setup: func(t *testing.T, cacheDir string) {
+				if err := ioutil.WriteFile(cacheDir, []byte("oops"), 0644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			},
+			check: func(err error) bool {
+				_, ok := errors.Cause(err).(CacheIsFileError)
+				return ok
+			},
+		},
+		{
+			label: "symlink to a file",
+			setup: func(t *testing.T, cacheDir string) {
+				fn := cacheDir + ".file"
+				if err := ioutil.WriteFile(fn, []byte("oops"), 0644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				if err := os.Symlink(fn, cacheDir); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+			},
+			check: func(err error) bool {
+				_, ok := errors.Cause(err).(CacheSymlinkError)
+				return ok
+			},
+		},
+		{
+			label: "dangling symlink",
+			setup: func(t *testing.T, cacheDir string) {
+				if err := os.Symlink(cacheDir+".nope", cacheDir); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+			},
+			check: func(err error) bool {
+				_, ok := errors.Cause(err).(CacheSymlinkError)
+				return ok
+			},
+		},
+		{
+			label: "symlink to a directory",
+			setup: func(t *testing.T, cacheDir string) {
+				d := cacheDir + ".dir"
+				if err := os.MkdirAll(d, 0755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				if err := os.Symlink(d, cacheDir); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+			},
+			check: func(err error) bool { return err == nil },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+			defer del()
+
+			cacheDir := filepath.Join(fx.root, cache)
+			if err := os.MkdirAll(filepath.Dir(cacheDir), 0755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			test.setup(t, cacheDir)
+			if err := Install(fx.root, []string{"a"}, Options{}); !test.check(err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnsureCachePermission(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	dir, err := ioutil.TempDir("", "pm-tests-cache-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ro := filepath.Join(dir, "ro")
+	if err := os.Mkdir(ro, 0500); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	defer os.Chmod(ro, 0700)
+	if _, ok := ensureCache(ro).(CachePermissionError); !ok {
+		t.Fatalf("unwritable cache: got %v, want a CachePermissionError", ensureCache(ro))
+	}
+	if _, ok := ensureCache(filepath.Join(ro, "cache")).(CachePermissionError); !ok {
+		t.Fatalf("uncreatable cache: want a CachePermissionError")
+	}
+
+	locked := filepath.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0000); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	defer os.Chmod(locked, 0700)
+	if _, ok := ensureCache(filepath.Join(locked, "cache")).(CachePermissionError); !ok {
+		t.Fatalf("inaccessible cache: want a CachePermissionError")
+	}
+}
+
+func TestCacheClean(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "a", Version: "2.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	dir := filepath.Join(fx.root, cache)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, n := range []string{"a-1.0.0.pkg", "a-2.0.0.pkg", "b-1.0.0.pkg", "gone-1.0.0.pkg"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(n), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "b-1.0.0.pkg"), old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	report, err := CacheReport(fx.root)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	type state struct{ referenced, installable bool }
+	got := map[string]state{}
+	for _, e := range report {
+		got[filepath.Base(e.Path)] = state{e.Referenced, e.Installable}
+	}
+	want := map[string]state{
+		"a-1.0.0.pkg":    {true, false},
+		"a-2.0.0.pkg":    {true, true},
+		"b-1.0.0.pkg":    {true, true},
+		"gone-1.0.0.pkg": {false, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("report: got %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		policy CachePolicy
+		gone   []string
+	}{
+		{CachePolicy{}, nil},
+		{CachePolicy{Unreferenced: true}, []string{"gone-1.0.0.pkg"}},
+		{CachePolicy{Superseded: true}, []string{"a-1.0.0.pkg"}},
+		{CachePolicy{OlderThan: 30 * 24 * time.Hour}, []string{"b-1.0.0.pkg"}},
+	}
+	for _, test := range tests {
+		freed, err := CacheClean(report, test.policy)
+		if err != nil {
+			t.Fatalf("%+v: clean: %v", test.policy, err)
+		}
+		var want int64
+		for _, n := range test.gone {
+			want += int64(len(n))
+			if fs.Exists(filepath.Join(dir, n)) {
+				t.Errorf("%+v: %v was not removed", test.policy, n)
+			}
+		}
+		if freed != want {
+			t.Errorf("%+v: freed %v bytes, want %v", test.policy, freed, want)
+		}
+		report, err = CacheReport(fx.root)
+		if err != nil {
+			t.Fatalf("report: %v", err)
+		}
+	}
+	if len(report) != 1 || filepath.Base(report[0].Path) != "a-2.0.0.pkg" {
+		t.Fatalf("left behind: %v", report)
+	}
+}
+
+func TestReclaimableSpace(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if err := Remove(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	stale := filepath.Join(fx.root, cache, "gone-1.0.0.pkg")
+	if err := ioutil.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	ab, cb, err := ReclaimableSpace(fx.root)
+	if err != nil {
+		t.Fatalf("reclaimable: %v", err)
+	}
+	// b's bin/x and share/x/README.
+	if ab != 37 {
+		t.Errorf("autoremove: got %v bytes, want 37", ab)
+	}
+	if cb != int64(len("stale")) {
+		t.Errorf("cache: got %v bytes, want %v", cb, len("stale"))
+	}
+	if !fs.Exists(filepath.Join(fx.root, "bin", "b")) || !fs.Exists(stale) {
+		t.Fatalf("ReclaimableSpace removed files")
+	}
+
+	ms, err := Autoremove(fx.root)
+	if err != nil {
+		t.Fatalf("autoremove: %v", err)
+	}
+	if len(ms) != 1 {
+		t.Fatalf("autoremoved %v, want b", ms)
+	}
+	if ab, _, err = ReclaimableSpace(fx.root); err != nil || ab != 0 {
+		t.Fatalf("after autoremove: got %v, %v, want 0 bytes", ab, err)
+	}
+}
@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+// CaseCollisionError is returned for a package with files whose paths differ
+// only in case, e.g. Readme and README, when it is being installed onto a
+// case-insensitive filesystem, where they would overwrite each other.
+type CaseCollisionError struct {
+	Package pm.Name
+	Paths   []string
+}
+
+func (e CaseCollisionError) Error() string {
+	return fmt.Sprintf("%v can't be installed on a case-insensitive filesystem: %v differ only in case", e.Package, strings.Join(e.Paths, " and "))
+}
+
+// caseInsensitive reports if the filesystem dir is on ignores case in file
+// names, by creating a file and looking for it under another case.
+func caseInsensitive(dir string) (bool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, errors.Wrap(err, "mkdir")
+	}
+	f, err := ioutil.TempFile(dir, "pm-Case-Probe-")
+	if err != nil {
+		return false, errors.Wrap(err, "creating probe")
+	}
+	defer os.Remove(f.Name())
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return false, errors.Wrap(err, "stat probe")
+	}
+	lfi, err := os.Stat(filepath.Join(dir, strings.ToLower(filepath.Base(f.Name()))))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "stat probe")
+	}
+	return os.SameFile(fi, lfi), nil
+}
+
+// caseCollisions returns the group of names that are the same but for case
+// whose folded name sorts first, itself sorted, or nil if there are none.
+func caseCollisions(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	folded := map[string][]string{}
+	keys := []string{}
+	for _, n := range sorted {
+		k := strings.ToLower(n)
+		if _, ok := folded[k]; !ok {
+			keys = append(keys, k)
+		}
+		folded[k] = append(folded[k], n)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if c := folded[k]; len(c) > 1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// checkCaseCollisions returns a CaseCollisionError if the files of m, whose
+// metadata has been expanded into ip, would collide under case-folding in
+// dest because its filesystem is case-insensitive.
+func checkCaseCollisions(dest, ip string, m pm.Meta, opts Options) error {
+	bf, err := os.Open(filepath.Join(ip, "bom.sha256"))
+	if err != nil {
+		return errors.Wrap(err, "opening bom")
+	}
+	cs, err := pm.ParseCS(bf)
+	bf.Close()
+	if err != nil {
+		return errors.Wrap(err, "parsing bom")
+	}
+	strip, err := stripCount(ip, m, opts)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for n := range cs {
+		if n = pm.StripPath(n, strip); n != "" {
+			names = append(names, n)
+		}
+	}
+	c := caseCollisions(names)
+	if c == nil {
+		return nil
+	}
+	ci, err := caseInsensitive(dest)
+	if err != nil {
+		return errors.Wrap(err, "checking filesystem case sensitivity")
+	}
+	if !ci {
+		return nil
+	}
+	return CaseCollisionError{Package: m.Name, Paths: c}
+}
@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestCaseCollisions(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"bin/a", "share/a/README"}, nil},
+		{[]string{"share/a/Readme", "bin/a", "share/a/README"}, []string{"share/a/README", "share/a/Readme"}},
+		{[]string{"Share/a", "share/A", "bin/b", "bin/B"}, []string{"bin/B", "bin/b"}},
+	}
+	for _, test := range tests {
+		if got := caseCollisions(test.names); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: got %v, want %v", test.names, got, test.want)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pm-tests-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ci, err := caseInsensitive(dir)
+	if err != nil {
+		t.Fatalf("case insensitive: %v", err)
+	}
+	// linux filesystems are case-sensitive, as tmp is almost always.
+	if runtime.GOOS == "linux" && ci {
+		t.Fatalf("%v reported case-insensitive", dir)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(fis) != 0 {
+		t.Fatalf("probe left behind: %v", fis[0].Name())
+	}
+}
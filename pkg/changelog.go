@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// NoChangelogError is returned by Changelog for a package that has no
+// changelog.
+type NoChangelogError struct {
+	Package pm.Name
+	Version pm.Version
+}
+
+func (e NoChangelogError) Error() string {
+	return fmt.Sprintf("%v@%v has no changelog", e.Package, e.Version)
+}
+
+// Changelog returns the changelog of the package named name at version, or
+// if version is empty, of its latest available version, or of its installed
+// version if none is available.
+//
+// The changelog of an installed version is read from its install dir, where
+// it was put if the package shipped one. Otherwise it is fetched from the
+// url in the package's pm.Meta, or failing that read from the package's
+// .pkg, which is downloaded if it isn't cached.
+func Changelog(root, name, version string) (string, error) {
+	n, v := pm.Name(name), pm.Version(version)
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return "", errors.Wrap(err, "loading installed db")
+	}
+	av, _, err := db.LoadAvailable(root)
+	if err != nil {
+		return "", errors.Wrap(err, "loading available db")
+	}
+	im, ok := iDB[n]
+	if v == "" {
+		if m, err := av.Get(n, ""); err == nil {
+			v = m.Version
+		} else if ok {
+			v = im.Version
+		}
+	}
+
+	if ok && im.Version == v {
+		b, err := ioutil.ReadFile(filepath.Join(root, installed, string(n), "CHANGELOG"))
+		if err == nil {
+			return string(b), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.Wrap(err, "reading changelog")
+		}
+		if im.Changelog == "" {
+			return "", NoChangelogError{Package: n, Version: v}
+		}
+		return fetchChangelog(im.Changelog)
+	}
+
+	m, err := av.Get(n, v)
+	if err != nil {
+		return "", err
+	}
+	if m.Changelog != "" {
+		return fetchChangelog(m.Changelog)
+	}
+	pn := filepath.Join(root, cache, m.Pkg())
+	if !fs.Exists(pn) {
+		tmp, err := ioutil.TempDir("", "pm-changelog-")
+		if err != nil {
+			return "", errors.Wrap(err, "making temp dir")
+		}
+		defer os.RemoveAll(tmp)
+		pn = filepath.Join(tmp, m.Pkg())
+		if _, err := fetchTo(fetchURL, m, pn); err != nil {
+			return "", errors.Wrapf(err, "downloading %v", m.Pkg())
+		}
+	}
+	return pkgChangelog(root, m, pn)
+}
+
+// fetchChangelog returns the changelog at url.
+func fetchChangelog(url string) (string, error) {
+	body, _, err := fetchURL(url)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching changelog")
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", errors.Wrap(err, "reading changelog")
+	}
+	return string(b), nil
+}
+
+// pkgChangelog returns the CHANGELOG in the .pkg at pn, whose metadata is
+// m, once it has been checked against the package's signed manifest.
+func pkgChangelog(root string, m pm.Meta, pn string) (string, error) {
+	if _, err := verifyManifestIntegrity(root, pn); err != nil {
+		return "", errors.Wrap(err, "verifying pkg integrity")
+	}
+	man, err := getReadCloser(pn, "manifest.sha256")
+	if err != nil {
+		return "", errors.Wrap(err, "getting manifest reader")
+	}
+	cs, err := pm.ParseCS(man)
+	man.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "parsing manifest")
+	}
+	want, ok := cs["CHANGELOG"]
+	if !ok {
+		return "", NoChangelogError{Package: m.Name, Version: m.Version}
+	}
+	cl, err := getReadCloser(pn, "CHANGELOG")
+	if err != nil {
+		return "", errors.Wrap(err, "getting changelog reader")
+	}
+	defer cl.Close()
+	b, err := ioutil.ReadAll(cl)
+	if err != nil {
+		return "", errors.Wrap(err, "reading changelog")
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(b)); got != want {
+		return "", errors.New("changelog checksum was incorrect")
+	}
+	return string(b), nil
+}
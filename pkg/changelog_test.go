@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+func TestChangelog(t *testing.T) {
+	const online = "b 1.0.0\n\n* Published online.\n"
+	const shipped = "c 1.0.0\n\n* First release.\n"
+	cls := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, online)
+	}))
+	defer cls.Close()
+
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg", Changelog: cls.URL + "/b"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if _, err := Changelog(fx.root, "a", ""); errors.Cause(err) != (NoChangelogError{Package: "a", Version: "1.0.0"}) {
+		t.Fatalf("a: got %v, want a NoChangelogError", err)
+	}
+	if got, err := Changelog(fx.root, "b", "1.0.0"); err != nil || got != online {
+		t.Fatalf("b: got %q, %v, want %q", got, err, online)
+	}
+	// c's changelog is in its .pkg, which is downloaded to read it.
+	if got, err := Changelog(fx.root, "c", ""); err != nil || got != shipped {
+		t.Fatalf("c: got %q, %v, want %q", got, err, shipped)
+	}
+	if got := fx.hitCount("/c-1.0.0.pkg"); got != 1 {
+		t.Fatalf("c downloaded %d times, want 1", got)
+	}
+
+	// once c is installed its changelog is read from its install dir.
+	if err := Install(fx.root, []string{"c"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	fx.setFail("/c-1.0.0.pkg", true)
+	if got, err := Changelog(fx.root, "c", ""); err != nil || got != shipped {
+		t.Fatalf("installed c: got %q, %v, want %q", got, err, shipped)
+	}
+	if _, err := Changelog(fx.root, "c", "2.0.0"); err == nil {
+		t.Fatalf("got a changelog for a missing version")
+	}
+}
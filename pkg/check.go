@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// Check verifies that the files belonging to the installed pkgs still match
+// the checksums recorded in the installed database at install time. Hard
+// links that still share a file are read once.
+func Check(root string, pkgs []string) error {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+
+	problems := []string{}
+	for _, name := range pkgs {
+		m, ok := iDB[pm.Name(name)]
+		if !ok {
+			return errors.Errorf("%v not installed", name)
+		}
+
+		fns := []string{}
+		for fn := range m.Files {
+			fns = append(fns, fn)
+		}
+		sort.Strings(fns)
+
+		ls := newLinkedSums(root, m.Hardlinks)
+		for _, fn := range fns {
+			sum, err := ls.sum(fn)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", m.Name, err))
+				continue
+			}
+			if sum != m.Files[fn] {
+				problems = append(problems, fmt.Sprintf("%v: %q checksum mismatch", m.Name, fn))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("check failed:\n%v", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func sha256File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	s := sha256.New()
+	if n, err := io.Copy(s, f); err != nil {
+		return "", errors.Wrapf(err, "reading %q after %d bytes", fn, n)
+	}
+	return fmt.Sprintf("%x", s.Sum(nil)), nil
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// ConflictResolution says what to do when a package being installed
+// conflicts with an installed one; see Options.ConflictResolution and
+// pm.Meta.Conflicts.
+type ConflictResolution string
+
+const (
+	// ConflictFail fails the install with a ConflictError. It is the
+	// default.
+	ConflictFail ConflictResolution = "fail"
+	// ConflictRemove removes the installed package as part of the install.
+	ConflictRemove ConflictResolution = "remove"
+	// ConflictSkip leaves the conflicting package, and any packages in the
+	// install that depend on it, out of the install.
+	ConflictSkip ConflictResolution = "skip"
+)
+
+// ParseConflictResolution returns the ConflictResolution named s.
+func ParseConflictResolution(s string) (ConflictResolution, error) {
+	switch c := ConflictResolution(s); c {
+	case ConflictFail, ConflictRemove, ConflictSkip:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown conflict resolution %q", s)
+}
+
+// ConflictError is returned when Package, which is being installed,
+// conflicts with With, which is installed, or is being installed too if
+// Batch is set.
+type ConflictError struct {
+	Package pm.Name
+	With    pm.Name
+	Batch   bool
+}
+
+func (e ConflictError) Error() string {
+	if e.Batch {
+		return fmt.Sprintf("%v conflicts with %v; they can't be installed together", e.Package, e.With)
+	}
+	return fmt.Sprintf("%v conflicts with installed %v", e.Package, e.With)
+}
+
+// conflicts reports if a and b can't be installed alongside each other,
+// according to either of them.
+func conflicts(a, b pm.Meta) bool {
+	if a.Name == b.Name {
+		return false
+	}
+	for _, c := range a.Conflicts {
+		if pm.Name(c) == b.Name {
+			return true
+		}
+	}
+	for _, c := range b.Conflicts {
+		if pm.Name(c) == a.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConflicts applies o.ConflictResolution to the packages in ms that
+// conflict with those installed in root. It returns ms and sels less any
+// skipped packages, and the installed packages to remove, with the reason
+// for each.
+func (o Options) resolveConflicts(root string, ms pm.Metas, sels []pm.Selection) (pm.Metas, []pm.Selection, []pm.Selection, error) {
+	for i, a := range ms {
+		for _, b := range ms[i+1:] {
+			if conflicts(a, b) {
+				return nil, nil, nil, ConflictError{Package: a.Name, With: b.Name, Batch: true}
+			}
+		}
+	}
+
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "loading installed db")
+	}
+	batch := map[pm.Name]bool{}
+	for _, m := range ms {
+		batch[m.Name] = true
+	}
+	// packages in the batch are checked as they will be, above.
+	is := pm.Metas{}
+	for m := range iDB.Traverse() {
+		if !batch[m.Name] {
+			is = append(is, m)
+		}
+	}
+
+	rms, rsels, rm := pm.Metas{}, []pm.Selection{}, []pm.Selection{}
+	removing := map[pm.Name]bool{}
+	skipped := map[pm.Name]bool{}
+	for i, m := range ms {
+		if n, ok := skippedDep(m, skipped); ok {
+			o.warnf(WarnConflictSkipped, m.Name, "not installing %v, which depends on skipped %v", m.Name, n)
+			skipped[m.Name] = true
+			continue
+		}
+		with := pm.Names{}
+		for _, im := range is {
+			if conflicts(m, im) {
+				with = append(with, im.Name)
+			}
+		}
+		if len(with) > 0 {
+			switch o.ConflictResolution {
+			case ConflictSkip:
+				o.warnf(WarnConflictSkipped, m.Name, "not installing %v, which conflicts with %v", m.Name, with[0])
+				skipped[m.Name] = true
+				continue
+			case ConflictRemove:
+				// removing packages needs the user's say so.
+				if !o.AutoApprove && o.Confirm == nil && !o.DryRun && !o.Simulate {
+					return nil, nil, nil, ConflictError{Package: m.Name, With: with[0]}
+				}
+				for _, n := range with {
+					if !removing[n] {
+						removing[n] = true
+						rm = append(rm, pm.Selection{Package: n, Version: iDB[n].Version, Reason: "conflicts with " + string(m.Name)})
+					}
+				}
+			default:
+				return nil, nil, nil, ConflictError{Package: m.Name, With: with[0]}
+			}
+		}
+		rms = append(rms, m)
+		if i < len(sels) {
+			rsels = append(rsels, sels[i])
+		}
+	}
+	return rms, rsels, rm, nil
+}
+
+// skippedDep returns a dependency of m that is in skipped, if any.
+func skippedDep(m pm.Meta, skipped map[pm.Name]bool) (pm.Name, bool) {
+	for _, d := range m.Deps {
+		if n, _, err := pm.ParseLabel(d); err == nil && skipped[n] {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// removeConflicting removes the packages in rm from root, those of them
+// that are still installed; see Options.ConflictResolution.
+func removeConflicting(root string, rm []pm.Selection, stg *staging) error {
+	if len(rm) == 0 {
+		return nil
+	}
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+	for _, s := range rm {
+		m, ok := iDB[s.Package]
+		if !ok {
+			continue
+		}
+		if stg != nil {
+			err = stg.uninstall(m)
+		} else {
+			err = remove(root, m, nil)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "removing conflicting %v", m.Name)
+		}
+	}
+	return nil
+}
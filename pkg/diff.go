@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// RootDiff describes how the packages installed in two roots, a and b,
+// differ; see DiffRoots.
+type RootDiff struct {
+	// OnlyA and OnlyB are the packages installed in only one of the roots.
+	OnlyA pm.Metas
+	OnlyB pm.Metas
+
+	// Versions lists the packages installed in both at different versions.
+	Versions []VersionDiff
+
+	// Files lists the files whose recorded checksums differ between the
+	// roots, for the packages installed in both at the same version.
+	Files []FileDiff
+}
+
+// Empty reports if the roots have the same packages installed, with the
+// same recorded files.
+func (d *RootDiff) Empty() bool {
+	return len(d.OnlyA)+len(d.OnlyB)+len(d.Versions)+len(d.Files) == 0
+}
+
+// VersionDiff is a package installed at version A in one root and B in the
+// other.
+type VersionDiff struct {
+	Name pm.Name
+	A, B pm.Version
+}
+
+// FileDiff is a file of Package whose recorded checksum is A in one root and
+// B in the other. A checksum is empty if the package doesn't have the file in
+// that root, e.g. because it was excluded.
+type FileDiff struct {
+	Package pm.Name
+	File    string
+	A, B    string
+}
+
+// DiffRoots compares the packages installed in roots a and b, as recorded in
+// their installed dbs, e.g. to check a deployed host against the image it
+// was built from. Nothing on disk is read but the dbs, and the boms of
+// packages installed before file checksums were recorded; see Check to
+// compare a root's files with its db.
+func DiffRoots(a, b string) (*RootDiff, error) {
+	aDB, err := db.LoadInstalled(a)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading installed db of %v", a)
+	}
+	bDB, err := db.LoadInstalled(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading installed db of %v", b)
+	}
+
+	as := pm.Metas{}
+	for m := range aDB.Traverse() {
+		as = append(as, m)
+	}
+	r := &RootDiff{}
+	for _, am := range as {
+		bm, ok := bDB[am.Name]
+		switch {
+		case !ok:
+			r.OnlyA = append(r.OnlyA, am)
+		case am.Version != bm.Version:
+			r.Versions = append(r.Versions, VersionDiff{Name: am.Name, A: am.Version, B: bm.Version})
+		default:
+			fds, err := diffFiles(a, b, am, bm)
+			if err != nil {
+				return nil, errors.Wrapf(err, "comparing files of %v", am.Name)
+			}
+			r.Files = append(r.Files, fds...)
+		}
+	}
+	for bm := range bDB.Traverse() {
+		if _, ok := aDB[bm.Name]; !ok {
+			r.OnlyB = append(r.OnlyB, bm)
+		}
+	}
+	return r, nil
+}
+
+// diffFiles compares the recorded files of am, installed in root a, and bm,
+// the same package installed in root b, in name order.
+func diffFiles(a, b string, am, bm pm.Meta) ([]FileDiff, error) {
+	af, err := installedFiles(filepath.Join(a, installed, string(am.Name)), am)
+	if err != nil {
+		return nil, err
+	}
+	bf, err := installedFiles(filepath.Join(b, installed, string(bm.Name)), bm)
+	if err != nil {
+		return nil, err
+	}
+	fns := []string{}
+	for fn := range af {
+		fns = append(fns, fn)
+	}
+	for fn := range bf {
+		if _, ok := af[fn]; !ok {
+			fns = append(fns, fn)
+		}
+	}
+	sort.Strings(fns)
+
+	r := []FileDiff{}
+	for _, fn := range fns {
+		if af[fn] != bf[fn] {
+			r = append(r, FileDiff{Package: am.Name, File: fn, A: af[fn], B: bf[fn]})
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+func TestDiffRoots(t *testing.T) {
+	roots := []string{}
+	for i := 0; i < 2; i++ {
+		root, err := ioutil.TempDir("", "pm-tests-root-")
+		if err != nil {
+			t.Fatalf("tmpdir: %v", err)
+		}
+		defer os.RemoveAll(root)
+		if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		roots = append(roots, root)
+	}
+	install := func(root string, ms ...pm.Meta) {
+		for _, m := range ms {
+			if err := db.AddInstalled(root, m); err != nil {
+				t.Fatalf("add installed: %v", err)
+			}
+		}
+	}
+	common := []pm.Meta{
+		{Name: "a", Version: "1.0.0", Files: map[string]string{"bin/a": "aaa"}},
+		{Name: "c", Version: "1.0.0", Files: map[string]string{"bin/c": "ccc", "etc/c.conf": "conf"}},
+	}
+	install(roots[0], common...)
+	install(roots[1], common...)
+
+	d, err := DiffRoots(roots[0], roots[1])
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if !d.Empty() {
+		t.Fatalf("identical roots differ: %+v", d)
+	}
+
+	install(roots[0], pm.Meta{Name: "b", Version: "1.0.0", Files: map[string]string{"bin/b": "b1"}})
+	install(roots[1], pm.Meta{Name: "b", Version: "1.1.0", Files: map[string]string{"bin/b": "b2"}})
+	install(roots[1], pm.Meta{Name: "c", Version: "1.0.0", Files: map[string]string{"bin/c": "ccc", "etc/c.conf": "edited"}})
+	install(roots[1], pm.Meta{Name: "d", Version: "1.0.0"})
+
+	d, err = DiffRoots(roots[0], roots[1])
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if len(d.OnlyA) != 0 || len(d.OnlyB) != 1 || d.OnlyB[0].Name != "d" {
+		t.Fatalf("got only a %v, only b %v, want only d in b", d.OnlyA, d.OnlyB)
+	}
+	if want := []VersionDiff{{Name: "b", A: "1.0.0", B: "1.1.0"}}; !reflect.DeepEqual(d.Versions, want) {
+		t.Fatalf("got versions %+v, want %+v", d.Versions, want)
+	}
+	if want := []FileDiff{{Package: "c", File: "etc/c.conf", A: "conf", B: "edited"}}; !reflect.DeepEqual(d.Files, want) {
+		t.Fatalf("got files %+v, want %+v", d.Files, want)
+	}
+}
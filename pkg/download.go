@@ -0,0 +1,335 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/oci"
+)
+
+// fetcher returns the body of the resource at url, and its length, or -1 if
+// the length isn't known up front.
+type fetcher func(url string) (io.ReadCloser, int64, error)
+
+func httpFetch(url string) (io.ReadCloser, int64, error) {
+	return clientFetch(http.DefaultClient, url)
+}
+
+func clientFetch(c *http.Client, url string) (io.ReadCloser, int64, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "http get")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, errors.Errorf("http get %q: %v", url, resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// fetchURL fetches url over http, or from an OCI registry if it is an oci://
+// url; see package oci.
+func fetchURL(url string) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(url, oci.Scheme+"://") {
+		return oci.Fetch(url)
+	}
+	return httpFetch(url)
+}
+
+// unixSocketFetcher is fetchURL, but with http requests sent to the proxy
+// listening on the unix socket at path, whatever host their url names. The
+// url is requested as is, so the proxy sees the original Host header.
+func unixSocketFetcher(path string) fetcher {
+	c := unixSocketClient(path)
+	return func(url string) (io.ReadCloser, int64, error) {
+		if strings.HasPrefix(url, oci.Scheme+"://") {
+			return oci.Fetch(url)
+		}
+		return clientFetch(c, url)
+	}
+}
+
+// unixSocketClient returns an http.Client that sends every request to the
+// proxy listening on the unix socket at path.
+func unixSocketClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// httpClient returns the client for plain http requests made on o's behalf,
+// which go through o.UnixSocketProxy if it is set.
+func (o Options) httpClient() *http.Client {
+	if o.UnixSocketProxy != "" {
+		return unixSocketClient(o.UnixSocketProxy)
+	}
+	return http.DefaultClient
+}
+
+// sizeTolerance is how far, as a fraction of the declared size, a package's
+// length may stray from its pm.Meta.DownloadSize.
+const sizeTolerance = 0.01
+
+// checkSize returns an error if length differs from declared, the
+// DownloadSize of a package, by more than sizeTolerance. Either being
+// unknown passes.
+func checkSize(declared, length int64) error {
+	if declared <= 0 || length < 0 {
+		return nil
+	}
+	diff := length - declared
+	if diff < 0 {
+		diff = -diff
+	}
+	if float64(diff) > float64(declared)*sizeTolerance {
+		return errors.Errorf("server reports %d bytes, but the available db says %d; try pulling again", length, declared)
+	}
+	return nil
+}
+
+// maxAttempts is how many times a package is fetched before giving up, when
+// downloads are retried.
+const maxAttempts = 3
+
+// download fetches the packages in ms that aren't already in cache, up to
+// opts.Concurrency at a time; see Options.MaxConcurrency for adaptive mode.
+// What it fetches, and what it finds in the cache, is added to opts.Report.
+//
+// A failed download stops new ones from starting, and the first error is
+// returned once those in flight have finished. Packages from remotes with
+// Options.Mirrors are fetched from the healthiest of them, and the mirrors'
+// stats are added to opts.Report.
+func download(cache string, ms pm.Metas, p *progress, opts Options) error {
+	queue := pm.Metas{}
+	for _, m := range ms {
+		fn := filepath.Join(cache, m.Pkg())
+		if p.Pkgs[m.Name] == done {
+			continue
+		}
+		if p.Pkgs[m.Name] >= downloaded {
+			if fi, err := os.Stat(fn); err == nil {
+				opts.Report.skip(fi.Size())
+				continue
+			}
+		}
+		queue = append(queue, m)
+	}
+
+	fetch := opts.fetch
+	if fetch == nil && opts.UnixSocketProxy != "" {
+		fetch = unixSocketFetcher(opts.UnixSocketProxy)
+	}
+	if fetch == nil {
+		fetch = fetchURL
+	}
+	pool, err := newMirrors(opts.Mirrors)
+	if err != nil {
+		return err
+	}
+	defer func() { opts.Report.mirrored(pool.report()) }()
+	t := newThrottle(opts.Concurrency, opts.MaxConcurrency, time.Now)
+	if report := opts.OnProgress; report != nil && t.max > 1 {
+		var mu sync.Mutex
+		opts.OnProgress = func(p Progress) {
+			mu.Lock()
+			defer mu.Unlock()
+			report(p)
+		}
+	}
+
+	type result struct {
+		m   pm.Meta
+		n   int64
+		err error
+	}
+	results := make(chan result)
+	attempts := map[pm.Name]int{}
+	inflight := 0
+	for {
+		for err == nil && len(queue) > 0 && inflight < t.limit() {
+			if opts.stopped() {
+				err = ErrStopped
+				break
+			}
+			m := queue[0]
+			if err = opts.emit(pm.Download, m); err != nil {
+				break
+			}
+			queue = queue[1:]
+			attempts[m.Name]++
+			inflight++
+			go func() {
+				n, err := pool.fetchTo(opts.metered(fetch, m), m, filepath.Join(cache, m.Pkg()), opts.warner(WarnMirrorFailed, m.Name))
+				results <- result{m, n, err}
+			}()
+		}
+		if inflight == 0 {
+			break
+		}
+
+		r := <-results
+		inflight--
+		t.observe(r.n, r.err)
+		opts.Report.fetched(r.n)
+		if r.err != nil {
+			if t.adaptive() && attempts[r.m.Name] < maxAttempts {
+				queue = append(queue, r.m)
+				continue
+			}
+			if err == nil {
+				err = errors.Wrapf(r.err, "downloading %v", r.m.Name)
+			}
+			continue
+		}
+		if perr := p.mark(r.m, downloaded); perr != nil && err == nil {
+			err = errors.Wrap(perr, "recording progress")
+		}
+	}
+	return err
+}
+
+// fetched records that n bytes were downloaded. A nil *InstallReport records
+// nothing.
+func (r *InstallReport) fetched(n int64) {
+	if r != nil {
+		r.DownloadedBytes += n
+	}
+}
+
+// mirrored records the stats of the mirrors used.
+func (r *InstallReport) mirrored(stats []MirrorStats) {
+	if r != nil {
+		r.Mirrors = append(r.Mirrors, stats...)
+	}
+}
+
+// skip records that a package of n bytes was found in the cache.
+func (r *InstallReport) skip(n int64) {
+	if r != nil {
+		r.SkippedBytes += n
+	}
+}
+
+// fetchTo writes m's .pkg to fn, returning the number of bytes written. A
+// download that ends before the length the server announced is an error, and
+// leaves nothing at fn.
+func fetchTo(fetch fetcher, m pm.Meta, fn string) (int64, error) {
+	url := m.URL()
+	body, length, err := fetch(url)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	if err := checkSize(m.DownloadSize, length); err != nil {
+		return 0, errors.Wrapf(err, "%v", url)
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return 0, errors.Wrap(err, "creating")
+	}
+	n, err := io.Copy(f, body)
+	if (err == nil || err == io.ErrUnexpectedEOF) && length >= 0 && n != length {
+		err = errors.Errorf("short download: got %d of %d bytes", n, length)
+	}
+	if err != nil {
+		f.Close()
+		// a truncated file would only fail later, when it is unpacked.
+		os.Remove(fn)
+		return n, errors.Wrapf(err, "copy %q to disk after %d bytes", url, n)
+	}
+	if err := f.Close(); err != nil {
+		return n, errors.Wrapf(err, "closing %q", fn)
+	}
+	return n, nil
+}
+
+// throttle decides how many downloads run at once. A fixed throttle always
+// allows min. An adaptive one starts at min and hill-climbs toward the
+// concurrency with the best aggregate throughput, up to max: every window of
+// limit() completed downloads it compares throughput with the previous
+// window, keeps moving in the same direction while it improves, turns around
+// when it gets worse, and halves on errors.
+type throttle struct {
+	min, max, n int
+	now         func() time.Time
+
+	dir   int
+	last  float64
+	start time.Time
+	bytes int64
+	done  int
+	errs  int
+}
+
+// threshold is the relative change in throughput between windows that is
+// considered significant.
+const threshold = 0.05
+
+func newThrottle(min, max int, now func() time.Time) *throttle {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &throttle{min: min, max: max, n: min, dir: 1, now: now, start: now()}
+}
+
+func (t *throttle) adaptive() bool {
+	return t.max > t.min
+}
+
+func (t *throttle) limit() int {
+	return t.n
+}
+
+// observe records a finished download of n bytes, or its failure.
+func (t *throttle) observe(n int64, err error) {
+	if !t.adaptive() {
+		return
+	}
+	t.done++
+	t.bytes += n
+	if err != nil {
+		t.errs++
+	}
+	if t.done < t.n {
+		return
+	}
+
+	elapsed := t.now().Sub(t.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(t.bytes) / elapsed
+	}
+	switch {
+	case t.errs > 0:
+		t.n /= 2
+		t.dir = 1
+	case t.last == 0 || rate > t.last*(1+threshold):
+		t.n += t.dir
+	case rate < t.last*(1-threshold):
+		t.dir = -t.dir
+		t.n += t.dir
+	}
+	if t.n < t.min {
+		t.n = t.min
+	}
+	if t.n > t.max {
+		t.n = t.max
+	}
+	t.last = rate
+	t.start, t.bytes, t.done, t.errs = t.now(), 0, 0, 0
+}
@@ -0,0 +1,644 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// link models a server whose aggregate throughput grows linearly with the
+// number of concurrent downloads up to best, and degrades past it.
+type link struct {
+	best    int
+	perConn float64
+}
+
+func (l link) rate(n int) float64 {
+	if n <= l.best {
+		return float64(n) * l.perConn
+	}
+	r := float64(l.best) * l.perConn * (1 - 0.15*float64(n-l.best))
+	if r < l.perConn/10 {
+		r = l.perConn / 10
+	}
+	return r
+}
+
+// clock is a fake time source for driving a throttle.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func TestThrottleAdapts(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		label    string
+		best     int
+		min, max int
+	}{
+		{"fast link", 6, 1, 16},
+		{"slow server", 2, 1, 16},
+		{"capped", 12, 1, 4},
+		{"floored", 1, 3, 8},
+	}
+	for _, test := range tests {
+		l := link{best: test.best, perConn: 1 << 20}
+		c := &clock{t: time.Unix(0, 0)}
+		th := newThrottle(test.min, test.max, c.now)
+
+		// let it find its footing, then watch where it settles.
+		seen := []int{}
+		for i := 0; i < 60; i++ {
+			n := th.limit()
+			c.t = c.t.Add(time.Duration(float64(size*n) / l.rate(n) * float64(time.Second)))
+			for j := 0; j < n; j++ {
+				th.observe(size, nil)
+			}
+			if i >= 30 {
+				seen = append(seen, n)
+			}
+		}
+
+		want := test.best
+		if want > test.max {
+			want = test.max
+		}
+		if want < test.min {
+			want = test.min
+		}
+		for _, n := range seen {
+			if n < want-1 || n > want+1 || n < test.min || n > test.max {
+				t.Fatalf("%v: settled on %v, want %v±1 within [%v, %v]", test.label, seen, want, test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestThrottleErrors(t *testing.T) {
+	c := &clock{t: time.Unix(0, 0)}
+	th := newThrottle(1, 16, c.now)
+	for th.limit() < 8 {
+		c.t = c.t.Add(time.Second)
+		for j, n := 0, th.limit(); j < n; j++ {
+			th.observe(int64(n), nil)
+		}
+	}
+	c.t = c.t.Add(time.Second)
+	for j := 0; j < 8; j++ {
+		var err error
+		if j == 0 {
+			err = errors.New("nope")
+		}
+		th.observe(8, err)
+	}
+	if got, want := th.limit(), 4; got != want {
+		t.Fatalf("after errors: got %v, want %v", got, want)
+	}
+
+	fixed := newThrottle(3, 0, c.now)
+	for j := 0; j < 10; j++ {
+		fixed.observe(0, errors.New("nope"))
+	}
+	if got, want := fixed.limit(), 3; got != want {
+		t.Fatalf("fixed: got %v, want %v", got, want)
+	}
+}
+
+// fakeFetcher serves every url from memory, failing the first fails
+// attempts of each, and records how many fetches ran at once.
+type fakeFetcher struct {
+	fails int
+	delay time.Duration
+
+	mu       sync.Mutex
+	tries    map[string]int
+	inflight int
+	peak     int
+}
+
+func (f *fakeFetcher) fetch(url string) (io.ReadCloser, int64, error) {
+	f.mu.Lock()
+	if f.tries == nil {
+		f.tries = map[string]int{}
+	}
+	f.tries[url]++
+	try := f.tries[url]
+	f.inflight++
+	if f.inflight > f.peak {
+		f.peak = f.inflight
+	}
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	f.inflight--
+	f.mu.Unlock()
+	if try <= f.fails {
+		return nil, 0, errors.New("flaky")
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte(url))), int64(len(url)), nil
+}
+
+func downloadFixture(t testing.TB, n int) (string, pm.Metas, *progress, func()) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	cache := filepath.Join(root, cache)
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	ms := pm.Metas{}
+	names := []string{}
+	for i := 0; i < n; i++ {
+		m := pm.Meta{Name: pm.Name(string(rune('a' + i%26))), Version: pm.Version(string(rune('0' + i/26)))}
+		ms = append(ms, m)
+		names = append(names, string(m.Name))
+	}
+	p, err := loadProgress(root, names, "", Options{}.warner(WarnCorruptProgress, ""))
+	if err != nil {
+		t.Fatalf("load progress: %v", err)
+	}
+	return cache, ms, p, func() { os.RemoveAll(root) }
+}
+
+func TestDownloadConcurrency(t *testing.T) {
+	cache, ms, p, del := downloadFixture(t, 8)
+	defer del()
+
+	f := &fakeFetcher{delay: 20 * time.Millisecond}
+	if err := download(cache, ms, p, Options{Concurrency: 3, fetch: f.fetch}); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if f.peak != 3 {
+		t.Fatalf("peak concurrency: got %v, want 3", f.peak)
+	}
+	for _, m := range ms {
+		if p.Pkgs[m.Name] != downloaded {
+			t.Fatalf("%v: not marked downloaded", m.Name)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(cache, m.Pkg()))
+		if err != nil {
+			t.Fatalf("read %v: %v", m.Pkg(), err)
+		}
+		if got, want := string(b), m.URL(); got != want {
+			t.Fatalf("%v: got %q, want %q", m.Pkg(), got, want)
+		}
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	cache, ms, p, del := downloadFixture(t, 4)
+	defer del()
+
+	f := &fakeFetcher{fails: maxAttempts - 1}
+	if err := download(cache, ms, p, Options{Concurrency: 1, MaxConcurrency: 4, fetch: f.fetch}); err != nil {
+		t.Fatalf("adaptive download: %v", err)
+	}
+
+	cache, ms, p, del = downloadFixture(t, 4)
+	defer del()
+	f = &fakeFetcher{fails: 1}
+	if err := download(cache, ms, p, Options{Concurrency: 2, fetch: f.fetch}); err == nil {
+		t.Fatalf("fixed download succeeded despite failures")
+	}
+}
+
+func TestDownloadReport(t *testing.T) {
+	cache, ms, p, del := downloadFixture(t, 4)
+	defer del()
+
+	f := &fakeFetcher{}
+	r := &InstallReport{}
+	if err := download(cache, ms[:2], p, Options{fetch: f.fetch, Report: r}); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	first := int64(len(ms[0].URL()) + len(ms[1].URL()))
+	if want := (InstallReport{DownloadedBytes: first}); !reflect.DeepEqual(*r, want) {
+		t.Fatalf("got %+v, want %+v", *r, want)
+	}
+
+	r = &InstallReport{}
+	if err := download(cache, ms, p, Options{fetch: f.fetch, Report: r}); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	rest := int64(len(ms[2].URL()) + len(ms[3].URL()))
+	if want := (InstallReport{DownloadedBytes: rest, SkippedBytes: first}); !reflect.DeepEqual(*r, want) {
+		t.Fatalf("got %+v, want %+v", *r, want)
+	}
+}
+
+// BenchmarkDownloadAdaptive downloads from a simulated server whose best
+// concurrency is 6, and reports the concurrency the throttle settled on.
+func BenchmarkDownloadAdaptive(b *testing.B) {
+	l := link{best: 6, perConn: 64 << 20}
+	var mu sync.Mutex
+	inflight := 0
+	const size = 1 << 20
+	fetch := func(url string) (io.ReadCloser, int64, error) {
+		mu.Lock()
+		inflight++
+		n := inflight
+		mu.Unlock()
+		// each download gets an even share of the link's throughput.
+		time.Sleep(time.Duration(float64(size*n) / l.rate(n) * float64(time.Second)))
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		return ioutil.NopCloser(bytes.NewReader(make([]byte, size))), size, nil
+	}
+
+	for i := 0; i < b.N; i++ {
+		cache, ms, p, del := downloadFixture(b, 200)
+		th := 0
+		opts := Options{Concurrency: 1, MaxConcurrency: 16, fetch: fetch}
+		opts.Observer = func(pm.Event) {
+			mu.Lock()
+			if inflight > th {
+				th = inflight
+			}
+			mu.Unlock()
+		}
+		if err := download(cache, ms, p, opts); err != nil {
+			b.Fatalf("download: %v", err)
+		}
+		del()
+		b.ReportMetric(float64(th), "peak-concurrency")
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	tests := []struct {
+		declared, length int64
+		ok               bool
+	}{
+		{0, 1000, true},
+		{1000, -1, true},
+		{1000, 1000, true},
+		{1000, 1010, true},
+		{1000, 990, true},
+		{1000, 1011, false},
+		{1000, 989, false},
+		{1000, 2000, false},
+	}
+	for _, test := range tests {
+		err := checkSize(test.declared, test.length)
+		if got := err == nil; got != test.ok {
+			t.Errorf("declared %v, got %v: ok %v, want %v (%v)", test.declared, test.length, got, test.ok, err)
+		}
+	}
+}
+
+// serveOCI serves the packages and available.json in dist as an OCI
+// registry holding a pm remote under the namespace pm.
+func serveOCI(t *testing.T, dist string) *httptest.Server {
+	read := func(repo, tag string) ([]byte, bool) {
+		fn := filepath.Join(dist, strings.TrimPrefix(repo, "pm/")+"-"+tag+".pkg")
+		if repo == "pm/available" {
+			fn = filepath.Join(dist, "available.json")
+		}
+		b, err := ioutil.ReadFile(fn)
+		return b, err == nil
+	}
+	digest := func(b []byte) string {
+		s := sha256.Sum256(b)
+		return "sha256:" + hex.EncodeToString(s[:])
+	}
+	blobs := map[string][]byte{}
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/v2/")
+		mu.Lock()
+		defer mu.Unlock()
+		if i := strings.LastIndex(p, "/manifests/"); i >= 0 {
+			b, ok := read(p[:i], p[i+len("/manifests/"):])
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			d := digest(b)
+			blobs[d] = b
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"layers": []map[string]interface{}{{"digest": d, "size": len(b)}},
+			})
+			return
+		}
+		if i := strings.LastIndex(p, "/blobs/"); i >= 0 {
+			b, ok := blobs[p[i+len("/blobs/"):]]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(b)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+func TestInstallFromOCI(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+	reg := serveOCI(t, fx.dist)
+	defer reg.Close()
+
+	if err := db.RemoveRemotes(fx.root, []string{fx.srv.URL}); err != nil {
+		t.Fatalf("remove remote: %v", err)
+	}
+	remote := "oci://" + strings.TrimPrefix(reg.URL, "http://") + "/pm"
+	if err := db.AddRemotes(fx.root, []string{remote}); err != nil {
+		t.Fatalf("add remote: %v", err)
+	}
+	if err := db.Pull(fx.root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	m := streamMeta(t, fx, "a")
+	if got, want := m.URL(), remote+"/a:1.0.0"; got != want {
+		t.Fatalf("url: got %v, want %v", got, want)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if !fs.Exists(filepath.Join(fx.root, "bin", "a")) {
+		t.Fatalf("bin/a not installed")
+	}
+	if got := fx.hitCount("/a-1.0.0.pkg"); got != 0 {
+		t.Fatalf("fetched over http %d times", got)
+	}
+}
+
+func TestFetchShort(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n0123456789")
+		buf.Flush()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	cache, ms, _, del := downloadFixture(t, 1)
+	defer del()
+	m := ms[0]
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	m.Remote = *u
+	fn := filepath.Join(cache, m.Pkg())
+
+	if _, err := fetchTo(httpFetch, m, fn); err == nil || !strings.Contains(err.Error(), "short download") {
+		t.Fatalf("got %v, want a short download error", err)
+	}
+	if fs.Exists(fn) {
+		t.Fatalf("truncated file left behind")
+	}
+
+	// a fetcher that hands back fewer bytes than it promised, without error.
+	short := func(string) (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(strings.NewReader("0123456789")), 100, nil
+	}
+	if _, err := fetchTo(short, m, fn); err == nil || !strings.Contains(err.Error(), "short download") {
+		t.Fatalf("got %v, want a short download error", err)
+	}
+	if fs.Exists(fn) {
+		t.Fatalf("truncated file left behind")
+	}
+}
+
+// zeros yields n zero bytes, chunk at a time.
+type zeros struct {
+	n, chunk int64
+}
+
+func (z *zeros) Read(b []byte) (int, error) {
+	if z.n == 0 {
+		return 0, io.EOF
+	}
+	k := z.chunk
+	if k > z.n {
+		k = z.n
+	}
+	if k > int64(len(b)) {
+		k = int64(len(b))
+	}
+	z.n -= k
+	return int(k), nil
+}
+
+func TestMeter(t *testing.T) {
+	const size = 1 << 30
+	tests := []struct {
+		label string
+		bytes int64
+		max   int
+	}{
+		// each read takes a microsecond, so the 1GB transfer takes about
+		// a quarter of a second, and is reported every 100ms.
+		{"interval", 0, 3 + 1},
+		{"bytes", 1 << 28, 4 + 1},
+	}
+	for _, test := range tests {
+		clock := time.Unix(0, 0)
+		now := func() time.Time {
+			clock = clock.Add(time.Microsecond)
+			return clock
+		}
+		ps := []Progress{}
+		m := newMeter(
+			ioutil.NopCloser(&zeros{n: size, chunk: 4096}),
+			Progress{Name: "big", Version: "1.0.0", Total: size},
+			100*time.Millisecond, test.bytes,
+			func(p Progress) { ps = append(ps, p) },
+			now,
+		)
+		if n, err := io.CopyBuffer(ioutil.Discard, m, make([]byte, 4096)); err != nil || n != size {
+			t.Fatalf("%v: copy: %v, %v", test.label, n, err)
+		}
+		if len(ps) < 2 || len(ps) > test.max {
+			t.Fatalf("%v: got %d updates, want 2 to %d", test.label, len(ps), test.max)
+		}
+		if last := ps[len(ps)-1]; !last.Done || last.Bytes != size {
+			t.Fatalf("%v: last update %+v, want all %d bytes done", test.label, last, size)
+		}
+		for _, p := range ps[:len(ps)-1] {
+			if p.Done {
+				t.Fatalf("%v: update %+v done early", test.label, p)
+			}
+		}
+	}
+}
+
+func TestInstallProgress(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	ps := []Progress{}
+	if err := Install(fx.root, []string{"a"}, Options{OnProgress: func(p Progress) { ps = append(ps, p) }}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(fx.dist, "a-1.0.0.pkg"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if len(ps) == 0 {
+		t.Fatalf("no progress reported")
+	}
+	last := ps[len(ps)-1]
+	if want := (Progress{Name: "a", Version: "1.0.0", Bytes: fi.Size(), Total: fi.Size(), Done: true}); last != want {
+		t.Fatalf("got %+v, want %+v", last, want)
+	}
+}
+
+func TestInstallProgressConcurrent(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	// unguarded, so that the race detector catches concurrent calls.
+	done := map[pm.Name]bool{}
+	var active, overlaps int32
+	onProgress := func(p Progress) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(time.Millisecond)
+		done[p.Name] = p.Done
+		atomic.AddInt32(&active, -1)
+	}
+	opts := Options{Concurrency: 3, OnProgress: onProgress, ProgressBytes: 64}
+	if err := Install(fx.root, []string{"a", "b", "c"}, opts); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Fatalf("OnProgress called concurrently %v times", n)
+	}
+	if want := map[pm.Name]bool{"a": true, "b": true, "c": true}; !reflect.DeepEqual(done, want) {
+		t.Fatalf("done: got %v, want %v", done, want)
+	}
+}
+
+func TestInstallVerifyProgress(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	ps := []VerifyProgress{}
+	if err := Install(fx.root, []string{"a"}, Options{OnVerifyProgress: func(p VerifyProgress) { ps = append(ps, p) }}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if len(ps) == 0 {
+		t.Fatalf("no progress reported")
+	}
+	files := map[string]bool{}
+	n := int64(0)
+	for _, p := range ps[:len(ps)-1] {
+		if p.Done {
+			t.Fatalf("update %+v done early", p)
+		}
+		if p.Bytes < n || p.FileBytes > p.FileTotal {
+			t.Fatalf("update %+v out of order", p)
+		}
+		n = p.Bytes
+		files[p.File] = true
+	}
+	if !files["root.tar.bz2"] || !files["meta.yaml"] {
+		t.Fatalf("got updates for %v, want root.tar.bz2 and meta.yaml", files)
+	}
+	last := ps[len(ps)-1]
+	if !last.Done || last.Name != "a" || last.Bytes != last.Total || last.Total == 0 {
+		t.Fatalf("last update %+v, want all of a done", last)
+	}
+}
+
+// unixProxy serves fx's packages through a proxy listening on a unix socket.
+// It returns the socket's path, a function reporting the host and path of
+// each request the proxy saw, and one that stops the proxy.
+func unixProxy(t *testing.T, fx *fixture) (string, func() []string, func()) {
+	dir, err := ioutil.TempDir("", "pm-tests-sock-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	sock := filepath.Join(dir, "proxy.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	mu := sync.Mutex{}
+	seen := []string{}
+	proxy := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Host+r.URL.Path)
+		mu.Unlock()
+		fx.srv.Config.Handler.ServeHTTP(w, r)
+	})}
+	go proxy.Serve(l)
+
+	saw := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, seen...)
+	}
+	return sock, saw, func() {
+		proxy.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInstallUnixSocketProxy(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+	sock, seen, stop := unixProxy(t, fx)
+	defer stop()
+
+	if err := Install(fx.root, []string{"a"}, Options{UnixSocketProxy: sock}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	u, err := url.Parse(fx.srv.URL)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got, want := seen(), []string{u.Host + "/a-1.0.0.pkg"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("proxy saw %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"mcquay.me/pm"
+)
+
+var (
+	notIdent = regexp.MustCompile(`[^A-Z0-9_]`)
+	bareWord = regexp.MustCompile(`^[A-Za-z0-9._+:~-]*$`)
+)
+
+// envName returns the shell variable that holds the version of package n:
+// its name, upper-cased, with anything that can't appear in a variable name
+// replaced by _, and suffixed with _VERSION.
+func envName(n pm.Name) string {
+	r := notIdent.ReplaceAllString(strings.ToUpper(string(n)), "_")
+	if r != "" && r[0] >= '0' && r[0] <= '9' {
+		r = "_" + r
+	}
+	return r + "_VERSION"
+}
+
+// writeEnv writes a line assigning the version of each of ms to a shell
+// variable named by envName, for scripts to source.
+func writeEnv(w io.Writer, ms pm.Metas) error {
+	for _, m := range ms {
+		v := string(m.Version)
+		if !bareWord.MatchString(v) {
+			v = "'" + strings.Replace(v, "'", `'\''`, -1) + "'"
+		}
+		if _, err := fmt.Fprintf(w, "%v=%v\n", envName(m.Name), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
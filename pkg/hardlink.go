@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// hardLink makes fn a hard link to src, replacing whatever is at fn.
+func hardLink(src, fn string) error {
+	dir, base := filepath.Split(fn)
+	tmp := filepath.Join(dir, "."+base+".pm-link")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing stale link")
+	}
+	if err := os.Link(src, tmp); err != nil {
+		return errors.Wrap(err, "link")
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "rename into place")
+	}
+	// renaming over another link to the same file does nothing.
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing temp link")
+	}
+	return nil
+}
+
+// linked reports if fn, relative to root, is still the same file as the
+// one it was installed as a hard link to, according to links; see
+// pm.Meta.Hardlinks. It returns that file if so.
+func linked(root, fn string, links map[string]string) (string, bool) {
+	target, ok := links[fn]
+	if !ok {
+		return "", false
+	}
+	a, err := os.Lstat(filepath.Join(root, fn))
+	if err != nil {
+		return "", false
+	}
+	b, err := os.Lstat(filepath.Join(root, target))
+	if err != nil {
+		return "", false
+	}
+	return target, os.SameFile(a, b)
+}
+
+// linkedSums checksums files under root, reading each group of hard links
+// once.
+type linkedSums struct {
+	root  string
+	links map[string]string
+	sums  map[string]string
+}
+
+func newLinkedSums(root string, links map[string]string) *linkedSums {
+	return &linkedSums{root: root, links: links, sums: map[string]string{}}
+}
+
+// sum returns the sha256 of fn, relative to root.
+func (ls *linkedSums) sum(fn string) (string, error) {
+	if target, ok := linked(ls.root, fn, ls.links); ok {
+		fn = target
+	}
+	if sum, ok := ls.sums[fn]; ok {
+		return sum, nil
+	}
+	sum, err := sha256File(filepath.Join(ls.root, fn))
+	if err != nil {
+		return "", err
+	}
+	ls.sums[fn] = sum
+	return sum, nil
+}
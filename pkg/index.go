@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/oci"
+)
+
+// indexSuffix is appended to a .pkg's url for that of its offset index; see
+// writeIndex.
+const indexSuffix = ".idx"
+
+// span is where an entry's contents lie within a .pkg.
+type span struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeIndex writes the offset index of a .pkg to fn: the span of each of its
+// crypto entries, as json. Published alongside the .pkg, it lets Manifest
+// fetch just the manifest and its signature with a single Range request.
+func writeIndex(fn string, idx map[string]span) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(idx); err != nil {
+		f.Close()
+		return errors.Wrap(err, "encoding offset index")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close offset index")
+	}
+	return nil
+}
+
+// Manifest returns the manifest of the package m, fetched from its remote and
+// verified against the keyring in root and the SignaturePolicy opts holds it
+// to, without downloading the whole package. This is enough to decide whether
+// the package is worth fetching, and what it should contain.
+//
+// If the remote publishes an offset index for the package only the bytes of
+// the manifest and its signature are requested. Otherwise the .pkg is read
+// from the start until both have arrived.
+func Manifest(root string, m pm.Meta, opts Options) (map[string]string, error) {
+	if m.Remote.Scheme == oci.Scheme {
+		return nil, errors.Errorf("%v: can't fetch the manifest alone from an oci registry", m.Name)
+	}
+	man, asc, err := fetchIndexed(m.URL())
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching manifest by offset index")
+	}
+	if man == nil {
+		if man, asc, err = fetchLeading(m, opts); err != nil {
+			return nil, errors.Wrap(err, "fetching manifest")
+		}
+	}
+	if _, err := opts.verifyManifestSignature(root, man, asc, m, opts.warner); err != nil {
+		return nil, errors.Wrap(err, "verifying pkg integrity")
+	}
+	cs, err := pm.ParseCS(bytes.NewReader(man))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing manifest")
+	}
+	return cs, nil
+}
+
+// fetchIndexed fetches the manifest and signature of the .pkg at u by way of
+// its offset index. It returns nil, nil, nil if there isn't one.
+func fetchIndexed(u string) ([]byte, []byte, error) {
+	resp, err := http.Get(u + indexSuffix)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "http get")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("http get %q: %v", u+indexSuffix, resp.Status)
+	}
+	idx := map[string]span{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifest)).Decode(&idx); err != nil {
+		return nil, nil, errors.Wrap(err, "decoding offset index")
+	}
+	ms, ok := idx["manifest.sha256"]
+	if !ok {
+		return nil, nil, errors.New("offset index has no manifest")
+	}
+	as, ok := idx["manifest.sha256.asc"]
+	if !ok {
+		return nil, nil, errors.New("offset index has no manifest signature")
+	}
+	for _, s := range []span{ms, as} {
+		if s.Offset < 0 || s.Length < 0 || s.Length > maxManifest {
+			return nil, nil, errors.Errorf("bad span in offset index: %+v", s)
+		}
+	}
+
+	// the two are adjacent in packages built by Create, so a single
+	// request covering both costs next to nothing extra.
+	start, end := ms.Offset, ms.Offset+ms.Length
+	if as.Offset < start {
+		start = as.Offset
+	}
+	if e := as.Offset + as.Length; e > end {
+		end = e
+	}
+	if end-start > 2*maxManifest {
+		return nil, nil, errors.New("manifest and signature are too far apart in offset index")
+	}
+	b, err := fetchRange(u, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b[ms.Offset-start : ms.Offset-start+ms.Length], b[as.Offset-start : as.Offset-start+as.Length], nil
+}
+
+// fetchRange fetches bytes [start, end) of the resource at u.
+func fetchRange(u string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "making request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "http get")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.Errorf("http get %q: %v", u, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading range")
+	}
+	if int64(len(b)) != end-start {
+		return nil, errors.Errorf("got %d bytes of %q, want %d", len(b), u, end-start)
+	}
+	return b, nil
+}
+
+// fetchLeading reads the .pkg of m from its start until its manifest and
+// signature have arrived, and returns them.
+func fetchLeading(m pm.Meta, opts Options) ([]byte, []byte, error) {
+	r := &resumingReader{
+		url:     m.URL(),
+		size:    m.DownloadSize,
+		retries: streamRetries,
+		client:  opts.httpClient(),
+		warnf:   opts.warner(WarnResumed, m.Name),
+	}
+	defer r.Close()
+	var man, asc []byte
+	tr := tar.NewReader(r)
+	for man == nil || asc == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil, errors.New("manifest not found in pkg")
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "tar traversal")
+		}
+		switch hdr.Name {
+		case "manifest.sha256":
+			if man, err = ioutil.ReadAll(io.LimitReader(tr, maxManifest)); err != nil {
+				return nil, nil, errors.Wrap(err, "reading manifest")
+			}
+		case "manifest.sha256.asc":
+			if asc, err = ioutil.ReadAll(io.LimitReader(tr, maxManifest)); err != nil {
+				return nil, nil, errors.Wrap(err, "reading manifest signature")
+			}
+		}
+	}
+	return man, asc, nil
+}
@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mcquay.me/pm"
+)
+
+func TestManifest(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	m := streamMeta(t, fx, "a")
+	pn := filepath.Join(fx.dist, "a-1.0.0.pkg")
+	ib, err := ioutil.ReadFile(pn + indexSuffix)
+	if err != nil {
+		t.Fatalf("read offset index: %v", err)
+	}
+	for _, indexed := range []bool{true, false} {
+		if !indexed {
+			if err := os.Remove(pn + indexSuffix); err != nil {
+				t.Fatalf("remove offset index: %v", err)
+			}
+		}
+		cs, err := Manifest(fx.root, m, Options{})
+		if err != nil {
+			t.Fatalf("indexed %v: manifest: %v", indexed, err)
+		}
+		for _, fn := range []string{"bom.sha256", "meta.yaml", "root.tar.bz2"} {
+			if _, ok := cs[fn]; !ok {
+				t.Fatalf("indexed %v: %v missing from manifest: %v", indexed, fn, cs)
+			}
+		}
+	}
+	if got, want := fx.hitCount("/a-1.0.0.pkg"+indexSuffix), 2; got != want {
+		t.Fatalf("offset index requests: got %v, want %v", got, want)
+	}
+	if got, want := fx.hitCount("/a-1.0.0.pkg"), 2; got != want {
+		t.Fatalf("pkg requests: got %v, want %v", got, want)
+	}
+
+	// the signature is held to the SignaturePolicy of its remote, however
+	// the remote is given.
+	opts := Options{
+		SignaturePolicies: map[string]SignaturePolicy{
+			m.Remote.String() + "/": {Algorithms: []string{"ECDSA"}},
+		},
+	}
+	if _, err := Manifest(fx.root, m, opts); err == nil {
+		t.Fatalf("manifest verified against a policy its signature breaks")
+	}
+
+	// a manifest that doesn't match its signature is caught from the
+	// indexed bytes alone.
+	if err := ioutil.WriteFile(pn+indexSuffix, ib, 0644); err != nil {
+		t.Fatalf("write offset index: %v", err)
+	}
+	idx := map[string]span{}
+	if err := json.Unmarshal(ib, &idx); err != nil {
+		t.Fatalf("decode offset index: %v", err)
+	}
+	b, err := ioutil.ReadFile(pn)
+	if err != nil {
+		t.Fatalf("read pkg: %v", err)
+	}
+	b[idx["manifest.sha256"].Offset] ^= 0xff
+	if err := ioutil.WriteFile(pn, b, 0644); err != nil {
+		t.Fatalf("write pkg: %v", err)
+	}
+	if _, err := Manifest(fx.root, m, Options{}); err == nil {
+		t.Fatalf("tampered manifest verified")
+	}
+}
@@ -4,149 +4,1099 @@ import (
 	"archive/tar"
 	"bufio"
 	"compress/bzip2"
+	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"mcquay.me/fs"
 	"mcquay.me/pm"
 	"mcquay.me/pm/db"
 	"mcquay.me/pm/keyring"
+	"mcquay.me/pm/oci"
+	"mcquay.me/pm/plugin"
 )
 
 const cache = "var/cache/pm"
 const installed = "var/lib/pm/installed"
 
-// Install fetches and installs pkgs from appropriate remotes.
-func Install(root string, pkgs []string) error {
-	av, err := db.LoadAvailable(root)
+// Options control the behavior of Install.
+type Options struct {
+	// NoDeps installs only the requested packages, skipping dependency
+	// resolution entirely.
+	NoDeps bool
+
+	// Observer, if set, is called as each package moves through each
+	// pm.Phase of the install.
+	Observer func(pm.Event)
+
+	// Hooks are called after Observer at each of the same points; unlike
+	// Observer, they can abort the install by returning an error. See
+	// plugin.Load.
+	Hooks []plugin.Hook
+
+	// OnProgress, if set, is called as each package downloads. Updates are
+	// coalesced: it is called once ProgressInterval (100ms if unset) has
+	// passed since the last update, or once ProgressBytes more have arrived
+	// if that is set, and always when a download completes. It is never
+	// called for two packages at once.
+	OnProgress       func(Progress)
+	ProgressInterval time.Duration
+	ProgressBytes    int64
+
+	// OnVerifyProgress, if set, is called as each package's contents are
+	// checked against its manifest, which can take a while for a large
+	// package. Updates are coalesced as for OnProgress.
+	OnVerifyProgress func(VerifyProgress)
+
+	// ValidatorFunc, if set, is called with the path of each package's
+	// .pkg once its contents have been verified against its signed
+	// manifest, and before anything is extracted, so that other tools,
+	// such as security scanners or license checkers, can inspect it. An
+	// error from it aborts the install. As the validator needs the .pkg,
+	// StreamInstall downloads it into the cache when this is set.
+	ValidatorFunc func(pkgPath string, m pm.Meta) error
+
+	// UnixSocketProxy, if set, is the path of a unix socket on which an
+	// http proxy, such as a local package cache, listens. Packages are
+	// downloaded through it rather than from their remotes directly.
+	// Packages in OCI registries are still fetched directly.
+	UnixSocketProxy string
+
+	// Mirrors maps the url of a remote, in any form pm.CanonicalURL reduces
+	// to that of pm.Meta.Remote, to those of mirrors serving the same
+	// packages. Each package is fetched from whichever of the remote and its
+	// mirrors has done best so far in the run, falling back to the others if
+	// that fails; their stats are added to Report. Packages are verified the
+	// same wherever they came from.
+	Mirrors map[string][]string
+
+	// Report, if set, is filled in with what the Install did as it goes.
+	Report *InstallReport
+
+	// Confirm, if set, is shown the Plan before anything is downloaded;
+	// Install is cancelled unless it returns true. It is not consulted when
+	// AutoApprove is set.
+	Confirm     func(Plan) bool
+	AutoApprove bool
+
+	// DryRun stops Install once it has worked out its Plan, before anything
+	// is downloaded, and writes the Plan to PlanWriter if set. Simulate is
+	// the same thing under apt's name for it; setting either is enough.
+	DryRun     bool
+	Simulate   bool
+	PlanWriter io.Writer
+
+	// MaxClockSkew is how far into the future a package's signature may be
+	// dated before it is rejected; DefaultMaxClockSkew is used if unset.
+	MaxClockSkew time.Duration
+
+	// Stop, if set, asks Install to stop once it is finished with the package
+	// it is working on when Stop is closed. A stopped Install returns
+	// ErrStopped and can be resumed by running it again.
+	Stop <-chan struct{}
+
+	// Concurrency is how many packages are downloaded at once; 1 if unset.
+	// If MaxConcurrency is greater, downloads start at Concurrency and
+	// adapt between the two: parallelism grows while aggregate throughput
+	// improves and shrinks when it drops or downloads start failing.
+	// Failed downloads are retried in adaptive mode.
+	Concurrency    int
+	MaxConcurrency int
+
+	// VerifyConcurrency is how many packages a StagedInstall verifies at
+	// once; runtime.NumCPU() if unset. Each package is still read start to
+	// finish by itself. OnVerifyProgress is never called for two packages
+	// at once.
+	VerifyConcurrency int
+
+	// BOM, if set, receives a bill of materials describing everything
+	// installed once Install completes successfully.
+	BOM io.Writer
+
+	// EnvOutput, if set, receives a line such as FOO_VERSION=1.2.3 for each
+	// package installed, once Install completes successfully, for scripts
+	// to source.
+	EnvOutput io.Writer
+
+	// TargetDir, if set, extracts packages into TargetDir rather than root.
+	// Packages are verified as usual, but install scripts are not run and
+	// nothing is recorded in the installed database.
+	TargetDir string
+
+	// ExcludePatterns lists filepath.Match patterns for files that should
+	// not be extracted. A pattern that matches a directory excludes
+	// everything below it. Excluded files are not checksummed, and are
+	// recorded as excluded in the installed database.
+	ExcludePatterns []string
+
+	// StripComponents removes this many leading path components from each
+	// file in a package, like tar's --strip-components; entries with no
+	// more components than that are skipped. If unset, a single leading
+	// <name>-<version>/ directory shared by every file is stripped.
+	StripComponents int
+
+	// StripDebug runs StripBin, or strip if unset, with --strip-debug on
+	// every ELF binary a package installs, to save space on small systems.
+	// The stripped file's checksum is what is recorded, so Check verifies
+	// the file as stripped.
+	StripDebug bool
+	StripBin   string
+
+	// AllowExtraFiles ignores, with a warning, files in a .pkg that its
+	// signed manifest doesn't list, instead of rejecting the package with
+	// an ExtraFileError. The files are not installed.
+	AllowExtraFiles bool
+
+	// Umask clears these permission bits from the mode of every file and
+	// directory a package installs, whatever the package declares; e.g.
+	// 022 keeps packages from installing anything group or world writable.
+	// Directories are also subject to the process umask, as always.
+	Umask os.FileMode
+
+	// MaxPackageBytes and MaxTransactionBytes, if set, cap how much a single
+	// package, and everything installed by one Install, may write to disk.
+	// They are checked against the sizes remotes advertise before anything
+	// is downloaded, and enforced as files are extracted; either way the
+	// Install fails with a QuotaError. A package that goes over while it is
+	// extracted is rolled back.
+	MaxPackageBytes     int64
+	MaxTransactionBytes int64
+
+	// SpecialFiles allows packages to create device nodes and FIFOs.
+	// Packages containing them are rejected by default; creating device
+	// nodes typically requires root.
+	SpecialFiles bool
+
+	// FromSource, if set, is the label of the remote the requested packages
+	// must be installed from, even if other remotes offer them. Their
+	// dependencies are resolved as usual.
+	FromSource string
+
+	// ProtectConffiles keeps config files, those under etc/, that have been
+	// edited since they were installed when a package is replaced by a new
+	// version. The new version of such a file is written alongside it as
+	// <filename>.pm-new for the user to review. UpgradeFromRepo always sets
+	// it.
+	ProtectConffiles bool
+
+	// MinPriority, if set, skips dependencies whose pm.Priority is less
+	// important than it, with a warning; e.g. pm.Standard leaves out
+	// Optional and Extra packages for a minimal install. Packages named in
+	// the Install are installed whatever their priority.
+	MinPriority pm.Priority
+
+	// HTTPSOnly refuses to install packages from remotes that would be
+	// reached in the clear, with a pm.URLError.
+	HTTPSOnly bool
+
+	// SystemABI is the ABI of the system being installed to, e.g. "glibc"
+	// or "musl". If set, packages tagged for a different ABI are rejected
+	// with a pm.ABIIncompatibilityError; see pm.Meta.ABITag.
+	SystemABI string
+
+	// TransparencyLogs maps the url of a remote, in any form pm.CanonicalURL
+	// reduces to that of pm.Meta.Remote, to the transparency log its package
+	// signatures are recorded in. Once a package from one of those remotes
+	// has had its signature verified, the signature is looked up in the log;
+	// see InclusionProof. A signature the log doesn't have raises a warning,
+	// as does a log that can't be reached, but a proof that doesn't hold up
+	// is a TransparencyError.
+	TransparencyLogs map[string]string
+
+	// RequireTransparency rejects packages from the remotes in
+	// TransparencyLogs whose signature isn't logged with a
+	// TransparencyError, rather than warning.
+	RequireTransparency bool
+
+	// AllowExpired installs packages whose pm.Meta.ExpiresAt has passed,
+	// which are otherwise rejected with a pm.PackageExpiredError. It is
+	// meant for emergencies, as expired packages are unsupported.
+	AllowExpired bool
+
+	// AllowMarginal accepts packages signed by keys with keyring.Marginal
+	// trust, with a warning. They are rejected by default.
+	AllowMarginal bool
+
+	// MinSignatureStrength rejects packages signed by weak or soon to
+	// expire keys, or over weak digests, with a WeakSignatureError.
+	MinSignatureStrength SignatureStrength
+
+	// SignaturePolicies maps the url of a remote, in any form
+	// pm.CanonicalURL reduces to that of pm.Meta.Remote, to the
+	// SignaturePolicy its packages are held to, for systems that mix
+	// strictly and loosely signed remotes. It replaces AllowMarginal,
+	// MaxClockSkew and MinSignatureStrength for those remotes; packages from
+	// any other remote are held to the policy they make up.
+	SignaturePolicies map[string]SignaturePolicy
+
+	// PostInstallVerify re-reads every extracted file from disk and checks it
+	// against the package's bom, catching corruption introduced while
+	// writing. A package that fails is rolled back. It doubles the I/O of
+	// an install, so it is off by default.
+	PostInstallVerify bool
+
+	// StagedInstall downloads and verifies every package before any of them
+	// is installed, so that a bad package is caught before anything on disk
+	// changes, and makes the install all-or-nothing: what the packages
+	// write goes to a stage, which is only moved into the live tree once
+	// all of them have installed. If a package fails the stage is thrown
+	// away, leaving upgraded packages at their old versions too. The
+	// packages' post-* scripts run once they are all in place. An
+	// interrupted switch-over is finished by the next Install.
+	// Installs of more than one package are staged unless Incremental is
+	// set.
+	StagedInstall bool
+
+	// Incremental verifies and installs each package in turn, as soon as
+	// it has been downloaded, rather than staging installs of more than
+	// one package. A failure leaves the packages before it installed.
+	Incremental bool
+
+	// Strict turns warnings into errors. Install still collects every
+	// warning raised up to the next point it would commit to something,
+	// such as downloading or extracting a package, and then fails with a
+	// StrictError listing them.
+	Strict bool
+
+	// UnownedFiles is what to do when a package would overwrite a file that
+	// is on disk but that no installed package owns, such as one put there
+	// by hand: UnownedAbort, the default, fails the install with an
+	// UnownedFileError; UnownedBackup moves the file to
+	// <filename>.pmorig first; and UnownedOverwrite replaces it. Either of
+	// the latter raises a WarnUnownedFile warning for each such file. A
+	// file that already has the package's contents isn't counted. Installs
+	// into TargetDir aren't checked.
+	UnownedFiles UnownedPolicy
+
+	// ConflictResolution is what to do when a package being installed
+	// conflicts with an installed one; see pm.Meta.Conflicts. ConflictFail,
+	// the default, fails the install with a ConflictError; ConflictSkip
+	// leaves the package out, with a warning; and ConflictRemove removes the
+	// installed package as part of the install. The packages to be removed
+	// are listed in the Plan, and removing them needs AutoApprove or a
+	// Confirm to approve it. Packages in the same install that conflict
+	// with each other are always a ConflictError. Installs into TargetDir
+	// aren't checked.
+	ConflictResolution ConflictResolution
+
+	// ReinstallDeps also reinstalls, at the versions they are installed at,
+	// the installed packages that depend, directly or not, on any of the
+	// packages being installed, after them; e.g. so that a compiled
+	// extension picks up a new version of what it was built against.
+	// Requested packages that are already installed are reinstalled too,
+	// rather than refused. Edited config files of reinstalled packages are
+	// kept, as with ProtectConffiles. It has no effect with TargetDir.
+	ReinstallDeps bool
+
+	// Warnings, if set, has each warning raised appended to it, for
+	// callers that want to act on them rather than read them in the log.
+	// UpgradeFromRepo, which takes no Options, only logs its warnings;
+	// Remove raises none.
+	Warnings *[]Warning
+
+	warnings *warnings
+
+	quota *quota
+
+	// upgrade allows install to replace packages that are already
+	// installed; see UpgradeFromRepo.
+	upgrade bool
+
+	// reinstall names the installed packages install may replace with the
+	// same version; see ReinstallDeps.
+	reinstall map[pm.Name]bool
+
+	// conflicting lists the installed packages to remove before installing;
+	// see ConflictResolution.
+	conflicting []pm.Selection
+
+	replacing *replacement
+
+	ownership *ownership
+
+	// staging, if set, is where install writes in place of root; see
+	// installStaged.
+	staging *staging
+
+	// links, if set, is filled in with the hard links extracted; see
+	// pm.Meta.Hardlinks.
+	links map[string]string
+
+	// fetch retrieves packages; fetchURL if unset.
+	fetch fetcher
+}
+
+// ErrCancelled is returned when the user declines an Install's Plan.
+var ErrCancelled = errors.New("cancelled")
+
+// ErrStopped is returned when an Install is stopped early via Options.Stop.
+var ErrStopped = errors.New("stopped")
+
+func (o Options) stopped() bool {
+	select {
+	case <-o.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultMaxClockSkew is the default value of Options.MaxClockSkew, and of
+// SignaturePolicy.MaxClockSkew.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// emit tells the Observer and Hooks that m has moved into phase p. An error
+// from a hook is returned.
+func (o Options) emit(p pm.Phase, m pm.Meta) error {
+	e := pm.Event{Phase: p, Name: m.Name, Version: m.Version}
+	if o.Observer != nil {
+		o.Observer(e)
+	}
+	for _, h := range o.Hooks {
+		if err := h(e); err != nil {
+			return errors.Wrapf(err, "%v hook", p)
+		}
+	}
+	return nil
+}
+
+// JSONObserver returns an Observer that writes each event to w as a line of
+// JSON.
+func JSONObserver(w io.Writer) func(pm.Event) {
+	enc := json.NewEncoder(w)
+	return func(e pm.Event) {
+		enc.Encode(e)
+	}
+}
+
+// InstallReport describes what an Install did; see Options.Report.
+type InstallReport struct {
+	// DownloadedBytes is how much was fetched over the network, including
+	// downloads that failed and were retried.
+	DownloadedBytes int64
+
+	// SkippedBytes is the size of the packages that were already in the
+	// cache, and so weren't downloaded.
+	SkippedBytes int64
+
+	// Mirrors is what was seen of each of the remotes with Mirrors, and
+	// of their mirrors.
+	Mirrors []MirrorStats
+}
+
+// Install fetches and installs pkgs, and any of their dependencies that are
+// not yet installed, from appropriate remotes.
+//
+// Progress through the batch is recorded as it goes, so re-running an
+// interrupted Install with the same pkgs resumes where the last run stopped.
+func Install(root string, pkgs []string, opts Options) error {
+	opts.warnings = &warnings{}
+
+	av, dbws, err := db.LoadAvailable(root)
 	if err != nil {
 		return errors.Wrap(err, "loading available db")
 	}
 
-	ms, err := av.Installable(pkgs)
+	now := time.Now()
+	if opts.AllowExpired {
+		now = time.Time{}
+	}
+	var ms pm.Metas
+	if opts.FromSource != "" {
+		ms, err = fromSource(root, opts.FromSource, pkgs, now)
+	} else {
+		ms, err = av.InstallableAt(pkgs, now)
+	}
 	if err != nil {
 		return errors.Wrap(err, "checking ability to install")
 	}
+	requested := map[pm.Name]bool{}
+	for _, m := range ms {
+		requested[m.Name] = true
+	}
+	for _, w := range dbws {
+		if requested[w.Package] {
+			opts.warnf(WarnUnknownReference, w.Package, "%v", w)
+		}
+	}
 
-	cacheDir := filepath.Join(root, cache)
-	if !fs.Exists(cacheDir) {
-		if err := os.MkdirAll(cacheDir, 0755); err != nil {
-			return errors.Wrap(err, "creating non-existent cache dir")
+	if err := opts.emit(pm.Resolve, pm.Meta{}); err != nil {
+		return err
+	}
+	sels := []pm.Selection{}
+	if opts.NoDeps {
+		if skipped := deps(ms); len(skipped) > 0 {
+			opts.warnf(WarnNoDeps, "", "not installing dependencies: %v", strings.Join(skipped, ", "))
+		}
+		for _, m := range ms {
+			sels = append(sels, pm.Selection{Package: m.Name, Version: m.Version, Reason: "requested"})
+		}
+	} else {
+		ms, sels, err = resolve(root, av, ms)
+		if err != nil {
+			return errors.Wrap(err, "resolving dependencies")
+		}
+	}
+	if opts.MinPriority != "" {
+		ms, sels = opts.prioritize(ms, sels, requested)
+	}
+	if opts.ReinstallDeps && opts.TargetDir == "" {
+		ms, sels, opts.reinstall, err = reinstallDeps(root, av, ms, sels)
+		if err != nil {
+			return errors.Wrap(err, "finding dependents to reinstall")
+		}
+	}
+	if opts.TargetDir == "" {
+		ms, sels, opts.conflicting, err = opts.resolveConflicts(root, ms, sels)
+		if err != nil {
+			return err
 		}
 	}
-	if !fs.IsDir(cacheDir) {
-		return errors.Errorf("%q is not a directory!", cacheDir)
+	for _, m := range ms {
+		if err := validateMetaConsistency(m); err != nil {
+			return err
+		}
+	}
+	if opts.TargetDir == "" {
+		iDB, err := db.LoadInstalled(root)
+		if err != nil {
+			return errors.Wrap(err, "loading installed db")
+		}
+		for _, m := range ms {
+			if err := iDB.CoInstallable(m); err != nil {
+				return err
+			}
+		}
+	}
+	if err := opts.checkKeys(root, ms); err != nil {
+		return err
+	}
+	if opts.HTTPSOnly {
+		for _, m := range ms {
+			if _, err := m.CheckURL(true); err != nil {
+				return err
+			}
+		}
+	}
+	if !opts.AllowExpired {
+		for _, m := range ms {
+			if err := m.CheckExpiry(now); err != nil {
+				return err
+			}
+		}
+	}
+	return run(root, pkgs, ms, sels, opts)
+}
+
+// prioritize drops the packages in ms, and their Selections, that are below
+// opts.MinPriority, except those in requested.
+func (o Options) prioritize(ms pm.Metas, sels []pm.Selection, requested map[pm.Name]bool) (pm.Metas, []pm.Selection) {
+	rms, rsels := pm.Metas{}, []pm.Selection{}
+	for i, m := range ms {
+		if !requested[m.Name] && !m.Priority.AtLeast(o.MinPriority) {
+			o.warnf(WarnLowPriority, m.Name, "not installing %v, whose priority is below %v", m.Name, o.MinPriority)
+			continue
+		}
+		rms = append(rms, m)
+		if i < len(sels) {
+			rsels = append(rsels, sels[i])
+		}
+	}
+	return rms, rsels
+}
+
+// run confirms, downloads and installs ms, the packages selected for the
+// batch named by pkgs.
+func run(root string, pkgs []string, ms pm.Metas, sels []pm.Selection, opts Options) error {
+	for _, m := range ms {
+		if err := m.CheckABI(opts.SystemABI); err != nil {
+			return err
+		}
+	}
+	if opts.TargetDir != "" && opts.BOM != nil {
+		return errors.New("a bill of materials cannot be written when installing to a target dir")
+	}
+	if err := checkQuotas(ms, opts); err != nil {
+		return err
+	}
+	opts.quota = &quota{}
+	if err := opts.strict(); err != nil {
+		return err
+	}
+
+	if opts.DryRun || opts.Simulate {
+		if opts.PlanWriter != nil {
+			if _, err := fmt.Fprint(opts.PlanWriter, newPlan(ms, sels, opts.conflicting)); err != nil {
+				return errors.Wrap(err, "writing plan")
+			}
+		}
+		return nil
+	}
+	if !opts.AutoApprove && opts.Confirm != nil && !opts.Confirm(newPlan(ms, sels, opts.conflicting)) {
+		return ErrCancelled
+	}
+
+	cacheDir := filepath.Join(root, cache)
+	if err := ensureCache(cacheDir); err != nil {
+		return errors.Wrap(err, "checking cache dir")
 	}
 	installedDir := filepath.Join(root, installed)
 	if !fs.Exists(installedDir) {
 		if err := os.MkdirAll(installedDir, 0755); err != nil {
-			return errors.Wrap(err, "creating non-existent cache dir")
+			return errors.Wrap(err, "creating non-existent installed dir")
 		}
 	}
-	if !fs.IsDir(cacheDir) {
-		return errors.Errorf("%q is not a directory!", cacheDir)
+	if !fs.IsDir(installedDir) {
+		return errors.Errorf("%q is not a directory!", installedDir)
+	}
+
+	if err := finishTransaction(root); err != nil {
+		return errors.Wrap(err, "finishing interrupted install")
+	}
+
+	p, err := loadProgress(root, pkgs, opts.TargetDir, opts.warner(WarnCorruptProgress, ""))
+	if err != nil {
+		return errors.Wrap(err, "loading progress")
+	}
+	if n := p.count(ms, done); n > 0 {
+		log.Printf("%d/%d already done", n, len(ms))
 	}
 
-	if err := download(cacheDir, ms); err != nil {
+	if err := download(cacheDir, ms, p, opts); err == ErrStopped {
+		return err
+	} else if err != nil {
 		return errors.Wrap(err, "downloading")
 	}
 
+	pending := 0
 	for _, m := range ms {
-		if err := install(root, m); err != nil {
+		if p.Pkgs[m.Name] != done {
+			pending++
+		}
+	}
+	opts.StagedInstall = opts.StagedInstall || (pending > 1 && !opts.Incremental)
+	if opts.StagedInstall {
+		if err := preverifyAll(root, ms, p, opts); err != nil {
+			return err
+		}
+		if err := opts.strict(); err != nil {
+			return err
+		}
+	}
+
+	requested := map[pm.Name]bool{}
+	for _, l := range pkgs {
+		n, _, err := pm.ParseLabel(l)
+		if err != nil {
+			return errors.Wrapf(err, "parsing %q", l)
+		}
+		requested[n] = true
+	}
+	if opts.StagedInstall && opts.TargetDir == "" {
+		err = installStaged(root, ms, requested, p, opts)
+	} else {
+		err = installEach(root, ms, requested, p, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.TargetDir == "" {
+		if err := runTriggers(root); err != nil {
+			return errors.Wrap(err, "running triggers")
+		}
+		op := "install"
+		if opts.upgrade {
+			op = "upgrade"
+		}
+		if err := recordTransaction(root, op, ms); err != nil {
+			return errors.Wrap(err, "recording last transaction")
+		}
+	}
+	if opts.BOM != nil {
+		if err := writeBOM(opts.BOM, root, ms); err != nil {
+			return errors.Wrap(err, "writing bill of materials")
+		}
+	}
+	if opts.EnvOutput != nil {
+		if err := writeEnv(opts.EnvOutput, ms); err != nil {
+			return errors.Wrap(err, "writing env")
+		}
+	}
+	return p.finish()
+}
+
+// installEach installs the packages in ms that aren't done yet into root, in
+// order, having first removed the installed packages they conflict with.
+func installEach(root string, ms pm.Metas, requested map[pm.Name]bool, p *progress, opts Options) error {
+	if err := removeConflicting(root, opts.conflicting, opts.staging); err != nil {
+		return err
+	}
+	by := installedBy(ms, requested)
+	for _, m := range ms {
+		if p.Pkgs[m.Name] == done {
+			continue
+		}
+		if opts.stopped() {
+			return ErrStopped
+		}
+		m.Auto = !requested[m.Name]
+		if m.Auto {
+			m.AutoInstalledBy = by[m.Name]
+		}
+		if err := install(root, m, p, opts); err != nil {
 			return errors.Wrapf(err, "installing %v", m.Name)
 		}
+		if err := p.mark(m, done); err != nil {
+			return errors.Wrap(err, "recording progress")
+		}
 	}
 	return nil
 }
 
-func download(cache string, ms pm.Metas) error {
-	// TODO (sm): concurrently fetch
+// installedBy maps the name of each package in ms that wasn't requested to
+// the package in ms that it is being installed as a dependency of, preferring
+// a requested one.
+func installedBy(ms pm.Metas, requested map[pm.Name]bool) map[pm.Name]pm.Name {
+	// a dependency names a package, one of the packages it provides, or
+	// the name a multi-arch package is qualified from.
+	names := map[pm.Name]pm.Names{}
 	for _, m := range ms {
-		resp, err := http.Get(m.URL())
-		if err != nil {
-			return errors.Wrap(err, "http get")
+		names[m.BaseName()] = append(names[m.BaseName()], m.Name)
+		for _, p := range m.Provides {
+			names[pm.Name(p)] = append(names[pm.Name(p)], m.Name)
 		}
-		fn := filepath.Join(cache, m.Pkg())
-		f, err := os.Create(fn)
-		if err != nil {
-			return errors.Wrap(err, "creating")
+	}
+	by := map[pm.Name]pm.Name{}
+	for _, explicit := range []bool{true, false} {
+		for _, m := range ms {
+			if requested[m.Name] != explicit {
+				continue
+			}
+			for _, d := range m.Deps {
+				dn, _, err := pm.ParseLabel(d)
+				if err != nil {
+					continue
+				}
+				for _, n := range append(pm.Names{dn}, names[dn]...) {
+					if _, ok := by[n]; !ok && !requested[n] && n != m.Name {
+						by[n] = m.Name
+					}
+				}
+			}
 		}
+	}
+	return by
+}
 
-		if n, err := io.Copy(f, resp.Body); err != nil {
-			return errors.Wrapf(err, "copy %q to disk after %d bytes", m.URL(), n)
+// preverifyAll preverifies the packages in ms that aren't done yet, up to
+// opts.VerifyConcurrency at a time. Packages are independent, so on a
+// multi-core machine hashing one overlaps with hashing the next. The first
+// failure cancels the rest, and is returned once those in flight have
+// stopped.
+func preverifyAll(root string, ms pm.Metas, p *progress, opts Options) error {
+	queue := pm.Metas{}
+	for _, m := range ms {
+		if p.Pkgs[m.Name] != done {
+			queue = append(queue, m)
 		}
+	}
+	n := opts.VerifyConcurrency
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	if report := opts.OnVerifyProgress; report != nil && n > 1 {
+		var mu sync.Mutex
+		opts.OnVerifyProgress = func(vp VerifyProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			report(vp)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		if err := resp.Body.Close(); err != nil {
-			return errors.Wrap(err, "closing resp body")
+	type result struct {
+		m   pm.Meta
+		err error
+	}
+	results := make(chan result)
+	inflight := 0
+	var err error
+	for {
+		for err == nil && len(queue) > 0 && inflight < n {
+			m := queue[0]
+			if err = opts.emit(pm.Verify, m); err != nil {
+				cancel()
+				break
+			}
+			queue = queue[1:]
+			inflight++
+			go func() {
+				results <- result{m, preverify(ctx, root, m, opts)}
+			}()
+		}
+		if inflight == 0 {
+			break
+		}
+
+		r := <-results
+		inflight--
+		if r.err != nil && err == nil {
+			err = errors.Wrapf(r.err, "verifying %v", r.m.Name)
+			cancel()
 		}
 	}
-	return nil
+	return err
 }
 
-func verifyManifestIntegrity(root string, m pm.Meta) error {
+// preverify checks m's cached .pkg the way install would, without installing
+// it; see Options.StagedInstall. It gives up between steps once ctx is done.
+func preverify(ctx context.Context, root string, m pm.Meta, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	pn := filepath.Join(root, cache, m.Pkg())
+	sig, err := opts.verifySignature(root, pn, m, opts.warner)
+	if err != nil {
+		return errors.Wrap(err, "verifying pkg integrity")
+	}
+	if sig != nil {
+		if err := checkTransparency(pn, m, opts, opts.warner); err != nil {
+			return errors.Wrap(err, "verifying pkg integrity")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "pm-verify-")
+	if err != nil {
+		return errors.Wrap(err, "making temp dir")
+	}
+	defer os.RemoveAll(tmp)
+	if err := expandPkgContents(pn, tmp, opts.extraFiles(opts.warner, m.Name), opts.verifyMeter(m)); err != nil {
+		return errors.Wrap(err, "verifying pkg contents")
+	}
+	return nil
+}
+
+// PackageNotInSourceError is returned when a package is requested from a
+// source that doesn't offer it; see Options.FromSource.
+type PackageNotInSourceError struct {
+	Package string
+	Source  string
+}
+
+func (e PackageNotInSourceError) Error() string {
+	return fmt.Sprintf("%v is not available from %v", e.Package, e.Source)
+}
+
+// fromSource returns the metas for pkgs as offered by the remote labeled
+// source, checking expiry as of now; see pm.Available.InstallableAt.
+func fromSource(root, source string, pkgs []string, now time.Time) (pm.Metas, error) {
+	u, err := db.FindRemote(root, source)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding source")
+	}
+	src, err := db.FetchPinned(root, u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %v", source)
+	}
+	for _, p := range pkgs {
+		n, v, err := pm.ParseLabel(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing name/version")
+		}
+		if _, err := src.Get(n, v); err != nil {
+			return nil, PackageNotInSourceError{Package: p, Source: source}
+		}
+	}
+	return src.InstallableAt(pkgs, now)
+}
+
+// resolve adds the dependencies of ms that are not already installed, and
+// explains the version chosen for each.
+func resolve(root string, av pm.Available, ms pm.Metas) (pm.Metas, []pm.Selection, error) {
+	all, sels, err := av.Explain(ms)
+	if err != nil {
+		return nil, nil, err
+	}
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "loading installed db")
+	}
+	requested := map[pm.Name]bool{}
+	for _, m := range ms {
+		requested[m.Name] = true
+	}
+	r := pm.Metas{}
+	rs := []pm.Selection{}
+	for i, m := range all {
+		if _, ok := iDB[m.Name]; ok && !requested[m.Name] {
+			continue
+		}
+		r = append(r, m)
+		rs = append(rs, sels[i])
+	}
+	return r, rs, nil
+}
+
+// reinstallDeps adds to ms, and sels, the installed packages that depend on
+// those in ms, as they are installed, and returns the names of the packages
+// in the result that are already installed.
+func reinstallDeps(root string, av pm.Available, ms pm.Metas, sels []pm.Selection) (pm.Metas, []pm.Selection, map[pm.Name]bool, error) {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "loading installed db")
+	}
+	batch := map[pm.Name]bool{}
+	names := pm.Names{}
+	for _, m := range ms {
+		batch[m.Name] = true
+		names = append(names, m.Name)
+	}
+	reinstall := map[pm.Name]bool{}
+	for _, m := range ms {
+		if _, ok := iDB[m.Name]; ok {
+			reinstall[m.Name] = true
+		}
+	}
+	for _, d := range iDB.Dependents(names...) {
+		if batch[d.Name] {
+			continue
+		}
+		m, err := av.Get(d.Name, d.Version)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "reinstalling %v", d.Name)
+		}
+		on := []string{}
+		for _, dep := range d.Deps {
+			if n, _, err := pm.ParseLabel(dep); err == nil && batch[n] {
+				on = append(on, string(n))
+			}
+		}
+		ms = append(ms, m)
+		sels = append(sels, pm.Selection{Package: m.Name, Version: m.Version, Reason: "reinstalled; depends on " + strings.Join(on, ", ")})
+		batch[m.Name] = true
+		reinstall[m.Name] = true
+	}
+	return ms, sels, reinstall, nil
+}
+
+// deps returns the declared dependencies of ms that are not themselves in ms.
+func deps(ms pm.Metas) []string {
+	in := map[pm.Name]bool{}
+	for _, m := range ms {
+		in[m.Name] = true
+	}
+	r := []string{}
+	for _, m := range ms {
+		for _, d := range m.Deps {
+			if n, _, err := pm.ParseLabel(d); err != nil || !in[n] {
+				r = append(r, d)
+			}
+		}
+	}
+	return r
+}
+
+// verifyManifestIntegrity checks the signature of the manifest in the .pkg at
+// pn against the keyring in root.
+func verifyManifestIntegrity(root, pn string) (*keyring.Signature, error) {
 	man, err := getReadCloser(pn, "manifest.sha256")
 	if err != nil {
-		return errors.Wrap(err, "getting manifest reader")
+		return nil, errors.Wrap(err, "getting manifest reader")
 	}
 	sig, err := getReadCloser(pn, "manifest.sha256.asc")
 	if err != nil {
-		return errors.Wrap(err, "getting manifest reader")
+		return nil, errors.Wrap(err, "getting manifest reader")
 	}
 
-	if err := keyring.Verify(root, man, sig); err != nil {
-		return errors.Wrap(err, "verifying manifest")
+	s, err := keyring.CheckSignature(root, man, sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying manifest")
 	}
 	if err := man.Close(); err != nil {
-		return errors.Wrap(err, "closing manifest reader")
+		return nil, errors.Wrap(err, "closing manifest reader")
 	}
 	if err := sig.Close(); err != nil {
-		return errors.Wrap(err, "closing manifest signature reader")
+		return nil, errors.Wrap(err, "closing manifest signature reader")
+	}
+	return s, nil
+}
+
+// checkSkew returns an error if s claims to have been made more than max into
+// the future relative to now. Signatures from the future within max are
+// passed to warnf, since they likely indicate a signer with a misconfigured
+// clock.
+func checkSkew(s *keyring.Signature, now time.Time, max time.Duration, warnf func(string, ...interface{})) error {
+	skew := s.CreatedAt.Sub(now)
+	if skew > max {
+		return errors.Errorf("signature made %v in the future, more than the allowed %v", skew, max)
+	}
+	if skew > 0 {
+		warnf("signature made %v in the future; check the signer's clock", skew)
 	}
 	return nil
 }
 
-func expandPkgContents(root string, m pm.Meta) error {
-	pn := filepath.Join(root, cache, m.Pkg())
+// checkTrust returns an error if s was made by a key with keyring.Marginal
+// trust, unless allowMarginal is set, in which case it is passed to warnf.
+func checkTrust(s *keyring.Signature, allowMarginal bool, warnf func(string, ...interface{})) error {
+	if s.Trust != keyring.Marginal {
+		return nil
+	}
+	id := s.Signer.PrimaryKey.KeyIdShortString()
+	if !allowMarginal {
+		return errors.Errorf("signed by marginally trusted key %v", id)
+	}
+	warnf("signed by marginally trusted key %v", id)
+	return nil
+}
+
+// validateMetaConsistency checks, before m is downloaded, that its .pkg's
+// filename, see pm.Meta.Pkg, is a plain file name, and that the file fetched
+// for it from an http remote, see pm.Meta.URL, is for m's version. A name or
+// version with a path separator in it points the download at some other
+// file, as does a remote url with a query or fragment, or a version with ?
+// or # in it; one with stray whitespace is a copy and paste error in the
+// remote's index that would otherwise only show as a failed download.
+func validateMetaConsistency(m pm.Meta) error {
+	fn := m.Pkg()
+	if strings.ContainsAny(fn, `/\`) || filepath.Clean(fn) != fn {
+		return errors.Errorf("%v@%v is malformed: its package file %q isn't a plain file name", m.Name, m.Version, fn)
+	}
+	for _, s := range []string{string(m.Name), string(m.Version)} {
+		if strings.TrimSpace(s) != s {
+			return errors.Errorf("%q@%q is malformed: stray whitespace", m.Name, m.Version)
+		}
+	}
+	if m.Remote.Scheme == oci.Scheme {
+		// fetched by tag, not file name.
+		return nil
+	}
+	u, err := url.Parse(m.URL())
+	if err != nil {
+		return errors.Wrapf(err, "%v@%v is malformed", m.Name, m.Version)
+	}
+	fn = path.Base(u.Path)
+	prefix := string(m.BaseName()) + "-"
+	if !strings.HasPrefix(fn, prefix) || !strings.HasSuffix(fn, ".pkg") {
+		return errors.Errorf("%v@%v is malformed: it would be fetched from %v, which isn't one of its package files", m.Name, m.Version, u)
+	}
+	if v := pm.Version(strings.TrimSuffix(strings.TrimPrefix(fn, prefix), ".pkg")); v != m.Version {
+		return errors.Errorf("%v@%v is malformed: it would be fetched from %v, which is for version %v", m.Name, m.Version, u, v)
+	}
+	return nil
+}
+
+// checkKeys checks that the keys the remotes of ms declare their packages
+// are signed with, see pm.Meta.KeyFingerprint, are in the keyring in root
+// and trusted, as checkTrust would find them once the packages are
+// downloaded.
+func (o Options) checkKeys(root string, ms pm.Metas) error {
+	for _, m := range ms {
+		if m.KeyFingerprint == "" {
+			continue
+		}
+		l, err := keyring.TrustOf(root, m.KeyFingerprint)
+		if err != nil {
+			return errors.Wrapf(err, "checking key of %v", m.Name)
+		}
+		switch l {
+		case keyring.Untrusted:
+			return errors.Errorf("%v is signed by untrusted key %v", m.Name, m.KeyFingerprint)
+		case keyring.Marginal:
+			if !o.signaturePolicy(m).AllowMarginal {
+				return errors.Errorf("%v is signed by marginally trusted key %v", m.Name, m.KeyFingerprint)
+			}
+		}
+	}
+	return nil
+}
+
+// SignerMismatchError is returned when a package turns out to be signed by
+// a different key than its remote declared; see pm.Meta.KeyFingerprint.
+type SignerMismatchError struct {
+	Package pm.Name
+	Want    string
+	Got     string
+}
+
+func (e SignerMismatchError) Error() string {
+	return fmt.Sprintf("%v is signed by key %v, but its remote declares %v", e.Package, e.Got, e.Want)
+}
+
+// checkSigner returns a SignerMismatchError if s wasn't made by the key m
+// declares, if any.
+func checkSigner(s *keyring.Signature, m pm.Meta) error {
+	if m.KeyFingerprint == "" {
+		return nil
+	}
+	want := strings.ToUpper(strings.Replace(m.KeyFingerprint, " ", "", -1))
+	if got := keyring.Fingerprint(s.Signer); got != want {
+		return SignerMismatchError{Package: m.Name, Want: want, Got: got}
+	}
+	return nil
+}
+
+// ExtraFileError is returned when a .pkg holds a file its signed manifest
+// doesn't list; see Options.AllowExtraFiles. Use errors.Cause to find it.
+type ExtraFileError struct {
+	Filename string
+}
+
+func (e ExtraFileError) Error() string {
+	return fmt.Sprintf("extra file %q found in tarfile", e.Filename)
+}
+
+// expandPkgContents verifies the contents of the .pkg at pn against its
+// manifest and writes them, except for the root.tar.bz2, into ip. Files the
+// manifest doesn't list are an ExtraFileError, unless extra is set, in which
+// case they are passed to it and skipped. Progress is reported to vm.
+func expandPkgContents(pn, ip string, extra func(string, ...interface{}), vm *verifyMeter) error {
 	man, err := getReadCloser(pn, "manifest.sha256")
 	if err != nil {
 		return errors.Wrap(err, "getting manifest reader")
 	}
 
-	ip := filepath.Join(root, installed, string(m.Name))
 	if err := os.MkdirAll(ip, 0755); err != nil {
-		return errors.Wrapf(err, "making install dir for %q", m.Name)
+		return errors.Wrapf(err, "making install dir %q", ip)
 	}
 
-	cs := map[string]string{}
-	s := bufio.NewScanner(man)
-	for s.Scan() {
-		elems := strings.Split(s.Text(), "\t")
-		if len(elems) != 2 {
-			return errors.Errorf("manifest format error; got %d elements, want 2", len(elems))
-		}
-		cs[elems[1]] = elems[0]
+	cs, err := pm.ParseCS(man)
+	if err != nil {
+		man.Close()
+		return errors.Wrap(err, "parsing manifest")
 	}
 	if err := man.Close(); err != nil {
 		return errors.Wrap(err, "closing manifest reader")
 	}
-	if err := s.Err(); err != nil {
-		return errors.Wrap(err, "scanning manifest")
-	}
 
 	pf, err := os.Open(pn)
 	if err != nil {
 		return errors.Wrap(err, "opening pkg file")
 	}
+	defer pf.Close()
+	if vm != nil {
+		if vm.p.Total, err = listedSize(pf, cs); err != nil {
+			return err
+		}
+	}
 	tr := tar.NewReader(pf)
 	for {
 		hdr, err := tr.Next()
@@ -157,6 +1107,10 @@ func expandPkgContents(root string, m pm.Meta) error {
 			return errors.Wrap(err, "tar traversal")
 		}
 
+		if err := relative(hdr.Name); err != nil {
+			return err
+		}
+
 		if hdr.Name == "manifest.sha256" || hdr.Name == "manifest.sha256.asc" {
 			continue
 		}
@@ -173,13 +1127,17 @@ func expandPkgContents(root string, m pm.Meta) error {
 
 		sha, ok := cs[hdr.Name]
 		if !ok {
-			return errors.Errorf("extra file %q found in tarfile!", hdr.Name)
+			if extra == nil {
+				return ExtraFileError{Filename: hdr.Name}
+			}
+			extra("ignoring %v", ExtraFileError{Filename: hdr.Name})
+			continue
 		}
 
 		name := filepath.Join(ip, hdr.Name)
 		sr := sha256.New()
 		var o io.WriteCloser
-		o = close{ioutil.Discard}
+		o = nopCloser{ioutil.Discard}
 		if hdr.Name != "root.tar.bz2" {
 			f, err := os.OpenFile(filepath.Join(ip, hdr.Name), os.O_WRONLY|os.O_CREATE, hdr.FileInfo().Mode())
 			if err != nil {
@@ -190,7 +1148,7 @@ func expandPkgContents(root string, m pm.Meta) error {
 
 		w := io.MultiWriter(o, sr)
 
-		if n, err := io.Copy(w, tr); err != nil {
+		if n, err := io.Copy(w, vm.entry(hdr.Name, hdr.Size, tr)); err != nil {
 			return errors.Wrapf(err, "copying file %q after %v bytes", hdr.Name, n)
 		}
 
@@ -202,6 +1160,47 @@ func expandPkgContents(root string, m pm.Meta) error {
 			return errors.Wrapf(err, "closing %v", name)
 		}
 	}
+	vm.done()
+	return nil
+}
+
+// listedSize returns the total size of the entries of the .pkg open in pf
+// that cs lists, and rewinds pf.
+func listedSize(pf *os.File, cs map[string]string) (int64, error) {
+	r := int64(0)
+	tr := tar.NewReader(pf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "tar traversal")
+		}
+		if _, ok := cs[hdr.Name]; ok && !hdr.FileInfo().IsDir() {
+			r += hdr.Size
+		}
+	}
+	if _, err := pf.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "rewinding pkg file")
+	}
+	return r, nil
+}
+
+// relative returns an error if the tar entry name is an absolute path, or
+// one that climbs out of the directory it is extracted into.
+//
+// Entries are always joined to a directory before being written, but an
+// absolute name is a sign the package was built incorrectly or maliciously,
+// so we refuse it explicitly. Joining doesn't help with .., so it is refused
+// too.
+func relative(name string) error {
+	if strings.HasPrefix(name, "/") {
+		return errors.Errorf("absolute path %q found in tarfile", name)
+	}
+	if c := filepath.ToSlash(filepath.Clean(name)); c == ".." || strings.HasPrefix(c, "../") {
+		return errors.Errorf("path %q outside the package found in tarfile", name)
+	}
 	return nil
 }
 
@@ -239,49 +1238,120 @@ func getReadCloser(tn, fn string) (io.ReadCloser, error) {
 	return nil, errors.Errorf("%q not found", fn)
 }
 
-// close should be used to wrap ioutil.Discard to give it a noop Close method.
-type close struct {
+// nopCloser should be used to wrap ioutil.Discard to give it a noop Close method.
+type nopCloser struct {
 	io.Writer
 }
 
-func (close) Close() error {
+func (nopCloser) Close() error {
 	return nil
 }
 
-func script(root string, m pm.Meta, name string) error {
+// MissingInterpreterError is returned when the interpreter a package's
+// script needs, its pm.Meta.ScriptInterpreter or the program on its #! line,
+// isn't on the system.
+type MissingInterpreterError struct {
+	Package     pm.Name
+	Script      string
+	Interpreter string
+}
+
+func (e MissingInterpreterError) Error() string {
+	return fmt.Sprintf("%v's %v script needs %v, which was not found", e.Package, e.Script, e.Interpreter)
+}
+
+// script runs m's script name, if it has one, with its interpreter; see
+// pm.Meta.ScriptInterpreter.
+func script(root string, m pm.Meta, name string, args ...string) error {
 	bin := filepath.Join(root, installed, string(m.Name), "bin", name)
 	if !fs.Exists(bin) {
 		return nil
 	}
-	cmd := exec.Command(bin)
+	interp := m.ScriptInterpreter
+	if interp == "" {
+		var err error
+		if interp, err = shebang(bin); err != nil {
+			return errors.Wrapf(err, "reading %v script", name)
+		}
+	}
+	if interp != "" {
+		if _, err := exec.LookPath(interp); err != nil {
+			return MissingInterpreterError{Package: m.Name, Script: name, Interpreter: interp}
+		}
+	}
+	cmd := exec.Command(bin, args...)
+	if m.ScriptInterpreter != "" {
+		cmd = exec.Command(m.ScriptInterpreter, append([]string{bin}, args...)...)
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-func expandRoot(root string, m pm.Meta) error {
-
-	bomn := filepath.Join(root, installed, string(m.Name), "bom.sha256")
-	bf, err := os.Open(bomn)
+// shebang returns the interpreter named on the #! line of the script fn, if
+// it has one.
+func shebang(fn string) (string, error) {
+	f, err := os.Open(fn)
 	if err != nil {
-		return errors.Wrap(err, "opening bom")
+		return "", errors.Wrap(err, "open")
 	}
-
-	cs := map[string]string{}
-	s := bufio.NewScanner(bf)
-	for s.Scan() {
-		elems := strings.Split(s.Text(), "\t")
-		if len(elems) != 2 {
-			return errors.Errorf("manifest format error; got %d elements, want 2", len(elems))
-		}
-		cs[elems[1]] = elems[0]
+	defer f.Close()
+	l, err := bufio.NewReader(io.LimitReader(f, 256)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "read")
+	}
+	if !strings.HasPrefix(l, "#!") {
+		return "", nil
+	}
+	words := strings.Fields(l[2:])
+	if len(words) == 0 {
+		return "", nil
 	}
+	return words[0], nil
+}
 
-	pn := filepath.Join(root, cache, m.Pkg())
+// expandRoot extracts the root.tar.bz2 of the .pkg at pn into dest, verifying
+// each file against the bom previously expanded into ip. It returns the
+// checksums of the files it wrote, keyed by path.
+//
+// The first strip components of each entry's path are removed; see
+// stripCount. Files matching opts.ExcludePatterns are skipped, and their
+// names returned separately. Device nodes and FIFOs are only created if
+// opts.SpecialFiles is set; any other non-regular entry is rejected, but
+// for hard links to files extracted before them, which are recorded in
+// opts.links if set.
+func expandRoot(dest, ip, pn string, strip int, opts Options) (map[string]string, []string, error) {
 	tbz, err := getReadCloser(pn, "root.tar.bz2")
 	if err != nil {
-		return errors.Wrap(err, "getting root.tar.bz2 reader")
+		return nil, nil, errors.Wrap(err, "getting root.tar.bz2 reader")
 	}
+	defer tbz.Close()
+	return extractRoot(dest, ip, tbz, strip, opts)
+}
+
+// extractRoot does the work of expandRoot, reading the root.tar.bz2 from tbz.
+// On error it also returns the files written before it, so they can be
+// rolled back.
+func extractRoot(dest, ip string, tbz io.Reader, strip int, opts Options) (map[string]string, []string, error) {
+	bomn := filepath.Join(ip, "bom.sha256")
+	bf, err := os.Open(bomn)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "opening bom")
+	}
+	cs, err := pm.ParseCS(bf)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing bom")
+	}
+	if err := bf.Close(); err != nil {
+		return nil, nil, errors.Wrap(err, "closing bom")
+	}
+
+	files := map[string]string{}
+	skipped := []string{}
+	// written is where each file was put, which for edited config files
+	// isn't at its name; see replacement.
+	written := map[string]string{}
+	used := int64(0)
 	tr := tar.NewReader(bzip2.NewReader(tbz))
 	for {
 		hdr, err := tr.Next()
@@ -289,30 +1359,308 @@ func expandRoot(root string, m pm.Meta) error {
 			break
 		}
 		if err != nil {
-			return errors.Wrap(err, "tar traversal")
+			return files, nil, errors.Wrap(err, "tar traversal")
+		}
+		if err := relative(hdr.Name); err != nil {
+			return files, nil, err
+		}
+		name := pm.StripPath(hdr.Name, strip)
+		if name == "" {
+			continue
+		}
+		if x, err := excluded(name, opts.ExcludePatterns); err != nil {
+			return files, nil, err
+		} else if x {
+			if !hdr.FileInfo().IsDir() {
+				skipped = append(skipped, name)
+			}
+			continue
 		}
 		if hdr.FileInfo().IsDir() {
-			d := filepath.Join(root, hdr.Name)
-			if err := os.MkdirAll(d, hdr.FileInfo().Mode()); err != nil {
-				return errors.Wrapf(err, "making directory %q", d)
+			d := filepath.Join(dest, name)
+			if err := os.MkdirAll(d, opts.mode(hdr.FileInfo().Mode())); err != nil {
+				return files, nil, errors.Wrapf(err, "making directory %q", d)
 			}
 			continue
 		}
-		f, err := os.OpenFile(filepath.Join(root, hdr.Name), os.O_WRONLY|os.O_CREATE, hdr.FileInfo().Mode())
+		sha, ok := cs[hdr.Name]
+		if !ok {
+			return files, nil, errors.Errorf("%q not found in bom", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			if opts.replacing.same(dest, name, sha) {
+				// the installed copy already matches, so leave it be.
+				files[name] = sha
+				written[name] = opts.staging.live(filepath.Join(dest, name))
+				continue
+			}
+		case tar.TypeLink:
+			if err := relative(hdr.Linkname); err != nil {
+				return files, nil, err
+			}
+			target := pm.StripPath(hdr.Linkname, strip)
+			src, ok := written[target]
+			if !ok {
+				// a link to an excluded file is excluded with it.
+				for _, n := range skipped {
+					if n == target {
+						ok = true
+					}
+				}
+				if ok {
+					skipped = append(skipped, name)
+					continue
+				}
+				return files, nil, errors.Errorf("%q links to %q, which isn't extracted before it", name, hdr.Linkname)
+			}
+			if sha != cs[hdr.Linkname] {
+				return files, nil, errors.Errorf("%q checksum was incorrect", name)
+			}
+			fn, err := opts.replacing.target(dest, name)
+			if err != nil {
+				return files, nil, errors.Wrapf(err, "checking %q for edits", name)
+			}
+			if err := opts.staging.mkdirs(fn); err != nil {
+				return files, nil, errors.Wrapf(err, "making directory for %q", name)
+			}
+			if err := opts.ownership.claim(fn, name, sha); err != nil {
+				return files, nil, err
+			}
+			if err := opts.replacing.save(fn, name); err != nil {
+				return files, nil, errors.Wrapf(err, "saving installed %q", name)
+			}
+			if err := hardLink(src, fn); err != nil {
+				return files, nil, errors.Wrapf(err, "linking %q", name)
+			}
+			files[name] = files[target]
+			written[name] = fn
+			if opts.links != nil {
+				opts.links[name] = target
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if !opts.SpecialFiles {
+				return files, nil, errors.Errorf("%q is a %v; special files are not allowed", name, typeName(hdr.Typeflag))
+			}
+			h := *hdr
+			h.Mode = int64(opts.mode(os.FileMode(h.Mode)))
+			if err := opts.staging.mkdirs(filepath.Join(dest, name)); err != nil {
+				return files, nil, errors.Wrapf(err, "making directory for %q", name)
+			}
+			if err := mknod(filepath.Join(dest, name), &h); err != nil {
+				return files, nil, errors.Wrapf(err, "creating %v %q", typeName(hdr.Typeflag), name)
+			}
+			// special files have no contents to checksum, so Check has
+			// nothing to verify and they are left out of files.
+			continue
+		default:
+			return files, nil, errors.Errorf("%q has unsupported tar entry type %q", name, hdr.Typeflag)
+		}
+		if err := opts.charge(used, hdr.Size); err != nil {
+			return files, nil, err
+		}
+		used += hdr.Size
+		fn, err := opts.replacing.target(dest, name)
 		if err != nil {
-			return errors.Wrapf(err, "open output file %q", hdr.Name)
+			return files, nil, errors.Wrapf(err, "checking %q for edits", name)
+		}
+		if err := opts.staging.mkdirs(fn); err != nil {
+			return files, nil, errors.Wrapf(err, "making directory for %q", name)
+		}
+		if err := opts.ownership.claim(fn, name, sha); err != nil {
+			return files, nil, err
+		}
+		if err := opts.replacing.save(fn, name); err != nil {
+			return files, nil, errors.Wrapf(err, "saving installed %q", name)
+		}
+		// the bom is checked before the file is moved into place, so a bad
+		// entry leaves the installed file as it was.
+		s := sha256.New()
+		var sum string
+		check := func() error {
+			sum = fmt.Sprintf("%x", s.Sum(nil))
+			if sum != sha {
+				return errors.Errorf("%q checksum was incorrect", name)
+			}
+			return nil
+		}
+		if err := replace(fn, opts.mode(hdr.FileInfo().Mode()), io.TeeReader(tr, s), sparse(hdr), check); err != nil {
+			return files, nil, errors.Wrapf(err, "writing %q", name)
+		}
+		if opts.StripDebug {
+			if sum, err = opts.stripDebug(fn, sum); err != nil {
+				return files, nil, errors.Wrapf(err, "stripping %q", name)
+			}
+		}
+		files[name] = sum
+		written[name] = fn
+	}
+	return files, skipped, nil
+}
+
+// stripCount returns how many leading path components to strip from the
+// entries of m's root.tar.bz2, whose bom has been expanded into ip:
+// opts.StripComponents if set, otherwise one if every entry is under a
+// <name>-<version>/ directory, as made by tools that tar up a build tree,
+// and none otherwise.
+//
+// Only a directory named for the package is stripped automatically, since
+// plenty of packages legitimately keep everything under a single directory,
+// like bin/.
+func stripCount(ip string, m pm.Meta, opts Options) (int, error) {
+	if opts.StripComponents > 0 {
+		return opts.StripComponents, nil
+	}
+	bf, err := os.Open(filepath.Join(ip, "bom.sha256"))
+	if err != nil {
+		return 0, errors.Wrap(err, "opening bom")
+	}
+	defer bf.Close()
+	cs, err := pm.ParseCS(bf)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing bom")
+	}
+	if len(cs) == 0 {
+		return 0, nil
+	}
+	prefix := fmt.Sprintf("%s-%s/", m.BaseName(), m.Version)
+	for n := range cs {
+		if !strings.HasPrefix(filepath.ToSlash(n), prefix) {
+			return 0, nil
 		}
-		if n, err := io.Copy(f, tr); err != nil {
-			return errors.Wrapf(err, "copy file %q after %v bytes", hdr.Name, n)
+	}
+	return 1, nil
+}
+
+// mode returns m, the mode a package declares for a file, less o.Umask.
+func (o Options) mode(m os.FileMode) os.FileMode {
+	return m &^ (o.Umask & os.ModePerm)
+}
+
+// verifyOnDisk checks that the files under dest still have the checksums in
+// files, which are keyed by path relative to dest. Each group of hard links
+// in links is read once; see linkedSums.
+func verifyOnDisk(dest string, files, links map[string]string) error {
+	problems := []string{}
+	ls := newLinkedSums(dest, links)
+	for fn, want := range files {
+		got, err := ls.sum(fn)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
 		}
-		if err := f.Close(); err != nil {
-			return errors.Wrapf(err, "closing %q", hdr.Name)
+		if got != want {
+			problems = append(problems, fmt.Sprintf("%q checksum mismatch on disk", fn))
 		}
 	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "\n"))
+	}
 	return nil
 }
 
-func install(root string, m pm.Meta) error {
+// rollback removes the files a failed install extracted into dest, and ip,
+// the package's install dir, if set. Files the package replaced are not
+// restored. Failures are logged, as the install has already failed.
+func rollback(dest, ip string, files map[string]string) {
+	for fn := range files {
+		if err := os.Remove(filepath.Join(dest, fn)); err != nil && !os.IsNotExist(err) {
+			log.Printf("rolling back: %v", err)
+		}
+	}
+	if ip == "" {
+		return
+	}
+	if err := os.RemoveAll(ip); err != nil {
+		log.Printf("rolling back: %v", err)
+	}
+}
+
+// excluded reports if name, or any directory containing it, matches one of
+// patterns.
+func excluded(name string, patterns []string) (bool, error) {
+	for n := filepath.Clean(name); n != "." && n != "/"; n = filepath.Dir(n) {
+		for _, p := range patterns {
+			ok, err := filepath.Match(p, n)
+			if err != nil {
+				return false, errors.Wrapf(err, "bad exclude pattern %q", p)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func typeName(t byte) string {
+	switch t {
+	case tar.TypeChar:
+		return "character device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return fmt.Sprintf("tar entry of type %q", t)
+}
+
+// replace writes the contents of r to fn with the given mode.
+//
+// The contents are written to a temporary file in the same directory which is
+// then renamed over fn. Anything holding the old fn open, such as a running
+// executable, keeps the old inode, and the new contents are live for anything
+// that opens fn afterwards.
+//
+// If sparse is set, runs of zeros in r are left as holes in fn; see
+// copySparse.
+//
+// check, if set, is called once all of r has been written, before the
+// rename; if it returns an error fn is left as it was.
+func replace(fn string, mode os.FileMode, r io.Reader, sparse bool, check func() error) error {
+	dir, base := filepath.Split(fn)
+	f, err := ioutil.TempFile(dir, "."+base+".pm-")
+	if err != nil {
+		return errors.Wrap(err, "creating temp file")
+	}
+	tmp := f.Name()
+
+	var n int64
+	if sparse {
+		n, err = copySparse(f, r)
+	} else {
+		n, err = io.Copy(f, r)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "copy after %v bytes", n)
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "chmod")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "closing temp file")
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "rename into place")
+	}
+	return nil
+}
+
+func install(root string, m pm.Meta, p *progress, opts Options) error {
 	defer func() {
 		cached := filepath.Join(root, cache, m.Pkg())
 		if !fs.Exists(cached) {
@@ -323,37 +1671,241 @@ func install(root string, m pm.Meta) error {
 		}
 	}()
 
-	already, err := db.IsInstalled(root, m)
-	if err != nil {
-		return errors.Wrapf(err, "is installed %v", m.Name)
+	pn := filepath.Join(root, cache, m.Pkg())
+	dest := root
+	if opts.staging != nil {
+		dest = opts.staging.dir
 	}
-	if already {
-		return errors.Errorf("%v already installed!", m.Name)
+	ip := filepath.Join(dest, installed, string(m.Name))
+	if opts.TargetDir != "" {
+		// nothing is recorded under root, so the package's contents only
+		// need to live long enough to be verified and extracted.
+		d, err := ioutil.TempDir("", "pm-target-")
+		if err != nil {
+			return errors.Wrap(err, "making temp dir")
+		}
+		defer os.RemoveAll(d)
+		ip, dest = d, opts.TargetDir
+	}
+	var stale map[string]string
+	if opts.TargetDir == "" {
+		iDB, err := db.LoadInstalled(root)
+		if err != nil {
+			return errors.Wrapf(err, "is installed %v", m.Name)
+		}
+		old, already := iDB[m.Name]
+		if already && !opts.upgrade && !opts.reinstall[m.Name] {
+			return errors.Errorf("%v already installed!", m.Name)
+		}
+		if already {
+			if opts.reinstall[m.Name] {
+				opts.ProtectConffiles = true
+			}
+			// a new version doesn't change why a package was installed.
+			m.Auto, m.AutoInstalledBy = old.Auto, old.AutoInstalledBy
+			// remember what the old version put on disk before its
+			// contents are replaced, so that anything the new version
+			// doesn't ship can be cleaned up afterwards.
+			stale, err = installedFiles(filepath.Join(root, installed, string(m.Name)), old)
+			if err != nil {
+				return errors.Wrapf(err, "reading files of installed %v", m.Name)
+			}
+			opts.replacing = newReplacement(m.Name, stale, opts)
+		}
+		opts.ownership = newOwnership(root, iDB, m.Name, opts)
+	}
+	log.Printf("installing %v@%v from %v", m.Name, m.Version, m.Repository)
+	warner := opts.warner
+	vm := opts.verifyMeter(m)
+	if opts.StagedInstall {
+		// the package is checked again in case the cache changed since, but
+		// its warnings, and progress, were reported when it was staged.
+		warner = func(string, pm.Name) func(string, ...interface{}) {
+			return func(string, ...interface{}) {}
+		}
+		vm = nil
+	} else if err := opts.emit(pm.Verify, m); err != nil {
+		return err
 	}
-	if err := verifyManifestIntegrity(root, m); err != nil {
+	sig, err := opts.verifySignature(root, pn, m, warner)
+	if err != nil {
 		return errors.Wrap(err, "verifying pkg integrity")
 	}
-	if err := expandPkgContents(root, m); err != nil {
-		if err := os.RemoveAll(filepath.Join(root, installed, string(m.Name))); err != nil {
-			err = errors.Wrap(err, "cleaning up")
+	if sig != nil {
+		if err := checkTransparency(pn, m, opts, warner); err != nil {
+			return errors.Wrap(err, "verifying pkg integrity")
+		}
+	}
+	if err := opts.strict(); err != nil {
+		return err
+	}
+	if sig != nil {
+		m.SignedBy = sig.Signer.PrimaryKey.KeyIdString()
+	}
+	if err := p.mark(m, verified); err != nil {
+		return errors.Wrap(err, "recording progress")
+	}
+	// upgraded is set once the new version's files are in place, after
+	// which the old version's install dir isn't put back.
+	upgraded := false
+	if stale != nil && opts.staging == nil {
+		// the new version gets a fresh install dir, so that scripts, or a
+		// changelog, it doesn't ship don't outlive the old one; the old one
+		// is set aside until then, and put back if the upgrade fails.
+		aside, err := ioutil.TempDir(filepath.Join(root, installed), "."+string(m.Name)+"-")
+		if err != nil {
+			return errors.Wrap(err, "making temp dir")
+		}
+		// the files the new version replaces are kept alongside it.
+		old := filepath.Join(aside, "install")
+		opts.replacing.backup = filepath.Join(aside, "files")
+		if err := os.Rename(ip, old); err != nil {
+			os.RemoveAll(aside)
+			return errors.Wrap(err, "setting aside old install dir")
+		}
+		defer func() {
+			if !upgraded {
+				if err := os.RemoveAll(ip); err != nil {
+					log.Printf("restoring %v: %v", m.Name, err)
+				} else if err := os.Rename(old, ip); err != nil {
+					log.Printf("restoring %v: %v", m.Name, err)
+				}
+			}
+			if err := os.RemoveAll(aside); err != nil {
+				log.Printf("cleaning up: %v", err)
+			}
+		}()
+	}
+	if err := expandPkgContents(pn, ip, opts.extraFiles(warner, m.Name), vm); err != nil {
+		if stale == nil {
+			if err := os.RemoveAll(ip); err != nil {
+				log.Printf("cleaning up: %v", err)
+			}
 		}
 		return errors.Wrap(err, "verifying pkg contents")
 	}
+	if opts.ValidatorFunc != nil {
+		if err := opts.ValidatorFunc(pn, m); err != nil {
+			if stale == nil {
+				if err := os.RemoveAll(ip); err != nil {
+					log.Printf("cleaning up: %v", err)
+				}
+			}
+			return errors.Wrap(err, "validating")
+		}
+	}
+	if err := checkCaseCollisions(dest, ip, m, opts); err != nil {
+		if stale == nil {
+			if err := os.RemoveAll(ip); err != nil {
+				log.Printf("cleaning up: %v", err)
+			}
+		}
+		return err
+	}
+
+	if opts.TargetDir != "" {
+		if err := opts.emit(pm.Extract, m); err != nil {
+			return err
+		}
+		strip, err := stripCount(ip, m, opts)
+		if err != nil {
+			return errors.Wrap(err, "root expansion")
+		}
+		opts.links = map[string]string{}
+		files, _, err := expandRoot(dest, ip, pn, strip, opts)
+		if err != nil {
+			rollback(dest, "", files)
+			if qe, ok := errors.Cause(err).(QuotaError); ok {
+				qe.Package = m.Name
+				return qe
+			}
+			return errors.Wrap(err, "root expansion")
+		}
+		if opts.PostInstallVerify {
+			if err := verifyOnDisk(dest, files, opts.links); err != nil {
+				rollback(dest, "", files)
+				return errors.Wrap(err, "post-install verification")
+			}
+		}
+		return nil
+	}
 
-	if err := script(root, m, "pre-install"); err != nil {
-		return errors.Wrap(err, "pre-install")
+	pre, post := "pre-install", "post-install"
+	if stale != nil {
+		pre, post = "pre-upgrade", "post-upgrade"
+	}
+	// while staged, the script is in the stage; the post one runs once the
+	// batch is committed.
+	if err := script(dest, m, pre); err != nil {
+		return errors.Wrap(err, pre)
 	}
 
-	if err := expandRoot(root, m); err != nil {
+	if err := opts.emit(pm.Extract, m); err != nil {
+		return err
+	}
+	strip, err := stripCount(ip, m, opts)
+	if err != nil {
 		return errors.Wrap(err, "root expansion")
 	}
+	opts.links = map[string]string{}
+	files, skipped, err := expandRoot(dest, ip, pn, strip, opts)
+	if err != nil {
+		opts.replacing.undo(dest, ip, files)
+		if qe, ok := errors.Cause(err).(QuotaError); ok {
+			qe.Package = m.Name
+			return qe
+		}
+		if ue, ok := errors.Cause(err).(UnownedFileError); ok {
+			return ue
+		}
+		return errors.Wrap(err, "root expansion")
+	}
+	m.Files = files
+	m.Hardlinks = opts.links
+	m.Excluded = skipped
+	m.StripComponents = strip
+	if opts.PostInstallVerify {
+		written := opts.replacing.written(files)
+		if err := verifyOnDisk(dest, written, opts.links); err != nil {
+			opts.replacing.undo(dest, ip, files)
+			return errors.Wrap(err, "post-install verification")
+		}
+	}
+	upgraded = true
 
-	if err := script(root, m, "post-install"); err != nil {
-		return errors.Wrap(err, "pre-install")
+	for n := range stale {
+		if _, ok := files[n]; ok {
+			continue
+		}
+		if opts.staging != nil {
+			opts.staging.remove = append(opts.staging.remove, n)
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, n)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing %v", n)
+		}
 	}
 
+	if opts.staging != nil {
+		// recorded, and its post script run, once the batch is committed.
+		opts.staging.installed = append(opts.staging.installed, m)
+		if stale != nil {
+			opts.staging.upgraded = append(opts.staging.upgraded, m.Name)
+		}
+		return opts.emit(pm.Commit, m)
+	}
+	if err := script(root, m, post); err != nil {
+		return errors.Wrap(err, post)
+	}
+
+	if err := opts.emit(pm.Commit, m); err != nil {
+		return err
+	}
 	if err := db.AddInstalled(root, m); err != nil {
-		return errors.Wrapf(err, "adding ", m.Name)
+		return errors.Wrapf(err, "adding %v", m.Name)
+	}
+	if err := activateTriggers(root, m); err != nil {
+		return errors.Wrap(err, "activating triggers")
 	}
 	return nil
 }
@@ -0,0 +1,2522 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	gocrypto "crypto"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	yaml "gopkg.in/yaml.v2"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+	"mcquay.me/pm/keyring"
+	"mcquay.me/pm/plugin"
+)
+
+// fixture is a pm root configured with a single remote that serves signed
+// packages built from testdata.
+type fixture struct {
+	root string
+	dist string
+	srv  *httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int
+	fail map[string]bool
+}
+
+// newFixture builds and serves a package for each of ms. The contents of
+// each package's root.tar.bz2 come from testdata/<name>.tar.bz2, and its
+// CHANGELOG, if it ships one, from testdata/<name>.CHANGELOG.
+func newFixture(t testing.TB, ms ...pm.Meta) (*fixture, func()) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	dist, err := ioutil.TempDir("", "pm-tests-dist-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "var", "lib", "pm"), 0700); err != nil {
+		t.Fatalf("making pm dirs: %v", err)
+	}
+
+	if err := keyring.NewKeyPair(root, "pm tests", "test@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+	key, err := keyring.FindSecretEntity(root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret key: %v", err)
+	}
+
+	av := pm.Available{}
+	for _, m := range ms {
+		dir := filepath.Join(dist, string(m.Name))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		copyFile(t, filepath.Join("testdata", string(m.Name)+".tar.bz2"), filepath.Join(dir, "root.tar.bz2"))
+		if cl := filepath.Join("testdata", string(m.Name)+".CHANGELOG"); fs.Exists(cl) {
+			copyFile(t, cl, filepath.Join(dir, "CHANGELOG"))
+		}
+		writeMeta(t, filepath.Join(dir, "meta.yaml"), m)
+		if err := Create(key, dir); err != nil {
+			t.Fatalf("create %v: %v", m.Name, err)
+		}
+		if err := av.Add(m); err != nil {
+			t.Fatalf("add %v: %v", m.Name, err)
+		}
+	}
+	f, err := os.Create(filepath.Join(dist, "available.json"))
+	if err != nil {
+		t.Fatalf("create available.json: %v", err)
+	}
+	if err := json.NewEncoder(f).Encode(av); err != nil {
+		t.Fatalf("encode available.json: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close available.json: %v", err)
+	}
+
+	fx := &fixture{
+		root: root,
+		dist: dist,
+		hits: map[string]int{},
+		fail: map[string]bool{},
+	}
+	files := http.FileServer(http.Dir(dist))
+	fx.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fx.mu.Lock()
+		fx.hits[r.URL.Path]++
+		fail := fx.fail[r.URL.Path]
+		fx.mu.Unlock()
+		if fail {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+
+	if err := db.AddRemotes(root, []string{fx.srv.URL}); err != nil {
+		t.Fatalf("add remote: %v", err)
+	}
+	if err := db.Pull(root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+
+	return fx, func() {
+		fx.srv.Close()
+		for _, d := range []string{root, dist} {
+			if err := os.RemoveAll(d); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+		}
+	}
+}
+
+func (fx *fixture) setFail(path string, fail bool) {
+	fx.mu.Lock()
+	fx.fail[path] = fail
+	fx.mu.Unlock()
+}
+
+func (fx *fixture) hitCount(path string) int {
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	return fx.hits[path]
+}
+
+// addRepo serves ms from a second remote labeled label, and configures it
+// without pulling. Each package's root is testdata/<name>-<version>.tar.bz2
+// if it exists, and testdata/<name>.tar.bz2 otherwise.
+func (fx *fixture) addRepo(t *testing.T, label string, ms ...pm.Meta) {
+	key, err := keyring.FindSecretEntity(fx.root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret key: %v", err)
+	}
+	av := pm.Available{}
+	for _, m := range ms {
+		dir := filepath.Join(fx.dist, label, string(m.Name))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		tbz := filepath.Join("testdata", fmt.Sprintf("%v-%v.tar.bz2", m.Name, m.Version))
+		if !fs.Exists(tbz) {
+			tbz = filepath.Join("testdata", string(m.Name)+".tar.bz2")
+		}
+		copyFile(t, tbz, filepath.Join(dir, "root.tar.bz2"))
+		writeMeta(t, filepath.Join(dir, "meta.yaml"), m)
+		if err := Create(key, dir); err != nil {
+			t.Fatalf("create %v: %v", m.Name, err)
+		}
+		if err := av.Add(m); err != nil {
+			t.Fatalf("add %v: %v", m.Name, err)
+		}
+	}
+	b, err := json.Marshal(av)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fx.dist, label, "available.json"), b, 0644); err != nil {
+		t.Fatalf("write available.json: %v", err)
+	}
+	if err := db.AddRemotes(fx.root, []string{fx.srv.URL + "/" + label}); err != nil {
+		t.Fatalf("add remote: %v", err)
+	}
+}
+
+func copyFile(t testing.TB, src, dst string) {
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func writeMeta(t testing.TB, fn string, m pm.Meta) {
+	md := map[string]interface{}{
+		"name":        m.Name,
+		"version":     m.Version,
+		"description": m.Description,
+	}
+	if len(m.Deps) > 0 {
+		md["deps"] = m.Deps
+	}
+	if len(m.Before) > 0 {
+		md["before"] = m.Before
+	}
+	if len(m.After) > 0 {
+		md["after"] = m.After
+	}
+	b, err := yaml.Marshal(md)
+	if err != nil {
+		t.Fatalf("marshal meta: %v", err)
+	}
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		t.Fatalf("write meta: %v", err)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	for _, fn := range []string{"bin/a", "share/a/README"} {
+		if !fs.Exists(filepath.Join(fx.root, fn)) {
+			t.Fatalf("%v not installed", fn)
+		}
+	}
+	ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"})
+	if err != nil {
+		t.Fatalf("is installed: %v", err)
+	}
+	if !ok {
+		t.Fatalf("a not recorded as installed")
+	}
+
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := len(iDB["a"].Files), 2; got != want {
+		t.Fatalf("recorded files: got %v, want %v", got, want)
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fx.root, "share/a/README"), []byte("tampered\n"), 0644); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if err := Check(fx.root, []string{"a"}); err == nil {
+		t.Fatalf("check should have found the modified README")
+	}
+}
+
+func TestInstallResume(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	pkgs := []string{"a", "b", "c"}
+
+	fx.setFail("/c-1.0.0.pkg", true)
+	if err := Install(fx.root, pkgs, Options{}); err == nil {
+		t.Fatalf("should have failed to install c")
+	}
+
+	p, err := loadProgress(fx.root, pkgs, "", Options{}.warner(WarnCorruptProgress, ""))
+	if err != nil {
+		t.Fatalf("load progress: %v", err)
+	}
+	for n, want := range map[pm.Name]stage{"a": downloaded, "b": downloaded, "c": pending} {
+		if got := p.Pkgs[n]; got != want {
+			t.Fatalf("progress for %v: got %v, want %v", n, got, want)
+		}
+	}
+
+	fx.setFail("/c-1.0.0.pkg", false)
+	if err := Install(fx.root, pkgs, Options{}); err != nil {
+		t.Fatalf("resumed install: %v", err)
+	}
+
+	for _, n := range pkgs {
+		if got, want := fx.hitCount("/"+n+"-1.0.0.pkg"), 1; n != "c" && got != want {
+			t.Fatalf("%v fetched %d times, want %d", n, got, want)
+		}
+		ok, err := db.IsInstalled(fx.root, pm.Meta{Name: pm.Name(n)})
+		if err != nil {
+			t.Fatalf("is installed: %v", err)
+		}
+		if !ok {
+			t.Fatalf("%v not installed after resume", n)
+		}
+	}
+	if fs.Exists(filepath.Join(fx.root, progressFile)) {
+		t.Fatalf("progress should be cleaned up after a completed batch")
+	}
+
+	// a different batch should start from scratch.
+	p, err = loadProgress(fx.root, []string{"a"}, "", Options{}.warner(WarnCorruptProgress, ""))
+	if err != nil {
+		t.Fatalf("load progress: %v", err)
+	}
+	if got := p.count(pm.Metas{{Name: "a"}}, downloaded); got != 0 {
+		t.Fatalf("unexpected progress for fresh batch: %v", got)
+	}
+}
+
+func TestInstallCorruptProgress(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	fn := filepath.Join(fx.root, progressFile)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// as left by a run that died while writing it.
+	if err := ioutil.WriteFile(fn, []byte(`{"pkgs":{"a":`), 0644); err != nil {
+		t.Fatalf("write progress: %v", err)
+	}
+
+	ws := []Warning{}
+	if err := Install(fx.root, []string{"a"}, Options{Warnings: &ws}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if len(ws) != 1 || ws[0].Code != WarnCorruptProgress {
+		t.Fatalf("warnings: got %+v, want one %v", ws, WarnCorruptProgress)
+	}
+	ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"})
+	if err != nil {
+		t.Fatalf("is installed: %v", err)
+	}
+	if !ok {
+		t.Fatalf("a not installed")
+	}
+	if fs.Exists(fn) {
+		t.Fatalf("progress should be cleaned up after a completed batch")
+	}
+}
+
+func TestExpandRootBadChecksum(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	m := pm.Meta{Name: "a", Version: "1.0.0"}
+	ip := filepath.Join(root, installed, string(m.Name))
+	for _, d := range []string{ip, filepath.Join(root, cache), filepath.Join(root, "bin")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	bom := fmt.Sprintf("%x\tbin/a\n", sha256.Sum256([]byte("not what's in the tarball")))
+	if err := ioutil.WriteFile(filepath.Join(ip, "bom.sha256"), []byte(bom), 0644); err != nil {
+		t.Fatalf("write bom: %v", err)
+	}
+	fn := filepath.Join(root, "bin", "a")
+	if err := ioutil.WriteFile(fn, []byte("installed\n"), 0755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tbz, err := ioutil.ReadFile(filepath.Join("testdata", "a.tar.bz2"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	pf, err := os.Create(filepath.Join(root, cache, m.Pkg()))
+	if err != nil {
+		t.Fatalf("create pkg: %v", err)
+	}
+	tw := tar.NewWriter(pf)
+	if err := tw.WriteHeader(&tar.Header{Name: "root.tar.bz2", Mode: 0644, Size: int64(len(tbz))}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write(tbz); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatalf("close pkg: %v", err)
+	}
+
+	if _, _, err := expandRoot(root, ip, filepath.Join(root, cache, m.Pkg()), 0, Options{}); err == nil || !strings.Contains(err.Error(), "checksum was incorrect") {
+		t.Fatalf("got %v, want a checksum error", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b) != "installed\n" {
+		t.Fatalf("bad entry replaced the installed file with %q", b)
+	}
+	fis, err := ioutil.ReadDir(filepath.Dir(fn))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("temp file left behind: %v", fis)
+	}
+}
+
+func TestRelative(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"usr/bin/foo", true},
+		{"./usr/bin/foo", true},
+		{"/etc/passwd", false},
+		{"/", false},
+		{"../../etc/passwd", false},
+		{"..", false},
+		{"usr/../../etc/passwd", false},
+		{"usr/../bin/foo", true},
+		{"..foo/bar", true},
+	}
+	for _, test := range tests {
+		if err := relative(test.name); (err == nil) != test.ok {
+			t.Fatalf("relative(%q): got %v, want ok == %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestExpandPkgContentsOutside(t *testing.T) {
+	for _, name := range []string{"/etc/passwd", "../../etc/passwd"} {
+		root, err := ioutil.TempDir("", "pm-tests-root-")
+		if err != nil {
+			t.Fatalf("tmpdir: %v", err)
+		}
+		defer os.RemoveAll(root)
+		if err := os.MkdirAll(filepath.Join(root, cache), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+
+		m := pm.Meta{Name: "evil", Version: "1.0.0"}
+		body := []byte("root::0:0::/root:/bin/sh\n")
+		man := fmt.Sprintf("%x\t%v\n", sha256.Sum256(body), name)
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, e := range []struct {
+			name string
+			body []byte
+		}{{"manifest.sha256", []byte(man)}, {name, body}} {
+			if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body))}); err != nil {
+				t.Fatalf("write header: %v", err)
+			}
+			if _, err := tw.Write(e.body); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("close tar: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, cache, m.Pkg()), buf.Bytes(), 0644); err != nil {
+			t.Fatalf("write pkg: %v", err)
+		}
+
+		if err := expandPkgContents(filepath.Join(root, cache, m.Pkg()), filepath.Join(root, installed, string(m.Name)), nil, nil); err == nil {
+			t.Fatalf("%q: extracted an entry outside the package", name)
+		}
+		if fs.Exists(filepath.Join(root, installed, string(m.Name), name)) {
+			t.Fatalf("%q: written", name)
+		}
+	}
+}
+
+func TestInstallOverOpenFile(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	fn := filepath.Join(fx.root, "bin", "a")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("old contents, which are longer than the new\n"), 0755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	running, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer running.Close()
+
+	// bin/a isn't owned by an installed package, so it must be overwritten
+	// explicitly.
+	if err := Install(fx.root, []string{"a"}, Options{UnownedFiles: UnownedOverwrite}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	old, err := ioutil.ReadAll(running)
+	if err != nil {
+		t.Fatalf("read old: %v", err)
+	}
+	if got, want := string(old), "old contents, which are longer than the new\n"; got != want {
+		t.Fatalf("open file was modified: got %q, want %q", got, want)
+	}
+	fresh, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read new: %v", err)
+	}
+	if got, want := string(fresh), "#!/bin/sh\necho a\n"; got != want {
+		t.Fatalf("new contents: got %q, want %q", got, want)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if got, want := fi.Mode().Perm(), os.FileMode(0755); got != want {
+		t.Fatalf("mode: got %v, want %v", got, want)
+	}
+}
+
+func TestInstallDeps(t *testing.T) {
+	ms := []pm.Meta{
+		{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		{Name: "b", Version: "1.0.0", Description: "a test pkg", Deps: []string{"c@1.0.0"}},
+		{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	}
+
+	t.Run("deps", func(t *testing.T) {
+		fx, del := newFixture(t, ms...)
+		defer del()
+
+		if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+			t.Fatalf("install: %v", err)
+		}
+		iDB, err := db.LoadInstalled(fx.root)
+		if err != nil {
+			t.Fatalf("load installed: %v", err)
+		}
+		if got, want := len(iDB), 3; got != want {
+			t.Fatalf("installed: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("no deps", func(t *testing.T) {
+		fx, del := newFixture(t, ms...)
+		defer del()
+
+		if err := Install(fx.root, []string{"a"}, Options{NoDeps: true}); err != nil {
+			t.Fatalf("install: %v", err)
+		}
+		iDB, err := db.LoadInstalled(fx.root)
+		if err != nil {
+			t.Fatalf("load installed: %v", err)
+		}
+		if got, want := len(iDB), 1; got != want {
+			t.Fatalf("installed: got %v, want %v", got, want)
+		}
+		if got, want := strings.Join(iDB["a"].Deps, ","), "b"; got != want {
+			t.Fatalf("recorded deps: got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestInstallMirrors(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+	mirror := httptest.NewServer(http.FileServer(http.Dir(fx.dist)))
+	defer mirror.Close()
+
+	fx.setFail("/a-1.0.0.pkg", true)
+	r := &InstallReport{}
+	ws := []Warning{}
+	// remotes are matched in canonical form, however they are given.
+	remote := strings.Replace(fx.srv.URL, "http://", "HTTP://", 1) + "/"
+	opts := Options{
+		Mirrors:  map[string][]string{remote: {mirror.URL}},
+		Report:   r,
+		Warnings: &ws,
+	}
+	if err := Install(fx.root, []string{"a"}, opts); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if !fs.Exists(filepath.Join(fx.root, "bin/a")) {
+		t.Fatalf("bin/a not installed")
+	}
+	if len(ws) != 1 || ws[0].Code != WarnMirrorFailed || ws[0].Package != "a" {
+		t.Fatalf("warnings: got %+v, want one about a's failed fetch", ws)
+	}
+
+	if got := len(r.Mirrors); got != 2 {
+		t.Fatalf("got stats for %d urls, want 2: %+v", got, r.Mirrors)
+	}
+	if got := r.Mirrors[0]; got.URL != fx.srv.URL || got.Failures != 1 || got.Downloads != 0 {
+		t.Fatalf("remote: got %+v, want 1 failure and no downloads", got)
+	}
+	if got := r.Mirrors[1]; got.URL != mirror.URL || got.Failures != 0 || got.Downloads != 1 {
+		t.Fatalf("mirror: got %+v, want 1 download", got)
+	}
+}
+
+func TestInstallEvents(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	buf := &bytes.Buffer{}
+	if err := Install(fx.root, []string{"a"}, Options{Observer: JSONObserver(buf)}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	got := []string{}
+	dec := json.NewDecoder(buf)
+	for {
+		e := pm.Event{}
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		got = append(got, e.String())
+	}
+	want := []string{
+		"resolve",
+		"download b@1.0.0",
+		"download a@1.0.0",
+		// installs of more than one package are staged.
+		"verify b@1.0.0",
+		"verify a@1.0.0",
+		"extract b@1.0.0",
+		"commit b@1.0.0",
+		"extract a@1.0.0",
+		"commit a@1.0.0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("events:\ngot:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInstallHooks(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		fx, del := newFixture(
+			t,
+			pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+			pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		)
+
+		seen := []string{}
+		record := func(e pm.Event) error {
+			seen = append(seen, e.String())
+			return nil
+		}
+		scanner := func(e pm.Event) error {
+			if e.Phase == pm.Extract && e.Name == "a" {
+				return errors.New("a looks suspicious")
+			}
+			return nil
+		}
+		err := Install(fx.root, []string{"a"}, Options{Hooks: []plugin.Hook{record, scanner}, Incremental: incremental})
+		if err == nil || !strings.Contains(err.Error(), "a looks suspicious") {
+			t.Fatalf("incremental %v: got %v, want the hook's error", incremental, err)
+		}
+
+		iDB, err := db.LoadInstalled(fx.root)
+		if err != nil {
+			t.Fatalf("load installed: %v", err)
+		}
+		// b is installed before a is rejected, and a staged install takes
+		// it out again.
+		if _, ok := iDB["b"]; ok != incremental {
+			t.Fatalf("incremental %v: b installed: got %v, want %v", incremental, ok, incremental)
+		}
+		if got := fs.Exists(filepath.Join(fx.root, "bin", "b")); got != incremental {
+			t.Fatalf("incremental %v: bin/b exists: got %v, want %v", incremental, got, incremental)
+		}
+		if _, ok := iDB["a"]; ok {
+			t.Fatalf("incremental %v: a installed despite its hook failing", incremental)
+		}
+		if got, want := seen[len(seen)-1], "extract a@1.0.0"; got != want {
+			t.Fatalf("incremental %v: last event: got %v, want %v", incremental, got, want)
+		}
+		// nothing is left half done, so the install can simply be run again.
+		if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+			t.Fatalf("incremental %v: reinstall: %v", incremental, err)
+		}
+		del()
+	}
+}
+
+func TestInstallConfirm(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}, DownloadSize: 10},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg", DownloadSize: 20},
+	)
+	defer del()
+
+	var plan Plan
+	decline := func(p Plan) bool {
+		plan = p
+		return false
+	}
+	if err := Install(fx.root, []string{"a"}, Options{Confirm: decline}); err != ErrCancelled {
+		t.Fatalf("got %v, want %v", err, ErrCancelled)
+	}
+	if got, want := len(plan.Packages), 2; got != want {
+		t.Fatalf("planned packages: got %v, want %v", got, want)
+	}
+	if got, want := plan.DownloadSize, int64(30); got != want {
+		t.Fatalf("planned download size: got %v, want %v", got, want)
+	}
+	if got, want := plan.Selections[0].Reason, "newest available; required by a"; got != want {
+		t.Fatalf("reason for b: got %q, want %q", got, want)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if len(iDB) != 0 {
+		t.Fatalf("nothing should be installed after declining: %v", iDB)
+	}
+
+	// the sizes above are made up, so the download is rejected once the
+	// server reports the real ones; getting that far shows Confirm was
+	// skipped.
+	err = Install(fx.root, []string{"a"}, Options{Confirm: decline, AutoApprove: true})
+	if err == nil || !strings.Contains(err.Error(), "available db says 20") {
+		t.Fatalf("auto approved install: got %v, want a download size mismatch", err)
+	}
+}
+
+func TestInstallDryRun(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	dry, sim := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := Install(fx.root, []string{"a"}, Options{DryRun: true, PlanWriter: dry}); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if err := Install(fx.root, []string{"a"}, Options{Simulate: true, PlanWriter: sim}); err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+	if !strings.Contains(dry.String(), "2 packages") {
+		t.Fatalf("plan not written: %q", dry)
+	}
+	if dry.String() != sim.String() {
+		t.Fatalf("simulate: got %q, want %q", sim, dry)
+	}
+	for _, pn := range []string{"/a-1.0.0.pkg", "/b-1.0.0.pkg"} {
+		if got := fx.hitCount(pn); got != 0 {
+			t.Fatalf("%v downloaded %d times", pn, got)
+		}
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if len(iDB) != 0 {
+		t.Fatalf("dry run installed %v", iDB)
+	}
+}
+
+func TestInstallBOM(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	buf := &bytes.Buffer{}
+	if err := Install(fx.root, []string{"a"}, Options{BOM: buf}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	b := BOM{}
+	if err := json.NewDecoder(buf).Decode(&b); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, want := len(b.Packages), 2; got != want {
+		t.Fatalf("packages: got %v, want %v", got, want)
+	}
+	for _, p := range b.Packages {
+		if p.SignedBy == "" {
+			t.Fatalf("%v: missing signing key", p.Name)
+		}
+		if got, want := len(p.Files), 2; got != want {
+			t.Fatalf("%v files: got %v, want %v", p.Name, got, want)
+		}
+	}
+}
+
+func TestCheckSkew(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		label   string
+		created time.Time
+		ok      bool
+	}{
+		{"past", now.Add(-time.Hour), true},
+		{"now", now, true},
+		{"minor skew", now.Add(time.Minute), true},
+		{"future", now.Add(24 * time.Hour), false},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			err := checkSkew(&keyring.Signature{CreatedAt: test.created}, now, DefaultMaxClockSkew, t.Logf)
+			if (err == nil) != test.ok {
+				t.Fatalf("got %v, want ok == %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestInstallStop(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	pkgs := []string{"a", "b"}
+	stop := make(chan struct{})
+	// a staged install is all or nothing, so stopping it would leave
+	// neither installed.
+	opts := Options{
+		Stop:        stop,
+		Incremental: true,
+		Observer: func(e pm.Event) {
+			// the signal arrives while a is being extracted.
+			if e.Phase == pm.Extract && e.Name == "a" {
+				close(stop)
+			}
+		},
+	}
+	if err := Install(fx.root, pkgs, opts); err != ErrStopped {
+		t.Fatalf("got %v, want %v", err, ErrStopped)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if _, ok := iDB["a"]; !ok || len(iDB) != 1 {
+		t.Fatalf("only a should be installed; got %v", iDB)
+	}
+
+	if err := Install(fx.root, pkgs, Options{}); err != nil {
+		t.Fatalf("resumed install: %v", err)
+	}
+	iDB, err = db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := len(iDB), 2; got != want {
+		t.Fatalf("installed after resume: got %v, want %v", got, want)
+	}
+}
+
+func TestInstallSpecialFiles(t *testing.T) {
+	for _, name := range []string{"chardev", "blockdev", "fifo"} {
+		fx, del := newFixture(t, pm.Meta{Name: pm.Name(name), Version: "1.0.0", Description: "a special pkg"})
+		err := Install(fx.root, []string{name}, Options{})
+		if err == nil {
+			t.Fatalf("%v: installed a package containing special files", name)
+		}
+		if !strings.Contains(err.Error(), "special files are not allowed") {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if fs.Exists(filepath.Join(fx.root, "dev", name)) {
+			t.Fatalf("%v: special file was created", name)
+		}
+		del()
+	}
+
+	// bin/mixed is written before dev/fifo is rejected.
+	fx, del := newFixture(t, pm.Meta{Name: "mixed", Version: "1.0.0", Description: "a special pkg"})
+	if err := Install(fx.root, []string{"mixed"}, Options{}); err == nil {
+		t.Fatalf("mixed: installed a package containing special files")
+	}
+	for _, fn := range []string{"bin/mixed", filepath.Join(installed, "mixed")} {
+		if fs.Exists(filepath.Join(fx.root, fn)) {
+			t.Fatalf("mixed: %v left behind", fn)
+		}
+	}
+	del()
+
+	// creating a fifo needs no privileges, so the opt-in can be exercised.
+	fx, del = newFixture(t, pm.Meta{Name: "fifo", Version: "1.0.0", Description: "a special pkg"})
+	defer del()
+	if err := Install(fx.root, []string{"fifo"}, Options{SpecialFiles: true}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(fx.root, "dev", "fifo"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("dev/fifo: got mode %v, want a named pipe", fi.Mode())
+	}
+}
+
+func TestInstallTargetDir(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	target, err := ioutil.TempDir("", "pm-tests-target-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(target)
+
+	if err := Install(fx.root, []string{"a"}, Options{TargetDir: target}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	for _, fn := range []string{"bin/a", "share/a/README"} {
+		if !fs.Exists(filepath.Join(target, fn)) {
+			t.Fatalf("%v not extracted into target", fn)
+		}
+		if fs.Exists(filepath.Join(fx.root, fn)) {
+			t.Fatalf("%v extracted into root", fn)
+		}
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if len(iDB) != 0 {
+		t.Fatalf("target dir install was recorded: %v", iDB)
+	}
+	if fs.Exists(filepath.Join(fx.root, installed, "a")) {
+		t.Fatalf("package contents left in installed dir")
+	}
+
+	// verification still applies.
+	other, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(other)
+	if err := keyring.NewKeyPair(other, "someone else", "else@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+	copyFile(t, filepath.Join(other, "var", "lib", "pm", "pgp", "pubring.gpg"), filepath.Join(fx.root, "var", "lib", "pm", "pgp", "pubring.gpg"))
+	if err := os.RemoveAll(filepath.Join(target, "bin")); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if err := Install(fx.root, []string{"a"}, Options{TargetDir: target}); err == nil {
+		t.Fatalf("installed a package signed by an unknown key")
+	}
+	if fs.Exists(filepath.Join(target, "bin", "a")) {
+		t.Fatalf("unverified package was extracted")
+	}
+}
+
+func TestInstallExclude(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{ExcludePatterns: []string{"share/*"}}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if !fs.Exists(filepath.Join(fx.root, "bin", "a")) {
+		t.Fatalf("bin/a not installed")
+	}
+	if fs.Exists(filepath.Join(fx.root, "share", "a", "README")) {
+		t.Fatalf("excluded file was installed")
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	m := iDB["a"]
+	if got, want := m.Excluded, []string{"share/a/README"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("excluded: got %v, want %v", got, want)
+	}
+	if _, ok := m.Files["share/a/README"]; ok {
+		t.Fatalf("excluded file recorded as installed")
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := Remove(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		want     bool
+	}{
+		{"usr/share/doc/a/README", []string{"usr/share/doc"}, true},
+		{"usr/share/doc/README", []string{"usr/share/doc/*"}, true},
+		{"usr/bin/a", []string{"usr/share/doc"}, false},
+		{"usr/bin/a", nil, false},
+		{"usr/share/man/man1/a.1", []string{"*/share/man"}, true},
+	}
+	for _, test := range tests {
+		got, err := excluded(test.name, test.patterns)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Fatalf("%v %v: got %v, want %v", test.name, test.patterns, got, test.want)
+		}
+	}
+	if _, err := excluded("a", []string{"["}); err == nil {
+		t.Fatalf("bad pattern not reported")
+	}
+}
+
+func TestInstallStrict(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b", "c"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	err := Install(fx.root, []string{"a"}, Options{NoDeps: true, Strict: true})
+	se, ok := err.(StrictError)
+	if !ok {
+		t.Fatalf("got %v, want a StrictError", err)
+	}
+	if got, want := len(se.Warnings), 1; got != want {
+		t.Fatalf("warnings: got %v, want %v", got, want)
+	}
+	if !strings.Contains(se.Error(), "b, c") {
+		t.Fatalf("error doesn't list the warning: %v", se)
+	}
+	if got := fx.hitCount("/a-1.0.0.pkg"); got != 0 {
+		t.Fatalf("strict install downloaded %d times", got)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{NoDeps: true}); err != nil {
+		t.Fatalf("lenient install: %v", err)
+	}
+}
+
+func TestInstallValidatorFunc(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	errPolicy := errors.New("against policy")
+	var seen []string
+	validate := func(pkgPath string, m pm.Meta) error {
+		if !fs.Exists(pkgPath) {
+			t.Fatalf("validator given missing %v", pkgPath)
+		}
+		seen = append(seen, filepath.Base(pkgPath))
+		if m.Name == "a" {
+			return errPolicy
+		}
+		return nil
+	}
+	err := Install(fx.root, []string{"a"}, Options{ValidatorFunc: validate})
+	if errors.Cause(err) != errPolicy {
+		t.Fatalf("got %v, want %v", err, errPolicy)
+	}
+	if !reflect.DeepEqual(seen, []string{"a-1.0.0.pkg"}) {
+		t.Fatalf("validated %v", seen)
+	}
+	if fs.Exists(filepath.Join(fx.root, "bin", "a")) {
+		t.Fatalf("bin/a extracted despite failing validation")
+	}
+	if ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"}); err != nil || ok {
+		t.Fatalf("a recorded as installed")
+	}
+
+	ok := func(string, pm.Meta) error { return nil }
+	if err := Install(fx.root, []string{"a"}, Options{ValidatorFunc: ok}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+}
+
+func TestPostInstallVerify(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{PostInstallVerify: true}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	files := iDB["a"].Files
+	if err := verifyOnDisk(fx.root, files, nil); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// simulate corruption introduced by the filesystem.
+	readme := filepath.Join(fx.root, "share", "a", "README")
+	if err := ioutil.WriteFile(readme, []byte("bit rot\n"), 0644); err != nil {
+		t.Fatalf("corrupting: %v", err)
+	}
+	err = verifyOnDisk(fx.root, files, nil)
+	if err == nil || !strings.Contains(err.Error(), "share/a/README") {
+		t.Fatalf("corruption not detected: %v", err)
+	}
+
+	ip := filepath.Join(fx.root, installed, "a")
+	rollback(fx.root, ip, files)
+	for _, fn := range []string{readme, filepath.Join(fx.root, "bin", "a"), ip} {
+		if fs.Exists(fn) {
+			t.Fatalf("%v left behind after rollback", fn)
+		}
+	}
+}
+
+func TestInstallOrdering(t *testing.T) {
+	// c must be installed before a, though neither depends on the other.
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg", Before: []string{"a"}},
+	)
+	defer del()
+
+	got := []string{}
+	opts := Options{
+		Observer: func(e pm.Event) {
+			if e.Phase == pm.Commit {
+				got = append(got, string(e.Name))
+			}
+		},
+	}
+	if err := Install(fx.root, []string{"a", "c"}, opts); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("install order: got %v, want %v", got, want)
+	}
+}
+
+func TestInstallMarginal(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	e, err := keyring.FindSecretEntity(fx.root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find key: %v", err)
+	}
+	if err := keyring.SetTrust(fx.root, keyring.Fingerprint(e), keyring.Marginal); err != nil {
+		t.Fatalf("set trust: %v", err)
+	}
+	if err := Install(fx.root, []string{"a"}, Options{}); err == nil {
+		t.Fatalf("installed a package signed by a marginal key")
+	}
+	if err := Install(fx.root, []string{"a"}, Options{AllowMarginal: true, Strict: true}); err == nil {
+		t.Fatalf("strict install accepted a marginal key")
+	}
+	if err := Install(fx.root, []string{"a"}, Options{AllowMarginal: true}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+}
+
+func TestInstallFromSource(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	// a second remote, labeled testing, offers a newer a.
+	fx.addRepo(t, "testing", pm.Meta{Name: "a", Version: "2.0.0", Description: "a test pkg"})
+
+	err := Install(fx.root, []string{"b"}, Options{FromSource: "testing"})
+	if _, ok := errors.Cause(err).(PackageNotInSourceError); !ok {
+		t.Fatalf("got %v, want a PackageNotInSourceError", err)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{FromSource: "testing"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := iDB["a"].Version, pm.Version("2.0.0"); got != want {
+		t.Fatalf("version: got %v, want %v", got, want)
+	}
+	if got, want := iDB["a"].Repository, "testing"; got != want {
+		t.Fatalf("repository: got %v, want %v", got, want)
+	}
+}
+
+func TestInstallABI(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg", ABITag: "glibc"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg", ABITag: "any"},
+	)
+	defer del()
+
+	err := Install(fx.root, []string{"a"}, Options{SystemABI: "musl"})
+	e, ok := errors.Cause(err).(pm.ABIIncompatibilityError)
+	if !ok {
+		t.Fatalf("got %v, want an ABIIncompatibilityError", err)
+	}
+	if e.Package != "b" {
+		t.Fatalf("got incompatible package %v, want b", e.Package)
+	}
+	if ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"}); err != nil || ok {
+		t.Fatalf("a installed despite incompatible dependency: %v, %v", ok, err)
+	}
+
+	if err := Install(fx.root, []string{"c"}, Options{SystemABI: "musl"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if err := Install(fx.root, []string{"a"}, Options{SystemABI: "glibc"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+}
+
+func TestInstallStripComponents(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "strip", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "deep", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	// strip's files are all under strip-1.0.0/, which is dropped on its
+	// own; deep's are under build/out/, which has to be asked for.
+	if err := Install(fx.root, []string{"strip"}, Options{}); err != nil {
+		t.Fatalf("install strip: %v", err)
+	}
+	if err := Install(fx.root, []string{"deep"}, Options{StripComponents: 2}); err != nil {
+		t.Fatalf("install deep: %v", err)
+	}
+	for _, n := range []string{"bin/strip", "bin/deep"} {
+		if !fs.Exists(filepath.Join(fx.root, n)) {
+			t.Errorf("%v missing", n)
+		}
+	}
+	for _, n := range []string{"strip-1.0.0", "build"} {
+		if fs.Exists(filepath.Join(fx.root, n)) {
+			t.Errorf("%v should have been stripped", n)
+		}
+	}
+	if err := Check(fx.root, []string{"strip", "deep"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	if err := Remove(fx.root, []string{"strip", "deep"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	for _, n := range []string{"bin/strip", "bin/deep"} {
+		if fs.Exists(filepath.Join(fx.root, n)) {
+			t.Errorf("%v not removed", n)
+		}
+	}
+}
+
+func TestInstallWarnings(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	e, err := keyring.FindSecretEntity(fx.root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find key: %v", err)
+	}
+	if err := keyring.SetTrust(fx.root, keyring.Fingerprint(e), keyring.Marginal); err != nil {
+		t.Fatalf("set trust: %v", err)
+	}
+
+	ws := []Warning{}
+	if err := Install(fx.root, []string{"a"}, Options{NoDeps: true, AllowMarginal: true, Warnings: &ws}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	want := []Warning{
+		{Code: WarnNoDeps},
+		{Code: WarnMarginalTrust, Package: "a"},
+	}
+	if len(ws) != len(want) {
+		t.Fatalf("warnings: got %v, want %v", ws, want)
+	}
+	for i := range want {
+		if ws[i].Code != want[i].Code || ws[i].Package != want[i].Package {
+			t.Fatalf("warning %d: got %+v, want %+v", i, ws[i], want[i])
+		}
+		if ws[i].Message == "" {
+			t.Fatalf("warning %d: no message", i)
+		}
+	}
+}
+
+func TestPlanRemove(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg", Deps: []string{"a"}},
+	)
+	defer del()
+	if err := Install(fx.root, []string{"c"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	names := func(ms pm.Metas) []pm.Name {
+		r := []pm.Name{}
+		for _, m := range ms {
+			r = append(r, m.Name)
+		}
+		return r
+	}
+	tests := []struct {
+		pkgs     []string
+		orphaned []pm.Name
+		broken   []pm.Name
+	}{
+		// b is only needed by way of a, and c needs a.
+		{[]string{"a"}, []pm.Name{"b"}, []pm.Name{"c"}},
+		{[]string{"c"}, []pm.Name{"a", "b"}, []pm.Name{}},
+		{[]string{"b"}, []pm.Name{}, []pm.Name{"a", "c"}},
+	}
+	for _, test := range tests {
+		p, err := PlanRemove(fx.root, test.pkgs)
+		if err != nil {
+			t.Fatalf("%v: plan remove: %v", test.pkgs, err)
+		}
+		if got := names(p.Orphaned); !reflect.DeepEqual(got, test.orphaned) {
+			t.Fatalf("%v: orphaned: got %v, want %v", test.pkgs, got, test.orphaned)
+		}
+		if got := names(p.Broken); !reflect.DeepEqual(got, test.broken) {
+			t.Fatalf("%v: broken: got %v, want %v", test.pkgs, got, test.broken)
+		}
+		if p.ReclaimedBytes == 0 {
+			t.Fatalf("%v: nothing reclaimed", test.pkgs)
+		}
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if len(iDB) != 3 {
+		t.Fatalf("planning removed packages: %v installed", len(iDB))
+	}
+
+	if _, err := PlanRemove(fx.root, []string{"nope"}); err == nil {
+		t.Fatalf("planned removal of a package that isn't installed")
+	}
+}
+
+func TestAutoremove(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if iDB["a"].Auto || !iDB["b"].Auto {
+		t.Fatalf("auto: got a %v, b %v, want a false, b true", iDB["a"].Auto, iDB["b"].Auto)
+	}
+	if got := iDB["b"].AutoInstalledBy; got != "a" {
+		t.Fatalf("b auto installed by %q, want a", got)
+	}
+
+	if err := db.MarkExplicit(fx.root, "b"); err != nil {
+		t.Fatalf("mark explicit: %v", err)
+	}
+	if iDB, err = db.LoadInstalled(fx.root); err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got := iDB["b"].AutoInstalledBy; got != "" {
+		t.Fatalf("explicit b auto installed by %q", got)
+	}
+	if err := Remove(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	ms, err := Autoremove(fx.root)
+	if err != nil {
+		t.Fatalf("autoremove: %v", err)
+	}
+	if len(ms) != 0 {
+		t.Fatalf("autoremoved %v", ms)
+	}
+	if !fs.Exists(filepath.Join(fx.root, "bin", "b")) {
+		t.Fatalf("b removed despite being marked explicit")
+	}
+
+	if err := db.MarkAuto(fx.root, "b"); err != nil {
+		t.Fatalf("mark auto: %v", err)
+	}
+	if ms, err = Autoremove(fx.root); err != nil {
+		t.Fatalf("autoremove: %v", err)
+	}
+	if len(ms) != 1 || ms[0].Name != "b" {
+		t.Fatalf("autoremoved %v, want b", ms)
+	}
+	if fs.Exists(filepath.Join(fx.root, "bin", "b")) {
+		t.Fatalf("bin/b left behind")
+	}
+	if err := db.MarkAuto(fx.root, "b"); err == nil {
+		t.Fatalf("marked a package that isn't installed")
+	}
+}
+
+func TestInstallStaged(t *testing.T) {
+	for _, staged := range []bool{false, true} {
+		fx, del := newFixture(
+			t,
+			pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+			pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		)
+		// b is installed first, so only a staged install notices a is bad
+		// before touching anything.
+		if err := ioutil.WriteFile(filepath.Join(fx.dist, "a-1.0.0.pkg"), []byte("not a pkg"), 0644); err != nil {
+			t.Fatalf("corrupt a: %v", err)
+		}
+		if err := Install(fx.root, []string{"a"}, Options{StagedInstall: staged, Incremental: !staged}); err == nil {
+			t.Fatalf("staged %v: installed a corrupt package", staged)
+		}
+		if got, want := fs.Exists(filepath.Join(fx.root, "bin", "b")), !staged; got != want {
+			t.Fatalf("staged %v: b installed: got %v, want %v", staged, got, want)
+		}
+		del()
+	}
+
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+	if err := Install(fx.root, []string{"a"}, Options{StagedInstall: true}); err != nil {
+		t.Fatalf("staged install: %v", err)
+	}
+	if err := Check(fx.root, []string{"a", "b"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestInstallStagedRollback(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	// b installs, and then a pushes the transaction over the quota.
+	err := Install(fx.root, []string{"a"}, Options{MaxTransactionBytes: 50})
+	if _, ok := errors.Cause(err).(QuotaError); !ok {
+		t.Fatalf("got %v, want a QuotaError", err)
+	}
+	if fs.Exists(filepath.Join(fx.root, "bin", "b")) {
+		t.Fatalf("bin/b left behind")
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if _, ok := iDB["b"]; ok {
+		t.Fatalf("b recorded as installed")
+	}
+	stages, err := filepath.Glob(filepath.Join(fx.root, pmDir, stagePrefix+"*"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(stages) != 0 {
+		t.Fatalf("stages left behind: %v", stages)
+	}
+	if fs.Exists(filepath.Join(fx.root, transactionFile)) {
+		t.Fatalf("transaction record left behind")
+	}
+}
+
+func TestInstallStagedScripts(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	// a's post-install script reads its files from root, and so only works
+	// once the batch is committed.
+	out := filepath.Join(fx.root, "post-install.out")
+	dir := filepath.Join(fx.dist, "a")
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	post := fmt.Sprintf("#!/bin/sh\ncat %v %v > %v\n", filepath.Join(fx.root, "bin", "a"), filepath.Join(fx.root, "bin", "b"), out)
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "post-install"), []byte(post), 0755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	key, err := keyring.FindSecretEntity(fx.root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret key: %v", err)
+	}
+	if err := Create(key, dir); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{StagedInstall: true}); err != nil {
+		t.Fatalf("staged install: %v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got, want := string(b), "#!/bin/sh\necho a\n#!/bin/sh\necho b\n"; got != want {
+		t.Fatalf("post-install saw %q, want %q", got, want)
+	}
+}
+
+func TestFinishTransaction(t *testing.T) {
+	fx, del := newFixture(t)
+	defer del()
+
+	stage, err := ioutil.TempDir(filepath.Join(fx.root, pmDir), stagePrefix)
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(stage, "bin"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(stage, "bin", "new"), []byte("new"), 0755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fx.root, "old"), []byte("old"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// as if interrupted after bin was created.
+	if err := os.Mkdir(filepath.Join(fx.root, "bin"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	b, err := json.Marshal(transaction{Stage: stage, Move: []string{"bin", "bin/new"}, Remove: []string{"old"}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fx.root, transactionFile), b, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := finishTransaction(fx.root); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(fx.root, "bin", "new")); err != nil || string(got) != "new" {
+		t.Fatalf("bin/new: got %q, %v", got, err)
+	}
+	for _, fn := range []string{filepath.Join(fx.root, "old"), filepath.Join(fx.root, transactionFile), stage} {
+		if fs.Exists(fn) {
+			t.Fatalf("%v left behind", fn)
+		}
+	}
+}
+
+func TestInstallUnownedFiles(t *testing.T) {
+	tests := []struct {
+		policy UnownedPolicy
+		err    bool
+		backup bool
+	}{
+		{"", true, false},
+		{UnownedAbort, true, false},
+		{UnownedBackup, false, true},
+		{UnownedOverwrite, false, false},
+	}
+	for _, test := range tests {
+		fx, del := newFixture(
+			t,
+			pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		)
+		fn := filepath.Join(fx.root, "bin", "a")
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("mine"), 0755); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		ws := []Warning{}
+		err := Install(fx.root, []string{"a"}, Options{UnownedFiles: test.policy, Warnings: &ws})
+		if test.err {
+			if ue, ok := errors.Cause(err).(UnownedFileError); !ok || ue.Package != "a" || ue.File != "bin/a" {
+				t.Fatalf("%q: got %v, want an UnownedFileError for bin/a", test.policy, err)
+			}
+			if got, err := ioutil.ReadFile(fn); err != nil || string(got) != "mine" {
+				t.Fatalf("%q: bin/a: got %q, %v, want it left alone", test.policy, got, err)
+			}
+			if ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"}); err != nil || ok {
+				t.Fatalf("%q: a recorded as installed", test.policy)
+			}
+			del()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: install: %v", test.policy, err)
+		}
+		if err := Check(fx.root, []string{"a"}); err != nil {
+			t.Fatalf("%q: check: %v", test.policy, err)
+		}
+		if len(ws) != 1 || ws[0].Code != WarnUnownedFile || ws[0].File != "bin/a" {
+			t.Fatalf("%q: got warnings %+v, want one for bin/a", test.policy, ws)
+		}
+		got, err := ioutil.ReadFile(fn + ".pmorig")
+		if test.backup && (err != nil || string(got) != "mine") {
+			t.Fatalf("%q: bin/a.pmorig: got %q, %v", test.policy, got, err)
+		}
+		if !test.backup && !os.IsNotExist(err) {
+			t.Fatalf("%q: bin/a.pmorig written", test.policy)
+		}
+		del()
+	}
+}
+
+func TestInstallReinstallDeps(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if err := Install(fx.root, []string{"b"}, Options{}); err == nil {
+		t.Fatalf("reinstalled b without ReinstallDeps")
+	}
+
+	commits := []pm.Name{}
+	opts := Options{
+		ReinstallDeps: true,
+		Observer: func(e pm.Event) {
+			if e.Phase == pm.Commit {
+				commits = append(commits, e.Name)
+			}
+		},
+	}
+	if err := Install(fx.root, []string{"b"}, opts); err != nil {
+		t.Fatalf("reinstall: %v", err)
+	}
+	if want := []pm.Name{"b", "a"}; !reflect.DeepEqual(commits, want) {
+		t.Fatalf("committed %v, want %v", commits, want)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if iDB["a"].Auto || !iDB["b"].Auto {
+		t.Fatalf("reinstall changed why a or b was installed: %+v", iDB)
+	}
+	if err := Check(fx.root, []string{"a", "b"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestInstallQuotas(t *testing.T) {
+	// each test package writes 37 bytes, and b is installed first.
+	tests := []struct {
+		label       string
+		size        int64
+		opts        Options
+		pkg         pm.Name
+		transaction bool
+		downloaded  bool
+	}{
+		{"planned package", 100, Options{MaxPackageBytes: 50}, "b", false, false},
+		{"planned transaction", 30, Options{MaxTransactionBytes: 50}, "a", true, false},
+		{"extracted package", 0, Options{MaxPackageBytes: 30}, "b", false, true},
+		{"extracted transaction", 0, Options{MaxTransactionBytes: 50}, "a", true, true},
+	}
+	for _, test := range tests {
+		fx, del := newFixture(
+			t,
+			pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}, InstalledSize: test.size},
+			pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg", InstalledSize: test.size},
+		)
+		err := Install(fx.root, []string{"a"}, test.opts)
+		qe, ok := errors.Cause(err).(QuotaError)
+		if !ok {
+			t.Fatalf("%v: got %v, want a QuotaError", test.label, err)
+		}
+		if qe.Package != test.pkg || qe.Transaction != test.transaction {
+			t.Fatalf("%v: got %+v, want package %v, transaction %v", test.label, qe, test.pkg, test.transaction)
+		}
+		if got := fx.hitCount("/a-1.0.0.pkg") > 0; got != test.downloaded {
+			t.Fatalf("%v: downloaded: got %v, want %v", test.label, got, test.downloaded)
+		}
+		if fs.Exists(filepath.Join(fx.root, "bin", string(test.pkg))) {
+			t.Fatalf("%v: bin/%v left behind", test.label, test.pkg)
+		}
+		del()
+	}
+}
+
+func TestInstallEnv(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	env := &bytes.Buffer{}
+	if err := Install(fx.root, []string{"a"}, Options{EnvOutput: env}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if got, want := env.String(), "B_VERSION=1.0.0\nA_VERSION=1.0.0\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		m    pm.Meta
+		want string
+	}{
+		{pm.Meta{Name: "go-tools", Version: "1.2.3+build.1"}, "GO_TOOLS_VERSION=1.2.3+build.1\n"},
+		{pm.Meta{Name: "7zip", Version: "16.02"}, "_7ZIP_VERSION=16.02\n"},
+		{pm.Meta{Name: "odd", Version: "it's 1.0"}, "ODD_VERSION='it'\\''s 1.0'\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := writeEnv(buf, pm.Metas{test.m}); err != nil {
+			t.Fatalf("write env: %v", err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Fatalf("%v: got %q, want %q", test.m.Name, got, test.want)
+		}
+	}
+}
+
+func TestInstallMinPriority(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b", "c"}, Priority: pm.Extra},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg", Priority: pm.Important},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg", Priority: pm.Optional},
+	)
+	defer del()
+
+	ws := []Warning{}
+	if err := Install(fx.root, []string{"a"}, Options{MinPriority: pm.Standard, Warnings: &ws}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	for n, want := range map[pm.Name]bool{"a": true, "b": true, "c": false} {
+		if _, got := iDB[n]; got != want {
+			t.Fatalf("%v installed: got %v, want %v", n, got, want)
+		}
+	}
+	if len(ws) != 1 || ws[0].Code != WarnLowPriority || ws[0].Package != "c" {
+		t.Fatalf("warnings: got %+v, want c skipped", ws)
+	}
+}
+
+func TestInstallHTTPSOnly(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	err := Install(fx.root, []string{"a"}, Options{HTTPSOnly: true})
+	ue, ok := errors.Cause(err).(pm.URLError)
+	if !ok {
+		t.Fatalf("got %v, want a pm.URLError", err)
+	}
+	if ue.Package != "a" {
+		t.Fatalf("got %+v, want a's remote", ue)
+	}
+	if iDB, err := db.LoadInstalled(fx.root); err != nil || len(iDB) != 0 {
+		t.Fatalf("installed %v (%v) from a plain http remote", iDB, err)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+}
+
+func TestInstallExpired(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg", ExpiresAt: &past},
+	)
+	defer del()
+
+	for _, pkgs := range [][]string{{"b"}, {"a"}} {
+		err := Install(fx.root, pkgs, Options{})
+		pe, ok := errors.Cause(err).(pm.PackageExpiredError)
+		if !ok || pe.Name != "b" {
+			t.Fatalf("%v: got %v, want a pm.PackageExpiredError for b", pkgs, err)
+		}
+	}
+	if iDB, err := db.LoadInstalled(fx.root); err != nil || len(iDB) != 0 {
+		t.Fatalf("installed %v (%v) despite expiry", iDB, err)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{AllowExpired: true}); err != nil {
+		t.Fatalf("install with AllowExpired: %v", err)
+	}
+}
+
+func TestInstallStripDebug(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "elf", Version: "1.0.0", Description: "a test pkg with a binary"},
+	)
+	defer del()
+
+	// a stand-in for strip that logs its arguments and shortens the binary.
+	log := filepath.Join(fx.root, "strip.log")
+	bin := filepath.Join(fx.root, "fake-strip")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %v\nfor f; do :; done\nprintf '\\177ELFstripped' > \"$f\"\n", log)
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("write fake strip: %v", err)
+	}
+
+	if err := Install(fx.root, []string{"elf"}, Options{StripDebug: true, StripBin: bin}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if got, want := string(b), "--strip-debug "+filepath.Join(fx.root, "bin", "elf")+"\n"; got != want {
+		t.Fatalf("strip called with %q, want %q", got, want)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(fx.root, "bin", "elf")); err != nil || string(b) != "\x7fELFstripped" {
+		t.Fatalf("binary not stripped: %q, %v", b, err)
+	}
+	// the stripped binary is what gets checked.
+	if err := Check(fx.root, []string{"elf"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestInstallUmask(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{Umask: 027}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	for fn, want := range map[string]os.FileMode{
+		"bin":            0750,
+		"bin/a":          0750,
+		"share/a":        0750,
+		"share/a/README": 0640,
+	} {
+		fi, err := os.Stat(filepath.Join(fx.root, fn))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Fatalf("%v: got %v, want %v", fn, got, want)
+		}
+	}
+}
+
+// addToPkg appends a file the manifest doesn't list to the .pkg fn.
+func addToPkg(t *testing.T, fn, name, contents string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	tr, tw := tar.NewReader(f), tar.NewWriter(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar traversal: %v", err)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatalf("copy: %v", err)
+		}
+	}
+	f.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := io.WriteString(tw, contents); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("write pkg: %v", err)
+	}
+}
+
+func TestInstallExtraFiles(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+	addToPkg(t, filepath.Join(fx.dist, "a-1.0.0.pkg"), "extra.txt", "not in the manifest\n")
+
+	err := Install(fx.root, []string{"a"}, Options{})
+	if ee, ok := errors.Cause(err).(ExtraFileError); !ok || ee.Filename != "extra.txt" {
+		t.Fatalf("got %v, want an ExtraFileError for extra.txt", err)
+	}
+
+	ws := []Warning{}
+	if err := Install(fx.root, []string{"a"}, Options{AllowExtraFiles: true, Warnings: &ws}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if len(ws) != 1 || ws[0].Code != WarnExtraFile || ws[0].Package != "a" {
+		t.Fatalf("warnings: got %+v, want one about a's extra file", ws)
+	}
+	if fs.Exists(filepath.Join(fx.root, installed, "a", "extra.txt")) {
+		t.Fatalf("extra file was written")
+	}
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	bin := filepath.Join(root, installed, "a", "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	out := filepath.Join(root, "ran")
+
+	tests := []struct {
+		label  string
+		interp string
+		script string
+		mode   os.FileMode
+		ran    bool
+		err    string
+	}{
+		{"shebang", "", "#!/bin/sh\ntouch " + out + "\n", 0755, true, ""},
+		{"declared", "sh", "touch " + out + "\n", 0644, true, ""},
+		{"declared over shebang", "sh", "#!/nonexistent/interp\ntouch " + out + "\n", 0644, true, ""},
+		{"missing declared", "/nonexistent/python9", "print('hi')\n", 0755, false, "/nonexistent/python9"},
+		{"missing shebang", "", "#!/nonexistent/interp -x\ntouch " + out + "\n", 0755, false, "/nonexistent/interp"},
+	}
+	for _, test := range tests {
+		os.Remove(out)
+		if err := ioutil.WriteFile(filepath.Join(bin, "pre-install"), []byte(test.script), test.mode); err != nil {
+			t.Fatalf("write script: %v", err)
+		}
+		if err := os.Chmod(filepath.Join(bin, "pre-install"), test.mode); err != nil {
+			t.Fatalf("chmod: %v", err)
+		}
+		m := pm.Meta{Name: "a", Version: "1.0.0", ScriptInterpreter: test.interp}
+		err := script(root, m, "pre-install")
+		if test.err == "" && err != nil {
+			t.Fatalf("%v: %v", test.label, err)
+		}
+		if test.err != "" {
+			mie, ok := errors.Cause(err).(MissingInterpreterError)
+			if !ok || mie.Interpreter != test.err || mie.Package != "a" {
+				t.Fatalf("%v: got %v, want a MissingInterpreterError for %v", test.label, err, test.err)
+			}
+		}
+		if got := fs.Exists(out); got != test.ran {
+			t.Fatalf("%v: ran: got %v, want %v", test.label, got, test.ran)
+		}
+	}
+}
+
+func TestInstallConflicts(t *testing.T) {
+	tests := []struct {
+		res     ConflictResolution
+		approve bool
+		err     bool
+		a, b    bool
+	}{
+		{"", true, true, true, false},
+		{ConflictFail, true, true, true, false},
+		{ConflictSkip, false, false, true, false},
+		{ConflictRemove, true, false, false, true},
+		{ConflictRemove, false, true, true, false},
+	}
+	for _, test := range tests {
+		fx, del := newFixture(
+			t,
+			pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+			pm.Meta{Name: "b", Version: "1.0.0", Description: "b test pkg", Conflicts: []string{"a"}},
+		)
+		if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+			t.Fatalf("%q: install a: %v", test.res, err)
+		}
+
+		ws := []Warning{}
+		err := Install(fx.root, []string{"b"}, Options{ConflictResolution: test.res, AutoApprove: test.approve, Warnings: &ws})
+		if test.err {
+			if ce, ok := errors.Cause(err).(ConflictError); !ok || ce.Package != "b" || ce.With != "a" {
+				t.Fatalf("%q: got %v, want a ConflictError", test.res, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%q: install b: %v", test.res, err)
+		}
+		for n, want := range map[pm.Name]bool{"a": test.a, "b": test.b} {
+			if ok, err := db.IsInstalled(fx.root, pm.Meta{Name: n}); err != nil || ok != want {
+				t.Fatalf("%q: %v installed: got %v, %v, want %v", test.res, n, ok, err, want)
+			}
+		}
+		if got := fs.Exists(filepath.Join(fx.root, "bin", "a")); got != test.a {
+			t.Fatalf("%q: bin/a exists: got %v, want %v", test.res, got, test.a)
+		}
+		if test.res == ConflictSkip && (len(ws) != 1 || ws[0].Code != WarnConflictSkipped) {
+			t.Fatalf("%q: got warnings %+v, want one for b", test.res, ws)
+		}
+		del()
+	}
+
+	// the plan shows what will be removed.
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "b test pkg", Conflicts: []string{"a"}},
+	)
+	defer del()
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install a: %v", err)
+	}
+	var plan Plan
+	confirm := func(p Plan) bool {
+		plan = p
+		return false
+	}
+	if err := Install(fx.root, []string{"b"}, Options{ConflictResolution: ConflictRemove, Confirm: confirm}); err != ErrCancelled {
+		t.Fatalf("got %v, want ErrCancelled", err)
+	}
+	if len(plan.Remove) != 1 || plan.Remove[0].Package != "a" {
+		t.Fatalf("plan removes %+v, want a", plan.Remove)
+	}
+	if !strings.Contains(plan.String(), "conflicts with b") {
+		t.Fatalf("removal not shown in plan:\n%v", plan)
+	}
+	if ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"}); err != nil || !ok {
+		t.Fatalf("a removed from a cancelled install")
+	}
+}
+
+func TestInstallKeyFingerprint(t *testing.T) {
+	fx, del := newFixture(t)
+	defer del()
+	key, err := keyring.FindSecretEntity(fx.root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret key: %v", err)
+	}
+	if err := keyring.NewKeyPair(fx.root, "pm tests", "other@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+	other, err := keyring.FindSecretEntity(fx.root, "other@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret key: %v", err)
+	}
+	fx.addRepo(
+		t, "signed",
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", KeyFingerprint: keyring.Fingerprint(key)},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "b test pkg", KeyFingerprint: "DEADBEEF"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "c test pkg", KeyFingerprint: keyring.Fingerprint(other)},
+	)
+	if err := db.Pull(fx.root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install a: %v", err)
+	}
+
+	// a key that isn't in the keyring is caught before downloading.
+	err = Install(fx.root, []string{"b"}, Options{})
+	if _, ok := errors.Cause(err).(keyring.KeyNotFoundError); !ok {
+		t.Fatalf("b: got %v, want a KeyNotFoundError", err)
+	}
+	if got := fx.hitCount("/signed/b-1.0.0.pkg"); got != 0 {
+		t.Fatalf("b: downloaded %d times", got)
+	}
+
+	// as is one that isn't trusted.
+	if err := keyring.SetTrust(fx.root, keyring.Fingerprint(other), keyring.Untrusted); err != nil {
+		t.Fatalf("set trust: %v", err)
+	}
+	if err := Install(fx.root, []string{"c"}, Options{}); err == nil {
+		t.Fatalf("c: installed a package declaring an untrusted key")
+	}
+	if got := fx.hitCount("/signed/c-1.0.0.pkg"); got != 0 {
+		t.Fatalf("c: downloaded %d times", got)
+	}
+
+	// c is really signed with the test key, not the one it declares.
+	if err := keyring.SetTrust(fx.root, keyring.Fingerprint(other), keyring.Trusted); err != nil {
+		t.Fatalf("set trust: %v", err)
+	}
+	err = Install(fx.root, []string{"c"}, Options{})
+	if me, ok := errors.Cause(err).(SignerMismatchError); !ok || me.Got != keyring.Fingerprint(key) {
+		t.Fatalf("c: got %v, want a SignerMismatchError", err)
+	}
+}
+
+func TestInstallHardlinks(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "hardlink", Version: "1.0.0", Description: "a multi-call pkg"})
+	defer del()
+	if err := Install(fx.root, []string{"hardlink"}, Options{PostInstallVerify: true}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	bb, err := os.Stat(filepath.Join(fx.root, "bin", "busybox"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	for _, n := range []string{"cat", "ls"} {
+		fi, err := os.Stat(filepath.Join(fx.root, "bin", n))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if !os.SameFile(bb, fi) {
+			t.Fatalf("bin/%v isn't a link to bin/busybox", n)
+		}
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	m := iDB["hardlink"]
+	want := map[string]string{"bin/cat": "bin/busybox", "bin/ls": "bin/busybox"}
+	if !reflect.DeepEqual(m.Hardlinks, want) {
+		t.Fatalf("hardlinks: got %v, want %v", m.Hardlinks, want)
+	}
+	if err := Check(fx.root, []string{"hardlink"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if n, err := diskUsage(fx.root, m); err != nil || n != bb.Size() {
+		t.Fatalf("disk usage: got %v, %v, want %v", n, err, bb.Size())
+	}
+
+	// a link replaced by a file of its own is checked on its own.
+	ls := filepath.Join(fx.root, "bin", "ls")
+	if err := os.Remove(ls); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := ioutil.WriteFile(ls, []byte("not busybox"), 0755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := Check(fx.root, []string{"hardlink"}); err == nil || !strings.Contains(err.Error(), "bin/ls") {
+		t.Fatalf("check: got %v, want a mismatch for bin/ls", err)
+	}
+
+	if err := Remove(fx.root, []string{"hardlink"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	for _, n := range []string{"busybox", "cat", "ls"} {
+		if fs.Exists(filepath.Join(fx.root, "bin", n)) {
+			t.Fatalf("bin/%v left behind", n)
+		}
+	}
+}
+
+func TestInstallTriggers(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Triggers: []string{"bin"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install a: %v", err)
+	}
+	out := filepath.Join(fx.root, "triggered")
+	trigger := filepath.Join(fx.root, installed, "a", "bin", "trigger")
+	if err := os.MkdirAll(filepath.Dir(trigger), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(trigger, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0755); err != nil {
+		t.Fatalf("write trigger: %v", err)
+	}
+
+	if err := Install(fx.root, []string{"b"}, Options{}); err != nil {
+		t.Fatalf("install b: %v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("a's trigger didn't run: %v", err)
+	}
+	if got, want := string(b), "bin/b\n"; got != want {
+		t.Fatalf("trigger args: got %q, want %q", got, want)
+	}
+	if fs.Exists(filepath.Join(fx.root, triggerCache)) {
+		t.Fatalf("trigger cache left behind")
+	}
+}
+
+// weakKey returns a new 1024 bit key that signs over SHA-1, imported into
+// the keyring in root.
+func weakKey(t *testing.T, root string) *openpgp.Entity {
+	weak, err := openpgp.NewEntity("weak", "pm", "weak@pm.mcquay.me", &packet.Config{RSABits: 1024, DefaultHash: gocrypto.SHA1})
+	if err != nil {
+		t.Fatalf("new entity: %v", err)
+	}
+	pub := &bytes.Buffer{}
+	w, err := armor.Encode(pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor: %v", err)
+	}
+	if err := weak.Serialize(w); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close armor: %v", err)
+	}
+	if err := keyring.Import(root, pub); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	return weak
+}
+
+// resignSHA1 replaces the signature on the manifest of the .pkg at pn with
+// one key makes over SHA-1, which keyring.Sign never does.
+func resignSHA1(t *testing.T, pn string, key *openpgp.Entity) {
+	f, err := os.Open(pn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	type entry struct {
+		hdr  *tar.Header
+		body []byte
+	}
+	entries := []entry{}
+	var man []byte
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %v: %v", hdr.Name, err)
+		}
+		if hdr.Name == "manifest.sha256" {
+			man = b
+		}
+		entries = append(entries, entry{hdr, b})
+	}
+	f.Close()
+
+	asc := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(asc, key, bytes.NewReader(man), &packet.Config{DefaultHash: gocrypto.SHA1}); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	out := &bytes.Buffer{}
+	tw := tar.NewWriter(out)
+	for _, e := range entries {
+		if e.hdr.Name == "manifest.sha256.asc" {
+			e.body = asc.Bytes()
+			e.hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write(e.body); err != nil {
+			t.Fatalf("write %v: %v", e.hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := ioutil.WriteFile(pn, out.Bytes(), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// the offset index no longer matches.
+	os.Remove(pn + indexSuffix)
+}
+
+func TestInstallSignatureStrength(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "b test pkg"},
+	)
+	defer del()
+
+	// a is re-signed with a 1024 bit key, over SHA-1.
+	weak := weakKey(t, fx.root)
+	if err := Create(weak, filepath.Join(fx.dist, "a")); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	resignSHA1(t, filepath.Join(fx.dist, "a-1.0.0.pkg"), weak)
+
+	tests := []struct {
+		pkg    string
+		ss     SignatureStrength
+		reason string
+	}{
+		{"a", SignatureStrength{MinBits: 2048}, "1024 bit RSA key"},
+		{"a", SignatureStrength{RejectSHA1: true}, "SHA-1"},
+		{"b", SignatureStrength{MinBits: 4096}, "2048 bit RSA key"},
+		{"b", SignatureStrength{MinBits: 2048, RejectSHA1: true, MinValidity: 24 * time.Hour}, ""},
+		{"a", SignatureStrength{}, ""},
+	}
+	for _, test := range tests {
+		err := Install(fx.root, []string{test.pkg}, Options{MinSignatureStrength: test.ss})
+		if test.reason == "" {
+			if err != nil {
+				t.Fatalf("%v %+v: install: %v", test.pkg, test.ss, err)
+			}
+			continue
+		}
+		we, ok := errors.Cause(err).(WeakSignatureError)
+		if !ok || we.Package != pm.Name(test.pkg) || !strings.Contains(we.Reason, test.reason) {
+			t.Fatalf("%v %+v: got %v, want a WeakSignatureError mentioning %q", test.pkg, test.ss, err, test.reason)
+		}
+	}
+}
+
+func TestValidateMetaConsistency(t *testing.T) {
+	tests := []struct {
+		name   pm.Name
+		ver    pm.Version
+		remote string
+		ok     bool
+	}{
+		{"a", "1.0.0", "https://example.com/pkgs", true},
+		{"a-b", "1.0.0-rc1", "https://example.com/pkgs", true},
+		{"a", "1.0.0+build.1", "https://example.com/pkgs", true},
+		{"a", "1.0.0", "oci://example.com/pkgs", true},
+		{"a", "1.0.0 ", "https://example.com/pkgs", false},
+		{" a", "1.0.0", "https://example.com/pkgs", false},
+		{"a", "../../b-1.0.0", "https://example.com/pkgs", false},
+		{"a/b", "1.0.0", "https://example.com/pkgs", false},
+		{"a", "1.0.0?x=1", "https://example.com/pkgs", false},
+		{"a", "1.0.0#2", "https://example.com/pkgs", false},
+		{"a", "1.0.0", "https://example.com/pkgs?token=x", false},
+		{"a", "1.0.0", "https://example.com/pkgs#frag", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.remote)
+		if err != nil {
+			t.Fatalf("parse %v: %v", test.remote, err)
+		}
+		err = validateMetaConsistency(pm.Meta{Name: test.name, Version: test.ver, Remote: *u})
+		if (err == nil) != test.ok {
+			t.Fatalf("%q@%q from %v: got %v, want ok: %v", test.name, test.ver, test.remote, err, test.ok)
+		}
+	}
+}
+
+func TestLastTransaction(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg", Deps: []string{"b"}},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if _, err := LastTransaction(fx.root); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want a not exist error", err)
+	}
+	if err := Install(fx.root, []string{"a"}, Options{DryRun: true}); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if _, err := LastTransaction(fx.root); !os.IsNotExist(err) {
+		t.Fatalf("dry run recorded: %v", err)
+	}
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	tx, err := LastTransaction(fx.root)
+	if err != nil {
+		t.Fatalf("last transaction: %v", err)
+	}
+	if tx.Operation != "install" || !reflect.DeepEqual(tx.Packages, []string{"b-1.0.0", "a-1.0.0"}) || tx.Status != 0 {
+		t.Fatalf("got %+v, want install of b-1.0.0 and a-1.0.0", tx)
+	}
+	if !strings.HasPrefix(tx.String(), "installed b-1.0.0, a-1.0.0 at ") {
+		t.Fatalf("got %q", tx)
+	}
+
+	if err := Remove(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if tx, err = LastTransaction(fx.root); err != nil || tx.Operation != "remove" || !reflect.DeepEqual(tx.Packages, []string{"a-1.0.0"}) {
+		t.Fatalf("got %+v, %v, want remove of a-1.0.0", tx, err)
+	}
+}
+
+// verifyFixture serves and downloads a, b and c, ready to be verified.
+func verifyFixture(t testing.TB) (*fixture, pm.Metas, *progress, func()) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	av, _, err := db.LoadAvailable(fx.root)
+	if err != nil {
+		t.Fatalf("load available: %v", err)
+	}
+	ms := pm.Metas{}
+	names := []string{}
+	for _, n := range []string{"a", "b", "c"} {
+		m, err := av.Get(pm.Name(n), "")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		ms = append(ms, m)
+		names = append(names, n)
+	}
+	p, err := loadProgress(fx.root, names, "", Options{}.warner(WarnCorruptProgress, ""))
+	if err != nil {
+		t.Fatalf("load progress: %v", err)
+	}
+	cacheDir := filepath.Join(fx.root, cache)
+	if err := ensureCache(cacheDir); err != nil {
+		t.Fatalf("cache: %v", err)
+	}
+	if err := download(cacheDir, ms, p, Options{}); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	return fx, ms, p, del
+}
+
+func TestPreverifyAll(t *testing.T) {
+	fx, ms, p, del := verifyFixture(t)
+	defer del()
+
+	var mu sync.Mutex
+	verified := map[pm.Name]bool{}
+	opts := Options{VerifyConcurrency: 3, Observer: func(e pm.Event) {
+		mu.Lock()
+		verified[e.Name] = e.Phase == pm.Verify
+		mu.Unlock()
+	}}
+	if err := preverifyAll(fx.root, ms, p, opts); err != nil {
+		t.Fatalf("preverify: %v", err)
+	}
+	if want := map[pm.Name]bool{"a": true, "b": true, "c": true}; !reflect.DeepEqual(verified, want) {
+		t.Fatalf("verified %v, want %v", verified, want)
+	}
+
+	pn := filepath.Join(fx.root, cache, ms[1].Pkg())
+	if err := os.Truncate(pn, 1024); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	err := preverifyAll(fx.root, ms, p, opts)
+	if err == nil {
+		t.Fatalf("corrupt b verified")
+	}
+	if !strings.Contains(err.Error(), "verifying b") {
+		t.Fatalf("got %v, want b to fail", err)
+	}
+}
+
+// BenchmarkPreverifyAll compares verifying a batch of packages one at a time
+// with verifying them concurrently.
+func BenchmarkPreverifyAll(b *testing.B) {
+	fx, ms, p, del := verifyFixture(b)
+	defer del()
+
+	for _, n := range []int{1, 0} {
+		name := "serial"
+		if n == 0 {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := preverifyAll(fx.root, ms, p, Options{VerifyConcurrency: n}); err != nil {
+					b.Fatalf("preverify: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+const lastTransactionFile = "var/lib/pm/last-transaction"
+
+// Transaction summarizes the last operation that changed the packages
+// installed in a root; see LastTransaction.
+type Transaction struct {
+	// Operation is "install", "remove" or "upgrade".
+	Operation string `json:"operation"`
+
+	// Packages are the packages the operation installed or removed, as
+	// name-version.
+	Packages []string `json:"packages"`
+
+	Time time.Time `json:"time"`
+
+	// Status is the operation's exit status. Only operations that succeed
+	// are recorded, so it is 0.
+	Status int `json:"status"`
+}
+
+func (t Transaction) String() string {
+	done := map[string]string{
+		"install": "installed",
+		"remove":  "removed",
+		"upgrade": "upgraded",
+	}[t.Operation]
+	if done == "" {
+		done = t.Operation
+	}
+	return fmt.Sprintf("%v %v at %v", done, strings.Join(t.Packages, ", "), t.Time.Format(time.RFC3339))
+}
+
+// recordTransaction records that op succeeded for ms in root, replacing the
+// previous record.
+func recordTransaction(root, op string, ms pm.Metas) error {
+	t := Transaction{Operation: op, Packages: []string{}, Time: time.Now().UTC().Truncate(time.Second)}
+	for _, m := range ms {
+		t.Packages = append(t.Packages, fmt.Sprintf("%v-%v", m.Name, m.Version))
+	}
+	f, err := os.Create(filepath.Join(root, lastTransactionFile))
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(t); err != nil {
+		f.Close()
+		return errors.Wrap(err, "encoding last transaction")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close last transaction")
+	}
+	return nil
+}
+
+// LastTransaction returns the summary of the last install, remove or upgrade
+// that succeeded in root. If there hasn't been one the error satisfies
+// os.IsNotExist.
+func LastTransaction(root string) (Transaction, error) {
+	t := Transaction{}
+	f, err := os.Open(filepath.Join(root, lastTransactionFile))
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&t); err != nil {
+		return t, errors.Wrap(err, "decoding last transaction")
+	}
+	return t, nil
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"mcquay.me/pm"
+)
+
+// Progress reports how much of a package has been downloaded; see
+// Options.OnProgress.
+type Progress struct {
+	Name    pm.Name
+	Version pm.Version
+
+	// Bytes have arrived of Total, which is -1 if the server didn't say.
+	Bytes int64
+	Total int64
+
+	// Done is set on the last update for a package, once it has all
+	// arrived.
+	Done bool
+}
+
+// defaultProgressInterval is the least time between progress updates when
+// Options.ProgressInterval is unset.
+const defaultProgressInterval = 100 * time.Millisecond
+
+// metered returns fetch, wrapped to report the progress of m's download to
+// o.OnProgress, if set.
+func (o Options) metered(fetch fetcher, m pm.Meta) fetcher {
+	if o.OnProgress == nil {
+		return fetch
+	}
+	every := o.ProgressInterval
+	if every <= 0 {
+		every = defaultProgressInterval
+	}
+	return func(url string) (io.ReadCloser, int64, error) {
+		body, length, err := fetch(url)
+		if err != nil {
+			return body, length, err
+		}
+		p := Progress{Name: m.Name, Version: m.Version, Total: length}
+		return newMeter(body, p, every, o.ProgressBytes, o.OnProgress, time.Now), length, nil
+	}
+}
+
+// meter counts the bytes read through it, reporting them at most once per
+// interval, or per bytes if set, and once more at io.EOF.
+type meter struct {
+	rc     io.ReadCloser
+	p      Progress
+	report func(Progress)
+
+	every time.Duration
+	bytes int64
+	now   func() time.Time
+
+	// last and lastN are when the last update was sent, and how many bytes
+	// it reported.
+	last  time.Time
+	lastN int64
+}
+
+func newMeter(rc io.ReadCloser, p Progress, every time.Duration, bytes int64, report func(Progress), now func() time.Time) *meter {
+	return &meter{rc: rc, p: p, report: report, every: every, bytes: bytes, now: now, last: now()}
+}
+
+func (m *meter) Read(b []byte) (int, error) {
+	n, err := m.rc.Read(b)
+	m.p.Bytes += int64(n)
+	if err == io.EOF {
+		if !m.p.Done {
+			m.p.Done = true
+			m.report(m.p)
+		}
+		return n, err
+	}
+	if n == 0 {
+		return n, err
+	}
+	if m.bytes > 0 && m.p.Bytes-m.lastN >= m.bytes {
+		m.send(m.now())
+	} else if t := m.now(); t.Sub(m.last) >= m.every {
+		m.send(t)
+	}
+	return n, err
+}
+
+func (m *meter) send(t time.Time) {
+	m.last, m.lastN = t, m.p.Bytes
+	m.report(m.p)
+}
+
+func (m *meter) Close() error {
+	return m.rc.Close()
+}
+
+// VerifyProgress reports how much of a package's contents have been checked
+// against its manifest; see Options.OnVerifyProgress.
+type VerifyProgress struct {
+	Name    pm.Name
+	Version pm.Version
+
+	// File is the entry being hashed, of which FileBytes have been of
+	// FileTotal.
+	File      string
+	FileBytes int64
+	FileTotal int64
+
+	// Bytes have been hashed of Total, across all the entries the
+	// manifest lists.
+	Bytes int64
+	Total int64
+
+	// Done is set on the last update for a package, once all of it has
+	// been verified.
+	Done bool
+}
+
+// verifyMeter reports the progress of verifying a .pkg, an entry at a time.
+// A nil *verifyMeter reports nothing.
+type verifyMeter struct {
+	p      VerifyProgress
+	report func(VerifyProgress)
+	every  time.Duration
+	bytes  int64
+}
+
+// verifyMeter returns a verifyMeter reporting the verification of m to
+// o.OnVerifyProgress, or nil if that is unset.
+func (o Options) verifyMeter(m pm.Meta) *verifyMeter {
+	if o.OnVerifyProgress == nil {
+		return nil
+	}
+	every := o.ProgressInterval
+	if every <= 0 {
+		every = defaultProgressInterval
+	}
+	return &verifyMeter{
+		p:      VerifyProgress{Name: m.Name, Version: m.Version},
+		report: o.OnVerifyProgress,
+		every:  every,
+		bytes:  o.ProgressBytes,
+	}
+}
+
+// entry returns r, the contents of the entry named name, wrapped to report
+// its size bytes being read.
+func (v *verifyMeter) entry(name string, size int64, r io.Reader) io.Reader {
+	if v == nil {
+		return r
+	}
+	base := v.p.Bytes
+	p := Progress{Name: v.p.Name, Version: v.p.Version, Total: size}
+	return newMeter(ioutil.NopCloser(r), p, v.every, v.bytes, func(p Progress) {
+		v.p.File, v.p.FileBytes, v.p.FileTotal = name, p.Bytes, size
+		v.p.Bytes = base + p.Bytes
+		v.report(v.p)
+	}, time.Now)
+}
+
+// done sends the last update, once every entry has been verified.
+func (v *verifyMeter) done() {
+	if v == nil {
+		return
+	}
+	v.p.Done = true
+	v.report(v.p)
+}
@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+// MirrorStats is what a download saw of one of the urls a remote's packages
+// were fetched from; see Options.Mirrors.
+type MirrorStats struct {
+	// URL is the remote's, or that of one of its mirrors.
+	URL string
+
+	// Downloads and Failures count the packages fetched from URL, and the
+	// attempts that failed.
+	Downloads int
+	Failures  int
+
+	// Bytes and Elapsed are how much was fetched from URL, and how long it
+	// took, failed attempts included.
+	Bytes   int64
+	Elapsed time.Duration
+
+	// strikes is the number of attempts that have failed since the last
+	// that didn't.
+	strikes int
+}
+
+// rate returns the throughput seen from the mirror, in bytes per second, or
+// 0 if nothing was fetched from it yet.
+func (s *MirrorStats) rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// mirrors tracks the health of the mirrors of each remote for the length of
+// a download, so that packages are fetched from those doing best. Nothing
+// about them outlives it.
+type mirrors struct {
+	mu sync.Mutex
+
+	// srcs maps the url of each remote with mirrors to its own url and
+	// those of its mirrors, in the order they were configured.
+	srcs  map[string][]url.URL
+	stats map[string]*MirrorStats
+}
+
+// newMirrors returns the mirrors for cfg, as in Options.Mirrors, or nil if
+// it is empty. The remotes of cfg are kept in canonical form, as the
+// remotes of packages are.
+func newMirrors(cfg map[string][]string) (*mirrors, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	ms := &mirrors{srcs: map[string][]url.URL{}, stats: map[string]*MirrorStats{}}
+	for remote, alts := range cfg {
+		ru, err := url.Parse(remote)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing remote %q", remote)
+		}
+		cu, err := pm.CanonicalURL(*ru)
+		if err != nil {
+			return nil, errors.Wrapf(err, "remote %q", remote)
+		}
+		key := cu.String()
+		ms.srcs[key] = append(ms.srcs[key], cu)
+		ms.stats[key] = &MirrorStats{URL: key}
+		for _, s := range alts {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing mirror %q", s)
+			}
+			ms.srcs[key] = append(ms.srcs[key], *u)
+			ms.stats[u.String()] = &MirrorStats{URL: u.String()}
+		}
+	}
+	return ms, nil
+}
+
+// canonicalRemote returns remote, a remote's url, in canonical form (see
+// pm.CanonicalURL), or as is if it has none.
+func canonicalRemote(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return remote
+	}
+	cu, err := pm.CanonicalURL(*u)
+	if err != nil {
+		return remote
+	}
+	return cu.String()
+}
+
+// order returns the urls packages from remote can be fetched from, best
+// first: those whose last attempts failed go last, and the others are
+// ranked by throughput, with the configured order breaking ties. It returns
+// nil if remote has no mirrors.
+func (ms *mirrors) order(remote string) []url.URL {
+	if ms == nil {
+		return nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	srcs := append([]url.URL{}, ms.srcs[remote]...)
+	sort.SliceStable(srcs, func(i, j int) bool {
+		a, b := ms.stats[srcs[i].String()], ms.stats[srcs[j].String()]
+		if a.strikes != b.strikes {
+			return a.strikes < b.strikes
+		}
+		return a.rate() > b.rate()
+	})
+	return srcs
+}
+
+// observe records an attempt to fetch a package from src, that fetched n
+// bytes in d and failed with err, if not nil.
+func (ms *mirrors) observe(src url.URL, n int64, d time.Duration, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s := ms.stats[src.String()]
+	s.Bytes += n
+	s.Elapsed += d
+	if err != nil {
+		s.Failures++
+		s.strikes++
+		return
+	}
+	s.Downloads++
+	s.strikes = 0
+}
+
+// fetchTo is fetchTo, but tries each of the urls m can be fetched from in
+// turn, best first, until one succeeds, telling warnf of each that fails.
+// The bytes of failed attempts count towards the total returned.
+func (ms *mirrors) fetchTo(fetch fetcher, m pm.Meta, fn string, warnf func(string, ...interface{})) (int64, error) {
+	srcs := ms.order(canonicalRemote(m.Remote.String()))
+	if len(srcs) == 0 {
+		return fetchTo(fetch, m, fn)
+	}
+	total := int64(0)
+	var err error
+	for _, src := range srcs {
+		mm := m
+		mm.Remote = src
+		start := time.Now()
+		var n int64
+		n, err = fetchTo(fetch, mm, fn)
+		ms.observe(src, n, time.Since(start), err)
+		total += n
+		if err == nil {
+			return total, nil
+		}
+		warnf("fetching %v from %v: %v", m.Name, src.String(), err)
+	}
+	return total, err
+}
+
+// report returns the stats of every mirror, grouped by remote in the order
+// they were configured.
+func (ms *mirrors) report() []MirrorStats {
+	if ms == nil {
+		return nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	remotes := []string{}
+	for remote := range ms.srcs {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	r := []MirrorStats{}
+	for _, remote := range remotes {
+		for _, src := range ms.srcs[remote] {
+			r = append(r, *ms.stats[src.String()])
+		}
+	}
+	return r
+}
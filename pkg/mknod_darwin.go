@@ -0,0 +1,20 @@
+package pkg
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// mknod creates the device node or fifo described by hdr at fn.
+func mknod(fn string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(fn, mode, int(hdr.Devmajor<<24|hdr.Devminor))
+}
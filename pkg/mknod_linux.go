@@ -0,0 +1,26 @@
+package pkg
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// mknod creates the device node or fifo described by hdr at fn.
+func mknod(fn string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(fn, mode, int(mkdev(hdr.Devmajor, hdr.Devminor)))
+}
+
+// mkdev encodes major and minor the way glibc's makedev does.
+func mkdev(major, minor int64) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return (ma&0x00000fff)<<8 | (ma&0xfffff000)<<32 | (mi & 0x000000ff) | (mi&0xffffff00)<<12
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package pkg
+
+import (
+	"archive/tar"
+
+	"github.com/pkg/errors"
+)
+
+// mknod is not supported on this platform.
+func mknod(fn string, hdr *tar.Header) error {
+	return errors.New("special files are not supported on this platform")
+}
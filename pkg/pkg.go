@@ -29,12 +29,14 @@ func init() {
 	validNames = map[string]bool{
 		"root.tar.bz2":     true,
 		"meta.yaml":        true,
+		"CHANGELOG":        true,
 		"bin/pre-install":  true,
 		"bin/post-install": true,
 		"bin/pre-upgrade":  true,
 		"bin/post-upgrade": true,
 		"bin/pre-remove":   true,
 		"bin/post-remove":  true,
+		"bin/trigger":      true,
 	}
 
 	crypto = []string{
@@ -44,7 +46,9 @@ func init() {
 	}
 }
 
-// Create traverses the contents of dir and emits a valid pkg, signed by id
+// Create traverses the contents of dir and emits a valid pkg, signed by id.
+// Next to it goes the pkg's offset index, for remotes to publish so that the
+// manifest can be fetched on its own; see Manifest.
 func Create(key *openpgp.Entity, dir string) error {
 	if !fs.Exists(dir) {
 		return fmt.Errorf("%q: doesn't exist", dir)
@@ -111,6 +115,7 @@ func Create(key *openpgp.Entity, dir string) error {
 	if err != nil {
 		return errors.Wrap(err, "creating bom.sha256")
 	}
+	sums := map[string]string{}
 	tr := tar.NewReader(bzip2.NewReader(f))
 	for {
 		hdr, err := tr.Next()
@@ -123,11 +128,21 @@ func Create(key *openpgp.Entity, dir string) error {
 		if hdr.FileInfo().IsDir() {
 			continue
 		}
+		if hdr.Typeflag == tar.TypeLink {
+			// a hard link has the contents of what it links to.
+			sum, ok := sums[hdr.Linkname]
+			if !ok {
+				return errors.Errorf("%q links to %q, which doesn't come before it", hdr.Name, hdr.Linkname)
+			}
+			fmt.Fprintf(bom, "%v\t%s\n", sum, hdr.Name)
+			continue
+		}
 		s := sha256.New()
 		if c, err := io.Copy(s, tr); err != nil {
 			return errors.Wrapf(err, "copy after %d bytes", c)
 		}
-		fmt.Fprintf(bom, "%x\t%s\n", s.Sum(nil), hdr.Name)
+		sums[hdr.Name] = fmt.Sprintf("%x", s.Sum(nil))
+		fmt.Fprintf(bom, "%v\t%s\n", sums[hdr.Name], hdr.Name)
 	}
 	if err := bom.Close(); err != nil {
 		return errors.Wrap(err, "closing bom")
@@ -182,7 +197,9 @@ func Create(key *openpgp.Entity, dir string) error {
 		return errors.Wrap(err, "opening final .pkg")
 	}
 
-	tw := tar.NewWriter(tf)
+	cw := &countingWriter{w: tf}
+	tw := tar.NewWriter(cw)
+	idx := map[string]span{}
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if path == dir {
 			return nil
@@ -201,6 +218,11 @@ func Create(key *openpgp.Entity, dir string) error {
 		if info.IsDir() {
 			return nil
 		}
+		for _, c := range crypto {
+			if p == c {
+				idx[p] = span{Offset: cw.n, Length: info.Size()}
+			}
+		}
 
 		f, err := os.Open(path)
 		if err != nil {
@@ -225,6 +247,9 @@ func Create(key *openpgp.Entity, dir string) error {
 	if err := tf.Close(); err != nil {
 		return errors.Wrap(err, "closing final .pkg")
 	}
+	if err := writeIndex(tn+indexSuffix, idx); err != nil {
+		return errors.Wrap(err, "writing offset index")
+	}
 
 	return nil
 }
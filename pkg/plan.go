@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+
+	"mcquay.me/pm"
+)
+
+// Plan describes the packages an Install is about to fetch and install,
+// including any dependencies pulled in along the way.
+type Plan struct {
+	Packages      pm.Metas
+	DownloadSize  int64
+	InstalledSize int64
+
+	// Selections explains the version chosen for each of Packages, in the
+	// same order.
+	Selections []pm.Selection
+
+	// Remove lists the installed packages that will be removed, and why;
+	// see Options.ConflictResolution.
+	Remove []pm.Selection
+}
+
+func newPlan(ms pm.Metas, sels, rm []pm.Selection) Plan {
+	r := Plan{Packages: ms, Selections: sels, Remove: rm}
+	for _, m := range ms {
+		r.DownloadSize += m.DownloadSize
+		r.InstalledSize += m.InstalledSize
+	}
+	return r
+}
+
+func (p Plan) String() string {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 1, ' ', 0)
+	for i, m := range p.Packages {
+		why := ""
+		if i < len(p.Selections) {
+			why = p.Selections[i].Reason
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Name, m.Version, m.Remote.String(), why)
+	}
+	w.Flush()
+	if len(p.Remove) > 0 {
+		fmt.Fprintf(buf, "\nto remove:\n")
+		w = tabwriter.NewWriter(buf, 0, 8, 1, ' ', 0)
+		for _, s := range p.Remove {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", s.Package, s.Version, s.Reason)
+		}
+		w.Flush()
+	}
+	fmt.Fprintf(buf, "\n%d packages, %v to download, %v installed\n", len(p.Packages), size(p.DownloadSize), size(p.InstalledSize))
+	return buf.String()
+}
+
+// size renders b in human-friendly units.
+func size(b int64) string {
+	if b == 0 {
+		return "unknown size"
+	}
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/keyring"
+)
+
+// SignaturePolicy is everything the signature on a package is held to before
+// it is installed. Each remote can have its own, see
+// Options.SignaturePolicies, so that e.g. a strictly signed production
+// remote and a looser internal one can be used side by side.
+type SignaturePolicy struct {
+	// Optional accepts packages that aren't signed at all, with a warning.
+	// Signed packages are checked as usual.
+	Optional bool
+
+	// Algorithms, if set, lists the public key algorithms a signature may
+	// be made with, as named by keyring.Signature, e.g. "RSA" or "ECDSA".
+	Algorithms []string
+
+	// Keys, if set, lists the fingerprints of the keys in the keyring that
+	// may sign packages; signatures by any other key are rejected.
+	Keys []string
+
+	// AllowMarginal accepts signatures by keys with keyring.Marginal trust,
+	// with a warning.
+	AllowMarginal bool
+
+	// MaxClockSkew is how far into the future a signature may be dated;
+	// DefaultMaxClockSkew if unset.
+	MaxClockSkew time.Duration
+
+	// SignatureStrength is the bar the signature must clear; its
+	// MinValidity is the window within which the signing key mustn't
+	// expire.
+	SignatureStrength
+}
+
+// SignaturePolicyError is returned when the signature on Package breaks the
+// SignaturePolicy of its Remote, for Reason.
+type SignaturePolicyError struct {
+	Package pm.Name
+	Remote  string
+	Reason  string
+}
+
+func (e SignaturePolicyError) Error() string {
+	return fmt.Sprintf("signature on %v breaks the policy of %v: %v", e.Package, e.Remote, e.Reason)
+}
+
+// signaturePolicy returns the SignaturePolicy m is held to: that of its
+// remote in o.SignaturePolicies, compared in canonical form, or else the one
+// AllowMarginal, MaxClockSkew and MinSignatureStrength make up.
+func (o Options) signaturePolicy(m pm.Meta) SignaturePolicy {
+	remote := canonicalRemote(m.Remote.String())
+	for r, sp := range o.SignaturePolicies {
+		if canonicalRemote(r) == remote {
+			return sp
+		}
+	}
+	return SignaturePolicy{
+		AllowMarginal:     o.AllowMarginal,
+		MaxClockSkew:      o.MaxClockSkew,
+		SignatureStrength: o.MinSignatureStrength,
+	}
+}
+
+// verifySignature checks the signature on the manifest of the .pkg at pn,
+// whose metadata is m, against the keyring in root and m's SignaturePolicy,
+// raising warnings with warner. It returns nil, nil for an unsigned package
+// the policy accepts.
+func (o Options) verifySignature(root, pn string, m pm.Meta, warner func(string, pm.Name) func(string, ...interface{})) (*keyring.Signature, error) {
+	sp := o.signaturePolicy(m)
+	if sp.Optional {
+		asc, err := getReadCloser(pn, "manifest.sha256.asc")
+		if err != nil {
+			warner(WarnUnsigned, m.Name)("%v is not signed", m.Name)
+			return nil, nil
+		}
+		asc.Close()
+	}
+	sig, err := verifyManifestIntegrity(root, pn)
+	if err != nil {
+		return nil, err
+	}
+	if err := sp.check(sig, m, time.Now(), warner); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// verifyManifestSignature is verifySignature for a manifest man and its
+// signature asc already read from the .pkg, as when streaming it.
+func (o Options) verifyManifestSignature(root string, man, asc []byte, m pm.Meta, warner func(string, pm.Name) func(string, ...interface{})) (*keyring.Signature, error) {
+	sig, err := keyring.CheckSignature(root, bytes.NewReader(man), bytes.NewReader(asc))
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying manifest")
+	}
+	if err := o.signaturePolicy(m).check(sig, m, time.Now(), warner); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// check returns an error if s, the signature on m, breaks sp as of now.
+func (sp SignaturePolicy) check(s *keyring.Signature, m pm.Meta, now time.Time, warner func(string, pm.Name) func(string, ...interface{})) error {
+	skew := sp.MaxClockSkew
+	if skew == 0 {
+		skew = DefaultMaxClockSkew
+	}
+	if err := checkSkew(s, now, skew, warner(WarnClockSkew, m.Name)); err != nil {
+		return err
+	}
+	if err := checkTrust(s, sp.AllowMarginal, warner(WarnMarginalTrust, m.Name)); err != nil {
+		return err
+	}
+	if len(sp.Algorithms) > 0 && !listed(sp.Algorithms, s.Algorithm) {
+		return SignaturePolicyError{
+			Package: m.Name,
+			Remote:  m.Remote.String(),
+			Reason:  fmt.Sprintf("made with %v, not one of %v", s.Algorithm, strings.Join(sp.Algorithms, ", ")),
+		}
+	}
+	if len(sp.Keys) > 0 {
+		fp := keyring.Fingerprint(s.Signer)
+		keys := []string{}
+		for _, k := range sp.Keys {
+			keys = append(keys, strings.ToUpper(strings.Replace(k, " ", "", -1)))
+		}
+		if !listed(keys, fp) {
+			return SignaturePolicyError{
+				Package: m.Name,
+				Remote:  m.Remote.String(),
+				Reason:  fmt.Sprintf("made by key %v, which isn't allowed to sign its packages", fp),
+			}
+		}
+	}
+	if err := sp.SignatureStrength.check(s, m, now); err != nil {
+		return err
+	}
+	return checkSigner(s, m)
+}
+
+// listed returns whether s is one of l.
+func listed(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
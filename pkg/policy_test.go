@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+	"mcquay.me/pm/keyring"
+)
+
+func TestSignaturePolicies(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	// an internal remote offers c, signed with a weak key.
+	fx.addRepo(t, "internal", pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"})
+	if err := Create(weakKey(t, fx.root), filepath.Join(fx.dist, "internal", "c")); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := db.Pull(fx.root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	a, c := streamMeta(t, fx, "a"), streamMeta(t, fx, "c")
+	prod, internal := a.Remote.String(), c.Remote.String()
+
+	key, err := keyring.FindSecretEntity(fx.root, "test@pm.mcquay.me")
+	if err != nil {
+		t.Fatalf("find secret key: %v", err)
+	}
+	strict := SignaturePolicy{
+		Algorithms:        []string{"RSA"},
+		Keys:              []string{keyring.Fingerprint(key)},
+		SignatureStrength: SignatureStrength{MinBits: 2048, RejectSHA1: true},
+	}
+	loose := SignaturePolicy{}
+
+	tests := []struct {
+		pkg      string
+		policies map[string]SignaturePolicy
+		strength SignatureStrength
+		reason   string
+	}{
+		{"a", map[string]SignaturePolicy{prod: strict, internal: loose}, SignatureStrength{}, ""},
+		{"c", map[string]SignaturePolicy{prod: strict, internal: loose}, SignatureStrength{}, ""},
+		{"c", map[string]SignaturePolicy{prod: strict, internal: strict}, SignatureStrength{}, "isn't allowed to sign"},
+		{"a", map[string]SignaturePolicy{prod: {Algorithms: []string{"ECDSA"}}}, SignatureStrength{}, "made with RSA"},
+
+		// remotes without a policy are held to Options.MinSignatureStrength.
+		{"c", map[string]SignaturePolicy{prod: strict}, SignatureStrength{MinBits: 2048}, "1024 bit"},
+		{"a", map[string]SignaturePolicy{internal: loose}, SignatureStrength{MinBits: 2048}, ""},
+	}
+	for i, test := range tests {
+		target, err := ioutil.TempDir("", "pm-tests-target-")
+		if err != nil {
+			t.Fatalf("tmpdir: %v", err)
+		}
+		defer os.RemoveAll(target)
+
+		err = Install(fx.root, []string{test.pkg}, Options{
+			TargetDir:            target,
+			SignaturePolicies:    test.policies,
+			MinSignatureStrength: test.strength,
+		})
+		if test.reason == "" {
+			if err != nil {
+				t.Fatalf("%d: install %v: %v", i, test.pkg, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Fatalf("%d: install %v: got %v, want an error mentioning %q", i, test.pkg, err, test.reason)
+		}
+		switch errors.Cause(err).(type) {
+		case SignaturePolicyError, WeakSignatureError:
+		default:
+			t.Fatalf("%d: got %T, want a SignaturePolicyError or WeakSignatureError", i, errors.Cause(err))
+		}
+	}
+}
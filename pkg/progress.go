@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+const progressFile = "var/lib/pm/progress.json"
+
+// stage documents how far along a package is in an install batch.
+type stage int
+
+const (
+	pending stage = iota
+	downloaded
+	verified
+	done
+)
+
+// progress persists the per-package state of an install batch so that an
+// interrupted batch can be resumed without redoing completed work.
+type progress struct {
+	Batch  []string          `json:"batch"`
+	Target string            `json:"target,omitempty"`
+	Pkgs   map[pm.Name]stage `json:"pkgs"`
+
+	// root is where the progress is saved; without one, as for a staged
+	// batch, it is only kept in memory.
+	root string
+}
+
+// loadProgress returns the recorded progress for pkgs being installed into
+// target, which is empty when installing into root. If the recorded batch was
+// for a different set of packages or target a fresh progress is returned. A
+// record that can't be decoded, as when an earlier run died mid-write, is
+// treated as absent: it is removed, and warnf told.
+func loadProgress(root string, pkgs []string, target string, warnf func(string, ...interface{})) (*progress, error) {
+	batch := append([]string{}, pkgs...)
+	sort.Strings(batch)
+	r := &progress{
+		Batch:  batch,
+		Target: target,
+		Pkgs:   map[pm.Name]stage{},
+		root:   root,
+	}
+
+	fn := filepath.Join(root, progressFile)
+	if !fs.Exists(fn) {
+		return r, nil
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	o := progress{}
+	derr := json.NewDecoder(f).Decode(&o)
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrap(err, "close progress")
+	}
+	if derr != nil {
+		warnf("discarding unreadable install progress %v: %v", fn, derr)
+		if err := os.Remove(fn); err != nil {
+			return nil, errors.Wrap(err, "removing unreadable progress")
+		}
+		return r, nil
+	}
+
+	if strings.Join(o.Batch, " ") != strings.Join(batch, " ") || o.Target != target {
+		return r, nil
+	}
+	if o.Pkgs != nil {
+		r.Pkgs = o.Pkgs
+	}
+	return r, nil
+}
+
+// count returns how many of ms have made it to at least stage s.
+func (p *progress) count(ms pm.Metas, s stage) int {
+	r := 0
+	for _, m := range ms {
+		if p.Pkgs[m.Name] >= s {
+			r++
+		}
+	}
+	return r
+}
+
+// mark records that m has reached stage s.
+func (p *progress) mark(m pm.Meta, s stage) error {
+	p.Pkgs[m.Name] = s
+	return p.save()
+}
+
+// save writes p out by way of a temporary file, so that a crash leaves the
+// last record whole.
+func (p *progress) save() error {
+	if p.root == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encoding progress")
+	}
+	if err := replace(filepath.Join(p.root, progressFile), 0644, bytes.NewReader(append(b, '\n')), false, nil); err != nil {
+		return errors.Wrap(err, "writing progress")
+	}
+	return nil
+}
+
+// finish removes the record of the batch; it is called once every package in
+// the batch has been installed.
+func (p *progress) finish() error {
+	fn := filepath.Join(p.root, progressFile)
+	if !fs.Exists(fn) {
+		return nil
+	}
+	return os.Remove(fn)
+}
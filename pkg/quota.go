@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"fmt"
+
+	"mcquay.me/pm"
+)
+
+// QuotaError is returned when installing a package would exceed
+// Options.MaxPackageBytes or, if Transaction is set,
+// Options.MaxTransactionBytes.
+type QuotaError struct {
+	Package     pm.Name
+	Size        int64
+	Limit       int64
+	Transaction bool
+}
+
+func (e QuotaError) Error() string {
+	if e.Transaction {
+		return fmt.Sprintf("%v brings the install to at least %v, over its limit of %v", e.Package, size(e.Size), size(e.Limit))
+	}
+	return fmt.Sprintf("%v is at least %v, over the per-package limit of %v", e.Package, size(e.Size), size(e.Limit))
+}
+
+// quota tracks how much an install has written, for
+// Options.MaxTransactionBytes.
+type quota struct {
+	used int64
+}
+
+// checkQuotas returns a QuotaError if the installed sizes the remotes
+// advertise for ms are already over opts' limits. Packages of unknown size
+// are only checked as they are extracted; see Options.charge.
+func checkQuotas(ms pm.Metas, opts Options) error {
+	total := int64(0)
+	for _, m := range ms {
+		if opts.MaxPackageBytes > 0 && m.InstalledSize > opts.MaxPackageBytes {
+			return QuotaError{Package: m.Name, Size: m.InstalledSize, Limit: opts.MaxPackageBytes}
+		}
+		total += m.InstalledSize
+		if opts.MaxTransactionBytes > 0 && total > opts.MaxTransactionBytes {
+			return QuotaError{Package: m.Name, Size: total, Limit: opts.MaxTransactionBytes, Transaction: true}
+		}
+	}
+	return nil
+}
+
+// charge records that n more bytes are about to be written for the package
+// being extracted, of which used have been written so far, returning a
+// QuotaError, without a Package, if that goes over a limit.
+func (o Options) charge(used, n int64) error {
+	if o.MaxPackageBytes > 0 && used+n > o.MaxPackageBytes {
+		return QuotaError{Size: used + n, Limit: o.MaxPackageBytes}
+	}
+	if o.quota == nil {
+		return nil
+	}
+	if o.MaxTransactionBytes > 0 && o.quota.used+n > o.MaxTransactionBytes {
+		return QuotaError{Size: o.quota.used + n, Limit: o.MaxTransactionBytes, Transaction: true}
+	}
+	o.quota.used += n
+	return nil
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// prunable is the cache policy ReclaimableSpace assumes: files that can't be
+// installed from the available db any more.
+var prunable = CachePolicy{Unreferenced: true, Superseded: true}
+
+// ReclaimableSpace reports how many bytes Autoremove would free from root,
+// and how many removing the unreferenced and superseded files from the
+// package cache would, without removing anything.
+//
+// An autoremovable package's size is its recorded InstalledSize, or, for
+// packages that don't record one, the sum of the sizes of its files still on
+// disk.
+func ReclaimableSpace(root string) (autoremoveBytes, cacheBytes int64, err error) {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "loading installed db")
+	}
+	for _, m := range iDB.Autoremovable() {
+		n, err := diskUsage(root, m)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "%v", m.Name)
+		}
+		autoremoveBytes += n
+	}
+
+	report, err := CacheReport(root)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "reading cache")
+	}
+	for _, e := range report {
+		if prunable.match(e) {
+			cacheBytes += e.Size
+		}
+	}
+	return autoremoveBytes, cacheBytes, nil
+}
+
+// diskUsage returns the number of bytes removing the installed package m
+// would free, counting each group of hard links once.
+func diskUsage(root string, m pm.Meta) (int64, error) {
+	if m.InstalledSize > 0 {
+		return m.InstalledSize, nil
+	}
+	files, err := installedFiles(filepath.Join(root, installed, string(m.Name)), m)
+	if err != nil {
+		return 0, err
+	}
+	var r int64
+	for n := range files {
+		if _, ok := linked(root, n, m.Hardlinks); ok {
+			// counted with the file it links to.
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(root, n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "stat")
+		}
+		if fi.Mode().IsRegular() {
+			r += fi.Size()
+		}
+	}
+	return r, nil
+}
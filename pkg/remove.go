@@ -1,8 +1,11 @@
 package pkg
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/pkg/errors"
 	"mcquay.me/pm"
@@ -22,40 +25,195 @@ func Remove(root string, pkgs []string) error {
 	}
 
 	for _, m := range ms {
-		if err := script(root, m, "pre-remove"); err != nil {
-			return errors.Wrap(err, "pre-remove")
+		if err := remove(root, m, nil); err != nil {
+			return err
 		}
+	}
+	if err := recordTransaction(root, "remove", ms); err != nil {
+		return errors.Wrap(err, "recording last transaction")
+	}
 
-		mdir := filepath.Join(root, installed, string(m.Name))
-		bom := filepath.Join(mdir, "bom.sha256")
-		bf, err := os.Open(bom)
-		if err != nil {
-			return errors.Wrapf(err, "%q: opening bom", m.Name)
-		}
+	return nil
+}
 
-		cs, err := pm.ParseCS(bf)
-		if err != nil {
-			return errors.Wrapf(err, "%q: parsing bom", m.Name)
-		}
+// RemovePlan describes the full effect of removing some packages; see
+// PlanRemove.
+type RemovePlan struct {
+	// Packages are the packages asked to be removed.
+	Packages pm.Metas
 
-		for n := range cs {
-			if err := os.Remove(filepath.Join(root, n)); err != nil {
-				return errors.Wrapf(err, "pkg %q", m.Name)
+	// Orphaned are the automatically installed packages that nothing
+	// would need any more once Packages are gone, and which Autoremove
+	// would then remove.
+	Orphaned pm.Metas
+
+	// Broken are the installed packages that depend, directly or not, on
+	// any of Packages, and would be left with missing dependencies.
+	Broken pm.Metas
+
+	// ReclaimedBytes is how much disk removing Packages and then Orphaned
+	// would free, estimated as for ReclaimableSpace.
+	ReclaimedBytes int64
+}
+
+func (p RemovePlan) String() string {
+	buf := &bytes.Buffer{}
+	list := func(title string, ms pm.Metas) {
+		if len(ms) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, "%v\n", title)
+		for _, m := range ms {
+			if m.AutoInstalledBy != "" {
+				fmt.Fprintf(buf, "  %v@%v (installed for %v)\n", m.Name, m.Version, m.AutoInstalledBy)
+				continue
 			}
+			fmt.Fprintf(buf, "  %v@%v\n", m.Name, m.Version)
 		}
+	}
+	list("the following packages will be removed:", p.Packages)
+	list("the following packages are no longer required, and will be removed by autoremove:", p.Orphaned)
+	list("the following packages depend on them, and will be BROKEN:", p.Broken)
+	if p.ReclaimedBytes > 0 {
+		fmt.Fprintf(buf, "\n%v will be freed\n", size(p.ReclaimedBytes))
+	}
+	return buf.String()
+}
 
-		if err := script(root, m, "post-remove"); err != nil {
-			return errors.Wrap(err, "post-remove")
+// PlanRemove works out what removing pkgs from root would do, without
+// removing anything.
+func PlanRemove(root string, pkgs []string) (*RemovePlan, error) {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading installed db")
+	}
+	ms, err := iDB.Removable(pkgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking ability to remove")
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+
+	r := &RemovePlan{Packages: ms}
+	removing := map[pm.Name]bool{}
+	names := pm.Names{}
+	for _, m := range ms {
+		removing[m.Name] = true
+		names = append(names, m.Name)
+	}
+	r.Broken = iDB.Dependents(names...)
+
+	// only what this removal orphans is counted, not what was orphaned
+	// already.
+	before := map[pm.Name]bool{}
+	for _, m := range iDB.Autoremovable() {
+		before[m.Name] = true
+	}
+	after := pm.Installed{}
+	for n, m := range iDB {
+		if !removing[n] {
+			after[n] = m
+		}
+	}
+	for _, m := range after.Autoremovable() {
+		if !before[m.Name] {
+			r.Orphaned = append(r.Orphaned, m)
 		}
+	}
 
-		if err := db.RemoveInstalled(root, m); err != nil {
-			return errors.Wrapf(err, "removing %q", m.Name)
+	for _, m := range append(append(pm.Metas{}, r.Packages...), r.Orphaned...) {
+		n, err := diskUsage(root, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%v", m.Name)
 		}
+		r.ReclaimedBytes += n
+	}
+	return r, nil
+}
+
+// Autoremove uninstalls the packages that were installed as dependencies and
+// are no longer needed by anything installed explicitly; see
+// pm.Installed.Autoremovable.
+func Autoremove(root string) (pm.Metas, error) {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading installed db")
+	}
+	ms := iDB.Autoremovable()
+	for _, m := range ms {
+		if err := remove(root, m, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// remove uninstalls m, leaving any of its files that are in keep.
+func remove(root string, m pm.Meta, keep map[string]string) error {
+	if err := script(root, m, "pre-remove"); err != nil {
+		return errors.Wrap(err, "pre-remove")
+	}
 
-		if err := os.RemoveAll(mdir); err != nil {
-			return errors.Wrapf(err, "%q: removing pm install dir", m.Name)
+	files, err := removedFiles(root, m, keep)
+	if err != nil {
+		return err
+	}
+	for _, n := range files {
+		if err := os.Remove(filepath.Join(root, n)); err != nil {
+			return errors.Wrapf(err, "pkg %q", m.Name)
 		}
 	}
 
+	if err := script(root, m, "post-remove"); err != nil {
+		return errors.Wrap(err, "post-remove")
+	}
+
+	if err := db.RemoveInstalled(root, m); err != nil {
+		return errors.Wrapf(err, "removing %q", m.Name)
+	}
+
+	mdir := filepath.Join(root, installed, string(m.Name))
+	if err := os.RemoveAll(mdir); err != nil {
+		return errors.Wrapf(err, "%q: removing pm install dir", m.Name)
+	}
 	return nil
 }
+
+// removedFiles returns the files, relative to root, that removing the
+// installed package m removes, leaving those in keep, in the order they are
+// to be removed.
+func removedFiles(root string, m pm.Meta, keep map[string]string) ([]string, error) {
+	bom := filepath.Join(root, installed, string(m.Name), "bom.sha256")
+	bf, err := os.Open(bom)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%q: opening bom", m.Name)
+	}
+
+	cs, err := pm.ParseCS(bf)
+	bf.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%q: parsing bom", m.Name)
+	}
+
+	skip := map[string]bool{}
+	for _, n := range m.Excluded {
+		skip[n] = true
+	}
+	for n := range keep {
+		skip[n] = true
+	}
+	// hard links are removed before the files they link to, so that a
+	// file's contents go with the last of its recorded links.
+	links, files := []string{}, []string{}
+	for n := range cs {
+		n = pm.StripPath(n, m.StripComponents)
+		if n == "" || skip[n] {
+			continue
+		}
+		if _, ok := m.Hardlinks[n]; ok {
+			links = append(links, n)
+		} else {
+			files = append(files, n)
+		}
+	}
+	return append(links, files...), nil
+}
@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+// replacement tracks the files of the installed version of a package while
+// it is replaced by another.
+type replacement struct {
+	// installed maps each file the old version put on disk to its checksum
+	// at the time.
+	installed map[string]string
+
+	// protect is set to keep edited config files; see
+	// Options.ProtectConffiles.
+	protect bool
+
+	// kept records the config files that were left alone because they had
+	// been edited.
+	kept map[string]bool
+
+	// unchanged records the files that are identical in both versions, and
+	// so were neither rewritten nor re-verified.
+	unchanged map[string]bool
+
+	// backup, if set, is where the installed files are kept as they are
+	// replaced, so that undo can put them back; saved maps each file kept
+	// there to where it came from.
+	backup string
+	saved  map[string]string
+
+	name pm.Name
+	opts Options
+}
+
+// newReplacement starts replacing name, whose installed files and their
+// checksums are installed.
+func newReplacement(name pm.Name, installed map[string]string, opts Options) *replacement {
+	return &replacement{
+		installed: installed,
+		protect:   opts.ProtectConffiles,
+		name:      name,
+		opts:      opts,
+		kept:      map[string]bool{},
+		unchanged: map[string]bool{},
+		saved:     map[string]string{},
+	}
+}
+
+// same reports if name, whose checksum in the new version is sum, is
+// unchanged from the installed version and still on disk under dest, or the
+// live tree it stands for, as it was installed, in which case it is recorded
+// as such.
+func (r *replacement) same(dest, name, sum string) bool {
+	if r == nil || r.installed[name] != sum {
+		return false
+	}
+	if cur, err := sha256File(r.opts.staging.live(filepath.Join(dest, name))); err != nil || cur != sum {
+		return false
+	}
+	r.unchanged[name] = true
+	return true
+}
+
+// isConffile reports if name, a path relative to the install root, is a
+// config file. As with Debian, everything under etc/ is.
+func isConffile(name string) bool {
+	return strings.HasPrefix(filepath.ToSlash(filepath.Clean(name)), "etc/")
+}
+
+// target returns where the file name should be written under dest: name
+// itself, unless it is a protected config file that has been edited since it
+// was installed, in which case the new version is written alongside it as
+// name.pm-new. While staged, the edits looked for are in the live tree.
+func (r *replacement) target(dest, name string) (string, error) {
+	fn := filepath.Join(dest, name)
+	if r == nil || !r.protect || !isConffile(name) {
+		return fn, nil
+	}
+	orig, ok := r.installed[name]
+	live := r.opts.staging.live(fn)
+	if !ok || !fs.Exists(live) {
+		return fn, nil
+	}
+	cur, err := sha256File(live)
+	if err != nil {
+		return "", err
+	}
+	if cur == orig {
+		return fn, nil
+	}
+	r.kept[name] = true
+	r.opts.warn(Warning{
+		Code:    WarnConffileKept,
+		Message: fmt.Sprintf("%v has been edited; writing the new version to %v.pm-new, please review the differences", live, live),
+		Package: r.name,
+		File:    name,
+	})
+	return fn + ".pm-new", nil
+}
+
+// written returns the members of files that this install wrote to their own
+// path, leaving out edited config files that were left alone and files that
+// didn't change.
+func (r *replacement) written(files map[string]string) map[string]string {
+	if r == nil || len(r.kept)+len(r.unchanged) == 0 {
+		return files
+	}
+	w := map[string]string{}
+	for n, sum := range files {
+		if !r.kept[n] && !r.unchanged[n] {
+			w[n] = sum
+		}
+	}
+	return w
+}
+
+// save keeps the installed version of name, about to be replaced at fn, in
+// r.backup.
+func (r *replacement) save(fn, name string) error {
+	if r == nil || r.backup == "" {
+		return nil
+	}
+	if _, ok := r.installed[name]; !ok {
+		return nil
+	}
+	fi, err := os.Lstat(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	b := filepath.Join(r.backup, name)
+	if err := os.MkdirAll(filepath.Dir(b), 0755); err != nil {
+		return errors.Wrap(err, "mkdir")
+	}
+	if err := os.Link(fn, b); err != nil {
+		// the backup isn't on the same filesystem as every part of root.
+		if err := cloneFile(fn, b, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	r.saved[b] = fn
+	return nil
+}
+
+// undo rolls back files, those the new version wrote under dest before it
+// failed. Without an installed version ip, the new version's install dir,
+// goes with them; otherwise the installed files they replaced are put back.
+func (r *replacement) undo(dest, ip string, files map[string]string) {
+	if r == nil {
+		rollback(dest, ip, files)
+		return
+	}
+	rollback(dest, "", r.written(files))
+	for b, fn := range r.saved {
+		if err := os.Rename(b, fn); err != nil {
+			log.Printf("restoring %v: %v", fn, err)
+		}
+	}
+	r.saved = map[string]string{}
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sparseBlock is the granularity at which runs of zeros in a sparse file are
+// left as holes rather than written.
+const sparseBlock = 4096
+
+// sparse reports if hdr is a sparse file, either as a GNU sparse entry or as
+// a regular entry carrying the GNU.sparse.* PAX records GNU tar writes for
+// sparse files with --format=pax. The tar reader fills in the holes of
+// either with zeros, so their contents read like any other file's.
+func sparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies r to f, seeking over blocks of zeros instead of writing
+// them so that they are left as holes, and returns how many bytes of r were
+// copied. f must be empty.
+func copySparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlock)
+	zero := make([]byte, sparseBlock)
+	n := int64(0)
+	for {
+		c, err := io.ReadFull(r, buf)
+		if c > 0 {
+			if bytes.Equal(buf[:c], zero[:c]) {
+				if _, err := f.Seek(int64(c), io.SeekCurrent); err != nil {
+					return n, errors.Wrap(err, "seek")
+				}
+			} else if _, err := f.Write(buf[:c]); err != nil {
+				return n, errors.Wrap(err, "write")
+			}
+			n += int64(c)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return n, errors.Wrap(err, "read")
+		}
+	}
+	// a trailing hole was only seeked over, so set the size explicitly.
+	if err := f.Truncate(n); err != nil {
+		return n, errors.Wrap(err, "truncate")
+	}
+	return n, nil
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"mcquay.me/pm"
+)
+
+func TestInstallSparse(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "sparse", Version: "1.0.0", Description: "a sparse pkg"})
+	defer del()
+	if err := Install(fx.root, []string{"sparse"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	// share/sparse/image is 2MiB with "head\n" at the start, "tail\n" at
+	// 1MiB, and holes everywhere else.
+	fn := filepath.Join(fx.root, "share", "sparse", "image")
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := make([]byte, 2<<20)
+	copy(want, "head\n")
+	copy(want[1<<20:], "tail\n")
+	if !bytes.Equal(b, want) {
+		t.Fatalf("sparse file contents don't match")
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if used := fi.Sys().(*syscall.Stat_t).Blocks * 512; used >= fi.Size() {
+		t.Fatalf("%v bytes allocated for a %v byte sparse file", used, fi.Size())
+	}
+}
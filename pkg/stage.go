@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm/db"
+)
+
+// StageInstall installs pkgs into a copy of the tree that root points to,
+// leaving the live tree untouched, and verifies the result. Calling activate
+// atomically points root at the staged tree.
+//
+// root must be a symlink to the live tree. The staged tree is created next to
+// the live one; unchanged files are hard links to their live counterparts, so
+// staging costs little more than the new package contents. The old tree is
+// left in place after activation so it can be switched back to.
+func StageInstall(root string, pkgs []string) (stage string, activate func() error, err error) {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "stat root")
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", nil, errors.Errorf("%q must be a symlink to be able to activate a staged install", root)
+	}
+	live, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "resolving root")
+	}
+
+	stage, err = ioutil.TempDir(filepath.Dir(live), filepath.Base(live)+".pm-stage-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "creating stage")
+	}
+	if err := clone(live, stage); err != nil {
+		os.RemoveAll(stage)
+		return "", nil, errors.Wrap(err, "cloning live tree")
+	}
+
+	if err := Install(stage, pkgs, Options{AutoApprove: true}); err != nil {
+		os.RemoveAll(stage)
+		return "", nil, errors.Wrap(err, "installing into stage")
+	}
+
+	iDB, err := db.LoadInstalled(stage)
+	if err != nil {
+		os.RemoveAll(stage)
+		return "", nil, errors.Wrap(err, "loading staged installed db")
+	}
+	names := []string{}
+	for n := range iDB {
+		names = append(names, string(n))
+	}
+	if err := Check(stage, names); err != nil {
+		os.RemoveAll(stage)
+		return "", nil, errors.Wrap(err, "verifying stage")
+	}
+
+	activate = func() error {
+		tmp := root + ".pm-new"
+		if err := os.Symlink(stage, tmp); err != nil {
+			return errors.Wrap(err, "creating symlink")
+		}
+		if err := os.Rename(tmp, root); err != nil {
+			os.Remove(tmp)
+			return errors.Wrap(err, "swapping symlink")
+		}
+		return nil
+	}
+	return stage, activate, nil
+}
+
+// private lists the parts of a tree that pm rewrites in place, and so must be
+// copied rather than linked when cloning.
+var private = []string{
+	filepath.Join("var", "lib", "pm"),
+	filepath.Join("var", "cache", "pm"),
+}
+
+// clone recreates the tree at src in dst using hard links for regular files.
+func clone(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrap(err, "rel")
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			l, err := os.Readlink(path)
+			if err != nil {
+				return errors.Wrap(err, "readlink")
+			}
+			return os.Symlink(l, target)
+		case isPrivate(rel):
+			return cloneFile(path, target, info.Mode().Perm())
+		}
+		return os.Link(path, target)
+	})
+}
+
+func isPrivate(rel string) bool {
+	for _, p := range private {
+		if rel == p || strings.HasPrefix(rel, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	if n, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "copy after %d bytes", n)
+	}
+	return out.Close()
+}
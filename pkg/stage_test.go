@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+)
+
+func TestStageInstall(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	dir, err := ioutil.TempDir("", "pm-tests-link-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Symlink(fx.root, root); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	stage, activate, err := StageInstall(root, []string{"a"})
+	if err != nil {
+		t.Fatalf("stage install: %v", err)
+	}
+	defer os.RemoveAll(stage)
+
+	if fs.Exists(filepath.Join(root, "bin", "a")) {
+		t.Fatalf("live tree changed before activation")
+	}
+	if !fs.Exists(filepath.Join(stage, "bin", "a")) {
+		t.Fatalf("bin/a missing from stage")
+	}
+
+	if err := activate(); err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	if got, err := os.Readlink(root); err != nil || got != stage {
+		t.Fatalf("root points at %q (%v), want %q", got, err, stage)
+	}
+	if !fs.Exists(filepath.Join(root, "bin", "a")) {
+		t.Fatalf("bin/a missing after activation")
+	}
+	if fs.Exists(filepath.Join(fx.root, "bin", "a")) {
+		t.Fatalf("old tree was modified")
+	}
+}
+
+func TestStageInstallNotSymlink(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if _, _, err := StageInstall(fx.root, []string{"a"}); err == nil {
+		t.Fatalf("expected error staging into a plain directory")
+	}
+}
@@ -0,0 +1,372 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+	"mcquay.me/pm/keyring"
+	"mcquay.me/pm/oci"
+)
+
+// maxManifest bounds how much of a streamed package is held in memory for
+// the manifest and its signature.
+const maxManifest = 1 << 20
+
+// streamRetries is how many times a dropped download is resumed before
+// StreamInstall gives up.
+const streamRetries = 3
+
+// errNotStreamable is returned by stream when the package's root.tar.bz2
+// arrives before the signed manifest needed to verify it.
+var errNotStreamable = errors.New("manifest does not precede root.tar.bz2")
+
+// StreamInstall installs m without storing the .pkg on disk. The package is
+// read from its remote, verified, and extracted in a single pass; only its
+// small metadata files are written to the installed dir along the way. A
+// download that is cut short is resumed where it left off. The signature is
+// held to opts as it would be by Install.
+//
+// Nothing is written until the signed manifest has been read and verified;
+// the entries before it are held in memory. This relies on the manifest and
+// its signature appearing in the .pkg before root.tar.bz2, as they do in
+// packages built by Create. When they don't, StreamInstall falls back to
+// downloading the package into the cache and installing it from there, as it
+// always does for packages in an OCI registry, and when opts.ValidatorFunc is
+// set.
+func StreamInstall(root string, m pm.Meta, opts Options) error {
+	opts.warnings = &warnings{}
+
+	already, err := db.IsInstalled(root, m)
+	if err != nil {
+		return errors.Wrapf(err, "is installed %v", m.Name)
+	}
+	if already {
+		return errors.Errorf("%v already installed!", m.Name)
+	}
+
+	if m.Remote.Scheme == oci.Scheme {
+		// resuming is done with plain http Range requests.
+		return installCached(root, m, opts)
+	}
+	if opts.ValidatorFunc != nil {
+		// the validator is given the .pkg, which a stream never has.
+		return installCached(root, m, opts)
+	}
+
+	log.Printf("streaming %v@%v from %v", m.Name, m.Version, m.Repository)
+	ip := filepath.Join(root, installed, string(m.Name))
+	r := &resumingReader{
+		url:     m.URL(),
+		size:    m.DownloadSize,
+		retries: streamRetries,
+		client:  opts.httpClient(),
+		warnf:   opts.warner(WarnResumed, m.Name),
+	}
+	opts.links = map[string]string{}
+	sig, files, err := stream(root, ip, m, r, opts)
+	r.Close()
+	if err == errNotStreamable {
+		if err := os.RemoveAll(ip); err != nil {
+			return errors.Wrap(err, "cleaning up")
+		}
+		log.Printf("%v: %v; installing from cache", m.Pkg(), err)
+		return installCached(root, m, opts)
+	}
+	if err != nil {
+		rollback(root, ip, files)
+		return errors.Wrapf(err, "streaming %v", m.Name)
+	}
+	m.SignedBy = sig.Signer.PrimaryKey.KeyIdString()
+	m.Files = files
+	m.Hardlinks = opts.links
+	// the bom is in place by now, so this finds what stream stripped.
+	if m.StripComponents, err = stripCount(ip, m, opts); err != nil {
+		return errors.Wrap(err, "root expansion")
+	}
+
+	if err := script(root, m, "post-install"); err != nil {
+		return errors.Wrap(err, "post-install")
+	}
+	if err := db.AddInstalled(root, m); err != nil {
+		return errors.Wrapf(err, "adding %v", m.Name)
+	}
+	if err := activateTriggers(root, m); err != nil {
+		return errors.Wrap(err, "activating triggers")
+	}
+	return runTriggers(root)
+}
+
+// installCached installs m the usual way, by way of the cache.
+func installCached(root string, m pm.Meta, opts Options) error {
+	p, err := loadProgress(root, []string{string(m.Name)}, "", opts.warner(WarnCorruptProgress, ""))
+	if err != nil {
+		return errors.Wrap(err, "loading progress")
+	}
+	cacheDir := filepath.Join(root, cache)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return errors.Wrap(err, "creating cache dir")
+	}
+	if err := download(cacheDir, pm.Metas{m}, p, opts); err != nil {
+		return errors.Wrap(err, "downloading")
+	}
+	if err := install(root, m, p, opts); err != nil {
+		return errors.Wrapf(err, "installing %v", m.Name)
+	}
+	if err := runTriggers(root); err != nil {
+		return errors.Wrap(err, "running triggers")
+	}
+	return p.finish()
+}
+
+// held is an entry of a streamed .pkg kept in memory until the manifest it
+// is checked against has been verified.
+type held struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// stream verifies and installs the .pkg read from r. Everything but the
+// root.tar.bz2 is written to ip, and the contents of the root.tar.bz2 are
+// extracted into root as they arrive, each file checked against the bom
+// before it is put in place. It returns the signature on the manifest and
+// the checksums of the files written to root, and records any hard links
+// among them in opts.links. On error, the files written to root so far are
+// returned, to be rolled back.
+func stream(root, ip string, m pm.Meta, r io.Reader, opts Options) (*keyring.Signature, map[string]string, error) {
+	if err := os.MkdirAll(ip, 0755); err != nil {
+		return nil, nil, errors.Wrapf(err, "making install dir %q", ip)
+	}
+
+	var man, asc []byte
+	var sig *keyring.Signature
+	var cs map[string]string
+	pending := []held{}
+	size := int64(0)
+	sums := map[string]string{}
+	files := map[string]string{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, files, errors.Wrap(err, "tar traversal")
+		}
+		if err := relative(hdr.Name); err != nil {
+			return nil, files, err
+		}
+
+		switch {
+		case hdr.Name == "manifest.sha256":
+			if man, err = ioutil.ReadAll(io.LimitReader(tr, maxManifest)); err != nil {
+				return nil, files, errors.Wrap(err, "reading manifest")
+			}
+		case hdr.Name == "manifest.sha256.asc":
+			if asc, err = ioutil.ReadAll(io.LimitReader(tr, maxManifest)); err != nil {
+				return nil, files, errors.Wrap(err, "reading manifest signature")
+			}
+		case hdr.Name == "root.tar.bz2":
+			if cs == nil {
+				return nil, files, errNotStreamable
+			}
+			if _, ok := sums["bom.sha256"]; !ok {
+				return nil, files, errNotStreamable
+			}
+			if err := checkCaseCollisions(root, ip, m, opts); err != nil {
+				return nil, files, err
+			}
+			if err := script(root, m, "pre-install"); err != nil {
+				return nil, files, errors.Wrap(err, "pre-install")
+			}
+
+			s := sha256.New()
+			tee := io.TeeReader(tr, s)
+			strip, err := stripCount(ip, m, opts)
+			if err != nil {
+				return nil, files, errors.Wrap(err, "root expansion")
+			}
+			if files, _, err = extractRoot(root, ip, tee, strip, opts); err != nil {
+				return nil, files, errors.Wrap(err, "root expansion")
+			}
+			if n, err := io.Copy(ioutil.Discard, tee); err != nil {
+				return nil, files, errors.Wrapf(err, "draining root.tar.bz2 after %d bytes", n)
+			}
+			sums[hdr.Name] = fmt.Sprintf("%x", s.Sum(nil))
+			if err := checkSums(cs, map[string]string{hdr.Name: sums[hdr.Name]}); err != nil {
+				return nil, files, err
+			}
+		case cs == nil:
+			// nothing is written before the manifest is verified.
+			if size += hdr.Size; size > maxManifest {
+				return nil, files, errNotStreamable
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, files, errors.Wrapf(err, "reading %v", hdr.Name)
+			}
+			pending = append(pending, held{hdr: hdr, data: data})
+		default:
+			if err := writeEntry(ip, hdr, tr, cs, sums); err != nil {
+				return nil, files, err
+			}
+		}
+
+		if cs != nil || man == nil || asc == nil {
+			continue
+		}
+		if sig, err = opts.verifyManifestSignature(root, man, asc, m, opts.warner); err != nil {
+			return nil, files, errors.Wrap(err, "verifying pkg integrity")
+		}
+		if log, ok := opts.transparencyLog(m); ok {
+			if err := checkLogged(asc, log, m, opts, opts.warner); err != nil {
+				return nil, files, errors.Wrap(err, "verifying pkg integrity")
+			}
+		}
+		if err := opts.strict(); err != nil {
+			return nil, files, err
+		}
+		if cs, err = pm.ParseCS(bytes.NewReader(man)); err != nil {
+			return nil, files, errors.Wrap(err, "parsing manifest")
+		}
+		for _, h := range pending {
+			if err := writeEntry(ip, h.hdr, bytes.NewReader(h.data), cs, sums); err != nil {
+				return nil, files, err
+			}
+		}
+		pending = nil
+	}
+
+	if cs == nil {
+		return nil, files, errors.New("root.tar.bz2 not found in pkg")
+	}
+	if len(sums) != len(cs) {
+		return nil, files, errors.Errorf("%d files in manifest but not in tarfile", len(cs)-len(sums))
+	}
+	return sig, files, nil
+}
+
+// writeEntry writes the entry hdr of a streamed .pkg, read from r, to ip,
+// checking it against the manifest cs before it is put in place and
+// recording its checksum in sums.
+func writeEntry(ip string, hdr *tar.Header, r io.Reader, cs, sums map[string]string) error {
+	if hdr.FileInfo().IsDir() {
+		if hdr.Name != "bin" {
+			return errors.Errorf("%v is unexpected", hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Join(ip, hdr.Name), hdr.FileInfo().Mode()); err != nil {
+			return errors.Wrapf(err, "mkdir for %v", hdr.Name)
+		}
+		return nil
+	}
+	s := sha256.New()
+	check := func() error {
+		sums[hdr.Name] = fmt.Sprintf("%x", s.Sum(nil))
+		return checkSums(cs, map[string]string{hdr.Name: sums[hdr.Name]})
+	}
+	if err := replace(filepath.Join(ip, hdr.Name), hdr.FileInfo().Mode(), io.TeeReader(r, s), false, check); err != nil {
+		return errors.Wrapf(err, "writing %v", hdr.Name)
+	}
+	return nil
+}
+
+// checkSums verifies each of the checksums in sums against the manifest cs.
+func checkSums(cs, sums map[string]string) error {
+	for fn, sum := range sums {
+		want, ok := cs[fn]
+		if !ok {
+			return ExtraFileError{Filename: fn}
+		}
+		if sum != want {
+			return errors.Errorf("%q checksum was incorrect", fn)
+		}
+	}
+	return nil
+}
+
+// resumingReader reads the body at url with client, transparently
+// re-requesting the remainder with a Range request if the connection drops,
+// and telling warnf it did. If size is set, the body's length is checked
+// against it as with checkSize.
+type resumingReader struct {
+	url     string
+	size    int64
+	retries int
+	client  *http.Client
+	warnf   func(string, ...interface{})
+
+	body io.ReadCloser
+	off  int64
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.off += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		r.body.Close()
+		r.body = nil
+		if r.retries == 0 {
+			return n, err
+		}
+		r.retries--
+		r.warnf("resuming %v at byte %d: %v", r.url, r.off, err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) open() error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return errors.Wrap(err, "making request")
+	}
+	want := http.StatusOK
+	if r.off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.off))
+		want = http.StatusPartialContent
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "http get")
+	}
+	if resp.StatusCode != want {
+		resp.Body.Close()
+		return errors.Errorf("http get %q: %v", r.url, resp.Status)
+	}
+	if r.off == 0 {
+		if err := checkSize(r.size, resp.ContentLength); err != nil {
+			resp.Body.Close()
+			return errors.Wrapf(err, "%v", r.url)
+		}
+	}
+	r.body = resp.Body
+	return nil
+}
+
+func (r *resumingReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+	"mcquay.me/pm/keyring"
+)
+
+func streamMeta(t *testing.T, fx *fixture, name string) pm.Meta {
+	av, _, err := db.LoadAvailable(fx.root)
+	if err != nil {
+		t.Fatalf("load available: %v", err)
+	}
+	m, err := av.Get(pm.Name(name), "")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	return m
+}
+
+func checkStreamed(t *testing.T, fx *fixture, name string) {
+	for _, fn := range []string{"bin/" + name, "share/" + name + "/README"} {
+		if !fs.Exists(filepath.Join(fx.root, fn)) {
+			t.Fatalf("%v not installed", fn)
+		}
+	}
+	if err := Check(fx.root, []string{name}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestStreamInstall(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := StreamInstall(fx.root, streamMeta(t, fx, "a"), Options{}); err != nil {
+		t.Fatalf("stream install: %v", err)
+	}
+	checkStreamed(t, fx, "a")
+	if fs.Exists(filepath.Join(fx.root, cache, "a-1.0.0.pkg")) {
+		t.Fatalf("streamed package was written to the cache")
+	}
+	if got, want := fx.hitCount("/a-1.0.0.pkg"), 1; got != want {
+		t.Fatalf("downloads: got %v, want %v", got, want)
+	}
+}
+
+func TestStreamInstallUnixSocketProxy(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+	sock, seen, stop := unixProxy(t, fx)
+	defer stop()
+
+	m := streamMeta(t, fx, "a")
+	if err := StreamInstall(fx.root, m, Options{UnixSocketProxy: sock}); err != nil {
+		t.Fatalf("stream install: %v", err)
+	}
+	checkStreamed(t, fx, "a")
+	if got, want := seen(), []string{m.Remote.Host + "/a-1.0.0.pkg"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("proxy saw %v, want %v", got, want)
+	}
+}
+
+func TestStreamInstallValidatorFunc(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	errPolicy := errors.New("against policy")
+	var seen []string
+	validate := func(pkgPath string, m pm.Meta) error {
+		seen = append(seen, filepath.Base(pkgPath))
+		return errPolicy
+	}
+	err := StreamInstall(fx.root, streamMeta(t, fx, "a"), Options{ValidatorFunc: validate})
+	if errors.Cause(err) != errPolicy {
+		t.Fatalf("got %v, want %v", err, errPolicy)
+	}
+	if !reflect.DeepEqual(seen, []string{"a-1.0.0.pkg"}) {
+		t.Fatalf("validated %v", seen)
+	}
+	if fs.Exists(filepath.Join(fx.root, "bin", "a")) {
+		t.Fatalf("bin/a extracted despite failing validation")
+	}
+	if ok, err := db.IsInstalled(fx.root, pm.Meta{Name: "a"}); err != nil || ok {
+		t.Fatalf("a recorded as installed")
+	}
+
+	ok := func(string, pm.Meta) error { return nil }
+	if err := StreamInstall(fx.root, streamMeta(t, fx, "a"), Options{ValidatorFunc: ok}); err != nil {
+		t.Fatalf("stream install: %v", err)
+	}
+	checkStreamed(t, fx, "a")
+}
+
+func TestStreamInstallUnverified(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	// a root whose keyring doesn't have the key the package was signed with.
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := keyring.NewKeyPair(root, "someone else", "else@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+
+	if err := StreamInstall(root, streamMeta(t, fx, "a"), Options{}); err == nil {
+		t.Fatalf("installed a package signed by an unknown key")
+	}
+	for _, fn := range []string{"bin/a", filepath.Join(installed, "a")} {
+		if fs.Exists(filepath.Join(root, fn)) {
+			t.Fatalf("%v was written for a package that failed verification", fn)
+		}
+	}
+}
+
+func TestStreamInstallResume(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	// the first request is cut off halfway through; later ones are served
+	// normally, honoring Range.
+	var mu sync.Mutex
+	ranges := []string{}
+	files := http.FileServer(http.Dir(fx.dist))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		first := len(ranges) == 0
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if !first {
+			files.ServeHTTP(w, r)
+			return
+		}
+		b, err := ioutil.ReadFile(filepath.Join(fx.dist, r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b[:len(b)/2])
+	}))
+	defer srv.Close()
+
+	m := streamMeta(t, fx, "a")
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	m.Remote = *u
+	ws := []Warning{}
+	if err := StreamInstall(fx.root, m, Options{Warnings: &ws}); err != nil {
+		t.Fatalf("stream install: %v", err)
+	}
+	checkStreamed(t, fx, "a")
+	if len(ws) != 1 || ws[0].Code != WarnResumed || ws[0].Package != "a" {
+		t.Fatalf("warnings: got %+v, want one about resuming a", ws)
+	}
+	if got, want := len(ranges), 2; got != want {
+		t.Fatalf("requests: got %v, want %v", got, want)
+	}
+	if ranges[1] == "" {
+		t.Fatalf("resumed request did not ask for a range")
+	}
+}
+
+func TestStreamInstallFallback(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	// move root.tar.bz2 to the front of the package so the manifest isn't
+	// known by the time it arrives.
+	pn := filepath.Join(fx.dist, "a-1.0.0.pkg")
+	f, err := os.Open(pn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	type entry struct {
+		hdr  *tar.Header
+		body []byte
+	}
+	entries := []entry{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		e := entry{hdr, b}
+		if hdr.Name == "root.tar.bz2" {
+			entries = append([]entry{e}, entries...)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	f.Close()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write(e.body); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := ioutil.WriteFile(pn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("write pkg: %v", err)
+	}
+
+	if err := StreamInstall(fx.root, streamMeta(t, fx, "a"), Options{}); err != nil {
+		t.Fatalf("stream install: %v", err)
+	}
+	checkStreamed(t, fx, "a")
+	if got, want := fx.hitCount("/a-1.0.0.pkg"), 2; got != want {
+		t.Fatalf("downloads: got %v, want %v", got, want)
+	}
+}
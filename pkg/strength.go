@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	gocrypto "crypto"
+	"fmt"
+	"time"
+
+	"mcquay.me/pm"
+	"mcquay.me/pm/keyring"
+)
+
+// SignatureStrength is the bar the signature on a package must clear to be
+// installed; see Options.MinSignatureStrength. The zero SignatureStrength
+// accepts any signature.
+type SignatureStrength struct {
+	// MinBits is the shortest RSA, DSA or ElGamal key accepted, e.g. 2048.
+	// Elliptic curve keys are far shorter for the same strength, and
+	// aren't held to it.
+	MinBits int
+
+	// RejectSHA1 rejects signatures made over SHA-1, or a weaker digest
+	// such as MD5.
+	RejectSHA1 bool
+
+	// MinValidity rejects keys that expire within it, so that packages
+	// aren't installed on the say so of a key that is about to lapse.
+	MinValidity time.Duration
+}
+
+// WeakSignatureError is returned when the signature on Package doesn't meet
+// Options.MinSignatureStrength, for Reason.
+type WeakSignatureError struct {
+	Package pm.Name
+	Reason  string
+}
+
+func (e WeakSignatureError) Error() string {
+	return fmt.Sprintf("signature on %v is too weak: %v", e.Package, e.Reason)
+}
+
+// weakHashes are the digests RejectSHA1 rejects.
+var weakHashes = map[gocrypto.Hash]bool{
+	gocrypto.MD5:       true,
+	gocrypto.SHA1:      true,
+	gocrypto.RIPEMD160: true,
+}
+
+// check returns a WeakSignatureError if s, the signature on m, doesn't meet
+// ss as of now.
+func (ss SignatureStrength) check(s *keyring.Signature, m pm.Meta, now time.Time) error {
+	switch s.Algorithm {
+	case "RSA", "DSA", "ElGamal":
+		if s.Bits < ss.MinBits {
+			return WeakSignatureError{Package: m.Name, Reason: fmt.Sprintf("made by a %d bit %v key, below the minimum of %d", s.Bits, s.Algorithm, ss.MinBits)}
+		}
+	}
+	if ss.RejectSHA1 && weakHashes[s.Hash] {
+		return WeakSignatureError{Package: m.Name, Reason: fmt.Sprintf("made over a %v digest", s.Hash)}
+	}
+	if ss.MinValidity > 0 && s.Expires != nil && s.Expires.Sub(now) < ss.MinValidity {
+		return WeakSignatureError{Package: m.Name, Reason: fmt.Sprintf("made by a key that expires at %v, within %v", s.Expires.Format(time.RFC3339), ss.MinValidity)}
+	}
+	return nil
+}
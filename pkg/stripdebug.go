@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+var elfMagic = []byte("\x7fELF")
+
+// isELF reports if the file fn is an ELF binary.
+func isELF(fn string) (bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	b := make([]byte, len(elfMagic))
+	if _, err := io.ReadFull(f, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "read")
+	}
+	return bytes.Equal(b, elfMagic), nil
+}
+
+// stripDebug strips the debug symbols from fn, whose checksum is sum, if it
+// is an ELF binary, and returns its checksum afterwards; see
+// Options.StripDebug.
+func (o Options) stripDebug(fn, sum string) (string, error) {
+	if elf, err := isELF(fn); err != nil || !elf {
+		return sum, err
+	}
+	bin := o.StripBin
+	if bin == "" {
+		bin = "strip"
+	}
+	if out, err := exec.Command(bin, "--strip-debug", fn).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "%v: %s", bin, bytes.TrimSpace(out))
+	}
+	return sha256File(fn)
+}
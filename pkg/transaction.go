@@ -0,0 +1,328 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+const (
+	pmDir           = "var/lib/pm"
+	transactionFile = "var/lib/pm/transaction.json"
+	stagePrefix     = "stage-"
+)
+
+// transaction records how to move the result of a staged install, see
+// installStaged, into the live tree. It is written before anything in the
+// live tree changes and removed once everything has, so that a commit that
+// is interrupted can be finished by the next Install; see finishTransaction.
+type transaction struct {
+	// Stage is the tree the batch was installed into.
+	Stage string `json:"stage"`
+
+	// Move lists, in the order they are to be applied, the paths relative
+	// to both trees that the batch added or changed. Directories are
+	// created, and everything else is renamed into place.
+	Move []string `json:"move"`
+
+	// Remove lists the paths the batch removed.
+	Remove []string `json:"remove"`
+
+	// Installed are the installed db records of the packages the batch
+	// installed, Upgraded the names of those of them that replaced another
+	// version, and Uninstalled the records of the packages it removed.
+	// Their post-* scripts run once everything else is in place.
+	Installed   pm.Metas  `json:"installed,omitempty"`
+	Upgraded    []pm.Name `json:"upgraded,omitempty"`
+	Uninstalled pm.Metas  `json:"uninstalled,omitempty"`
+}
+
+// staging collects what a staged install changes until it is committed; see
+// installStaged.
+type staging struct {
+	// root is the live tree, and dir the stage: a tree laid out as root is,
+	// empty to start with, that what the batch writes goes to instead.
+	root, dir string
+
+	// remove lists the paths, relative to root, the batch removes.
+	remove []string
+
+	installed   pm.Metas
+	upgraded    []pm.Name
+	uninstalled pm.Metas
+}
+
+// live returns the path in the live tree that fn, a path in the stage,
+// stands for. Without a stage, it is fn.
+func (s *staging) live(fn string) string {
+	if s == nil {
+		return fn
+	}
+	rel, err := filepath.Rel(s.dir, fn)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fn
+	}
+	return filepath.Join(s.root, rel)
+}
+
+// mkdirs makes the directory that fn, a path in the stage, is written to,
+// which the live tree may have but the stage not yet.
+func (s *staging) mkdirs(fn string) error {
+	if s == nil {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(fn), 0755)
+}
+
+// uninstall is remove, for an installed package the batch replaces. Its
+// pre-remove script runs now, but its files and record are only removed,
+// and its post-remove script run, when the batch is committed.
+func (s *staging) uninstall(m pm.Meta) error {
+	if err := script(s.root, m, "pre-remove"); err != nil {
+		return errors.Wrap(err, "pre-remove")
+	}
+	files, err := removedFiles(s.root, m, nil)
+	if err != nil {
+		return err
+	}
+	s.remove = append(s.remove, files...)
+	s.uninstalled = append(s.uninstalled, m)
+	return nil
+}
+
+// installStaged installs ms, as installEach does, but only once all of them
+// have installed does it move the result into root. If any of them fails
+// root is left as it was, upgraded and conflicting packages included.
+//
+// Only what the batch changes is staged: everything it reads comes from
+// root, and everything it writes goes to an empty tree under var/lib/pm, so
+// that it is on the same filesystem as root. The pre-* scripts of the
+// packages run before the batch is committed, from the stage; their post-*
+// scripts run against root, and their installed db records are added and
+// their triggers activated, once it is.
+func installStaged(root string, ms pm.Metas, requested map[pm.Name]bool, p *progress, opts Options) error {
+	live, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return errors.Wrap(err, "resolving root")
+	}
+	dir, err := ioutil.TempDir(filepath.Join(live, pmDir), stagePrefix)
+	if err != nil {
+		return errors.Wrap(err, "creating stage")
+	}
+	committing := false
+	defer func() {
+		// once committing, the stage is needed to finish.
+		if !committing {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	opts.staging = &staging{root: live, dir: dir}
+	// the packages aren't done until the batch is committed, so until then
+	// their progress is kept in memory.
+	sp := &progress{Batch: p.Batch, Target: p.Target, Pkgs: map[pm.Name]stage{}}
+	for n, s := range p.Pkgs {
+		sp.Pkgs[n] = s
+	}
+	if err := installEach(live, ms, requested, sp, opts); err != nil {
+		return err
+	}
+
+	t, err := opts.staging.plan()
+	if err != nil {
+		return errors.Wrap(err, "planning commit")
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "encoding transaction")
+	}
+	if err := ioutil.WriteFile(filepath.Join(live, transactionFile), b, 0644); err != nil {
+		return errors.Wrap(err, "recording transaction")
+	}
+	committing = true
+	if err := t.commit(live); err != nil {
+		return err
+	}
+	for _, m := range t.Installed {
+		if err := activateTriggers(live, m); err != nil {
+			return errors.Wrap(err, "activating triggers")
+		}
+		if err := p.mark(m, done); err != nil {
+			return errors.Wrap(err, "recording progress")
+		}
+	}
+	return nil
+}
+
+// plan works out the transaction that moves what s staged into its root.
+// Directories the root already has are left as they are. The files that
+// the old version of an upgraded package kept in its install dir, and the
+// new version doesn't, are removed.
+func (s *staging) plan() (transaction, error) {
+	t := transaction{Stage: s.dir, Installed: s.installed, Upgraded: s.upgraded, Uninstalled: s.uninstalled}
+	moved := map[string]bool{}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return errors.Wrap(err, "rel")
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.IsDir() {
+			if _, err := os.Lstat(filepath.Join(s.root, rel)); err == nil {
+				return nil
+			} else if !os.IsNotExist(err) {
+				return errors.Wrap(err, "stat")
+			}
+		}
+		t.Move = append(t.Move, rel)
+		moved[rel] = true
+		return nil
+	})
+	if err != nil {
+		return transaction{}, err
+	}
+
+	for _, m := range s.installed {
+		ip := filepath.Join(s.root, installed, string(m.Name))
+		err := filepath.Walk(ip, func(path string, info os.FileInfo, err error) error {
+			if path == ip && os.IsNotExist(err) {
+				// not an upgrade.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(s.root, path)
+			if err != nil {
+				return errors.Wrap(err, "rel")
+			}
+			if !moved[rel] {
+				t.Remove = append(t.Remove, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return transaction{}, err
+		}
+	}
+	for _, rel := range s.remove {
+		// a file that one package drops and another installs stays.
+		if !moved[rel] {
+			t.Remove = append(t.Remove, rel)
+		}
+	}
+	return t, nil
+}
+
+// commit applies t to live. Each step can be repeated, so an interrupted
+// commit can be run again from the start, though that runs the post-*
+// scripts of the packages again. A failing script doesn't stop the others,
+// or the commit, but the first failure is returned.
+func (t transaction) commit(live string) error {
+	for _, rel := range t.Move {
+		src, dst := filepath.Join(t.Stage, rel), filepath.Join(live, rel)
+		fi, err := os.Lstat(src)
+		if os.IsNotExist(err) {
+			// moved before the commit was interrupted.
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "stat")
+		}
+		if fi.IsDir() {
+			if err := os.Mkdir(dst, fi.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return errors.Wrapf(err, "creating %v", rel)
+			}
+			if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "creating %v", rel)
+			}
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return errors.Wrapf(err, "moving %v into place", rel)
+		}
+	}
+	for _, rel := range t.Remove {
+		if err := os.Remove(filepath.Join(live, rel)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing %v", rel)
+		}
+	}
+	var serr error
+	for _, m := range t.Uninstalled {
+		if err := db.RemoveInstalled(live, m); err != nil {
+			return errors.Wrapf(err, "removing %v", m.Name)
+		}
+		// the script is in the install dir, so it goes afterwards.
+		if err := script(live, m, "post-remove"); err != nil && serr == nil {
+			serr = errors.Wrapf(err, "%v: post-remove", m.Name)
+		}
+		if err := os.RemoveAll(filepath.Join(live, installed, string(m.Name))); err != nil {
+			return errors.Wrapf(err, "%v: removing pm install dir", m.Name)
+		}
+	}
+	upgraded := map[pm.Name]bool{}
+	for _, n := range t.Upgraded {
+		upgraded[n] = true
+	}
+	for _, m := range t.Installed {
+		if err := db.AddInstalled(live, m); err != nil {
+			return errors.Wrapf(err, "adding %v", m.Name)
+		}
+		post := "post-install"
+		if upgraded[m.Name] {
+			post = "post-upgrade"
+		}
+		if err := script(live, m, post); err != nil && serr == nil {
+			serr = errors.Wrapf(err, "%v: %v", m.Name, post)
+		}
+	}
+	if err := os.Remove(filepath.Join(live, transactionFile)); err != nil {
+		return errors.Wrap(err, "removing transaction record")
+	}
+	if err := os.RemoveAll(t.Stage); err != nil {
+		return errors.Wrap(err, "removing stage")
+	}
+	return serr
+}
+
+// finishTransaction finishes committing a staged install into root that was
+// interrupted, if there is one.
+func finishTransaction(root string) error {
+	fn := filepath.Join(root, transactionFile)
+	if !fs.Exists(fn) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return errors.Wrap(err, "reading transaction")
+	}
+	t := transaction{}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return errors.Wrap(err, "decoding transaction")
+	}
+	if !fs.Exists(t.Stage) {
+		return errors.Errorf("an interrupted install can't be finished, as its stage %v is gone; remove %v and run pm recover", t.Stage, fn)
+	}
+	log.Printf("finishing an interrupted install")
+	live, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return errors.Wrap(err, "resolving root")
+	}
+	return t.commit(live)
+}
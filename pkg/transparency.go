@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+// InclusionProof is a transparency log's proof that an entry is in its tree,
+// in the form of RFC 6962: the entry's index, the size and root hash of the
+// tree, and the audit path from the entry to the root. Hashes are hex
+// encoded.
+//
+// A log serves the proof for a package signature, manifest.sha256.asc, at
+// <log>/entries/<hex sha256 of the signature>, and answers 404 if the
+// signature was never logged.
+type InclusionProof struct {
+	LogIndex int64    `json:"log_index"`
+	TreeSize int64    `json:"tree_size"`
+	RootHash string   `json:"root_hash"`
+	Hashes   []string `json:"hashes"`
+}
+
+// TransparencyError is returned when a package's signature is missing from
+// the transparency log of its remote, and transparency is required, or when
+// the log's proof that it is there doesn't hold up; see
+// Options.TransparencyLogs.
+type TransparencyError struct {
+	Package pm.Name
+	Log     string
+	Msg     string
+}
+
+func (e TransparencyError) Error() string {
+	return fmt.Sprintf("%v: transparency log %v: %v", e.Package, e.Log, e.Msg)
+}
+
+// transparencyLog returns the transparency log configured for m's remote in
+// opts.TransparencyLogs, compared in canonical form, if there is one.
+func (o Options) transparencyLog(m pm.Meta) (string, bool) {
+	remote := canonicalRemote(m.Remote.String())
+	for r, log := range o.TransparencyLogs {
+		if canonicalRemote(r) == remote {
+			return log, true
+		}
+	}
+	return "", false
+}
+
+// checkTransparency looks up the signature of m, whose .pkg is at pn, in the
+// transparency log configured for m's remote, if there is one.
+func checkTransparency(pn string, m pm.Meta, opts Options, warner func(string, pm.Name) func(string, ...interface{})) error {
+	log, ok := opts.transparencyLog(m)
+	if !ok {
+		return nil
+	}
+	rc, err := getReadCloser(pn, "manifest.sha256.asc")
+	if err != nil {
+		return errors.Wrap(err, "getting manifest signature reader")
+	}
+	sig, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return errors.Wrap(err, "reading manifest signature")
+	}
+	return checkLogged(sig, log, m, opts, warner)
+}
+
+// checkLogged looks up sig, the signature of m, in the transparency log at
+// log.
+func checkLogged(sig []byte, log string, m pm.Meta, opts Options, warner func(string, pm.Name) func(string, ...interface{})) error {
+	sum := sha256.Sum256(sig)
+	url := fmt.Sprintf("%v/entries/%x", strings.TrimSuffix(log, "/"), sum)
+	resp, err := opts.httpClient().Get(url)
+	if err != nil {
+		warner(WarnLogUnreachable, m.Name)("can't check %v against transparency log: %v", m.Name, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		if opts.RequireTransparency {
+			return TransparencyError{Package: m.Name, Log: log, Msg: "signature not logged"}
+		}
+		warner(WarnNotLogged, m.Name)("%v's signature is not in transparency log %v", m.Name, log)
+		return nil
+	default:
+		warner(WarnLogUnreachable, m.Name)("can't check %v against transparency log: %v", m.Name, resp.Status)
+		return nil
+	}
+	p := InclusionProof{}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return TransparencyError{Package: m.Name, Log: log, Msg: fmt.Sprintf("decoding proof: %v", err)}
+	}
+	if err := p.verify(sig); err != nil {
+		return TransparencyError{Package: m.Name, Log: log, Msg: err.Error()}
+	}
+	return nil
+}
+
+// verify checks that p proves entry is in the tree with p's root hash, per
+// RFC 9162 section 2.1.3.2.
+func (p InclusionProof) verify(entry []byte) error {
+	if p.LogIndex < 0 || p.LogIndex >= p.TreeSize {
+		return errors.Errorf("index %d out of range for tree of size %d", p.LogIndex, p.TreeSize)
+	}
+	root, err := hex.DecodeString(p.RootHash)
+	if err != nil {
+		return errors.Wrap(err, "decoding root hash")
+	}
+	r := hashLeaf(entry)
+	fn, sn := p.LogIndex, p.TreeSize-1
+	for _, s := range p.Hashes {
+		h, err := hex.DecodeString(s)
+		if err != nil {
+			return errors.Wrap(err, "decoding audit path")
+		}
+		if sn == 0 {
+			return errors.New("audit path too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(h, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, h)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return errors.New("inclusion proof does not match the log's root hash")
+	}
+	return nil
+}
+
+func hashLeaf(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func hashChildren(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+func TestInclusionProof(t *testing.T) {
+	leaves := [][]byte{hashLeaf([]byte("x")), hashLeaf([]byte("sig")), hashLeaf([]byte("y"))}
+	root := hashChildren(hashChildren(leaves[0], leaves[1]), leaves[2])
+	hx := func(bs ...[]byte) []string {
+		r := []string{}
+		for _, b := range bs {
+			r = append(r, hex.EncodeToString(b))
+		}
+		return r
+	}
+
+	tests := []struct {
+		label string
+		entry string
+		p     InclusionProof
+		ok    bool
+	}{
+		{"middle", "sig", InclusionProof{1, 3, hex.EncodeToString(root), hx(leaves[0], leaves[2])}, true},
+		{"last", "y", InclusionProof{2, 3, hex.EncodeToString(root), hx(hashChildren(leaves[0], leaves[1]))}, true},
+		{"single", "sig", InclusionProof{0, 1, hex.EncodeToString(leaves[1]), nil}, true},
+		{"wrong entry", "z", InclusionProof{1, 3, hex.EncodeToString(root), hx(leaves[0], leaves[2])}, false},
+		{"wrong index", "sig", InclusionProof{0, 3, hex.EncodeToString(root), hx(leaves[0], leaves[2])}, false},
+		{"short path", "sig", InclusionProof{1, 3, hex.EncodeToString(root), hx(leaves[0])}, false},
+		{"long path", "sig", InclusionProof{1, 3, hex.EncodeToString(root), hx(leaves[0], leaves[2], leaves[2])}, false},
+		{"out of range", "sig", InclusionProof{3, 3, hex.EncodeToString(root), hx(leaves[0], leaves[2])}, false},
+	}
+	for _, test := range tests {
+		if err := test.p.verify([]byte(test.entry)); (err == nil) != test.ok {
+			t.Errorf("%v: got %v, want ok %v", test.label, err, test.ok)
+		}
+	}
+}
+
+func TestInstallTransparency(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	rc, err := getReadCloser(filepath.Join(fx.dist, "a-1.0.0.pkg"), "manifest.sha256.asc")
+	if err != nil {
+		t.Fatalf("reading signature: %v", err)
+	}
+	sig, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("reading signature: %v", err)
+	}
+	other := hashLeaf([]byte("another package's signature"))
+	good := InclusionProof{
+		LogIndex: 1,
+		TreeSize: 2,
+		RootHash: hex.EncodeToString(hashChildren(other, hashLeaf(sig))),
+		Hashes:   []string{hex.EncodeToString(other)},
+	}
+	bad := good
+	bad.RootHash = hex.EncodeToString(other)
+
+	var proof *InclusionProof
+	entry := fmt.Sprintf("/entries/%x", sha256.Sum256(sig))
+	log := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proof == nil || r.URL.Path != entry {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(proof)
+	}))
+	defer log.Close()
+
+	av, _, err := db.LoadAvailable(fx.root)
+	if err != nil {
+		t.Fatalf("load available: %v", err)
+	}
+	m := av["a"]["1.0.0"]
+	// remotes are matched in canonical form, however they are given.
+	remote := m.Remote.String() + "/"
+
+	tests := []struct {
+		label   string
+		proof   *InclusionProof
+		log     string
+		require bool
+		strict  bool
+		warning string
+		err     bool
+	}{
+		{label: "logged", proof: &good, log: log.URL, require: true},
+		{label: "not logged", log: log.URL, warning: WarnNotLogged},
+		{label: "not logged, required", log: log.URL, require: true, err: true},
+		{label: "bad proof", proof: &bad, log: log.URL, err: true},
+		{label: "unreachable", log: "http://127.0.0.1:1", require: true, warning: WarnLogUnreachable},
+		{label: "unreachable, strict", log: "http://127.0.0.1:1", strict: true, err: true},
+	}
+	for _, test := range tests {
+		proof = test.proof
+		ws := []Warning{}
+		err := Install(fx.root, []string{"a"}, Options{
+			TransparencyLogs:    map[string]string{remote: test.log},
+			RequireTransparency: test.require,
+			Strict:              test.strict,
+			Warnings:            &ws,
+		})
+		if (err != nil) != test.err {
+			t.Fatalf("%v: got %v, want error %v", test.label, err, test.err)
+		}
+		if _, ok := errors.Cause(err).(TransparencyError); err != nil && !test.strict && !ok {
+			t.Fatalf("%v: got %v, want a TransparencyError", test.label, err)
+		}
+		codes := []string{}
+		for _, w := range ws {
+			codes = append(codes, w.Code)
+		}
+		if test.warning != "" && (len(codes) != 1 || codes[0] != test.warning) {
+			t.Fatalf("%v: got warnings %v, want %v", test.label, codes, test.warning)
+		}
+		if err == nil {
+			if err := Remove(fx.root, []string{"a"}); err != nil {
+				t.Fatalf("%v: remove: %v", test.label, err)
+			}
+		}
+	}
+}
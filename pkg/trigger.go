@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// triggerCache records the file triggers an Install has activated but not
+// yet run, so that those of an interrupted Install run with the next one.
+const triggerCache = "var/lib/pm/trigger-cache"
+
+// activateTriggers records, in root's trigger cache, the files the newly
+// installed package m put on disk that match the Triggers of the other
+// installed packages; see pm.Meta.Triggers.
+func activateTriggers(root string, m pm.Meta) error {
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+	ims := pm.Metas{}
+	for im := range iDB.Traverse() {
+		if im.Name != m.Name && len(im.Triggers) > 0 {
+			ims = append(ims, im)
+		}
+	}
+	if len(ims) == 0 {
+		return nil
+	}
+
+	pending, err := loadTriggers(root)
+	if err != nil {
+		return err
+	}
+	activated := false
+	for fn := range m.Files {
+		for _, im := range ims {
+			ok, err := excluded(fn, im.Triggers)
+			if err != nil {
+				return errors.Wrapf(err, "triggers of %v", im.Name)
+			}
+			if ok {
+				pending[im.Name] = append(pending[im.Name], fn)
+				activated = true
+			}
+		}
+	}
+	if !activated {
+		return nil
+	}
+	return saveTriggers(root, pending)
+}
+
+// runTriggers runs the trigger script of each package with triggers pending
+// in root's trigger cache once, with the files that activated it, in name
+// order, as arguments, and then empties the cache. Packages that have since
+// been removed are skipped.
+func runTriggers(root string) error {
+	pending, err := loadTriggers(root)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+	names := pm.Names{}
+	for n := range pending {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, n := range names {
+		m, ok := iDB[n]
+		if !ok {
+			continue
+		}
+		fns := dedupe(pending[n])
+		if err := script(root, m, "trigger", fns...); err != nil {
+			return errors.Wrapf(err, "%v trigger", n)
+		}
+		// a failed trigger is retried, but not the ones before it.
+		delete(pending, n)
+		if err := saveTriggers(root, pending); err != nil {
+			return err
+		}
+	}
+	return os.Remove(filepath.Join(root, triggerCache))
+}
+
+// dedupe returns the distinct strings in ss, sorted.
+func dedupe(ss []string) []string {
+	sort.Strings(ss)
+	r := []string{}
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// loadTriggers returns the files that have activated each package's
+// triggers, pending in root's trigger cache.
+func loadTriggers(root string) (map[pm.Name][]string, error) {
+	r := map[pm.Name][]string{}
+	fn := filepath.Join(root, triggerCache)
+	if !fs.Exists(fn) {
+		return r, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "decoding trigger cache")
+	}
+	return r, nil
+}
+
+func saveTriggers(root string, pending map[pm.Name][]string) error {
+	f, err := os.Create(filepath.Join(root, triggerCache))
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(pending); err != nil {
+		f.Close()
+		return errors.Wrap(err, "encoding trigger cache")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close trigger cache")
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+// UnownedPolicy says what to do when a package would overwrite a file that
+// no installed package owns; see Options.UnownedFiles.
+type UnownedPolicy string
+
+const (
+	// UnownedAbort fails the install with an UnownedFileError. It is the
+	// default.
+	UnownedAbort UnownedPolicy = "abort"
+	// UnownedBackup moves the file aside, to <filename>.pmorig, and
+	// installs the package's version.
+	UnownedBackup UnownedPolicy = "backup"
+	// UnownedOverwrite replaces the file with the package's version.
+	UnownedOverwrite UnownedPolicy = "overwrite"
+)
+
+// ParseUnownedPolicy returns the UnownedPolicy named s.
+func ParseUnownedPolicy(s string) (UnownedPolicy, error) {
+	switch p := UnownedPolicy(s); p {
+	case UnownedAbort, UnownedBackup, UnownedOverwrite:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown policy %q for unowned files", s)
+}
+
+// UnownedFileError is returned when a package would overwrite File, which is
+// on disk but isn't owned by any installed package, and Options.UnownedFiles
+// is UnownedAbort.
+type UnownedFileError struct {
+	Package pm.Name
+	File    string
+}
+
+func (e UnownedFileError) Error() string {
+	return fmt.Sprintf("%v would overwrite %v, which no installed package owns", e.Package, e.File)
+}
+
+// ownership tracks which files, relative to the install root, installed
+// packages own while another package is extracted.
+type ownership struct {
+	owned map[string]bool
+
+	name pm.Name
+	opts Options
+}
+
+// newOwnership starts extracting name into a root whose installed packages
+// are iDB.
+func newOwnership(root string, iDB pm.Installed, name pm.Name, opts Options) *ownership {
+	r := &ownership{owned: map[string]bool{}, name: name, opts: opts}
+	for n, m := range iDB {
+		files, err := installedFiles(filepath.Join(root, installed, string(n)), m)
+		if err != nil {
+			log.Printf("reading files of installed %v: %v", n, err)
+			continue
+		}
+		for fn := range files {
+			r.owned[fn] = true
+		}
+	}
+	return r
+}
+
+// claim is called before the file name, whose checksum in the package is sum,
+// is written to fn. If fn is there but not owned, claim applies the policy: it
+// returns an UnownedFileError, or raises a warning and moves the file aside
+// or leaves it to be overwritten. A file that already has the package's
+// contents is left to be overwritten quietly. While staged, the file looked
+// for is the one in the live tree.
+func (o *ownership) claim(fn, name, sum string) error {
+	if o == nil || o.owned[name] {
+		return nil
+	}
+	live := o.opts.staging.live(fn)
+	fi, err := os.Lstat(live)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+	if fi.Mode().IsRegular() {
+		cur, err := sha256File(live)
+		if err != nil {
+			return err
+		}
+		if cur == sum {
+			return nil
+		}
+	}
+
+	switch o.opts.UnownedFiles {
+	case UnownedBackup:
+		backup := os.Rename
+		if o.opts.staging != nil {
+			// the live file stays until the batch is committed.
+			backup = os.Link
+		}
+		if err := backup(live, fn+".pmorig"); err != nil {
+			return errors.Wrap(err, "backing up")
+		}
+		o.opts.warn(Warning{
+			Code:    WarnUnownedFile,
+			Message: fmt.Sprintf("%v isn't owned by any installed package; moved it to %v.pmorig before installing %v's version", live, live, o.name),
+			Package: o.name,
+			File:    name,
+		})
+	case UnownedOverwrite:
+		o.opts.warn(Warning{
+			Code:    WarnUnownedFile,
+			Message: fmt.Sprintf("%v isn't owned by any installed package; overwriting it with %v's version", live, o.name),
+			Package: o.name,
+			File:    name,
+		})
+	default:
+		return UnownedFileError{Package: o.name, File: name}
+	}
+	return nil
+}
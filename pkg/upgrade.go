@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+// UpgradeFromRepo upgrades installed packages to the newest versions offered
+// by the remote labeled repo. Installed packages that repo has no newer
+// version of are left untouched, even if another remote does, as are those
+// pinned by another installed package; see pm.Available.UpgradeablePackages.
+//
+// Installed packages that repo has renamed, as published in its
+// obsoletes.json, are replaced by the newest version of their new name.
+//
+// Dependencies that the upgraded packages add are resolved as usual.
+func UpgradeFromRepo(root string, repo string) error {
+	opts := Options{AutoApprove: true, ProtectConffiles: true, upgrade: true, warnings: &warnings{}}
+
+	u, err := db.FindRemote(root, repo)
+	if err != nil {
+		return errors.Wrap(err, "finding repo")
+	}
+	src, err := db.FetchPinned(root, u)
+	if err != nil {
+		return errors.Wrapf(err, "fetching %v", repo)
+	}
+	iDB, err := db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+
+	obs, err := db.FetchObsoletes(u)
+	if err != nil {
+		return errors.Wrapf(err, "fetching %v obsoletes", repo)
+	}
+	renames := map[pm.Name]pm.Name{}
+	ms := pm.Metas{}
+	for _, o := range obs {
+		if _, ok := iDB[o.Old]; !ok {
+			continue
+		}
+		if _, ok := iDB[o.New]; ok {
+			continue
+		}
+		m, err := src.Get(o.New, "")
+		if err != nil {
+			log.Printf("%v was renamed to %v, which %v doesn't offer", o.Old, o.New, repo)
+			continue
+		}
+		renames[o.Old] = o.New
+		ms = append(ms, m)
+	}
+	up, err := src.UpgradeablePackages(iDB)
+	if err != nil {
+		return errors.Wrapf(err, "finding upgrades in %v", repo)
+	}
+	for _, m := range up {
+		if _, ok := renames[m.Name]; !ok {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 {
+		log.Printf("nothing to upgrade from %v", repo)
+		return nil
+	}
+
+	av, _, err := db.LoadAvailable(root)
+	if err != nil {
+		return errors.Wrap(err, "loading available db")
+	}
+	// repo's copy of a package takes precedence over that of any remote
+	// configured before it.
+	if err := av.Update(src); err != nil {
+		return errors.Wrapf(err, "merging %v", repo)
+	}
+
+	// anything resolve adds is a new dependency, and so installed as such.
+	pkgs := []string{}
+	for _, m := range ms {
+		pkgs = append(pkgs, string(m.Name))
+	}
+
+	if err := opts.emit(pm.Resolve, pm.Meta{}); err != nil {
+		return err
+	}
+	ms, sels, err := resolve(root, av, ms)
+	if err != nil {
+		return errors.Wrap(err, "resolving dependencies")
+	}
+	if err := run(root, pkgs, ms, sels, opts); err != nil {
+		return err
+	}
+
+	if len(renames) == 0 {
+		return nil
+	}
+	iDB, err = db.LoadInstalled(root)
+	if err != nil {
+		return errors.Wrap(err, "loading installed db")
+	}
+	for o, n := range renames {
+		log.Printf("replacing %v with %v", o, n)
+		// files that moved to the new name must survive the old one's
+		// removal.
+		if err := remove(root, iDB[o], iDB[n].Files); err != nil {
+			return errors.Wrapf(err, "removing %v, obsoleted by %v", o, n)
+		}
+	}
+	return nil
+}
+
+// installedFiles returns the files m, the installed package whose metadata
+// lives in ip, put on disk.
+func installedFiles(ip string, m pm.Meta) (map[string]string, error) {
+	if len(m.Files) > 0 {
+		return m.Files, nil
+	}
+	// packages installed before Files was recorded only have their bom.
+	bf, err := os.Open(filepath.Join(ip, "bom.sha256"))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening bom")
+	}
+	defer bf.Close()
+	cs, err := pm.ParseCS(bf)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing bom")
+	}
+	r := map[string]string{}
+	for n, sum := range cs {
+		if n = pm.StripPath(n, m.StripComponents); n != "" {
+			r[n] = sum
+		}
+	}
+	for _, n := range m.Excluded {
+		delete(r, n)
+	}
+	return r, nil
+}
@@ -0,0 +1,389 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"mcquay.me/fs"
+	"mcquay.me/pm"
+	"mcquay.me/pm/db"
+)
+
+func TestUpgradeFromRepo(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a", "b", "c"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	// security only has a newer a; a newer b is published elsewhere.
+	fx.addRepo(t, "security",
+		pm.Meta{Name: "a", Version: "2.0.0", Description: "a test pkg"},
+		pm.Meta{Name: "c", Version: "1.0.0", Description: "a test pkg"},
+	)
+	fx.addRepo(t, "testing", pm.Meta{Name: "b", Version: "2.0.0", Description: "a test pkg"})
+	if err := db.Pull(fx.root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+
+	if err := UpgradeFromRepo(fx.root, "security"); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	want := map[pm.Name]pm.Version{"a": "2.0.0", "b": "1.0.0", "c": "1.0.0"}
+	for n, v := range want {
+		if got := iDB[n].Version; got != v {
+			t.Errorf("%v: got %v, want %v", n, got, v)
+		}
+	}
+	if got, want := iDB["a"].Repository, "security"; got != want {
+		t.Errorf("a's repository: got %v, want %v", got, want)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(fx.root, "bin", "a"))
+	if err != nil {
+		t.Fatalf("read bin/a: %v", err)
+	}
+	if got, want := string(b), "#!/bin/sh\necho a 2.0.0\n"; got != want {
+		t.Errorf("bin/a: got %q, want %q", got, want)
+	}
+	if fs.Exists(filepath.Join(fx.root, "share", "a", "README")) {
+		t.Errorf("file dropped by a@2.0.0 was not removed")
+	}
+
+	// nothing left to do
+	if err := UpgradeFromRepo(fx.root, "security"); err != nil {
+		t.Fatalf("second upgrade: %v", err)
+	}
+}
+
+func TestUpgradeObsoletes(t *testing.T) {
+	fx, del := newFixture(
+		t,
+		pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+	)
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	// security renamed a to b.
+	fx.addRepo(t, "security", pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"})
+	obs := `[{"old": "a", "new": "b"}]`
+	if err := ioutil.WriteFile(filepath.Join(fx.dist, "security", "obsoletes.json"), []byte(obs), 0644); err != nil {
+		t.Fatalf("write obsoletes.json: %v", err)
+	}
+
+	if err := UpgradeFromRepo(fx.root, "security"); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if _, ok := iDB["a"]; ok {
+		t.Errorf("a still installed")
+	}
+	if _, ok := iDB["b"]; !ok {
+		t.Errorf("b not installed")
+	}
+	if fs.Exists(filepath.Join(fx.root, "bin", "a")) {
+		t.Errorf("a's files were not removed")
+	}
+	if !fs.Exists(filepath.Join(fx.root, "bin", "b")) {
+		t.Errorf("b's files were not installed")
+	}
+}
+
+func TestUpgradeProtectsConffiles(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "conf", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"conf"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	edited := filepath.Join(fx.root, "etc", "conf.conf")
+	if err := ioutil.WriteFile(edited, []byte("mine\n"), 0644); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+
+	fx.addRepo(t, "security", pm.Meta{Name: "conf", Version: "2.0.0", Description: "a test pkg"})
+	if err := UpgradeFromRepo(fx.root, "security"); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	want := map[string]string{
+		"etc/conf.conf":        "mine\n",
+		"etc/conf.conf.pm-new": "v2\n",
+		"etc/other.conf":       "v2\n",
+	}
+	for n, w := range want {
+		b, err := ioutil.ReadFile(filepath.Join(fx.root, n))
+		if err != nil {
+			t.Fatalf("read %v: %v", n, err)
+		}
+		if got := string(b); got != w {
+			t.Errorf("%v: got %q, want %q", n, got, w)
+		}
+	}
+}
+
+func TestUpgradeUnchangedFiles(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	stat := func(n string) os.FileInfo {
+		fi, err := os.Stat(filepath.Join(fx.root, n))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		return fi
+	}
+	bin, readme := stat("bin/a"), stat("share/a/README")
+
+	// only bin/a differs in 1.1.0.
+	fx.addRepo(t, "security", pm.Meta{Name: "a", Version: "1.1.0", Description: "a test pkg"})
+	if err := UpgradeFromRepo(fx.root, "security"); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	if os.SameFile(bin, stat("bin/a")) {
+		t.Errorf("changed bin/a was not rewritten")
+	}
+	if !os.SameFile(readme, stat("share/a/README")) {
+		t.Errorf("unchanged share/a/README was rewritten")
+	}
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := len(iDB["a"].Files), 2; got != want {
+		t.Fatalf("recorded files: got %v, want %v", got, want)
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestUpgradeCorruptPkg(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	fx.addRepo(t, "security", pm.Meta{Name: "a", Version: "2.0.0", Description: "a test pkg"})
+	addToPkg(t, filepath.Join(fx.dist, "security", "a-2.0.0.pkg"), "extra.txt", "not in the manifest\n")
+	if err := UpgradeFromRepo(fx.root, "security"); err == nil {
+		t.Fatalf("upgrade to a corrupt pkg should have failed")
+	}
+
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := iDB["a"].Version, pm.Version("1.0.0"); got != want {
+		t.Fatalf("a: got %v, want %v", got, want)
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := Remove(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	for _, n := range []string{"bin/a", "share/a/README", filepath.Join(installed, "a")} {
+		if fs.Exists(filepath.Join(fx.root, n)) {
+			t.Errorf("%v left behind", n)
+		}
+	}
+}
+
+func TestUpgradeRestoresUnchangedFiles(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	readme := filepath.Join(fx.root, "share", "a", "README")
+	if err := os.Remove(readme); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	// share/a/README is the same in 1.1.0, but is no longer on disk.
+	fx.addRepo(t, "security", pm.Meta{Name: "a", Version: "1.1.0", Description: "a test pkg"})
+	if err := UpgradeFromRepo(fx.root, "security"); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	if !fs.Exists(readme) {
+		t.Fatalf("missing share/a/README was not rewritten")
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestUpgradeStaged(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		fx, del := newFixture(
+			t,
+			pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"},
+			pm.Meta{Name: "b", Version: "1.0.0", Description: "a test pkg"},
+		)
+		if err := Install(fx.root, []string{"a", "b"}, Options{}); err != nil {
+			t.Fatalf("install: %v", err)
+		}
+		news := filepath.Join(fx.root, "share", "b", "NEWS")
+		if fail {
+			// b@2.0.0 ships share/b/NEWS, which nothing owns yet, so it
+			// fails once a has been upgraded in the stage.
+			if err := ioutil.WriteFile(news, []byte("mine\n"), 0644); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+
+		// upgrading both is staged.
+		fx.addRepo(t, "security",
+			pm.Meta{Name: "a", Version: "2.0.0", Description: "a test pkg"},
+			pm.Meta{Name: "b", Version: "2.0.0", Description: "a test pkg"},
+		)
+		err := UpgradeFromRepo(fx.root, "security")
+		if _, ok := errors.Cause(err).(UnownedFileError); ok != fail {
+			t.Fatalf("fail %v: got %v", fail, err)
+		}
+
+		want, wantNews := pm.Version("2.0.0"), "new in b 2.0.0\n"
+		if fail {
+			want, wantNews = "1.0.0", "mine\n"
+		}
+		iDB, err := db.LoadInstalled(fx.root)
+		if err != nil {
+			t.Fatalf("load installed: %v", err)
+		}
+		for _, n := range []pm.Name{"a", "b"} {
+			if got := iDB[n].Version; got != want {
+				t.Errorf("fail %v: %v: got %v, want %v", fail, n, got, want)
+			}
+		}
+		if err := Check(fx.root, []string{"a", "b"}); err != nil {
+			t.Errorf("fail %v: check: %v", fail, err)
+		}
+		// a@2.0.0 dropped it.
+		if got, want := fs.Exists(filepath.Join(fx.root, "share", "a", "README")), fail; got != want {
+			t.Errorf("fail %v: share/a/README exists: got %v, want %v", fail, got, want)
+		}
+		if b, err := ioutil.ReadFile(news); err != nil {
+			t.Errorf("fail %v: read share/b/NEWS: %v", fail, err)
+		} else if got := string(b); got != wantNews {
+			t.Errorf("fail %v: share/b/NEWS: got %q, want %q", fail, got, wantNews)
+		}
+		stages, err := filepath.Glob(filepath.Join(fx.root, pmDir, stagePrefix+"*"))
+		if err != nil {
+			t.Fatalf("glob: %v", err)
+		}
+		if len(stages) != 0 {
+			t.Errorf("fail %v: stages left behind: %v", fail, stages)
+		}
+		del()
+	}
+}
+
+func TestUpgradeUnownedFile(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	// a@1.2.0 ships share/a/NEW, after it has replaced bin/a.
+	news := filepath.Join(fx.root, "share", "a", "NEW")
+	if err := ioutil.WriteFile(news, []byte("mine\n"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	fx.addRepo(t, "security", pm.Meta{Name: "a", Version: "1.2.0", Description: "a test pkg"})
+	err := UpgradeFromRepo(fx.root, "security")
+	if _, ok := errors.Cause(err).(UnownedFileError); !ok {
+		t.Fatalf("got %v, want an UnownedFileError", err)
+	}
+
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := iDB["a"].Version, pm.Version("1.0.0"); got != want {
+		t.Fatalf("a: got %v, want %v", got, want)
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	for fn, want := range map[string]string{"bin/a": "#!/bin/sh\necho a\n", "share/a/NEW": "mine\n"} {
+		b, err := ioutil.ReadFile(filepath.Join(fx.root, fn))
+		if err != nil {
+			t.Fatalf("read %v: %v", fn, err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("%v: got %q, want %q", fn, got, want)
+		}
+	}
+	asides, err := filepath.Glob(filepath.Join(fx.root, installed, ".a-*"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(asides) != 0 {
+		t.Fatalf("left behind: %v", asides)
+	}
+}
+
+func TestUpgradeQuota(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+
+	if err := Install(fx.root, []string{"a"}, Options{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	// a@1.2.0 goes over the quota once it has replaced bin/a.
+	fx.addRepo(t, "security", pm.Meta{Name: "a", Version: "1.2.0", Description: "a test pkg"})
+	if err := db.Pull(fx.root); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	err := Install(fx.root, []string{"a@1.2.0"}, Options{MaxPackageBytes: 30, upgrade: true})
+	if _, ok := errors.Cause(err).(QuotaError); !ok {
+		t.Fatalf("got %v, want a QuotaError", err)
+	}
+
+	iDB, err := db.LoadInstalled(fx.root)
+	if err != nil {
+		t.Fatalf("load installed: %v", err)
+	}
+	if got, want := iDB["a"].Version, pm.Version("1.0.0"); got != want {
+		t.Fatalf("a: got %v, want %v", got, want)
+	}
+	if err := Check(fx.root, []string{"a"}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if fs.Exists(filepath.Join(fx.root, "share", "a", "NEW")) {
+		t.Fatalf("share/a/NEW left behind")
+	}
+}
@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm/keyring"
+)
+
+// VerifyFile checks the .pkg at pn: that its manifest is properly signed,
+// and that its contents match the manifest. Nothing is installed.
+//
+// If key is empty the signature is checked against root's keyring, as
+// Install would. Otherwise key names a file holding an armored public key,
+// and the signature is checked against that key alone, which allows checking
+// a package from an untrusted source without importing its key.
+func VerifyFile(root, pn, key string) error {
+	if key == "" {
+		if _, err := verifyManifestIntegrity(root, pn); err != nil {
+			return errors.Wrap(err, "verifying pkg integrity")
+		}
+	} else if err := verifyManifestWithKey(pn, key); err != nil {
+		return errors.Wrap(err, "verifying pkg integrity")
+	}
+
+	tmp, err := ioutil.TempDir("", "pm-verify-")
+	if err != nil {
+		return errors.Wrap(err, "making temp dir")
+	}
+	defer os.RemoveAll(tmp)
+	if err := expandPkgContents(pn, tmp, nil, nil); err != nil {
+		return errors.Wrap(err, "verifying pkg contents")
+	}
+	return nil
+}
+
+// verifyManifestWithKey checks the signature of the manifest in the .pkg at
+// pn against the armored public key in the file named key.
+func verifyManifestWithKey(pn, key string) error {
+	kf, err := os.Open(key)
+	if err != nil {
+		return errors.Wrap(err, "opening key")
+	}
+	defer kf.Close()
+	man, err := getReadCloser(pn, "manifest.sha256")
+	if err != nil {
+		return errors.Wrap(err, "getting manifest reader")
+	}
+	defer man.Close()
+	sig, err := getReadCloser(pn, "manifest.sha256.asc")
+	if err != nil {
+		return errors.Wrap(err, "getting manifest signature reader")
+	}
+	defer sig.Close()
+
+	if err := keyring.VerifyWithKey(man, sig, kf); err != nil {
+		return errors.Wrap(err, "verifying manifest")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mcquay.me/pm"
+	"mcquay.me/pm/keyring"
+)
+
+func TestVerifyFile(t *testing.T) {
+	fx, del := newFixture(t, pm.Meta{Name: "a", Version: "1.0.0", Description: "a test pkg"})
+	defer del()
+	pn := filepath.Join(fx.dist, "a-1.0.0.pkg")
+
+	if err := VerifyFile(fx.root, pn, ""); err != nil {
+		t.Fatalf("verify against keyring: %v", err)
+	}
+
+	// a root without the signer's key in its keyring can still check the
+	// package against a key it was handed.
+	other, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(other)
+	if err := keyring.NewKeyPair(other, "someone else", "else@pm.mcquay.me"); err != nil {
+		t.Fatalf("new key pair: %v", err)
+	}
+	if err := VerifyFile(other, pn, ""); err == nil {
+		t.Fatalf("verified against a keyring without the signer's key")
+	}
+
+	export := func(root, email string) string {
+		f, err := ioutil.TempFile("", "pm-tests-key-")
+		if err != nil {
+			t.Fatalf("tmpfile: %v", err)
+		}
+		defer f.Close()
+		if err := keyring.Export(root, f, email); err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		return f.Name()
+	}
+	good := export(fx.root, "test@pm.mcquay.me")
+	defer os.Remove(good)
+	bad := export(other, "else@pm.mcquay.me")
+	defer os.Remove(bad)
+
+	if err := VerifyFile(other, pn, good); err != nil {
+		t.Fatalf("verify against matching key: %v", err)
+	}
+	if err := VerifyFile(fx.root, pn, bad); err == nil {
+		t.Fatalf("verified against non-matching key")
+	}
+}
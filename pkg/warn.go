@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"mcquay.me/pm"
+)
+
+// Warning codes identify the kind of a Warning. They are stable, so callers
+// can act on them without parsing messages.
+const (
+	// WarnNoDeps: dependencies were skipped because of Options.NoDeps.
+	WarnNoDeps = "no-deps"
+	// WarnClockSkew: a signature is dated in the future, within
+	// Options.MaxClockSkew.
+	WarnClockSkew = "clock-skew"
+	// WarnMarginalTrust: a package was signed by a keyring.Marginal key and
+	// accepted because of Options.AllowMarginal.
+	WarnMarginalTrust = "marginal-trust"
+	// WarnConffileKept: an edited config file was left alone, and the new
+	// version written alongside it; see Options.ProtectConffiles.
+	WarnConffileKept = "conffile-kept"
+	// WarnUnknownReference: a requested package refers to a package the
+	// available db doesn't offer; see db.CheckReferences.
+	WarnUnknownReference = "unknown-reference"
+	// WarnLowPriority: a dependency was skipped because of
+	// Options.MinPriority.
+	WarnLowPriority = "low-priority"
+	// WarnExtraFile: a file missing from a package's manifest was ignored
+	// because of Options.AllowExtraFiles.
+	WarnExtraFile = "extra-file"
+	// WarnNotLogged: a package's signature is missing from the transparency
+	// log of its remote; see Options.TransparencyLogs.
+	WarnNotLogged = "not-logged"
+	// WarnLogUnreachable: a package's signature couldn't be looked up in the
+	// transparency log of its remote.
+	WarnLogUnreachable = "log-unreachable"
+	// WarnUnownedFile: a file no installed package owns was moved aside or
+	// overwritten; see Options.UnownedFiles.
+	WarnUnownedFile = "unowned-file"
+	// WarnConflictSkipped: a package conflicting with an installed one, or
+	// depending on one that does, was left out of an install; see
+	// Options.ConflictResolution.
+	WarnConflictSkipped = "conflict-skipped"
+	// WarnCorruptProgress: the recorded progress of an interrupted install
+	// couldn't be read, and was discarded.
+	WarnCorruptProgress = "corrupt-progress"
+	// WarnMirrorFailed: a package couldn't be fetched from one of the
+	// mirrors of its remote, and the next was tried; see Options.Mirrors.
+	WarnMirrorFailed = "mirror-failed"
+	// WarnResumed: a dropped download was resumed where it left off.
+	WarnResumed = "resumed"
+	// WarnUnsigned: an unsigned package was accepted because the
+	// SignaturePolicy of its remote makes signatures optional.
+	WarnUnsigned = "unsigned"
+)
+
+// Warning is something worth telling the user about that didn't stop an
+// operation.
+type Warning struct {
+	Code    string
+	Message string
+
+	// Package and File are what the warning is about, if anything in
+	// particular; File is relative to the install root.
+	Package pm.Name
+	File    string
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+// StrictError is returned in strict mode when warnings were raised; see
+// Options.Strict.
+type StrictError struct {
+	Warnings []string
+}
+
+func (e StrictError) Error() string {
+	return fmt.Sprintf("strict mode: %d warnings:\n%v", len(e.Warnings), strings.Join(e.Warnings, "\n"))
+}
+
+// warnings collects the warnings raised over the course of an operation.
+// Packages can be verified concurrently, so it is guarded by mu.
+type warnings struct {
+	mu sync.Mutex
+	ws []Warning
+}
+
+// warningsMu guards the appends to Options.Warnings, which are made whether
+// or not the Options collect warnings of their own.
+var warningsMu sync.Mutex
+
+// warn logs w, records it if o is collecting warnings, and passes it on to
+// Options.Warnings.
+func (o Options) warn(w Warning) {
+	log.Printf("warning: %v", w.Message)
+	if o.warnings != nil {
+		o.warnings.mu.Lock()
+		o.warnings.ws = append(o.warnings.ws, w)
+		o.warnings.mu.Unlock()
+	}
+	if o.Warnings != nil {
+		warningsMu.Lock()
+		*o.Warnings = append(*o.Warnings, w)
+		warningsMu.Unlock()
+	}
+}
+
+// warnf raises a Warning with the given code about package name, if any.
+func (o Options) warnf(code string, name pm.Name, f string, args ...interface{}) {
+	o.warn(Warning{Code: code, Package: name, Message: fmt.Sprintf(f, args...)})
+}
+
+// warner returns a function that raises warnings with the given code about
+// package name, for checks that only deal in messages.
+func (o Options) warner(code string, name pm.Name) func(string, ...interface{}) {
+	return func(f string, args ...interface{}) {
+		o.warnf(code, name, f, args...)
+	}
+}
+
+// extraFiles returns the function expandPkgContents passes the extra files
+// in package name to, raising warnings with w, or nil if o doesn't allow
+// extra files.
+func (o Options) extraFiles(w func(string, pm.Name) func(string, ...interface{}), name pm.Name) func(string, ...interface{}) {
+	if !o.AllowExtraFiles {
+		return nil
+	}
+	return w(WarnExtraFile, name)
+}
+
+// strict returns a StrictError listing every warning raised so far if o is in
+// strict mode.
+func (o Options) strict() error {
+	if !o.Strict || o.warnings == nil || len(o.warnings.ws) == 0 {
+		return nil
+	}
+	msgs := []string{}
+	for _, w := range o.warnings.ws {
+		msgs = append(msgs, w.Message)
+	}
+	return StrictError{Warnings: msgs}
+}
@@ -0,0 +1,21 @@
+// Package plugin loads hooks that extend pm from shared objects installed
+// under var/lib/pm/plugins.
+//
+// Loading plugins relies on the standard library's plugin package, so it is
+// only supported by builds with the plugin build tag, e.g.
+//
+//	go build -tags plugin mcquay.me/pm/cmd/pm
+package plugin
+
+import "mcquay.me/pm"
+
+// Dir is where plugins are installed, relative to the pm root.
+const Dir = "var/lib/pm/plugins"
+
+// Symbol is the name of the function a plugin must export, with the
+// signature func(pm.Event) error.
+const Symbol = "PmHook"
+
+// Hook is called as an operation moves a package through each pm.Phase. An
+// error aborts the operation.
+type Hook func(pm.Event) error
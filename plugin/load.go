@@ -0,0 +1,37 @@
+//go:build plugin
+
+package plugin
+
+import (
+	"path/filepath"
+	goplugin "plugin"
+
+	"github.com/pkg/errors"
+	"mcquay.me/pm"
+)
+
+// Load opens each *.so in root's plugin dir and returns their hooks, in
+// lexical order of file name.
+func Load(root string) ([]Hook, error) {
+	sos, err := filepath.Glob(filepath.Join(root, Dir, "*.so"))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding plugins")
+	}
+	r := []Hook{}
+	for _, so := range sos {
+		p, err := goplugin.Open(so)
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening %v", so)
+		}
+		s, err := p.Lookup(Symbol)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%v", so)
+		}
+		h, ok := s.(func(pm.Event) error)
+		if !ok {
+			return nil, errors.Errorf("%v: %v is a %T, not a func(pm.Event) error", so, Symbol, s)
+		}
+		r = append(r, h)
+	}
+	return r, nil
+}
@@ -0,0 +1,22 @@
+//go:build !plugin
+
+package plugin
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Load returns an error if any plugins are installed in root, since this
+// build of pm can't load them; see the package documentation.
+func Load(root string) ([]Hook, error) {
+	sos, err := filepath.Glob(filepath.Join(root, Dir, "*.so"))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding plugins")
+	}
+	if len(sos) > 0 {
+		return nil, errors.Errorf("%d plugins installed in %v, but pm was built without plugin support", len(sos), filepath.Join(root, Dir))
+	}
+	return nil, nil
+}
@@ -0,0 +1,32 @@
+//go:build !plugin
+
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadUnsupported(t *testing.T) {
+	root, err := ioutil.TempDir("", "pm-tests-root-")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if hs, err := Load(root); err != nil || len(hs) != 0 {
+		t.Fatalf("no plugins: got %v, %v", hs, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, Dir), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, Dir, "notify.so"), nil, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(root); err == nil {
+		t.Fatalf("plugins silently ignored by a build without plugin support")
+	}
+}
@@ -0,0 +1,41 @@
+package pm
+
+import "fmt"
+
+// Priority says how important a package is to a working system, as with
+// Debian's priorities. From most to least important they are Required,
+// Important, Standard, Optional and Extra. Packages that don't declare one
+// are Standard.
+type Priority string
+
+// The priorities a package can declare.
+const (
+	Required  Priority = "required"
+	Important Priority = "important"
+	Standard  Priority = "standard"
+	Optional  Priority = "optional"
+	Extra     Priority = "extra"
+)
+
+var priorities = map[Priority]int{
+	Required:  0,
+	Important: 1,
+	Standard:  2,
+	"":        2,
+	Optional:  3,
+	Extra:     4,
+}
+
+// ParsePriority returns the Priority named s.
+func ParsePriority(s string) (Priority, error) {
+	p := Priority(s)
+	if _, ok := priorities[p]; !ok || p == "" {
+		return "", fmt.Errorf("unknown priority %q", s)
+	}
+	return p, nil
+}
+
+// AtLeast reports if p is as important as min, or more.
+func (p Priority) AtLeast(min Priority) bool {
+	return priorities[p] <= priorities[min]
+}
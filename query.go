@@ -0,0 +1,267 @@
+package pm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Query is a parsed search query; see ParseQuery.
+type Query interface {
+	// Match reports if m satisfies the query.
+	Match(m Meta) bool
+	String() string
+}
+
+// Term matches packages whose name or description contains it, ignoring
+// case.
+type Term string
+
+// And matches packages that match both of its operands.
+type And struct{ L, R Query }
+
+// Or matches packages that match either of its operands.
+type Or struct{ L, R Query }
+
+// Not matches packages that don't match Q.
+type Not struct{ Q Query }
+
+// Match implements Query.
+func (t Term) Match(m Meta) bool {
+	s := strings.ToLower(string(t))
+	return strings.Contains(strings.ToLower(string(m.Name)), s) ||
+		strings.Contains(strings.ToLower(m.Description), s)
+}
+
+func (t Term) String() string {
+	return fmt.Sprintf("%q", string(t))
+}
+
+// Match implements Query.
+func (q And) Match(m Meta) bool { return q.L.Match(m) && q.R.Match(m) }
+
+func (q And) String() string { return fmt.Sprintf("(%v AND %v)", q.L, q.R) }
+
+// Match implements Query.
+func (q Or) Match(m Meta) bool { return q.L.Match(m) || q.R.Match(m) }
+
+func (q Or) String() string { return fmt.Sprintf("(%v OR %v)", q.L, q.R) }
+
+// Match implements Query.
+func (q Not) Match(m Meta) bool { return !q.Q.Match(m) }
+
+func (q Not) String() string { return fmt.Sprintf("NOT %v", q.Q) }
+
+// QueryParseError is returned by ParseQuery for a malformed query. Pos is the
+// byte offset in the query at which the problem was found.
+type QueryParseError struct {
+	Query string
+	Pos   int
+	Msg   string
+}
+
+func (e QueryParseError) Error() string {
+	return fmt.Sprintf("bad query at offset %d: %v\n\t%v\n\t%v^", e.Pos, e.Msg, e.Query, strings.Repeat(" ", e.Pos))
+}
+
+// ParseQuery parses s, a search query: terms combined with the operators
+// AND, OR and NOT, and grouped with parentheses. NOT binds tightest and OR
+// loosest, and terms written side by side are ANDed, so
+//
+//	(network OR dns) NOT deprecated
+//
+// matches packages about networking or dns that aren't deprecated.
+// Operators must be upper case; a term containing spaces, or spelled like an
+// operator, can be quoted: "not found".
+func ParseQuery(s string) (Query, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{s: s, toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, p.errorf("empty query")
+	}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf("unexpected %v", t)
+	}
+	return q, nil
+}
+
+// Search returns the packages in a that match q, in Iterator order.
+func (a Available) Search(q Query) Metas {
+	r := Metas{}
+	it := a.Iterator()
+	for it.Next() {
+		if m := it.Value(); q.Match(m) {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokTerm
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokTerm:
+		return fmt.Sprintf("term %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var operators = map[string]tokKind{
+	"AND": tokAnd,
+	"OR":  tokOr,
+	"NOT": tokNot,
+}
+
+// lex splits s into tokens.
+func lex(s string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, QueryParseError{Query: s, Pos: i, Msg: "unterminated quote"}
+			}
+			toks = append(toks, token{tokTerm, s[i+1 : i+1+end], i})
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune(`()"`, rune(s[j])) {
+				j++
+			}
+			w := s[i:j]
+			kind, ok := operators[w]
+			if !ok {
+				kind = tokTerm
+			}
+			toks = append(toks, token{kind, w, i})
+			i = j
+		}
+	}
+	return append(toks, token{tokEOF, "", len(s)}), nil
+}
+
+// parser is a recursive descent parser over the tokens of a query.
+type parser struct {
+	s    string
+	toks []token
+}
+
+func (p *parser) peek() token {
+	return p.toks[0]
+}
+
+func (p *parser) next() token {
+	t := p.toks[0]
+	if t.kind != tokEOF {
+		p.toks = p.toks[1:]
+	}
+	return t
+}
+
+func (p *parser) errorf(f string, args ...interface{}) error {
+	return QueryParseError{Query: p.s, Pos: p.peek().pos, Msg: fmt.Sprintf(f, args...)}
+}
+
+// or := and { OR and }
+func (p *parser) or() (Query, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = Or{l, r}
+	}
+	return l, nil
+}
+
+// and := unary { [AND] unary }
+func (p *parser) and() (Query, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokTerm, tokNot, tokLParen:
+		default:
+			return l, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = And{l, r}
+	}
+}
+
+// unary := NOT unary | ( or ) | term
+func (p *parser) unary() (Query, error) {
+	switch t := p.peek(); t.kind {
+	case tokNot:
+		p.next()
+		q, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{q}, nil
+	case tokLParen:
+		p.next()
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, p.errorf("expected \")\" to close \"(\" at offset %d, got %v", t.pos, p.peek())
+		}
+		p.next()
+		return q, nil
+	case tokTerm:
+		p.next()
+		return Term(t.text), nil
+	default:
+		return nil, p.errorf("expected a term, got %v", t)
+	}
+}
@@ -0,0 +1,90 @@
+package pm
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"dns", `"dns"`},
+		{"network dns", `("network" AND "dns")`},
+		{"network AND dns OR tls", `(("network" AND "dns") OR "tls")`},
+		{"network OR dns AND tls", `("network" OR ("dns" AND "tls"))`},
+		{"(network OR dns) NOT deprecated", `(("network" OR "dns") AND NOT "deprecated")`},
+		{"NOT NOT x", `NOT NOT "x"`},
+		{`"not found" OR and`, `("not found" OR "and")`},
+	}
+	for _, test := range tests {
+		q, err := ParseQuery(test.in)
+		if err != nil {
+			t.Fatalf("%v: %v", test.in, err)
+		}
+		if got := q.String(); got != test.want {
+			t.Fatalf("%v: got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos int
+	}{
+		{"", 0},
+		{"   ", 3},
+		{"(network OR dns", 15},
+		{"network OR", 10},
+		{"network)", 7},
+		{"AND dns", 0},
+		{"a NOT", 5},
+		{`a "b`, 2},
+		{"()", 1},
+	}
+	for _, test := range tests {
+		_, err := ParseQuery(test.in)
+		qe, ok := errors.Cause(err).(QueryParseError)
+		if !ok {
+			t.Fatalf("%q: got %v, want a QueryParseError", test.in, err)
+		}
+		if qe.Pos != test.pos {
+			t.Fatalf("%q: got position %d, want %d (%v)", test.in, qe.Pos, test.pos, qe)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "bind", Version: "9.0", Description: "a DNS server"},
+		{Name: "curl", Version: "7.0", Description: "fetch things from the network"},
+		{Name: "dnsmasq", Version: "2.0", Description: "lightweight dns and dhcp"},
+		{Name: "netkit", Version: "0.1", Description: "deprecated network tools"},
+		{Name: "zsh", Version: "5.0", Description: "a shell"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	q, err := ParseQuery("(network OR dns) NOT deprecated")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	got := []Name{}
+	for _, m := range a.Search(q) {
+		got = append(got, m.Name)
+	}
+	want := []Name{"bind", "curl", "dnsmasq"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
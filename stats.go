@@ -0,0 +1,42 @@
+package pm
+
+import "time"
+
+// RepoStats summarizes the contents of an Available.
+type RepoStats struct {
+	// PackageCount counts every version of every package.
+	PackageCount int
+	// UniqueNames counts package names, regardless of how many versions
+	// each has.
+	UniqueNames int
+
+	TotalDownloadSize  int64
+	TotalInstalledSize int64
+
+	// OldestVersion and NewestVersion are the earliest and latest publish
+	// times of the packages, and are zero if no package records one.
+	OldestVersion time.Time
+	NewestVersion time.Time
+}
+
+// Statistics returns a summary of a.
+func (a Available) Statistics() RepoStats {
+	r := RepoStats{UniqueNames: len(a)}
+	for _, vers := range a {
+		for _, m := range vers {
+			r.PackageCount++
+			r.TotalDownloadSize += m.DownloadSize
+			r.TotalInstalledSize += m.InstalledSize
+			if m.Published.IsZero() {
+				continue
+			}
+			if r.OldestVersion.IsZero() || m.Published.Before(r.OldestVersion) {
+				r.OldestVersion = m.Published
+			}
+			if m.Published.After(r.NewestVersion) {
+				r.NewestVersion = m.Published
+			}
+		}
+	}
+	return r
+}
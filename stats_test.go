@@ -0,0 +1,36 @@
+package pm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatistics(t *testing.T) {
+	if got, want := (Available{}).Statistics(), (RepoStats{}); got != want {
+		t.Fatalf("empty: got %+v, want %+v", got, want)
+	}
+
+	day := func(d int) time.Time { return time.Date(2018, 1, d, 0, 0, 0, 0, time.UTC) }
+	a := Available{}
+	for _, m := range []Meta{
+		{Name: "a", Version: "1.0.0", Description: "d", DownloadSize: 10, InstalledSize: 100, Published: day(3)},
+		{Name: "a", Version: "1.1.0", Description: "d", DownloadSize: 20, InstalledSize: 200, Published: day(9)},
+		{Name: "b", Version: "1.0.0", Description: "d", DownloadSize: 5, InstalledSize: 50, Published: day(1)},
+		{Name: "c", Version: "1.0.0", Description: "d"},
+	} {
+		if err := a.Add(m); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	want := RepoStats{
+		PackageCount:       4,
+		UniqueNames:        3,
+		TotalDownloadSize:  35,
+		TotalInstalledSize: 350,
+		OldestVersion:      day(1),
+		NewestVersion:      day(9),
+	}
+	if got := a.Statistics(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+package pm
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Schemes are the url schemes a remote may use: those pm knows how to fetch
+// from. A program that fetches from others may enable them here.
+var Schemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"oci":   true,
+}
+
+// secure are the schemes allowed under an https-only policy. oci registries
+// are reached over https, except on loopback addresses.
+var secure = map[string]bool{
+	"https": true,
+	"oci":   true,
+}
+
+// URLError is returned when a package's remote has an unusable url.
+type URLError struct {
+	Package Name
+	Version Version
+	URL     string
+	Err     error
+}
+
+func (e URLError) Error() string {
+	return fmt.Sprintf("%v@%v: bad remote url %q: %v", e.Package, e.Version, e.URL, e.Err)
+}
+
+// CanonicalURL returns the canonical form of u, a remote's url: its scheme
+// and host in lower case, default ports dropped, and its path cleaned, with
+// no trailing slash. Only the scheme, host and path are kept. It fails if
+// u's scheme isn't one of Schemes, or it has no host.
+func CanonicalURL(u url.URL) (url.URL, error) {
+	s := strings.ToLower(u.Scheme)
+	if !Schemes[s] {
+		return url.URL{}, errors.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	h := strings.ToLower(u.Host)
+	if h == "" {
+		return url.URL{}, errors.New("no host")
+	}
+	if hh, port, err := net.SplitHostPort(h); err == nil {
+		if (s == "http" && port == "80") || (s == "https" && port == "443") {
+			h = hh
+		}
+	}
+	p := ""
+	if u.Path != "" {
+		p = path.Clean("/" + u.Path)
+		if p == "/" {
+			p = ""
+		}
+	}
+	return url.URL{Scheme: s, Host: h, Path: p}, nil
+}
+
+// CheckURL returns the canonical form of m's remote url (see CanonicalURL),
+// or a URLError if it is unusable. If httpsOnly is set, a remote that would
+// be reached in the clear is unusable too.
+func (m Meta) CheckURL(httpsOnly bool) (url.URL, error) {
+	u, err := CanonicalURL(m.Remote)
+	if err == nil && httpsOnly && !secure[u.Scheme] {
+		err = errors.Errorf("%v is not allowed by the https-only policy", u.Scheme)
+	}
+	if err != nil {
+		return url.URL{}, URLError{Package: m.Name, Version: m.Version, URL: m.Remote.String(), Err: err}
+	}
+	return u, nil
+}
+
+// CheckURLs canonicalizes the remote url of every package in a, and returns
+// a URLError for the first that is unusable; see Meta.CheckURL.
+func (a Available) CheckURLs(httpsOnly bool) error {
+	it := a.Iterator()
+	for it.Next() {
+		m := it.Value()
+		u, err := m.CheckURL(httpsOnly)
+		if err != nil {
+			return err
+		}
+		m.Remote = u
+		a[m.Name][m.Version] = m
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package pm
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"https://pm.mcquay.me/darwin/amd64/stable", "https://pm.mcquay.me/darwin/amd64/stable", true},
+		{"HTTPS://PM.mcquay.me:443/darwin//amd64/stable/", "https://pm.mcquay.me/darwin/amd64/stable", true},
+		{"http://pm.mcquay.me:80/", "http://pm.mcquay.me", true},
+		{"http://pm.mcquay.me:8080/a?x=1#y", "http://pm.mcquay.me:8080/a", true},
+		{"oci://registry.example.com/pm", "oci://registry.example.com/pm", true},
+		{"ftp://pm.mcquay.me/a", "", false},
+		{"file:///srv/pm", "", false},
+		{"/srv/pm", "", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.in)
+		if err != nil {
+			t.Fatalf("%v: parse: %v", test.in, err)
+		}
+		got, err := CanonicalURL(*u)
+		if (err == nil) != test.ok {
+			t.Fatalf("%v: got err %v, want ok %v", test.in, err, test.ok)
+		}
+		if err == nil && got.String() != test.want {
+			t.Fatalf("%v: got %v, want %v", test.in, got.String(), test.want)
+		}
+	}
+}
+
+func TestCheckURLs(t *testing.T) {
+	mk := func(remotes ...string) Available {
+		a := Available{}
+		for i, r := range remotes {
+			u, err := url.Parse(r)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			n := Name(string(rune('a' + i)))
+			a[n] = map[Version]Meta{"1.0": {Name: n, Version: "1.0", Remote: *u}}
+		}
+		return a
+	}
+
+	a := mk("HTTPS://pm.mcquay.me/stable/", "oci://reg.example.com/pm")
+	if err := a.CheckURLs(true); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if got, want := a["a"]["1.0"].URL(), "https://pm.mcquay.me/stable/a-1.0.pkg"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	a = mk("https://pm.mcquay.me/stable", "http://pm.mcquay.me/testing")
+	if err := a.CheckURLs(false); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	err := a.CheckURLs(true)
+	ue, ok := errors.Cause(err).(URLError)
+	if !ok {
+		t.Fatalf("https-only: got %v, want a URLError", err)
+	}
+	if ue.Package != "b" || ue.URL != "http://pm.mcquay.me/testing" {
+		t.Fatalf("got %+v, want b's remote", ue)
+	}
+
+	a = mk("ftp://pm.mcquay.me/stable")
+	if _, ok := errors.Cause(a.CheckURLs(false)).(URLError); !ok {
+		t.Fatalf("accepted an ftp remote")
+	}
+}